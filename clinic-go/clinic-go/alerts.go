@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Kinds of pharmacy alert
+const (
+	alertExpiring = "expiring" // stock expires within one of the expiry windows
+	alertExpired  = "expired"  // stock on hand is past its expiry date
+	alertLowStock = "low_stock"
+)
+
+// alertPolicy controls the pharmacy alert job.
+type alertPolicy struct {
+	ExpiryWindows []int         // days before expiry, shortest first
+	Interval      time.Duration // how often the job runs
+	Renotify      time.Duration // how often unacknowledged alerts are sent again
+	Channel       string        // notification channel for alerts
+	To            string        // pharmacy's address on Channel; alerts are not sent without one
+}
+
+// loadAlertPolicy reads the pharmacy alert policy from the environment.
+// PHARMACY_EXPIRY_WINDOWS is a comma-separated list of days such as
+// "90,30,7".
+func loadAlertPolicy() alertPolicy {
+	policy := alertPolicy{
+		Interval: getenvDuration("PHARMACY_ALERT_INTERVAL", time.Hour),
+		Renotify: getenvDuration("PHARMACY_ALERT_RENOTIFY", 24*time.Hour),
+		Channel:  getenv("PHARMACY_ALERT_CHANNEL", channelEmail),
+		To:       getenv("PHARMACY_ALERT_TO", ""),
+	}
+	for _, value := range strings.Split(getenv("PHARMACY_EXPIRY_WINDOWS", "90,30,7"), ",") {
+		days, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || days <= 0 {
+			log.Printf("Invalid expiry window %q, ignoring it", value)
+			continue
+		}
+		policy.ExpiryWindows = append(policy.ExpiryWindows, days)
+	}
+	sort.Ints(policy.ExpiryWindows)
+	return policy
+}
+
+// PharmacyAlert flags stock that is expiring, expired or below its drug's
+// reorder threshold. An alert stays open until its condition clears; while
+// open and unacknowledged it is sent again every Renotify.
+type PharmacyAlert struct {
+	ID             uint       `json:"id"`
+	Kind           string     `json:"kind"`
+	DrugID         uint       `json:"drug_id"`
+	DrugName       string     `json:"drug_name"`
+	LotID          *uint      `json:"lot_id,omitempty"`
+	LotNumber      string     `json:"lot_number,omitempty"`
+	WindowDays     *int       `json:"window_days,omitempty"` // expiring alerts only
+	Message        string     `json:"message"`
+	CreatedAt      time.Time  `json:"created_at"`
+	NotifiedAt     *time.Time `json:"notified_at,omitempty"`
+	AcknowledgedAt *time.Time `json:"acknowledged_at,omitempty"`
+	AcknowledgedBy *uint      `json:"acknowledged_by,omitempty"`
+	ResolvedAt     *time.Time `json:"resolved_at,omitempty"`
+
+	// openKey identifies the condition of an open alert; the database allows
+	// one open alert per key.
+	openKey string
+}
+
+// startPharmacyAlertJob checks stock now and then every policy.Interval in
+// the background.
+func startPharmacyAlertJob(policy alertPolicy, sender Notifier) {
+	go func() {
+		for {
+			if err := checkPharmacyStock(policy); err != nil {
+				log.Println("Error checking pharmacy stock:", err)
+			}
+			if err := notifyPharmacyAlerts(policy, sender); err != nil {
+				log.Println("Error sending pharmacy alerts:", err)
+			}
+			time.Sleep(policy.Interval)
+		}
+	}()
+}
+
+// expiryWindow returns the shortest window containing an expiry date, or
+// false when it is further away than every window.
+func (p alertPolicy) expiryWindow(expiry, today Date) (int, bool) {
+	days := daysBetween(today, expiry)
+	for _, window := range p.ExpiryWindows {
+		if days <= window {
+			return window, true
+		}
+	}
+	return 0, false
+}
+
+// expiryAlert returns the alert for stock of a drug expiring on expiry, or
+// false when no alert is due. lotNumber is empty for untracked stock.
+func (p alertPolicy) expiryAlert(drugID uint, drugName string, lotID *uint, lotNumber string, expiry, today Date, quantity float64) (PharmacyAlert, bool) {
+	alert := PharmacyAlert{DrugID: drugID, DrugName: drugName, LotID: lotID, LotNumber: lotNumber}
+	subject := drugName + " (stock without a lot)"
+	key := fmt.Sprintf("drug:%d", drugID)
+	if lotID != nil {
+		subject = fmt.Sprintf("Lot %s of %s", lotNumber, drugName)
+		key = fmt.Sprintf("lot:%d", *lotID)
+	}
+
+	if expiry.Before(today) {
+		alert.Kind = alertExpired
+		alert.Message = fmt.Sprintf("%s expired on %s; %g on hand.", subject, expiry, quantity)
+		alert.openKey = alertExpired + ":" + key
+		return alert, true
+	}
+	window, ok := p.expiryWindow(expiry, today)
+	if !ok {
+		return alert, false
+	}
+	alert.Kind = alertExpiring
+	alert.WindowDays = &window
+	alert.Message = fmt.Sprintf("%s expires on %s, within %d days; %g on hand.", subject, expiry, window, quantity)
+	alert.openKey = fmt.Sprintf("%s:%s:%d", alertExpiring, key, window)
+	return alert, true
+}
+
+// dueAlerts returns the alerts whose conditions currently hold. Each lot,
+// and each drug's untracked stock, has at most one expiry alert, for the
+// shortest window it falls in.
+func dueAlerts(policy alertPolicy) ([]PharmacyAlert, error) {
+	today := dateOf(time.Now().In(clinicLocation))
+	horizon := today
+	if n := len(policy.ExpiryWindows); n > 0 {
+		horizon = today.AddDays(policy.ExpiryWindows[n-1])
+	}
+
+	var alerts []PharmacyAlert
+	collect := func(query string, args []interface{}, scan func(*sql.Rows) (PharmacyAlert, bool, error)) error {
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			alert, ok, err := scan(rows)
+			if err != nil {
+				return err
+			}
+			if ok {
+				alerts = append(alerts, alert)
+			}
+		}
+		return rows.Err()
+	}
+
+	err := collect("SELECT l.id, l.drug_id, d.drug_name, l.lot_number, l.expiry_date, l.quantity_on_hand"+
+		" FROM drug_lots l JOIN drugs d ON d.id = l.drug_id WHERE l.quantity_on_hand > 0 AND l.recall_id IS NULL AND l.expiry_date <= ?",
+		[]interface{}{horizon}, func(rows *sql.Rows) (PharmacyAlert, bool, error) {
+			var lotID, drugID uint
+			var name, number string
+			var expiry Date
+			var quantity float64
+			if err := rows.Scan(&lotID, &drugID, &name, &number, &expiry, &quantity); err != nil {
+				return PharmacyAlert{}, false, err
+			}
+			alert, ok := policy.expiryAlert(drugID, name, &lotID, number, expiry, today, quantity)
+			return alert, ok, nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	// Untracked stock expires on the catalog's expiration_date
+	err = collect("SELECT d.id, d.drug_name, d.expiration_date, d.quantity_on_hand - COALESCE(SUM(l.quantity_on_hand), 0) AS untracked"+
+		" FROM drugs d LEFT JOIN drug_lots l ON l.drug_id = d.id"+
+		" WHERE d.expiration_date IS NOT NULL AND d.expiration_date <= ?"+
+		" GROUP BY d.id, d.drug_name, d.expiration_date, d.quantity_on_hand HAVING untracked > 0",
+		[]interface{}{horizon}, func(rows *sql.Rows) (PharmacyAlert, bool, error) {
+			var drugID uint
+			var name string
+			var expiry Date
+			var quantity float64
+			if err := rows.Scan(&drugID, &name, &expiry, &quantity); err != nil {
+				return PharmacyAlert{}, false, err
+			}
+			alert, ok := policy.expiryAlert(drugID, name, nil, "", expiry, today, quantity)
+			return alert, ok, nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	err = collect("SELECT id, drug_name, quantity_on_hand, reorder_threshold FROM drugs WHERE reorder_threshold IS NOT NULL AND quantity_on_hand <= reorder_threshold",
+		nil, func(rows *sql.Rows) (PharmacyAlert, bool, error) {
+			var drugID uint
+			var name string
+			var quantity, threshold float64
+			if err := rows.Scan(&drugID, &name, &quantity, &threshold); err != nil {
+				return PharmacyAlert{}, false, err
+			}
+			return PharmacyAlert{
+				Kind:     alertLowStock,
+				DrugID:   drugID,
+				DrugName: name,
+				Message:  fmt.Sprintf("%s is low: %g on hand, reorder threshold %g.", name, quantity, threshold),
+				openKey:  fmt.Sprintf("%s:drug:%d", alertLowStock, drugID),
+			}, true, nil
+		})
+	return alerts, err
+}
+
+// checkPharmacyStock opens an alert for each condition that has newly
+// arisen and resolves the open alerts whose condition has cleared, including
+// expiry alerts superseded by a shorter window.
+func checkPharmacyStock(policy alertPolicy) error {
+	due, err := dueAlerts(policy)
+	if err != nil {
+		return err
+	}
+
+	current := make(map[string]bool, len(due))
+	for _, alert := range due {
+		current[alert.openKey] = true
+		_, err := db.Exec("INSERT INTO pharmacy_alerts (kind, drug_id, lot_id, window_days, message, open_key) VALUES (?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE id = id",
+			alert.Kind, alert.DrugID, alert.LotID, alert.WindowDays, alert.Message, alert.openKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	rows, err := db.Query("SELECT id, open_key FROM pharmacy_alerts WHERE open_key IS NOT NULL")
+	if err != nil {
+		return err
+	}
+	var cleared []uint
+	for rows.Next() {
+		var id uint
+		var key string
+		if err := rows.Scan(&id, &key); err != nil {
+			rows.Close()
+			return err
+		}
+		if !current[key] {
+			cleared = append(cleared, id)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range cleared {
+		if _, err := db.Exec("UPDATE pharmacy_alerts SET resolved_at = NOW(), open_key = NULL WHERE id = ?", id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notifyPharmacyAlerts sends the open, unacknowledged alerts that have not
+// been sent within policy.Renotify to the pharmacy as one message.
+func notifyPharmacyAlerts(policy alertPolicy, sender Notifier) error {
+	if policy.To == "" {
+		return nil
+	}
+
+	rows, err := db.Query(pharmacyAlertSelect+" WHERE a.resolved_at IS NULL AND a.acknowledged_at IS NULL AND (a.notified_at IS NULL OR a.notified_at <= ?)"+
+		pharmacyAlertOrder, time.Now().Add(-policy.Renotify).UTC())
+	if err != nil {
+		return err
+	}
+	var pending []PharmacyAlert
+	for rows.Next() {
+		alert, err := scanPharmacyAlert(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		pending = append(pending, alert)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(pending) == 0 {
+		return err
+	}
+
+	var body strings.Builder
+	body.WriteString("Pharmacy stock needs attention:\n\n")
+	ids := make([]interface{}, len(pending))
+	for i, alert := range pending {
+		fmt.Fprintf(&body, "- %s\n", alert.Message)
+		ids[i] = alert.ID
+	}
+	body.WriteString("\nAcknowledge alerts to stop these notifications.\n")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	msg := Message{
+		Channel: policy.Channel,
+		To:      policy.To,
+		Subject: fmt.Sprintf("Pharmacy alerts (%d)", len(pending)),
+		Body:    body.String(),
+	}
+	if _, err := sender.Send(ctx, msg); err != nil {
+		return err
+	}
+
+	_, err = db.Exec("UPDATE pharmacy_alerts SET notified_at = NOW() WHERE id IN (?"+strings.Repeat(", ?", len(ids)-1)+")", ids...)
+	return err
+}
+
+const pharmacyAlertSelect = "SELECT a.id, a.kind, a.drug_id, d.drug_name, a.lot_id, COALESCE(l.lot_number, ''), a.window_days, a.message," +
+	" a.created_at, a.notified_at, a.acknowledged_at, a.acknowledged_by, a.resolved_at" +
+	" FROM pharmacy_alerts a JOIN drugs d ON d.id = a.drug_id LEFT JOIN drug_lots l ON l.id = a.lot_id"
+
+// pharmacyAlertOrder puts expired stock first, then the shortest expiry
+// windows, then low stock.
+const pharmacyAlertOrder = " ORDER BY FIELD(a.kind, 'expired', 'expiring', 'low_stock'), a.window_days, a.created_at, a.id"
+
+func scanPharmacyAlert(row rowScanner) (PharmacyAlert, error) {
+	var alert PharmacyAlert
+	err := row.Scan(&alert.ID, &alert.Kind, &alert.DrugID, &alert.DrugName, &alert.LotID, &alert.LotNumber, &alert.WindowDays, &alert.Message,
+		&alert.CreatedAt, &alert.NotifiedAt, &alert.AcknowledgedAt, &alert.AcknowledgedBy, &alert.ResolvedAt)
+	return alert, err
+}
+
+// Handler function to list pharmacy alerts. ?status= is open (the default),
+// unacknowledged, acknowledged, resolved or all; ?kind= filters by kind.
+func getPharmacyAlerts(c echo.Context) error {
+	query := pharmacyAlertSelect + " WHERE 1 = 1"
+	var args []interface{}
+	switch c.QueryParam("status") {
+	case "", "open":
+		query += " AND a.resolved_at IS NULL"
+	case "unacknowledged":
+		query += " AND a.resolved_at IS NULL AND a.acknowledged_at IS NULL"
+	case "acknowledged":
+		query += " AND a.resolved_at IS NULL AND a.acknowledged_at IS NOT NULL"
+	case "resolved":
+		query += " AND a.resolved_at IS NOT NULL"
+	case "all":
+	default:
+		return c.String(http.StatusBadRequest, "Invalid status")
+	}
+	if kind := c.QueryParam("kind"); kind != "" {
+		query += " AND a.kind = ?"
+		args = append(args, kind)
+	}
+
+	rows, err := db.Query(query+pharmacyAlertOrder, args...)
+	if err != nil {
+		log.Println("Error querying pharmacy alerts:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get alerts")
+	}
+	defer rows.Close()
+
+	alerts := make([]PharmacyAlert, 0)
+	for rows.Next() {
+		alert, err := scanPharmacyAlert(rows)
+		if err != nil {
+			log.Println("Error scanning pharmacy alert row:", err)
+			continue
+		}
+		alerts = append(alerts, alert)
+	}
+
+	return c.JSON(http.StatusOK, alerts)
+}
+
+// Handler function to acknowledge a pharmacy alert, which stops it being
+// sent again. It stays listed until its condition clears.
+func acknowledgePharmacyAlert(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid alert ID")
+	}
+
+	_, err = db.Exec("UPDATE pharmacy_alerts SET acknowledged_at = NOW(), acknowledged_by = ? WHERE id = ? AND acknowledged_at IS NULL",
+		currentActor(c).nullableID(), id)
+	if err != nil {
+		log.Println("Error acknowledging pharmacy alert:", err)
+		return c.String(http.StatusInternalServerError, "Failed to acknowledge alert")
+	}
+
+	alert, err := scanPharmacyAlert(db.QueryRow(pharmacyAlertSelect+" WHERE a.id = ?", id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.String(http.StatusNotFound, "Alert not found")
+		}
+		log.Println("Error getting pharmacy alert:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get alert")
+	}
+
+	return c.JSON(http.StatusOK, alert)
+}
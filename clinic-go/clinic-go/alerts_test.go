@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpiryWindow(t *testing.T) {
+	policy := alertPolicy{ExpiryWindows: []int{7, 30, 90}}
+	today := Date{Year: 2026, Month: time.March, Day: 2}
+	tests := []struct {
+		name       string
+		expiry     Date
+		wantWindow int
+		wantOK     bool
+	}{
+		{"today", today, 7, true},
+		{"edge of the shortest window", today.AddDays(7), 7, true},
+		{"just past the shortest window", today.AddDays(8), 30, true},
+		{"edge of the longest window", today.AddDays(90), 90, true},
+		{"beyond every window", today.AddDays(91), 0, false},
+		{"across a month end", Date{Year: 2026, Month: time.April, Day: 1}, 30, true},
+	}
+	for _, tt := range tests {
+		window, ok := policy.expiryWindow(tt.expiry, today)
+		if window != tt.wantWindow || ok != tt.wantOK {
+			t.Errorf("%s: expiryWindow(%s) = %d, %v, want %d, %v", tt.name, tt.expiry, window, ok, tt.wantWindow, tt.wantOK)
+		}
+	}
+
+	if _, ok := (alertPolicy{}).expiryWindow(today, today); ok {
+		t.Error("a policy without windows raised an expiring alert")
+	}
+}
+
+func TestExpiryAlert(t *testing.T) {
+	policy := alertPolicy{ExpiryWindows: []int{7, 30, 90}}
+	today := Date{Year: 2026, Month: time.March, Day: 2}
+	lotID := uint(12)
+	tests := []struct {
+		name        string
+		lotID       *uint
+		lotNumber   string
+		expiry      Date
+		wantOK      bool
+		wantKind    string
+		wantWindow  int
+		wantKey     string
+		wantMessage string
+	}{
+		{"expired lot", &lotID, "L-7", today.AddDays(-1), true, alertExpired, 0, "expired:lot:12", "Lot L-7 of Amoxicillin expired on 2026-03-01; 40 on hand."},
+		{"lot expiring today is not yet expired", &lotID, "L-7", today, true, alertExpiring, 7, "expiring:lot:12:7", "within 7 days"},
+		{"lot in the 30-day window", &lotID, "L-7", today.AddDays(20), true, alertExpiring, 30, "expiring:lot:12:30", "expires on 2026-03-22, within 30 days"},
+		{"untracked stock", nil, "", today.AddDays(60), true, alertExpiring, 90, "expiring:drug:3:90", "Amoxicillin (stock without a lot)"},
+		{"untracked stock expired", nil, "", today.AddDays(-30), true, alertExpired, 0, "expired:drug:3", "expired on 2026-01-31"},
+		{"not yet due", &lotID, "L-7", today.AddDays(120), false, "", 0, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alert, ok := policy.expiryAlert(3, "Amoxicillin", tt.lotID, tt.lotNumber, tt.expiry, today, 40)
+			if ok != tt.wantOK {
+				t.Fatalf("ok = %v, want %v", ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if alert.Kind != tt.wantKind || alert.openKey != tt.wantKey {
+				t.Errorf("kind %q key %q, want %q %q", alert.Kind, alert.openKey, tt.wantKind, tt.wantKey)
+			}
+			if tt.wantWindow == 0 && alert.WindowDays != nil {
+				t.Errorf("window_days = %d, want none", *alert.WindowDays)
+			}
+			if tt.wantWindow != 0 && (alert.WindowDays == nil || *alert.WindowDays != tt.wantWindow) {
+				t.Errorf("window_days = %v, want %d", alert.WindowDays, tt.wantWindow)
+			}
+			if !strings.Contains(alert.Message, tt.wantMessage) {
+				t.Errorf("message %q does not contain %q", alert.Message, tt.wantMessage)
+			}
+			if alert.DrugID != 3 || alert.LotID != tt.lotID || alert.LotNumber != tt.lotNumber {
+				t.Errorf("alert identifies drug %d lot %v %q", alert.DrugID, alert.LotID, alert.LotNumber)
+			}
+		})
+	}
+}
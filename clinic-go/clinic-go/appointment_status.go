@@ -0,0 +1,197 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Appointment lifecycle statuses
+const (
+	statusRequested      = "requested"
+	statusConfirmed      = "confirmed"
+	statusCheckedIn      = "checked_in"
+	statusInConsultation = "in_consultation"
+	statusCompleted      = "completed"
+	statusCancelled      = "cancelled"
+	statusNoShow         = "no_show"
+)
+
+// appointmentTransitions lists, for each status, the statuses an appointment
+// may move to next. Completed, cancelled and no-show appointments are final.
+var appointmentTransitions = map[string][]string{
+	statusRequested:      {statusConfirmed, statusCancelled},
+	statusConfirmed:      {statusCheckedIn, statusCancelled, statusNoShow},
+	statusCheckedIn:      {statusInConsultation, statusCancelled},
+	statusInConsultation: {statusCompleted},
+}
+
+// transitionError reports a status change the lifecycle does not allow.
+type transitionError struct {
+	From string
+	To   string
+}
+
+func (e *transitionError) Error() string {
+	return fmt.Sprintf("cannot move appointment from %s to %s", e.From, e.To)
+}
+
+// canTransition reports whether an appointment may move from one status to
+// another.
+func canTransition(from, to string) bool {
+	for _, next := range appointmentTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// StatusChange is one step in the lifecycle of an appointment
+type StatusChange struct {
+	ID            uint      `json:"id"`
+	AppointmentID uint      `json:"appointment_id"`
+	FromStatus    string    `json:"from_status"`
+	ToStatus      string    `json:"to_status"`
+	ActorUserID   *uint     `json:"actor_user_id"`
+	ActorRole     string    `json:"actor_role"`
+	Reason        string    `json:"reason,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// transitionAppointment moves an appointment to a new status and records who
+// did it. A non-zero version makes the change conditional on the stored
+// version, as with saveAppointment.
+func transitionAppointment(id int, to string, actor Actor, reason string, version uint) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := transitionAppointmentTx(tx, id, to, actor, reason, version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// transitionAppointmentTx is transitionAppointment within the caller's
+// transaction.
+func transitionAppointmentTx(tx *sql.Tx, id int, to string, actor Actor, reason string, version uint) error {
+	var from string
+	var current uint
+	err := tx.QueryRow("SELECT status, version FROM patient_appointments WHERE id = ? AND deleted_at IS NULL FOR UPDATE", id).Scan(&from, &current)
+	if err != nil {
+		return err
+	}
+	if version != 0 && version != current {
+		return errPreconditionFailed
+	}
+	if !canTransition(from, to) {
+		return &transitionError{From: from, To: to}
+	}
+
+	_, err = tx.Exec("UPDATE patient_appointments SET status = ?, version = version + 1 WHERE id = ?", to, id)
+	if err != nil {
+		return err
+	}
+	if err := syncQueue(tx, id, to); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("INSERT INTO appointment_status_history (appointment_id, from_status, to_status, actor_user_id, actor_role, reason) VALUES (?, ?, ?, ?, ?, ?)",
+		id, from, to, actor.nullableID(), actor.Role, reason)
+	return err
+}
+
+// transitionHandler returns a handler that moves the appointment in the path
+// to the given status. The request body may carry a {"reason": "..."}.
+func transitionHandler(to string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid appointment ID")
+		}
+
+		expected, err := ifMatch(c)
+		if err != nil {
+			return updateFailed(c, err, "Appointment")
+		}
+
+		var body struct {
+			Reason string `json:"reason"`
+		}
+		if c.Request().ContentLength > 0 {
+			if err := c.Bind(&body); err != nil {
+				return c.String(http.StatusBadRequest, "Invalid request payload")
+			}
+		}
+
+		err = transitionAppointment(id, to, currentActor(c), body.Reason, expected)
+		if err != nil {
+			var illegal *transitionError
+			if errors.As(err, &illegal) {
+				return c.String(http.StatusConflict, illegal.Error())
+			}
+			return updateFailed(c, err, "Appointment")
+		}
+		publishStatusChange(id)
+		if to == statusCancelled {
+			offerCancelledSlot(id)
+		}
+
+		return getAppointment(c)
+	}
+}
+
+// publishStatusChange publishes a status change of an appointment, and of
+// its queue entry when it has one.
+func publishStatusChange(id int) {
+	publishAppointment("status_changed", id)
+	if entry, err := findQueueEntryByAppointment(id); err == nil {
+		publishQueueEntry(entry)
+	}
+}
+
+// Handler function to get the status history of an appointment
+func getAppointmentHistory(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid appointment ID")
+	}
+
+	if _, err := findAppointment(id, false); err != nil {
+		if err == sql.ErrNoRows {
+			return c.String(http.StatusNotFound, "Appointment not found")
+		}
+		log.Println("Error getting appointment:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get appointment")
+	}
+
+	rows, err := db.Query("SELECT id, appointment_id, from_status, to_status, actor_user_id, actor_role, reason, created_at FROM appointment_status_history WHERE appointment_id = ? ORDER BY id", id)
+	if err != nil {
+		log.Println("Error querying appointment history:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get appointment history")
+	}
+	defer rows.Close()
+
+	history := make([]StatusChange, 0)
+	for rows.Next() {
+		var change StatusChange
+		err := rows.Scan(&change.ID, &change.AppointmentID, &change.FromStatus, &change.ToStatus,
+			&change.ActorUserID, &change.ActorRole, &change.Reason, &change.CreatedAt)
+		if err != nil {
+			log.Println("Error scanning appointment history row:", err)
+			continue
+		}
+		history = append(history, change)
+	}
+
+	return c.JSON(http.StatusOK, history)
+}
@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestCanTransition(t *testing.T) {
+	allowed := map[[2]string]bool{
+		{statusRequested, statusConfirmed}:      true,
+		{statusRequested, statusCancelled}:      true,
+		{statusConfirmed, statusCheckedIn}:      true,
+		{statusConfirmed, statusCancelled}:      true,
+		{statusConfirmed, statusNoShow}:         true,
+		{statusCheckedIn, statusInConsultation}: true,
+		{statusCheckedIn, statusCancelled}:      true,
+		{statusInConsultation, statusCompleted}: true,
+	}
+	statuses := []string{statusRequested, statusConfirmed, statusCheckedIn, statusInConsultation, statusCompleted, statusCancelled, statusNoShow}
+	for _, from := range statuses {
+		for _, to := range statuses {
+			if got, want := canTransition(from, to), allowed[[2]string{from, to}]; got != want {
+				t.Errorf("canTransition(%s, %s) = %v, want %v", from, to, got, want)
+			}
+		}
+	}
+}
+
+func TestCanTransitionEdgeCases(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to string
+	}{
+		{"final status completed", statusCompleted, statusCancelled},
+		{"final status cancelled", statusCancelled, statusConfirmed},
+		{"final status no-show", statusNoShow, statusCheckedIn},
+		{"skipping check-in", statusConfirmed, statusInConsultation},
+		{"going back", statusInConsultation, statusCheckedIn},
+		{"to itself", statusConfirmed, statusConfirmed},
+		{"unknown from", "archived", statusConfirmed},
+		{"unknown to", statusRequested, "archived"},
+		{"empty", "", ""},
+	}
+	for _, tt := range tests {
+		if canTransition(tt.from, tt.to) {
+			t.Errorf("%s: canTransition(%q, %q) = true, want false", tt.name, tt.from, tt.to)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Roles recognised by the API
+const (
+	roleAdmin        = "admin"
+	roleDoctor       = "doctor"
+	roleReceptionist = "receptionist"
+	rolePharmacist   = "pharmacist"
+	rolePatient      = "patient"
+)
+
+// Actor identifies who is making a request. The API runs behind the clinic
+// gateway, which authenticates staff and patients and forwards their identity
+// in the X-User-ID and X-User-Role headers.
+type Actor struct {
+	UserID uint
+	Role   string
+}
+
+// currentActor returns the actor making the request. Requests without
+// identity headers yield the zero Actor.
+func currentActor(c echo.Context) Actor {
+	id, _ := strconv.ParseUint(c.Request().Header.Get("X-User-ID"), 10, 32)
+	return Actor{
+		UserID: uint(id),
+		Role:   c.Request().Header.Get("X-User-Role"),
+	}
+}
+
+// IsAdmin reports whether the actor has administrative privileges.
+func (a Actor) IsAdmin() bool {
+	return a.Role == roleAdmin
+}
+
+// nullableID returns the actor's user ID for nullable actor columns, or nil
+// for anonymous requests.
+func (a Actor) nullableID() *uint {
+	if a.UserID == 0 {
+		return nil
+	}
+	return &a.UserID
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// defaultAppointmentDuration is how long an appointment occupies its doctor
+// and patient when the doctor has no schedule covering it.
+const defaultAppointmentDuration = 30 * time.Minute
+
+// bookingConflict reports an appointment that overlaps an existing one for
+// the same doctor or the same patient, or a slot held for a waitlist offer.
+type bookingConflict struct {
+	Reason      string
+	Conflicting *PatientAppointment // nil for a held slot
+}
+
+func (e *bookingConflict) Error() string {
+	return e.Reason
+}
+
+// conflictResponse writes the 409 response for a booking conflict.
+func conflictResponse(c echo.Context, conflict *bookingConflict) error {
+	body := map[string]interface{}{"error": conflict.Reason}
+	if conflict.Conflicting != nil {
+		body["conflicting_appointment"] = conflict.Conflicting
+	}
+	return c.JSON(http.StatusConflict, body)
+}
+
+// lockBooking serializes bookings that involve the same doctor or patient by
+// locking their rows until tx ends. The doctor is always locked first so two
+// bookings can never wait on each other.
+func lockBooking(tx *sql.Tx, appointment PatientAppointment) error {
+	var id int
+	if err := tx.QueryRow("SELECT id FROM doctors WHERE id = ? FOR UPDATE", appointment.DoctorID).Scan(&id); err != nil {
+		return err
+	}
+	return tx.QueryRow("SELECT id FROM patients WHERE id = ? FOR UPDATE", appointment.PatientID).Scan(&id)
+}
+
+// findBookingConflict returns a *bookingConflict when a live appointment
+// other than excludeID overlaps appointment for its doctor or patient. It
+// must run inside the transaction holding lockBooking's locks.
+func findBookingConflict(tx *sql.Tx, appointment PatientAppointment, excludeID int) error {
+	duration, err := slotDuration(appointment.DoctorID, appointment.AppointmentDate)
+	if err != nil {
+		return err
+	}
+
+	// Two appointments of the same length overlap when their start times are
+	// less than one length apart.
+	start := appointment.AppointmentDate.Add(-duration).UTC()
+	end := appointment.AppointmentDate.Add(duration).UTC()
+	row := tx.QueryRow(appointmentSelect+
+		" WHERE a.deleted_at IS NULL AND a.status NOT IN ('cancelled', 'no_show') AND a.id <> ?"+
+		" AND (a.doctor_id = ? OR a.patient_id = ?) AND a.appointment_date > ? AND a.appointment_date < ?"+
+		" ORDER BY a.appointment_date LIMIT 1",
+		excludeID, appointment.DoctorID, appointment.PatientID, start, end)
+
+	existing, err := scanAppointment(row)
+	if err == sql.ErrNoRows {
+		return findHeldSlot(tx, appointment, start, end)
+	}
+	if err != nil {
+		return err
+	}
+
+	reason := fmt.Sprintf("patient already has appointment %d at %s", existing.ID, existing.AppointmentDate.Format(time.RFC3339))
+	if existing.DoctorID == appointment.DoctorID {
+		reason = fmt.Sprintf("doctor is already booked by appointment %d at %s", existing.ID, existing.AppointmentDate.Format(time.RFC3339))
+	}
+	return &bookingConflict{Reason: reason, Conflicting: &existing}
+}
+
+// findHeldSlot returns a *bookingConflict when the doctor's time between
+// start and end is held for a pending waitlist offer to another patient.
+func findHeldSlot(tx *sql.Tx, appointment PatientAppointment, start, end time.Time) error {
+	var expires time.Time
+	err := tx.QueryRow("SELECT o.expires_at FROM waitlist_offers o JOIN waitlist_entries w ON w.id = o.entry_id"+
+		" WHERE o.status = ? AND o.expires_at > ? AND o.doctor_id = ? AND w.patient_id <> ?"+
+		" AND o.appointment_date > ? AND o.appointment_date < ? ORDER BY o.expires_at DESC LIMIT 1",
+		offerPending, time.Now().UTC(), appointment.DoctorID, appointment.PatientID, start, end).Scan(&expires)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	reason := fmt.Sprintf("slot is held for a waitlist offer until %s", expires.In(clinicLocation).Format(time.RFC3339))
+	return &bookingConflict{Reason: reason}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// openTestDB connects the package's db to the MySQL database named by
+// CLINIC_TEST_DSN, e.g.
+//
+//	root:@tcp(localhost:3306)/clinic_test?parseTime=true&loc=UTC&time_zone=%27%2B00%3A00%27
+//
+// and brings it up to date. The database must already hold the base
+// clinic_db schema and may be written to; tests that need it are skipped
+// when the variable is unset.
+func openTestDB(t *testing.T) {
+	t.Helper()
+	dsn := os.Getenv("CLINIC_TEST_DSN")
+	if dsn == "" {
+		t.Skip("CLINIC_TEST_DSN is not set")
+	}
+
+	var err error
+	db, err = sql.Open("mysql", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := migrate(db); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// insertTestRow runs an INSERT and returns the new row's ID.
+func insertTestRow(t *testing.T, query string, args ...interface{}) int64 {
+	t.Helper()
+	result, err := db.Exec(query, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// TestConcurrentBookingsOneWins books the same doctor and slot for several
+// patients at once. lockBooking must let exactly one booking through and
+// turn every other one into a conflict naming the winner.
+func TestConcurrentBookingsOneWins(t *testing.T) {
+	openTestDB(t)
+	const bookings = 8
+
+	suffix := time.Now().UnixNano()
+	userID := insertTestRow(t, "INSERT INTO users (name, email) VALUES (?, ?)", "Race Doctor", fmt.Sprintf("race-%d@clinic.test", suffix))
+	doctorID := insertTestRow(t, "INSERT INTO doctors (user_id, specialization, created_at, updated_at, profile_photo_path) VALUES (?, ?, NOW(), NOW(), '')", userID, "General")
+	patientIDs := make([]int64, bookings)
+	for i := range patientIDs {
+		patientIDs[i] = insertTestRow(t, "INSERT INTO patients (nik, name, gender, date_of_birth, address, password, price_tier) VALUES (?, ?, 'F', '1990-01-01', '', '', 'general')",
+			fmt.Sprintf("RACE-%d-%d", suffix, i), fmt.Sprintf("Race Patient %d", i))
+	}
+	t.Cleanup(func() {
+		db.Exec("DELETE h FROM appointment_status_history h JOIN patient_appointments a ON a.id = h.appointment_id WHERE a.doctor_id = ?", doctorID)
+		db.Exec("DELETE FROM patient_appointments WHERE doctor_id = ?", doctorID)
+		for _, id := range patientIDs {
+			db.Exec("DELETE FROM patients WHERE id = ?", id)
+		}
+		db.Exec("DELETE FROM doctors WHERE id = ?", doctorID)
+		db.Exec("DELETE FROM users WHERE id = ?", userID)
+	})
+
+	e := echo.New()
+	e.POST("/appointments", createAppointment)
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	slot := time.Now().AddDate(0, 1, 0).UTC().Truncate(time.Hour)
+	type response struct {
+		status int
+		body   map[string]json.RawMessage
+	}
+	responses := make([]response, bookings)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < bookings; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			payload := fmt.Sprintf(`{"patient_id": %d, "doctor_id": %d, "appointment_date": %q}`, patientIDs[i], doctorID, slot.Format(time.RFC3339))
+			<-start
+			resp, err := http.Post(server.URL+"/appointments", echo.MIMEApplicationJSON, strings.NewReader(payload))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			responses[i].status = resp.StatusCode
+			json.NewDecoder(resp.Body).Decode(&responses[i].body)
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	created := 0
+	for i, r := range responses {
+		switch r.status {
+		case http.StatusCreated:
+			created++
+		case http.StatusConflict:
+			if _, ok := r.body["conflicting_appointment"]; !ok {
+				t.Errorf("booking %d: 409 without conflicting_appointment: %v", i, r.body)
+			}
+		default:
+			t.Errorf("booking %d: status %d, want 201 or 409", i, r.status)
+		}
+	}
+	if created != 1 {
+		t.Errorf("%d bookings succeeded, want exactly 1", created)
+	}
+
+	var stored int
+	if err := db.QueryRow("SELECT COUNT(*) FROM patient_appointments WHERE doctor_id = ? AND deleted_at IS NULL", doctorID).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored != 1 {
+		t.Errorf("%d appointments stored for the slot, want 1", stored)
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Owners of calendar feeds
+const (
+	feedOwnerDoctor  = "doctor"
+	feedOwnerPatient = "patient"
+)
+
+// CalendarFeed is a secret iCalendar feed URL for a doctor's or a patient's
+// appointments. Only a hash of the token is stored; the token itself is
+// returned once, when the feed is created.
+type CalendarFeed struct {
+	ID         uint       `json:"id"`
+	OwnerType  string     `json:"owner_type"`
+	OwnerID    int        `json:"owner_id"`
+	Label      string     `json:"label"`
+	Token      string     `json:"token,omitempty"`
+	URL        string     `json:"url,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// hashFeedToken returns the stored form of a feed token.
+func hashFeedToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// feedOwnerExists returns sql.ErrNoRows when the owner of a feed does not
+// exist.
+func feedOwnerExists(ownerType string, id int) error {
+	if ownerType == feedOwnerDoctor {
+		_, err := findDoctor(id)
+		return err
+	}
+	_, err := findPatient(id, false)
+	return err
+}
+
+// feedOwnerParam parses the owner ID in the path and checks the owner exists.
+func feedOwnerParam(c echo.Context, ownerType string) (int, int, error) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return 0, http.StatusBadRequest, fmt.Errorf("Invalid %s ID", ownerType)
+	}
+	if err := feedOwnerExists(ownerType, id); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, http.StatusNotFound, fmt.Errorf("%s%s not found", strings.ToUpper(ownerType[:1]), ownerType[1:])
+		}
+		log.Println("Error getting "+ownerType+":", err)
+		return 0, http.StatusInternalServerError, fmt.Errorf("Failed to get %s", ownerType)
+	}
+	return id, 0, nil
+}
+
+// Handler function to list the calendar feeds of a doctor or a patient,
+// including revoked ones
+func calendarFeedsHandler(ownerType string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id, status, err := feedOwnerParam(c, ownerType)
+		if err != nil {
+			return c.String(status, err.Error())
+		}
+
+		rows, err := db.Query("SELECT id, owner_type, owner_id, label, created_at, last_used_at, revoked_at FROM calendar_feeds WHERE owner_type = ? AND owner_id = ? ORDER BY id",
+			ownerType, id)
+		if err != nil {
+			log.Println("Error querying calendar feeds:", err)
+			return c.String(http.StatusInternalServerError, "Failed to get calendar feeds")
+		}
+		defer rows.Close()
+
+		feeds := make([]CalendarFeed, 0)
+		for rows.Next() {
+			var feed CalendarFeed
+			if err := rows.Scan(&feed.ID, &feed.OwnerType, &feed.OwnerID, &feed.Label, &feed.CreatedAt, &feed.LastUsedAt, &feed.RevokedAt); err != nil {
+				log.Println("Error scanning calendar feed row:", err)
+				continue
+			}
+			feeds = append(feeds, feed)
+		}
+
+		return c.JSON(http.StatusOK, feeds)
+	}
+}
+
+// Handler function to create a calendar feed for a doctor or a patient. The
+// response carries the feed's secret token and URL, which cannot be
+// retrieved again.
+func createCalendarFeedHandler(ownerType string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id, status, err := feedOwnerParam(c, ownerType)
+		if err != nil {
+			return c.String(status, err.Error())
+		}
+
+		var body struct {
+			Label string `json:"label"`
+		}
+		if c.Request().ContentLength > 0 {
+			if err := c.Bind(&body); err != nil {
+				return c.String(http.StatusBadRequest, "Invalid request payload")
+			}
+		}
+
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			log.Println("Error generating calendar feed token:", err)
+			return c.String(http.StatusInternalServerError, "Failed to create calendar feed")
+		}
+		token := base64.RawURLEncoding.EncodeToString(secret)
+
+		result, err := db.Exec("INSERT INTO calendar_feeds (owner_type, owner_id, label, token_hash) VALUES (?, ?, ?, ?)",
+			ownerType, id, body.Label, hashFeedToken(token))
+		if err != nil {
+			log.Println("Error inserting calendar feed:", err)
+			return c.String(http.StatusInternalServerError, "Failed to create calendar feed")
+		}
+		feedID, err := result.LastInsertId()
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to get last insert ID")
+		}
+
+		return c.JSON(http.StatusCreated, CalendarFeed{
+			ID:        uint(feedID),
+			OwnerType: ownerType,
+			OwnerID:   id,
+			Label:     body.Label,
+			Token:     token,
+			URL:       getenv("PUBLIC_BASE_URL", "") + "/calendar/" + token + ".ics",
+			CreatedAt: time.Now().UTC(),
+		})
+	}
+}
+
+// Handler function to revoke a calendar feed. Calendar apps subscribed to it
+// get 404 from then on.
+func revokeCalendarFeed(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid calendar feed ID")
+	}
+
+	result, err := db.Exec("UPDATE calendar_feeds SET revoked_at = NOW() WHERE id = ? AND revoked_at IS NULL", id)
+	if err != nil {
+		log.Println("Error revoking calendar feed:", err)
+		return c.String(http.StatusInternalServerError, "Failed to revoke calendar feed")
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM calendar_feeds WHERE id = ?)", id).Scan(&exists); err == nil && !exists {
+			return c.String(http.StatusNotFound, "Calendar feed not found")
+		}
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Handler function to serve a calendar feed, /calendar/<token>.ics. The
+// token is the only credential, so calendar apps can subscribe without the
+// gateway's identity headers.
+func getCalendarFeed(c echo.Context) error {
+	token := strings.TrimSuffix(c.Param("token"), ".ics")
+
+	var feed CalendarFeed
+	err := db.QueryRow("SELECT id, owner_type, owner_id FROM calendar_feeds WHERE token_hash = ? AND revoked_at IS NULL", hashFeedToken(token)).
+		Scan(&feed.ID, &feed.OwnerType, &feed.OwnerID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.String(http.StatusNotFound, "Calendar feed not found")
+		}
+		log.Println("Error getting calendar feed:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get calendar feed")
+	}
+	if _, err := db.Exec("UPDATE calendar_feeds SET last_used_at = NOW() WHERE id = ?", feed.ID); err != nil {
+		log.Println("Error updating calendar feed:", err)
+	}
+
+	// Deleted appointments stay in the feed, cancelled, so subscribed
+	// calendars remove them.
+	column := "a.patient_id"
+	if feed.OwnerType == feedOwnerDoctor {
+		column = "a.doctor_id"
+	}
+	since := time.Now().AddDate(0, 0, -getenvInt("CALENDAR_PAST_DAYS", 90))
+	rows, err := db.Query(appointmentSelect+" WHERE "+column+" = ? AND a.appointment_date >= ? ORDER BY a.appointment_date, a.id",
+		feed.OwnerID, since.UTC())
+	if err != nil {
+		log.Println("Error querying calendar appointments:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get calendar feed")
+	}
+	defer rows.Close()
+
+	var appointments []PatientAppointment
+	for rows.Next() {
+		appointment, err := scanAppointment(rows)
+		if err != nil {
+			log.Println("Error scanning appointment row:", err)
+			continue
+		}
+		appointments = append(appointments, appointment)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Error querying calendar appointments:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get calendar feed")
+	}
+
+	cal := &icalWriter{}
+	cal.line("BEGIN:VCALENDAR")
+	cal.line("VERSION:2.0")
+	cal.line("PRODID:-//Clinic//Appointments//EN")
+	cal.line("CALSCALE:GREGORIAN")
+	cal.line("METHOD:PUBLISH")
+	cal.property("X-WR-CALNAME", "Clinic appointments")
+	cal.property("X-WR-TIMEZONE", clinicLocation.String())
+	end := time.Now().AddDate(1, 0, 0)
+	if n := len(appointments); n > 0 && appointments[n-1].AppointmentDate.After(end) {
+		end = appointments[n-1].AppointmentDate.AddDate(1, 0, 0)
+	}
+	cal.timezone(clinicLocation, since, end)
+	for _, appointment := range appointments {
+		cal.event(appointment, feed.OwnerType)
+	}
+	cal.line("END:VCALENDAR")
+
+	c.Response().Header().Set("Cache-Control", "private, max-age=300")
+	return c.Blob(http.StatusOK, "text/calendar; charset=utf-8", []byte(cal.String()))
+}
+
+// icalWriter builds an iCalendar (RFC 5545) document.
+type icalWriter struct {
+	strings.Builder
+}
+
+// line writes a content line, folded to 75 octets.
+func (w *icalWriter) line(s string) {
+	limit := 75
+	for len(s) > limit {
+		cut := limit
+		for !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		w.WriteString(s[:cut] + "\r\n ")
+		s = s[cut:]
+		limit = 74 // continuation lines start with a space
+	}
+	w.WriteString(s + "\r\n")
+}
+
+// property writes a property with an escaped text value.
+func (w *icalWriter) property(name, text string) {
+	text = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(text)
+	w.line(name + ":" + text)
+}
+
+// icalUTC formats a time as an iCalendar UTC date-time.
+func icalUTC(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+// icalOffset formats a UTC offset in seconds as ±hhmm[ss].
+func icalOffset(offset int) string {
+	sign := "+"
+	if offset < 0 {
+		sign, offset = "-", -offset
+	}
+	s := fmt.Sprintf("%s%02d%02d", sign, offset/3600, offset/60%60)
+	if offset%60 != 0 {
+		s += fmt.Sprintf("%02d", offset%60)
+	}
+	return s
+}
+
+// timezone writes a VTIMEZONE for loc covering [from, to). Go does not
+// expose the zone's rules, so the transitions are found by probing the
+// offset week by week and emitted as individual observances.
+func (w *icalWriter) timezone(loc *time.Location, from, to time.Time) {
+	observance := func(at time.Time, offsetFrom int) {
+		name, offset := at.In(loc).Zone()
+		kind := "STANDARD"
+		if at.In(loc).IsDST() {
+			kind = "DAYLIGHT"
+		}
+		w.line("BEGIN:" + kind)
+		// DTSTART is the local time of the transition under the old offset
+		w.line("DTSTART:" + at.UTC().Add(time.Duration(offsetFrom)*time.Second).Format("20060102T150405"))
+		w.line("TZOFFSETFROM:" + icalOffset(offsetFrom))
+		w.line("TZOFFSETTO:" + icalOffset(offset))
+		w.property("TZNAME", name)
+		w.line("END:" + kind)
+	}
+
+	w.line("BEGIN:VTIMEZONE")
+	w.line("TZID:" + loc.String())
+	start := from.Truncate(time.Hour)
+	_, offset := start.In(loc).Zone()
+	observance(start, offset)
+	for t := start; t.Before(to); t = t.Add(7 * 24 * time.Hour) {
+		next := t.Add(7 * 24 * time.Hour)
+		if _, nextOffset := next.In(loc).Zone(); nextOffset == offset {
+			continue
+		}
+		// Narrow the change down to the second it happens
+		lo, hi := t, next
+		for hi.Sub(lo) > time.Second {
+			mid := lo.Add(hi.Sub(lo) / 2)
+			if _, o := mid.In(loc).Zone(); o == offset {
+				lo = mid
+			} else {
+				hi = mid
+			}
+		}
+		observance(hi, offset)
+		_, offset = hi.In(loc).Zone()
+		t = hi.Add(-7 * 24 * time.Hour)
+	}
+	w.line("END:VTIMEZONE")
+}
+
+// event writes an appointment as a VEVENT. The UID depends only on the
+// appointment ID, so updates replace the event in subscribed calendars, and
+// SEQUENCE follows the appointment's version. Doctors see the patient's name;
+// patients see the doctor's. Notes and prescriptions are never included.
+func (w *icalWriter) event(appointment PatientAppointment, ownerType string) {
+	duration, err := slotDuration(appointment.DoctorID, appointment.AppointmentDate)
+	if err != nil {
+		log.Println("Error getting slot duration:", err)
+		duration = defaultAppointmentDuration
+	}
+	start := appointment.AppointmentDate.In(clinicLocation)
+	tzid := ";TZID=" + clinicLocation.String() + ":"
+
+	summary := "Clinic appointment"
+	if ownerType == feedOwnerDoctor && appointment.Patient != nil {
+		summary = "Appointment: " + appointment.Patient.Name
+	} else if ownerType == feedOwnerPatient && appointment.Doctor != nil && appointment.Doctor.Name != "" {
+		summary = "Appointment with " + appointment.Doctor.Name
+		if appointment.Doctor.Specialization != "" {
+			summary += " (" + appointment.Doctor.Specialization + ")"
+		}
+	}
+
+	status := "CONFIRMED"
+	switch {
+	case appointment.DeletedAt != nil || appointment.Status == statusCancelled:
+		status = "CANCELLED"
+	case appointment.Status == statusRequested:
+		status = "TENTATIVE"
+	}
+
+	w.line("BEGIN:VEVENT")
+	w.line(fmt.Sprintf("UID:appointment-%d@%s", appointment.ID, getenv("CALENDAR_UID_DOMAIN", "clinic.local")))
+	w.line("DTSTAMP:" + icalUTC(appointment.UpdatedAt))
+	w.line("CREATED:" + icalUTC(appointment.CreatedAt))
+	w.line("LAST-MODIFIED:" + icalUTC(appointment.UpdatedAt))
+	w.line("SEQUENCE:" + strconv.Itoa(int(appointment.Version)))
+	w.line("DTSTART" + tzid + start.Format("20060102T150405"))
+	w.line("DTEND" + tzid + start.Add(duration).Format("20060102T150405"))
+	w.property("SUMMARY", summary)
+	w.line("STATUS:" + status)
+	w.line("TRANSP:OPAQUE")
+	w.line("END:VEVENT")
+}
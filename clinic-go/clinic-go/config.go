@@ -0,0 +1,62 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// getenv returns the value of the environment variable key, or fallback when
+// it is unset or empty.
+func getenv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// getenvInt is getenv for integer settings. Invalid values are logged and
+// replaced by fallback.
+func getenvInt(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid %s %q, using %d", key, value, fallback)
+		return fallback
+	}
+	return n
+}
+
+// getenvDuration is getenv for durations such as "24h" or "15m". Invalid
+// values are logged and replaced by fallback.
+func getenvDuration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid %s %q, using %s", key, value, fallback)
+		return fallback
+	}
+	return d
+}
+
+// getenvDecimal is getenv for decimal settings such as percentages. Invalid
+// values are logged and replaced by fallback.
+func getenvDecimal(key string, fallback Decimal) Decimal {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	d, err := parseDecimal(value)
+	if err != nil {
+		log.Printf("Invalid %s %q, using %s", key, value, fallback)
+		return fallback
+	}
+	return d
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+	_ "time/tzdata" // clinics may run on hosts without a zoneinfo database
+)
+
+// dateLayout is the wire and storage format of a Date.
+const dateLayout = "2006-01-02"
+
+// clinicLocation is the clinic's local timezone. Timestamps are stored in
+// UTC; appointment times and daily reports are rendered in this zone.
+var clinicLocation = time.UTC
+
+// loadClinicLocation reads the clinic's IANA timezone from CLINIC_TIMEZONE,
+// defaulting to Asia/Jakarta.
+func loadClinicLocation() *time.Location {
+	name := getenv("CLINIC_TIMEZONE", "Asia/Jakarta")
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		log.Printf("Invalid CLINIC_TIMEZONE %q, using UTC", name)
+		return time.UTC
+	}
+	return loc
+}
+
+// clinicDay returns the bounds of the local calendar day in the clinic's
+// timezone that contains t.
+func clinicDay(t time.Time) (start, end time.Time) {
+	local := t.In(clinicLocation)
+	start = time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, clinicLocation)
+	return start, start.AddDate(0, 0, 1)
+}
+
+// Date is a calendar date with no time of day or timezone, such as a date of
+// birth or an expiry date. It is encoded as "YYYY-MM-DD"; the zero Date is
+// encoded as null and stored as NULL.
+type Date struct {
+	Year  int
+	Month time.Month
+	Day   int
+}
+
+// parseDate parses a "YYYY-MM-DD" string.
+func parseDate(s string) (Date, error) {
+	t, err := time.Parse(dateLayout, s)
+	if err != nil {
+		return Date{}, err
+	}
+	return dateOf(t), nil
+}
+
+// dateOf returns the date of t in t's location.
+func dateOf(t time.Time) Date {
+	year, month, day := t.Date()
+	return Date{year, month, day}
+}
+
+// IsZero reports whether d is the zero Date.
+func (d Date) IsZero() bool {
+	return d == Date{}
+}
+
+// In returns midnight at the start of d in loc.
+func (d Date) In(loc *time.Location) time.Time {
+	return time.Date(d.Year, d.Month, d.Day, 0, 0, 0, 0, loc)
+}
+
+// Before reports whether d is before other.
+func (d Date) Before(other Date) bool {
+	return d.In(time.UTC).Before(other.In(time.UTC))
+}
+
+// AddDays returns the date n days after d.
+func (d Date) AddDays(n int) Date {
+	return dateOf(d.In(time.UTC).AddDate(0, 0, n))
+}
+
+func (d Date) String() string {
+	return fmt.Sprintf("%04d-%02d-%02d", d.Year, d.Month, d.Day)
+}
+
+// MarshalJSON implements json.Marshaler.
+func (d Date) MarshalJSON() ([]byte, error) {
+	if d.IsZero() {
+		return []byte("null"), nil
+	}
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Date) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*d = Date{}
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := parseDate(s)
+	if err != nil {
+		return fmt.Errorf("invalid date %q, want YYYY-MM-DD", s)
+	}
+	*d = parsed
+	return nil
+}
+
+// Scan implements sql.Scanner.
+func (d *Date) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*d = Date{}
+		return nil
+	case time.Time:
+		*d = dateOf(v)
+		return nil
+	case []byte:
+		return d.scanString(string(v))
+	case string:
+		return d.scanString(v)
+	default:
+		return fmt.Errorf("cannot scan %T into Date", src)
+	}
+}
+
+func (d *Date) scanString(s string) error {
+	if len(s) > len(dateLayout) {
+		s = s[:len(dateLayout)]
+	}
+	parsed, err := parseDate(s)
+	if err != nil {
+		return err
+	}
+	*d = parsed
+	return nil
+}
+
+// Value implements driver.Valuer.
+func (d Date) Value() (driver.Value, error) {
+	if d.IsZero() {
+		return nil, nil
+	}
+	return d.String(), nil
+}
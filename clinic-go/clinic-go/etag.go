@@ -0,0 +1,106 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// errPreconditionFailed is returned by a versioned update when the stored
+// row no longer has the version the client last saw.
+var errPreconditionFailed = errors.New("precondition failed")
+
+// etag formats a row version as a strong entity tag.
+func etag(version uint) string {
+	return fmt.Sprintf("%q", strconv.FormatUint(uint64(version), 10))
+}
+
+// setETag exposes a row version to the client through the ETag header.
+func setETag(c echo.Context, version uint) {
+	c.Response().Header().Set("ETag", etag(version))
+}
+
+// ifMatch returns the row version required by the request's If-Match
+// header, or 0 when the header is absent or "*". A header that cannot match
+// any version (a weak tag, a list, garbage) yields errPreconditionFailed.
+func ifMatch(c echo.Context) (uint, error) {
+	header := strings.TrimSpace(c.Request().Header.Get("If-Match"))
+	if header == "" || header == "*" {
+		return 0, nil
+	}
+
+	unquoted, err := strconv.Unquote(header)
+	if err != nil || !strings.HasPrefix(header, `"`) {
+		return 0, errPreconditionFailed
+	}
+	version, err := strconv.ParseUint(unquoted, 10, 32)
+	if err != nil || version == 0 {
+		return 0, errPreconditionFailed
+	}
+	return uint(version), nil
+}
+
+// checkVersionedUpdate inspects the result of an UPDATE guarded by a row
+// version. It returns sql.ErrNoRows when the row does not exist and
+// errPreconditionFailed when it exists but was changed in the meantime.
+func checkVersionedUpdate(result sql.Result, table string, id int) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected > 0 {
+		return nil
+	}
+
+	query := "SELECT version FROM " + table + " WHERE id = ?"
+	if softDeleteTables[table] {
+		query += " AND deleted_at IS NULL"
+	}
+
+	var version uint
+	err = db.QueryRow(query, id).Scan(&version)
+	if err != nil {
+		return err
+	}
+	return errPreconditionFailed
+}
+
+// updateFailed writes the response for an error returned while saving a
+// resource. name is the capitalized resource name, e.g. "Drug".
+func updateFailed(c echo.Context, err error, name string) error {
+	var conflict *bookingConflict
+	var insufficient *insufficientStockError
+	var prescription *prescriptionError
+	var price *pricingError
+	var blocked *interactionBlockedError
+	switch {
+	case errors.As(err, &conflict):
+		return conflictResponse(c, conflict)
+	case errors.As(err, &insufficient):
+		return c.String(http.StatusConflict, insufficient.Error())
+	case errors.As(err, &prescription):
+		return c.String(prescription.Status, prescription.Message)
+	case errors.As(err, &price):
+		return c.String(price.Status, price.Message)
+	case errors.As(err, &blocked):
+		return interactionBlockedResponse(c, blocked)
+	case errors.Is(err, sql.ErrNoRows):
+		return c.String(http.StatusNotFound, name+" not found")
+	case errors.Is(err, errPreconditionFailed):
+		return c.String(http.StatusPreconditionFailed, name+" was modified by another request")
+	case errors.Is(err, errOutsideSchedule), errors.Is(err, errNonPositiveQuantity), errors.Is(err, errQuantityPrecision), errors.Is(err, errInvalidPriceTier):
+		return c.String(http.StatusUnprocessableEntity, err.Error())
+	default:
+		if status, message, ok := integrityError(err); ok {
+			return c.String(status, message)
+		}
+		log.Printf("Error updating %s: %v", strings.ToLower(name), err)
+		return c.String(http.StatusInternalServerError, "Failed to update "+strings.ToLower(name))
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Event topics. Queue events are published on "queue:<doctor_id>"; a
+// subscription to "queue" receives every doctor's queue.
+const (
+	topicAppointments = "appointments"
+	topicTransactions = "transactions"
+	topicQueue        = "queue"
+)
+
+// subscriberBuffer is how many events a subscriber may fall behind before it
+// is disconnected. Clients reconnect with Last-Event-ID and catch up from the
+// replay buffer.
+const subscriberBuffer = 64
+
+// Event is a domain event published to SSE subscribers.
+type Event struct {
+	ID    uint64      `json:"id"`
+	Topic string      `json:"topic"`
+	Type  string      `json:"type"`
+	Time  time.Time   `json:"time"`
+	Data  interface{} `json:"data"`
+
+	// Audience of events about one patient's records; zero for events
+	// visible to every subscriber of the topic.
+	patientID    uint
+	doctorUserID int
+}
+
+// eventBus fans events out to subscribers and keeps the most recent ones for
+// clients resuming with Last-Event-ID.
+type eventBus struct {
+	mu          sync.Mutex
+	nextID      uint64
+	replay      []Event // ring buffer, oldest at replayStart
+	replayStart int
+	subscribers map[*subscriber]struct{}
+}
+
+type subscriber struct {
+	ch     chan Event
+	accept func(Event) bool
+}
+
+// events is the process-wide event bus.
+var events = newEventBus(getenvInt("EVENTS_REPLAY_SIZE", 1000))
+
+// newEventBus returns a bus replaying up to size events. IDs are seeded from
+// the clock so they keep increasing across restarts and a Last-Event-ID from
+// before a restart is recognised as stale.
+func newEventBus(size int) *eventBus {
+	if size < 1 {
+		size = 1
+	}
+	return &eventBus{
+		nextID:      uint64(time.Now().UnixMicro()),
+		replay:      make([]Event, 0, size),
+		subscribers: make(map[*subscriber]struct{}),
+	}
+}
+
+// Publish assigns e an ID and delivers it to every interested subscriber.
+// Subscribers that have fallen too far behind are disconnected.
+func (b *eventBus) Publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.nextID++
+	e.ID = b.nextID
+	e.Time = time.Now().UTC()
+
+	if len(b.replay) < cap(b.replay) {
+		b.replay = append(b.replay, e)
+	} else {
+		b.replay[b.replayStart] = e
+		b.replayStart = (b.replayStart + 1) % len(b.replay)
+	}
+
+	for sub := range b.subscribers {
+		if !sub.accept(e) {
+			continue
+		}
+		select {
+		case sub.ch <- e:
+		default:
+			delete(b.subscribers, sub)
+			close(sub.ch)
+		}
+	}
+}
+
+// Subscribe registers a subscriber for the events accepted by accept. When
+// lastID is non-zero, the accepted events published after it are returned
+// for replay; complete is false when some of them have already left the
+// replay buffer. The channel is closed by unsubscribe or when the subscriber
+// falls behind.
+func (b *eventBus) Subscribe(accept func(Event) bool, lastID uint64) (replay []Event, complete bool, ch <-chan Event, unsubscribe func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	complete = true
+	if lastID != 0 {
+		oldest := b.nextID + 1
+		if len(b.replay) > 0 {
+			oldest = b.replay[b.replayStart].ID
+		}
+		complete = lastID+1 >= oldest && lastID <= b.nextID
+		for i := 0; i < len(b.replay); i++ {
+			e := b.replay[(b.replayStart+i)%len(b.replay)]
+			if e.ID > lastID && accept(e) {
+				replay = append(replay, e)
+			}
+		}
+	}
+
+	sub := &subscriber{ch: make(chan Event, subscriberBuffer), accept: accept}
+	b.subscribers[sub] = struct{}{}
+	unsubscribe = func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subscribers[sub]; ok {
+			delete(b.subscribers, sub)
+			close(sub.ch)
+		}
+	}
+	return replay, complete, sub.ch, unsubscribe
+}
+
+// topicFamily returns the part of a topic before any ":<id>" suffix.
+func topicFamily(topic string) string {
+	family, _, _ := strings.Cut(topic, ":")
+	return family
+}
+
+// parseTopics validates a comma-separated topic list.
+func parseTopics(param string) ([]string, error) {
+	var topics []string
+	for _, topic := range strings.Split(param, ",") {
+		topic = strings.TrimSpace(topic)
+		family, id, scoped := strings.Cut(topic, ":")
+		switch {
+		case topic == topicAppointments || topic == topicTransactions || topic == topicQueue:
+		case family == topicQueue && scoped:
+			if _, err := strconv.Atoi(id); err != nil {
+				return nil, fmt.Errorf("invalid topic %q", topic)
+			}
+		default:
+			return nil, fmt.Errorf("invalid topic %q", topic)
+		}
+		topics = append(topics, topic)
+	}
+	return topics, nil
+}
+
+// canSubscribe reports whether the actor may subscribe to a topic at all.
+// Queues only carry queue numbers and are public, like the waiting-room
+// display.
+func (a Actor) canSubscribe(topic string) bool {
+	switch topicFamily(topic) {
+	case topicQueue:
+		return true
+	case topicAppointments:
+		return a.Role == roleAdmin || a.Role == roleReceptionist || a.Role == roleDoctor || a.Role == rolePatient
+	case topicTransactions:
+		return a.Role == roleAdmin || a.Role == roleReceptionist || a.Role == rolePharmacist || a.Role == rolePatient
+	}
+	return false
+}
+
+// canSee reports whether the actor may receive an event on a topic it has
+// subscribed to. Patients only see their own records and doctors only their
+// own appointments.
+func (a Actor) canSee(e Event) bool {
+	switch {
+	case topicFamily(e.Topic) == topicQueue:
+		return true
+	case a.Role == rolePatient:
+		return e.patientID != 0 && e.patientID == a.UserID
+	case a.Role == roleDoctor && e.Topic == topicAppointments:
+		return e.doctorUserID != 0 && e.doctorUserID == int(a.UserID)
+	}
+	return a.canSubscribe(e.Topic)
+}
+
+// Handler function to stream events, ?topics=appointments,queue:12, as
+// Server-Sent Events
+func streamEvents(c echo.Context) error {
+	topics, err := parseTopics(c.QueryParam("topics"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	actor := currentActor(c)
+	for _, topic := range topics {
+		if !actor.canSubscribe(topic) {
+			return c.String(http.StatusForbidden, "Not allowed to subscribe to "+topic)
+		}
+	}
+
+	accept := func(e Event) bool {
+		for _, topic := range topics {
+			if (topic == e.Topic || topic == topicFamily(e.Topic)) && actor.canSee(e) {
+				return true
+			}
+		}
+		return false
+	}
+
+	lastID, _ := strconv.ParseUint(c.Request().Header.Get("Last-Event-ID"), 10, 64)
+	replay, complete, ch, unsubscribe := events.Subscribe(accept, lastID)
+	defer unsubscribe()
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Header().Set("Connection", "keep-alive")
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+
+	// Tell clients whose Last-Event-ID is older than the replay buffer that
+	// they missed events and should reload.
+	if !complete {
+		fmt.Fprint(res, "event: reset\ndata: {}\n\n")
+	}
+	for _, e := range replay {
+		if err := writeEvent(res, e); err != nil {
+			return nil
+		}
+	}
+	res.Flush()
+
+	heartbeat := time.NewTicker(getenvDuration("EVENTS_HEARTBEAT", 15*time.Second))
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(res, ": heartbeat\n\n"); err != nil {
+				return nil
+			}
+		case e, ok := <-ch:
+			if !ok {
+				// Fell behind; the client reconnects and resumes
+				return nil
+			}
+			if err := writeEvent(res, e); err != nil {
+				return nil
+			}
+		}
+		res.Flush()
+	}
+}
+
+func writeEvent(res *echo.Response, e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		log.Println("Error encoding event:", err)
+		return nil
+	}
+	_, err = fmt.Fprintf(res, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+	return err
+}
+
+// publishAppointment publishes an event about the appointment with the given
+// ID, deleted or not.
+func publishAppointment(kind string, id int) {
+	appointment, err := findAppointment(id, true)
+	if err != nil {
+		log.Println("Error reading appointment for event:", err)
+		return
+	}
+
+	var doctorUserID int
+	if appointment.DoctorID != 0 {
+		if err := db.QueryRow("SELECT user_id FROM doctors WHERE id = ?", appointment.DoctorID).Scan(&doctorUserID); err != nil {
+			log.Println("Error reading doctor for event:", err)
+		}
+	}
+
+	events.Publish(Event{
+		Topic:        topicAppointments,
+		Type:         "appointment." + kind,
+		Data:         appointment,
+		patientID:    appointment.PatientID,
+		doctorUserID: doctorUserID,
+	})
+}
+
+// publishTransaction publishes an event about the transaction with the given
+// ID, deleted or not.
+func publishTransaction(kind string, id int) {
+	transaction, err := findTransaction(id, true)
+	if err != nil {
+		log.Println("Error reading transaction for event:", err)
+		return
+	}
+
+	events.Publish(Event{
+		Topic:     topicTransactions,
+		Type:      "transaction." + kind,
+		Data:      transaction,
+		patientID: transaction.PatientID,
+	})
+}
+
+// publishQueueEntry publishes a change to a queue entry on its doctor's
+// queue topic.
+func publishQueueEntry(entry QueueEntry) {
+	events.Publish(Event{
+		Topic: topicQueue + ":" + strconv.Itoa(entry.DoctorID),
+		Type:  "queue.updated",
+		Data:  entry,
+	})
+}
+
+// publishRestored publishes the restore of a soft-deleted record on tables
+// that have a topic.
+func publishRestored(table string, id int) {
+	switch table {
+	case "patient_appointments":
+		publishAppointment("restored", id)
+	case "transactions":
+		publishTransaction("restored", id)
+	}
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// baseCurrency is the clinic's own currency. Transactions in other
+// currencies are converted to it when they are priced, and reports total
+// in it.
+var baseCurrency = "IDR"
+
+// loadBaseCurrency reads the base currency from BASE_CURRENCY, defaulting
+// to IDR.
+func loadBaseCurrency() string {
+	currency := strings.ToUpper(strings.TrimSpace(getenv("BASE_CURRENCY", "IDR")))
+	if !currencyPattern.MatchString(currency) {
+		log.Printf("Invalid BASE_CURRENCY %q, using IDR", currency)
+		return "IDR"
+	}
+	return currency
+}
+
+var currencyPattern = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// ExchangeRate is one entry of the offline exchange-rate table: how many
+// units of the base currency one unit of Currency buys. Like prices, a rate
+// applies from EffectiveFrom until the next rate for the currency takes
+// effect. Rates are entered or imported by staff; nothing is fetched.
+type ExchangeRate struct {
+	ID            uint       `json:"id"`
+	BaseCurrency  string     `json:"base_currency"` // read-only
+	Currency      string     `json:"currency"`
+	Rate          Decimal    `json:"rate"`
+	EffectiveFrom time.Time  `json:"effective_from"`
+	EffectiveTo   *time.Time `json:"effective_to,omitempty"` // read-only, when the next rate took over
+	Current       bool       `json:"current"`                // read-only
+	Source        string     `json:"source,omitempty"`       // e.g. the bank or bulletin the rate came from
+	CreatedBy     *uint      `json:"created_by,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+// errExchangeRateInUse is returned for changes to a rate that transactions
+// were converted with.
+var errExchangeRateInUse = errors.New("exchange rate has been used by transactions")
+
+// exchangeRateUsedQuery reports whether any transaction was converted with
+// the rate given as its argument.
+const exchangeRateUsedQuery = "SELECT EXISTS (SELECT 1 FROM transactions WHERE exchange_rate_id = ?)"
+
+const exchangeRateColumns = "id, base_currency, currency, rate, effective_from, source, created_by, created_at"
+
+func scanExchangeRate(row rowScanner) (ExchangeRate, error) {
+	var r ExchangeRate
+	err := row.Scan(&r.ID, &r.BaseCurrency, &r.Currency, &r.Rate, &r.EffectiveFrom, &r.Source, &r.CreatedBy, &r.CreatedAt)
+	return r, err
+}
+
+// effectiveRate returns the rate from a currency to the base currency in
+// effect at a time.
+func effectiveRate(tx *sql.Tx, currency string, at time.Time) (ExchangeRate, error) {
+	return scanExchangeRate(tx.QueryRow("SELECT "+exchangeRateColumns+" FROM exchange_rates WHERE base_currency = ? AND currency = ? AND effective_from <= ?"+
+		" ORDER BY effective_from DESC, id DESC LIMIT 1", baseCurrency, strings.ToUpper(currency), at.UTC()))
+}
+
+// convertTransaction converts a priced transaction's total to the base
+// currency at the rate in effect at a time, keeping the rate used.
+func convertTransaction(tx *sql.Tx, t *Transaction, at time.Time) error {
+	t.BaseCurrency = baseCurrency
+	t.ExchangeRateID = nil
+	if strings.EqualFold(t.Currency, baseCurrency) {
+		t.ExchangeRate = decimalFromInt(1)
+		t.BaseTotalPrice = roundMoney(t.TotalPrice, baseCurrency)
+		return nil
+	}
+
+	rate, err := effectiveRate(tx, t.Currency, at)
+	if err == sql.ErrNoRows {
+		return &pricingError{http.StatusUnprocessableEntity, fmt.Sprintf("no exchange rate from %s to %s is in effect", t.Currency, baseCurrency)}
+	}
+	if err != nil {
+		return err
+	}
+	t.ExchangeRateID = &rate.ID
+	t.ExchangeRate = rate.Rate
+	converted, err := t.TotalPrice.Mul(rate.Rate)
+	if err != nil {
+		return &pricingError{http.StatusUnprocessableEntity, fmt.Sprintf("total_price is out of range in %s", baseCurrency)}
+	}
+	t.BaseTotalPrice = roundMoney(converted, baseCurrency)
+	return nil
+}
+
+// convertPastTransactions converts transactions recorded before they had a
+// base currency amount, or before a rate for their currency was entered,
+// using the rate in effect when each was created. Transactions without such
+// a rate are left for a later run.
+func convertPastTransactions() error {
+	places, ok := currencyDecimals[baseCurrency]
+	if !ok {
+		places = 2
+	}
+	_, err := db.Exec("UPDATE transactions SET base_currency = ?, exchange_rate = 1, exchange_rate_id = NULL, base_total_price = ROUND(total_price, ?), updated_at = updated_at"+
+		" WHERE base_currency = '' AND currency = ?", baseCurrency, places, baseCurrency)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE transactions t SET t.exchange_rate_id = (SELECT r.id FROM exchange_rates r WHERE r.base_currency = ? AND r.currency = t.currency AND r.effective_from <= t.created_at"+
+		" ORDER BY r.effective_from DESC, r.id DESC LIMIT 1), t.updated_at = t.updated_at WHERE t.base_currency = ''", baseCurrency)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE transactions t JOIN exchange_rates r ON r.id = t.exchange_rate_id"+
+		" SET t.base_currency = r.base_currency, t.exchange_rate = r.rate, t.base_total_price = ROUND(t.total_price * r.rate, ?), t.updated_at = t.updated_at"+
+		" WHERE t.base_currency = ''", places)
+	return err
+}
+
+// exchangeRateError reports a rate that cannot be saved as given.
+type exchangeRateError struct {
+	Message string
+}
+
+func (e *exchangeRateError) Error() string {
+	return e.Message
+}
+
+// saveExchangeRate validates and upserts one rate and returns its ID. A
+// rate for the same currency and time replaces the earlier one, unless
+// transactions were converted with it. Invalid rates yield an
+// *exchangeRateError.
+func saveExchangeRate(tx *sql.Tx, r ExchangeRate, actor Actor) (int64, error) {
+	r.Currency = strings.ToUpper(strings.TrimSpace(r.Currency))
+	if !currencyPattern.MatchString(r.Currency) {
+		return 0, &exchangeRateError{"currency must be a three-letter code such as USD"}
+	}
+	if r.Currency == baseCurrency {
+		return 0, &exchangeRateError{fmt.Sprintf("%s is the base currency", r.Currency)}
+	}
+	if r.Rate.Sign() <= 0 {
+		return 0, &exchangeRateError{"rate must be positive"}
+	}
+	if r.EffectiveFrom.IsZero() {
+		r.EffectiveFrom = time.Now()
+	}
+	effectiveFrom := r.EffectiveFrom.Truncate(time.Second).UTC()
+
+	var existing int64
+	err := tx.QueryRow("SELECT id FROM exchange_rates WHERE base_currency = ? AND currency = ? AND effective_from = ? FOR UPDATE",
+		baseCurrency, r.Currency, effectiveFrom).Scan(&existing)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	if err == nil {
+		var used bool
+		if err := tx.QueryRow(exchangeRateUsedQuery, existing).Scan(&used); err != nil {
+			return 0, err
+		}
+		if used {
+			return 0, errExchangeRateInUse
+		}
+	}
+
+	result, err := tx.Exec("INSERT INTO exchange_rates (base_currency, currency, rate, effective_from, source, created_by) VALUES (?, ?, ?, ?, ?, ?)"+
+		" ON DUPLICATE KEY UPDATE id = LAST_INSERT_ID(id), rate = VALUES(rate), source = VALUES(source), created_by = VALUES(created_by)",
+		baseCurrency, r.Currency, r.Rate, effectiveFrom, r.Source, actor.nullableID())
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// Handler function to get the exchange-rate history to the base currency,
+// newest first, optionally for one ?currency=
+func getExchangeRates(c echo.Context) error {
+	query := "SELECT " + exchangeRateColumns + " FROM exchange_rates WHERE base_currency = ?"
+	args := []interface{}{baseCurrency}
+	if currency := c.QueryParam("currency"); currency != "" {
+		query += " AND currency = ?"
+		args = append(args, strings.ToUpper(currency))
+	}
+	rows, err := db.Query(query+" ORDER BY currency, effective_from DESC, id DESC", args...)
+	if err != nil {
+		log.Println("Error querying exchange rates:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get exchange rates")
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	rates := make([]ExchangeRate, 0)
+	superseding := make(map[string]time.Time) // the rate after the one being read, by currency
+	for rows.Next() {
+		r, err := scanExchangeRate(rows)
+		if err != nil {
+			log.Println("Error scanning exchange rate row:", err)
+			continue
+		}
+		next, superseded := superseding[r.Currency]
+		if superseded {
+			r.EffectiveTo = &next
+		}
+		r.Current = !r.EffectiveFrom.After(now) && (!superseded || next.After(now))
+		superseding[r.Currency] = r.EffectiveFrom
+		rates = append(rates, r)
+	}
+
+	return c.JSON(http.StatusOK, rates)
+}
+
+// Handler function to add or update one exchange rate. effective_from
+// defaults to now; a past one also converts earlier transactions that had
+// no rate. A rate transactions were converted with cannot be replaced.
+func createExchangeRate(c echo.Context) error {
+	var r ExchangeRate
+	if err := c.Bind(&r); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid request payload")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println("Error saving exchange rate:", err)
+		return c.String(http.StatusInternalServerError, "Failed to save exchange rate")
+	}
+	defer tx.Rollback()
+
+	id, err := saveExchangeRate(tx, r, currentActor(c))
+	var invalid *exchangeRateError
+	switch {
+	case errors.Is(err, errExchangeRateInUse):
+		return c.String(http.StatusConflict, "Exchange rate has been used by transactions")
+	case errors.As(err, &invalid):
+		return c.String(http.StatusUnprocessableEntity, invalid.Message)
+	case err != nil:
+		log.Println("Error saving exchange rate:", err)
+		return c.String(http.StatusInternalServerError, "Failed to save exchange rate")
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println("Error saving exchange rate:", err)
+		return c.String(http.StatusInternalServerError, "Failed to save exchange rate")
+	}
+	if err := convertPastTransactions(); err != nil {
+		log.Println("Error converting past transactions:", err)
+	}
+
+	r, err = scanExchangeRate(db.QueryRow("SELECT "+exchangeRateColumns+" FROM exchange_rates WHERE id = ?", id))
+	if err != nil {
+		log.Println("Error reading back exchange rate:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get exchange rate")
+	}
+
+	return c.JSON(http.StatusCreated, r)
+}
+
+// Handler function to import exchange rates from a JSON array or, with
+// Content-Type text/csv, a CSV file with a header row naming the columns
+// currency, rate, effective_from and source. effective_from is an RFC 3339
+// time or a YYYY-MM-DD date, taken as midnight at the clinic. Rows that
+// cannot be imported are reported and skipped.
+func importExchangeRates(c echo.Context) error {
+	var records []ExchangeRate
+	var rowErrors []error // CSV values that could not be parsed, by row
+	mediaType, _, _ := mime.ParseMediaType(c.Request().Header.Get(echo.HeaderContentType))
+	if mediaType == "text/csv" {
+		var err error
+		records, rowErrors, err = readExchangeRateCSV(c.Request().Body)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid CSV: "+err.Error())
+		}
+	} else if err := json.NewDecoder(c.Request().Body).Decode(&records); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid request payload")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println("Error importing exchange rates:", err)
+		return c.String(http.StatusInternalServerError, "Failed to import exchange rates")
+	}
+	defer tx.Rollback()
+
+	actor := currentActor(c)
+	imported := 0
+	failures := make([]importRowError, 0)
+	for i, record := range records {
+		if rowErrors != nil && rowErrors[i] != nil {
+			failures = append(failures, importRowError{Row: i + 1, Message: rowErrors[i].Error()})
+			continue
+		}
+		var invalid *exchangeRateError
+		_, err := saveExchangeRate(tx, record, actor)
+		if errors.As(err, &invalid) || errors.Is(err, errExchangeRateInUse) {
+			failures = append(failures, importRowError{Row: i + 1, Message: err.Error()})
+			continue
+		}
+		if err != nil {
+			log.Println("Error importing exchange rates:", err)
+			return c.String(http.StatusInternalServerError, "Failed to import exchange rates")
+		}
+		imported++
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println("Error importing exchange rates:", err)
+		return c.String(http.StatusInternalServerError, "Failed to import exchange rates")
+	}
+	if err := convertPastTransactions(); err != nil {
+		log.Println("Error converting past transactions:", err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"imported": imported,
+		"errors":   failures,
+	})
+}
+
+// readExchangeRateCSV reads exchange rates in CSV form, with an error for
+// each row whose rate or effective_from cannot be parsed. Rows may leave out
+// trailing optional columns.
+func readExchangeRateCSV(r io.Reader) ([]ExchangeRate, []error, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, nil, err
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, required := range []string{"currency", "rate"} {
+		if _, ok := columns[required]; !ok {
+			return nil, nil, fmt.Errorf("missing column %s", required)
+		}
+	}
+
+	var records []ExchangeRate
+	var rowErrors []error
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return records, rowErrors, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(row) {
+				return strings.TrimSpace(row[i])
+			}
+			return ""
+		}
+		record := ExchangeRate{Currency: field("currency"), Source: field("source")}
+		record.Rate, err = parseDecimal(field("rate"))
+		if err != nil {
+			err = fmt.Errorf("rate %q: %w", field("rate"), err)
+		} else if record.EffectiveFrom, err = parseEffectiveFrom(field("effective_from")); err != nil {
+			err = fmt.Errorf("effective_from must be an RFC 3339 time or YYYY-MM-DD")
+		}
+		records = append(records, record)
+		rowErrors = append(rowErrors, err)
+	}
+}
+
+// parseEffectiveFrom parses an imported effective_from. Empty means now.
+func parseEffectiveFrom(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	day, err := parseDate(s)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Date(day.Year, day.Month, day.Day, 0, 0, 0, 0, clinicLocation), nil
+}
+
+// Handler function to delete an exchange rate no transaction was converted
+// with, such as a mistyped or scheduled one
+func deleteExchangeRate(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid exchange rate ID")
+	}
+
+	var used bool
+	err = db.QueryRow(exchangeRateUsedQuery, id).Scan(&used)
+	if err != nil {
+		log.Println("Error checking exchange rate:", err)
+		return c.String(http.StatusInternalServerError, "Failed to delete exchange rate")
+	}
+	if used {
+		return c.String(http.StatusConflict, "Exchange rate has been used by transactions")
+	}
+
+	result, err := db.Exec("DELETE FROM exchange_rates WHERE id = ?", id)
+	if err != nil {
+		log.Println("Error deleting exchange rate:", err)
+		return c.String(http.StatusInternalServerError, "Failed to delete exchange rate")
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return c.String(http.StatusNotFound, "Exchange rate not found")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
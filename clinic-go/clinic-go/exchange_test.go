@@ -0,0 +1,65 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadExchangeRateCSV(t *testing.T) {
+	wib := time.FixedZone("WIB", 7*60*60)
+	useClinicLocation(t, wib)
+	type row struct {
+		currency, rate string
+		from           time.Time
+		source         string
+		wantErr        bool
+	}
+	tests := []struct {
+		name    string
+		in      string
+		want    []row
+		wantErr bool
+	}{
+		{"date is midnight in the clinic's zone", "currency,rate,effective_from,source\nUSD,15800.5,2026-03-02,BI\n",
+			[]row{{"USD", "15800.5", time.Date(2026, 3, 2, 0, 0, 0, 0, wib), "BI", false}}, false},
+		{"RFC 3339 time", "currency,rate,effective_from\nEUR,17100,2026-03-02T08:30:00Z\n",
+			[]row{{"EUR", "17100", time.Date(2026, 3, 2, 8, 30, 0, 0, time.UTC), "", false}}, false},
+		{"empty effective_from means now", "currency,rate,effective_from\nSGD, 11800 ,\n",
+			[]row{{"SGD", "11800", time.Time{}, "", false}}, false},
+		{"header case, spacing and order", " RATE ,Currency\n0.00006329,JPY\n",
+			[]row{{"JPY", "0.00006329", time.Time{}, "", false}}, false},
+		{"trailing optional columns left out", "currency,rate,effective_from,source\nUSD,15800\nEUR,17100,2026-03-02,ECB\n",
+			[]row{{"USD", "15800", time.Time{}, "", false}, {"EUR", "17100", time.Date(2026, 3, 2, 0, 0, 0, 0, wib), "ECB", false}}, false},
+		{"bad rows reported, good rows kept", "currency,rate,effective_from\nUSD,abc,\nEUR,1.123456789,\nSGD,11800,02/03/2026\nMYR,3400,\n",
+			[]row{{currency: "USD", wantErr: true}, {currency: "EUR", wantErr: true}, {currency: "SGD", rate: "11800", wantErr: true}, {"MYR", "3400", time.Time{}, "", false}}, false},
+		{"missing required column", "currency,effective_from\nUSD,2026-03-02\n", nil, true},
+		{"empty file", "", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, rowErrors, err := readExchangeRateCSV(strings.NewReader(tt.in))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if len(records) != len(tt.want) || len(rowErrors) != len(tt.want) {
+				t.Fatalf("got %d records and %d row errors, want %d", len(records), len(rowErrors), len(tt.want))
+			}
+			for i, want := range tt.want {
+				got := records[i]
+				if (rowErrors[i] != nil) != want.wantErr {
+					t.Errorf("row %d error = %v, want error %v", i, rowErrors[i], want.wantErr)
+				}
+				if got.Currency != want.currency {
+					t.Errorf("row %d currency = %q, want %q", i, got.Currency, want.currency)
+				}
+				if want.wantErr {
+					continue
+				}
+				if got.Rate.Cmp(mustDecimal(t, want.rate)) != 0 || !got.EffectiveFrom.Equal(want.from) || got.Source != want.source {
+					t.Errorf("row %d = %s from %s (%q), want %s from %s (%q)", i, got.Rate, got.EffectiveFrom, got.Source, want.rate, want.from, want.source)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// MySQL error numbers for foreign key violations
+const (
+	mysqlRowIsReferenced = 1451 // deleting or updating a parent row that is still referenced
+	mysqlNoReferencedRow = 1452 // inserting or updating a child row whose parent does not exist
+)
+
+// cascadePolicy decides what happens to dependent rows when the row they
+// reference is deleted.
+type cascadePolicy string
+
+const (
+	// cascadeBlock refuses the delete while dependent rows exist.
+	cascadeBlock cascadePolicy = "block"
+	// cascadeArchive soft-deletes dependent rows along with their parent,
+	// and restores them with it.
+	cascadeArchive cascadePolicy = "archive"
+)
+
+// relationship describes one reference between two tables.
+type relationship struct {
+	Constraint string // foreign key constraint name, empty if not enforced by the database
+	Child      string // referencing table
+	Column     string // referencing column in Child
+	Parent     string // referenced table, always by its id
+	OnDelete   cascadePolicy
+}
+
+// relationships lists every reference the API maintains, together with its
+// delete policy. Clinical and financial history is never silently dropped:
+// a patient's appointments are archived with the patient, everything else
+// blocks the delete.
+var relationships = []relationship{
+	{"fk_patient_appointments_patient_id", "patient_appointments", "patient_id", "patients", cascadeArchive},
+	{"fk_patient_appointments_doctor_id", "patient_appointments", "doctor_id", "doctors", cascadeBlock},
+	{"fk_transactions_patient_id", "transactions", "patient_id", "patients", cascadeBlock},
+	{"fk_transactions_drug_id", "transactions", "drug_id", "drugs", cascadeBlock},
+	{"fk_stock_movements_drug_id", "stock_movements", "drug_id", "drugs", cascadeBlock},
+	{"fk_drug_lots_drug_id", "drug_lots", "drug_id", "drugs", cascadeBlock},
+	{"fk_drug_recalls_drug_id", "drug_recalls", "drug_id", "drugs", cascadeBlock},
+	{"fk_patient_allergies_drug_id", "patient_allergies", "drug_id", "drugs", cascadeBlock},
+	{"fk_prescriptions_appointment_id", "prescriptions", "appointment_id", "patient_appointments", cascadeBlock},
+	{"fk_prescription_items_drug_id", "prescription_items", "drug_id", "drugs", cascadeBlock},
+	{"fk_doctors_user_id", "doctors", "user_id", "users", cascadeBlock},
+}
+
+// tableNouns names the rows of each table in error messages.
+var tableNouns = map[string]string{
+	"users":                "user",
+	"patients":             "patient",
+	"patient_appointments": "appointment",
+	"drugs":                "drug",
+	"doctors":              "doctor",
+	"transactions":         "transaction",
+	"stock_movements":      "stock movement",
+	"drug_lots":            "lot",
+	"drug_recalls":         "recall",
+	"patient_allergies":    "allergy",
+	"prescriptions":        "prescription",
+	"prescription_items":   "prescription item",
+}
+
+// reference is a foreign key value supplied by a client.
+type reference struct {
+	Field string // JSON field carrying the reference, e.g. "drug_id"
+	Table string // referenced table
+	ID    int64
+}
+
+// referenceError reports a reference to a row that does not exist.
+type referenceError struct {
+	Field string
+	Table string
+	ID    int64
+}
+
+func (e *referenceError) Error() string {
+	return fmt.Sprintf("%s %d does not refer to an existing %s", e.Field, e.ID, tableNouns[e.Table])
+}
+
+// blockedError reports a delete refused because dependent rows still exist.
+type blockedError struct {
+	Parent string
+	Child  string
+	Count  int
+}
+
+func (e *blockedError) Error() string {
+	return fmt.Sprintf("%s is still referenced by %d %s(s)", tableNouns[e.Parent], e.Count, tableNouns[e.Child])
+}
+
+// checkReferences verifies that every reference points at an existing row.
+// Soft-deleted rows do not count as existing.
+func checkReferences(refs ...reference) error {
+	for _, ref := range refs {
+		query := "SELECT 1 FROM " + ref.Table + " WHERE id = ?"
+		if softDeleteTables[ref.Table] {
+			query += " AND deleted_at IS NULL"
+		}
+
+		var exists int
+		err := db.QueryRow(query, ref.ID).Scan(&exists)
+		if err == sql.ErrNoRows {
+			return &referenceError{Field: ref.Field, Table: ref.Table, ID: ref.ID}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteRecord deletes row id of table after applying the delete policy of
+// every relationship that references it. Tables in softDeleteTables are
+// soft-deleted; everything else is removed. Archived children get the same
+// deleted_at as their parent, which is how restoreDeleted finds them. It
+// returns sql.ErrNoRows when there is no such row, or it is already deleted.
+func deleteRecord(table string, id int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Lock the row first so a missing row is reported before any policy runs
+	query := "SELECT 1 FROM " + table + " WHERE id = ?"
+	soft := softDeleteTables[table]
+	if soft {
+		query += " AND deleted_at IS NULL"
+	}
+	var exists int
+	if err := tx.QueryRow(query+" FOR UPDATE", id).Scan(&exists); err != nil {
+		return err
+	}
+
+	deletedAt := time.Now().UTC().Truncate(time.Second)
+	for _, rel := range relationships {
+		if rel.Parent != table {
+			continue
+		}
+		if err := applyDeletePolicy(tx, rel, id, soft, deletedAt); err != nil {
+			return err
+		}
+	}
+
+	if soft {
+		_, err = tx.Exec("UPDATE "+table+" SET deleted_at = ?, version = version + 1 WHERE id = ? AND deleted_at IS NULL", deletedAt, id)
+	} else {
+		_, err = tx.Exec("DELETE FROM "+table+" WHERE id = ?", id)
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func applyDeletePolicy(tx *sql.Tx, rel relationship, id int, softParent bool, deletedAt time.Time) error {
+	// A soft-deleted parent only has to account for live children; a hard
+	// delete has to account for every row the foreign key would trip on.
+	where := " WHERE " + rel.Column + " = ?"
+	if softParent && softDeleteTables[rel.Child] {
+		where += " AND deleted_at IS NULL"
+	}
+
+	switch rel.OnDelete {
+	case cascadeArchive:
+		_, err := tx.Exec("UPDATE "+rel.Child+" SET deleted_at = ?, version = version + 1 WHERE "+rel.Column+" = ? AND deleted_at IS NULL", deletedAt, id)
+		return err
+	default:
+		var count int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM "+rel.Child+where, id).Scan(&count); err != nil {
+			return err
+		}
+		if count > 0 {
+			return &blockedError{Parent: rel.Parent, Child: rel.Child, Count: count}
+		}
+		return nil
+	}
+}
+
+var constraintName = regexp.MustCompile("CONSTRAINT `([^`]+)`")
+
+// integrityError maps referential integrity failures, whether detected by
+// the API or by the database, to a response status and message. ok is false
+// for any other error.
+func integrityError(err error) (status int, message string, ok bool) {
+	var refErr *referenceError
+	if errors.As(err, &refErr) {
+		return http.StatusUnprocessableEntity, refErr.Error(), true
+	}
+	var blocked *blockedError
+	if errors.As(err, &blocked) {
+		return http.StatusConflict, "Cannot delete " + blocked.Error(), true
+	}
+
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		switch mysqlErr.Number {
+		case mysqlNoReferencedRow:
+			if rel, found := constraintRelationship(mysqlErr.Message); found {
+				return http.StatusUnprocessableEntity, fmt.Sprintf("%s does not refer to an existing %s", rel.Column, tableNouns[rel.Parent]), true
+			}
+			return http.StatusUnprocessableEntity, "A referenced record does not exist", true
+		case mysqlRowIsReferenced:
+			if rel, found := constraintRelationship(mysqlErr.Message); found {
+				return http.StatusConflict, fmt.Sprintf("Cannot delete %s: still referenced by %s", tableNouns[rel.Parent], rel.Child), true
+			}
+			return http.StatusConflict, "Record is still referenced by other records", true
+		}
+	}
+
+	return 0, "", false
+}
+
+func constraintRelationship(message string) (relationship, bool) {
+	match := constraintName.FindStringSubmatch(message)
+	if match == nil {
+		return relationship{}, false
+	}
+	for _, rel := range relationships {
+		if rel.Constraint == match[1] {
+			return rel, true
+		}
+	}
+	return relationship{}, false
+}
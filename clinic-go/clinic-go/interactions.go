@@ -0,0 +1,682 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Interaction severities, least severe first. Major and contraindicated
+// warnings block prescribing unless overridden with a reason.
+const (
+	severityMinor           = "minor"
+	severityModerate        = "moderate"
+	severityMajor           = "major"
+	severityContraindicated = "contraindicated"
+)
+
+var severityRank = map[string]int{
+	severityMinor:           1,
+	severityModerate:        2,
+	severityMajor:           3,
+	severityContraindicated: 4,
+}
+
+// Kinds of prescribing warning
+const (
+	warningInteraction = "interaction"
+	warningAllergy     = "allergy"
+)
+
+// DrugInteraction is an entry of the interaction knowledge base. Pairs are
+// stored with the lower drug ID first.
+type DrugInteraction struct {
+	ID          uint      `json:"id"`
+	DrugAID     uint      `json:"drug_a_id"`
+	DrugAName   string    `json:"drug_a_name"`
+	DrugBID     uint      `json:"drug_b_id"`
+	DrugBName   string    `json:"drug_b_name"`
+	Severity    string    `json:"severity"`
+	Description string    `json:"description"`
+	Source      string    `json:"source,omitempty"` // dataset the entry was imported from
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// PatientAllergy records that a patient must not be given a drug.
+type PatientAllergy struct {
+	ID        uint      `json:"id"`
+	PatientID uint      `json:"patient_id"`
+	DrugID    uint      `json:"drug_id"`
+	DrugName  string    `json:"drug_name"`
+	Reaction  string    `json:"reaction"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// InteractionWarning is a problem found when prescribing a drug to a
+// patient.
+type InteractionWarning struct {
+	Kind                string `json:"kind"`
+	Severity            string `json:"severity"`
+	DrugID              uint   `json:"drug_id"`
+	InteractingDrugID   uint   `json:"interacting_drug_id,omitempty"`
+	InteractingDrugName string `json:"interacting_drug_name,omitempty"`
+	Description         string `json:"description"`
+	RequiresOverride    bool   `json:"requires_override"`
+}
+
+// interactionBlockedError is returned when prescribing a drug raises
+// warnings that need an override reason and none was given.
+type interactionBlockedError struct {
+	Warnings []InteractionWarning
+}
+
+func (e *interactionBlockedError) Error() string {
+	return "prescribing this drug raises severe warnings; resubmit with an override_reason to proceed"
+}
+
+// interactionBlockedResponse writes the 409 response for blocked warnings.
+func interactionBlockedResponse(c echo.Context, blocked *interactionBlockedError) error {
+	return c.JSON(http.StatusConflict, map[string]interface{}{
+		"error":    blocked.Error(),
+		"warnings": blocked.Warnings,
+	})
+}
+
+// activeMedicationsQuery selects the drugs a patient is currently taking:
+// those dispensed to them or prescribed on a prescription that has not been
+// cancelled within ACTIVE_MEDICATION_DAYS. Its parameters are the patient ID,
+// the start of that window and a transaction to leave out, then the patient
+// ID and the start of the window again.
+const activeMedicationsQuery = "SELECT drug_id FROM transactions WHERE patient_id = ? AND deleted_at IS NULL AND created_at >= ? AND id <> ?" +
+	" UNION SELECT i.drug_id FROM prescription_items i JOIN prescriptions p ON p.id = i.prescription_id JOIN patient_appointments a ON a.id = p.appointment_id" +
+	" WHERE a.patient_id = ? AND p.cancelled_at IS NULL AND p.created_at >= ?"
+
+// checkInteractions returns the warnings for prescribing drugID to a
+// patient, most severe first: the patient's allergies to the drug and its
+// interactions with their active medications. excludeTransactionID, when not
+// zero, is a transaction being changed, whose drug no longer counts.
+func checkInteractions(patientID, drugID, excludeTransactionID uint) ([]InteractionWarning, error) {
+	warnings := make([]InteractionWarning, 0)
+
+	rows, err := db.Query("SELECT reaction FROM patient_allergies WHERE patient_id = ? AND drug_id = ?", patientID, drugID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var reaction string
+		if err := rows.Scan(&reaction); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		description := "Patient is allergic to this drug"
+		if reaction != "" {
+			description += ": " + reaction
+		}
+		warnings = append(warnings, InteractionWarning{Kind: warningAllergy, Severity: severityContraindicated, DrugID: drugID, Description: description})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	since := time.Now().AddDate(0, 0, -getenvInt("ACTIVE_MEDICATION_DAYS", 90)).UTC()
+	rows, err = db.Query("SELECT i.severity, i.description, d.id, d.drug_name"+
+		" FROM (SELECT DISTINCT drug_id FROM ("+activeMedicationsQuery+") active WHERE drug_id <> ?) m"+
+		" JOIN drug_interactions i ON i.drug_a_id = LEAST(m.drug_id, ?) AND i.drug_b_id = GREATEST(m.drug_id, ?)"+
+		" JOIN drugs d ON d.id = m.drug_id",
+		patientID, since, excludeTransactionID, patientID, since, drugID, drugID, drugID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		w := InteractionWarning{Kind: warningInteraction, DrugID: drugID}
+		if err := rows.Scan(&w.Severity, &w.Description, &w.InteractingDrugID, &w.InteractingDrugName); err != nil {
+			return nil, err
+		}
+		warnings = append(warnings, w)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range warnings {
+		warnings[i].RequiresOverride = requiresOverride(warnings[i].Severity)
+	}
+	sort.SliceStable(warnings, func(i, j int) bool {
+		return severityRank[warnings[i].Severity] > severityRank[warnings[j].Severity]
+	})
+	return warnings, nil
+}
+
+// requiresOverride reports whether warnings of a severity block prescribing
+// unless overridden.
+func requiresOverride(severity string) bool {
+	return severityRank[severity] >= severityRank[severityMajor]
+}
+
+// interactionBetween returns the warning for prescribing drugID together
+// with otherID, or nil if the knowledge base has no entry for the pair.
+func interactionBetween(drugID, otherID uint) (*InteractionWarning, error) {
+	if drugID == otherID {
+		return nil, nil
+	}
+	a, b := drugID, otherID
+	if b < a {
+		a, b = b, a
+	}
+	w := InteractionWarning{Kind: warningInteraction, DrugID: drugID, InteractingDrugID: otherID}
+	err := db.QueryRow("SELECT i.severity, i.description, d.drug_name FROM drug_interactions i JOIN drugs d ON d.id = ? WHERE i.drug_a_id = ? AND i.drug_b_id = ?",
+		otherID, a, b).Scan(&w.Severity, &w.Description, &w.InteractingDrugName)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	w.RequiresOverride = requiresOverride(w.Severity)
+	return &w, nil
+}
+
+// checkPrescribing checks a drug for a patient and returns its warnings, or
+// an *interactionBlockedError when some need an override and overrideReason
+// is empty. excludeTransactionID is as for checkInteractions.
+func checkPrescribing(patientID, drugID, excludeTransactionID uint, overrideReason string) ([]InteractionWarning, error) {
+	warnings, err := checkInteractions(patientID, drugID, excludeTransactionID)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(overrideReason) != "" {
+		return warnings, nil
+	}
+	for _, w := range warnings {
+		if w.RequiresOverride {
+			return warnings, &interactionBlockedError{Warnings: warnings}
+		}
+	}
+	return warnings, nil
+}
+
+// What an override was given for: a transaction, or a line of a prescription
+const (
+	overrideTransaction      = "transaction_id"
+	overridePrescriptionItem = "prescription_item_id"
+)
+
+// recordOverride keeps the reason a prescriber gave for going ahead despite
+// warnings, with the warnings they overrode. subject is overrideTransaction
+// or overridePrescriptionItem and id the row it names.
+func recordOverride(tx *sql.Tx, subject string, id uint, patientID, drugID uint, reason string, warnings []InteractionWarning, actor Actor) error {
+	if strings.TrimSpace(reason) == "" || len(warnings) == 0 {
+		return nil
+	}
+	encoded, err := json.Marshal(warnings)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO interaction_overrides ("+subject+", patient_id, drug_id, reason, warnings, created_by) VALUES (?, ?, ?, ?, ?, ?)",
+		id, patientID, drugID, reason, string(encoded), actor.nullableID())
+	return err
+}
+
+// Handler function to check a drug for a patient before prescribing it
+func checkInteractionsHandler(c echo.Context) error {
+	var body struct {
+		PatientID uint `json:"patient_id"`
+		DrugID    uint `json:"drug_id"`
+	}
+	if err := c.Bind(&body); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid request payload")
+	}
+
+	err := checkReferences(
+		reference{"patient_id", "patients", int64(body.PatientID)},
+		reference{"drug_id", "drugs", int64(body.DrugID)},
+	)
+	if err != nil {
+		if status, message, ok := integrityError(err); ok {
+			return c.String(status, message)
+		}
+		log.Println("Error validating interaction check:", err)
+		return c.String(http.StatusInternalServerError, "Failed to check interactions")
+	}
+
+	warnings, err := checkInteractions(body.PatientID, body.DrugID, 0)
+	if err != nil {
+		log.Println("Error checking interactions:", err)
+		return c.String(http.StatusInternalServerError, "Failed to check interactions")
+	}
+	requiresOverride := false
+	for _, w := range warnings {
+		requiresOverride = requiresOverride || w.RequiresOverride
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"warnings":          warnings,
+		"requires_override": requiresOverride,
+	})
+}
+
+const drugInteractionSelect = "SELECT i.id, i.drug_a_id, a.drug_name, i.drug_b_id, b.drug_name, i.severity, i.description, i.source, i.updated_at" +
+	" FROM drug_interactions i JOIN drugs a ON a.id = i.drug_a_id JOIN drugs b ON b.id = i.drug_b_id"
+
+func scanDrugInteraction(row rowScanner) (DrugInteraction, error) {
+	var i DrugInteraction
+	err := row.Scan(&i.ID, &i.DrugAID, &i.DrugAName, &i.DrugBID, &i.DrugBName, &i.Severity, &i.Description, &i.Source, &i.UpdatedAt)
+	return i, err
+}
+
+// Handler function to list the interaction knowledge base, optionally the
+// entries involving ?drug_id=
+func getDrugInteractions(c echo.Context) error {
+	query := drugInteractionSelect
+	var args []interface{}
+	if param := c.QueryParam("drug_id"); param != "" {
+		drugID, err := strconv.Atoi(param)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid drug ID")
+		}
+		query += " WHERE i.drug_a_id = ? OR i.drug_b_id = ?"
+		args = append(args, drugID, drugID)
+	}
+
+	rows, err := db.Query(query+" ORDER BY i.drug_a_id, i.drug_b_id", args...)
+	if err != nil {
+		log.Println("Error querying drug interactions:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get drug interactions")
+	}
+	defer rows.Close()
+
+	interactions := make([]DrugInteraction, 0)
+	for rows.Next() {
+		interaction, err := scanDrugInteraction(rows)
+		if err != nil {
+			log.Println("Error scanning drug interaction row:", err)
+			continue
+		}
+		interactions = append(interactions, interaction)
+	}
+
+	return c.JSON(http.StatusOK, interactions)
+}
+
+// drugRef names a drug in an imported dataset by ID or by exact drug_name.
+type drugRef string
+
+// UnmarshalJSON accepts drug IDs as numbers as well as strings.
+func (r *drugRef) UnmarshalJSON(data []byte) error {
+	var id uint
+	if err := json.Unmarshal(data, &id); err == nil {
+		*r = drugRef(strconv.FormatUint(uint64(id), 10))
+		return nil
+	}
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		return err
+	}
+	*r = drugRef(name)
+	return nil
+}
+
+// interactionRecord is one entry of an imported dataset.
+type interactionRecord struct {
+	DrugA       drugRef `json:"drug_a"`
+	DrugB       drugRef `json:"drug_b"`
+	Severity    string  `json:"severity"`
+	Description string  `json:"description"`
+	Source      string  `json:"source"`
+}
+
+// resolveDrug finds the drug an imported record refers to.
+func resolveDrug(tx *sql.Tx, r drugRef) (uint, error) {
+	ref := strings.TrimSpace(string(r))
+	if id, err := strconv.ParseUint(ref, 10, 64); err == nil {
+		var exists bool
+		if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM drugs WHERE id = ?)", id).Scan(&exists); err != nil {
+			return 0, err
+		}
+		if !exists {
+			return 0, &interactionRecordError{fmt.Sprintf("drug %s does not exist", ref)}
+		}
+		return uint(id), nil
+	}
+
+	rows, err := tx.Query("SELECT id FROM drugs WHERE drug_name = ? LIMIT 2", ref)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	var ids []uint
+	for rows.Next() {
+		var id uint
+		if err := rows.Scan(&id); err != nil {
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	switch {
+	case rows.Err() != nil:
+		return 0, rows.Err()
+	case len(ids) == 0:
+		return 0, &interactionRecordError{fmt.Sprintf("no drug is named %q", ref)}
+	case len(ids) > 1:
+		return 0, &interactionRecordError{fmt.Sprintf("several drugs are named %q; use the drug ID", ref)}
+	}
+	return ids[0], nil
+}
+
+// interactionRecordError reports a knowledge base entry that cannot be
+// saved as given.
+type interactionRecordError struct {
+	Message string
+}
+
+func (e *interactionRecordError) Error() string {
+	return e.Message
+}
+
+// saveInteraction validates and upserts one knowledge base entry and
+// returns its ID. Invalid entries yield an *interactionRecordError.
+func saveInteraction(tx *sql.Tx, record interactionRecord) (int64, error) {
+	severity := strings.ToLower(strings.TrimSpace(record.Severity))
+	if severityRank[severity] == 0 {
+		return 0, &interactionRecordError{"severity must be minor, moderate, major or contraindicated"}
+	}
+	a, err := resolveDrug(tx, record.DrugA)
+	if err != nil {
+		return 0, err
+	}
+	b, err := resolveDrug(tx, record.DrugB)
+	if err != nil {
+		return 0, err
+	}
+	if a == b {
+		return 0, &interactionRecordError{"a drug cannot interact with itself"}
+	}
+	if b < a {
+		a, b = b, a
+	}
+	result, err := tx.Exec("INSERT INTO drug_interactions (drug_a_id, drug_b_id, severity, description, source) VALUES (?, ?, ?, ?, ?)"+
+		" ON DUPLICATE KEY UPDATE id = LAST_INSERT_ID(id), severity = VALUES(severity), description = VALUES(description), source = VALUES(source)",
+		a, b, severity, record.Description, record.Source)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// importRowError reports a dataset row that was not imported.
+type importRowError struct {
+	Row     int    `json:"row"`
+	Message string `json:"message"`
+}
+
+// Handler function to import interactions from a JSON array or, with
+// Content-Type text/csv, a CSV file with a header row naming the columns
+// drug_a, drug_b, severity, description and source. Existing pairs are
+// updated. Rows that cannot be imported are reported and skipped.
+func importDrugInteractions(c echo.Context) error {
+	var records []interactionRecord
+	mediaType, _, _ := mime.ParseMediaType(c.Request().Header.Get(echo.HeaderContentType))
+	if mediaType == "text/csv" {
+		var err error
+		records, err = readInteractionCSV(c.Request().Body)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid CSV: "+err.Error())
+		}
+	} else if err := json.NewDecoder(c.Request().Body).Decode(&records); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid request payload")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println("Error importing drug interactions:", err)
+		return c.String(http.StatusInternalServerError, "Failed to import drug interactions")
+	}
+	defer tx.Rollback()
+
+	imported := 0
+	failures := make([]importRowError, 0)
+	for i, record := range records {
+		var invalid *interactionRecordError
+		_, err := saveInteraction(tx, record)
+		if errors.As(err, &invalid) {
+			failures = append(failures, importRowError{Row: i + 1, Message: invalid.Message})
+			continue
+		}
+		if err != nil {
+			log.Println("Error importing drug interactions:", err)
+			return c.String(http.StatusInternalServerError, "Failed to import drug interactions")
+		}
+		imported++
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println("Error importing drug interactions:", err)
+		return c.String(http.StatusInternalServerError, "Failed to import drug interactions")
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"imported": imported,
+		"errors":   failures,
+	})
+}
+
+// readInteractionCSV reads an interaction dataset in CSV form. Rows may
+// leave out trailing optional columns.
+func readInteractionCSV(r io.Reader) ([]interactionRecord, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, required := range []string{"drug_a", "drug_b", "severity"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("missing column %s", required)
+		}
+	}
+
+	var records []interactionRecord
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(row) {
+				return row[i]
+			}
+			return ""
+		}
+		records = append(records, interactionRecord{
+			DrugA:       drugRef(field("drug_a")),
+			DrugB:       drugRef(field("drug_b")),
+			Severity:    field("severity"),
+			Description: field("description"),
+			Source:      field("source"),
+		})
+	}
+}
+
+// Handler function to add or update one interaction
+func createDrugInteraction(c echo.Context) error {
+	var record interactionRecord
+	if err := c.Bind(&record); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid request payload")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println("Error saving drug interaction:", err)
+		return c.String(http.StatusInternalServerError, "Failed to save drug interaction")
+	}
+	defer tx.Rollback()
+
+	id, err := saveInteraction(tx, record)
+	var invalid *interactionRecordError
+	if errors.As(err, &invalid) {
+		return c.String(http.StatusUnprocessableEntity, invalid.Message)
+	}
+	if err != nil {
+		log.Println("Error saving drug interaction:", err)
+		return c.String(http.StatusInternalServerError, "Failed to save drug interaction")
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println("Error saving drug interaction:", err)
+		return c.String(http.StatusInternalServerError, "Failed to save drug interaction")
+	}
+
+	interaction, err := scanDrugInteraction(db.QueryRow(drugInteractionSelect+" WHERE i.id = ?", id))
+	if err != nil {
+		log.Println("Error reading back drug interaction:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get drug interaction")
+	}
+
+	return c.JSON(http.StatusCreated, interaction)
+}
+
+// Handler function to remove an interaction from the knowledge base
+func deleteDrugInteraction(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid drug interaction ID")
+	}
+
+	result, err := db.Exec("DELETE FROM drug_interactions WHERE id = ?", id)
+	if err != nil {
+		log.Println("Error deleting drug interaction:", err)
+		return c.String(http.StatusInternalServerError, "Failed to delete drug interaction")
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return c.String(http.StatusNotFound, "Drug interaction not found")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Handler function to list a patient's recorded allergies
+func getPatientAllergies(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid patient ID")
+	}
+
+	if _, err := findPatient(id, false); err != nil {
+		if err == sql.ErrNoRows {
+			return c.String(http.StatusNotFound, "Patient not found")
+		}
+		log.Println("Error getting patient:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get patient")
+	}
+
+	rows, err := db.Query("SELECT a.id, a.patient_id, a.drug_id, d.drug_name, a.reaction, a.created_at FROM patient_allergies a JOIN drugs d ON d.id = a.drug_id WHERE a.patient_id = ? ORDER BY a.id", id)
+	if err != nil {
+		log.Println("Error querying allergies:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get allergies")
+	}
+	defer rows.Close()
+
+	allergies := make([]PatientAllergy, 0)
+	for rows.Next() {
+		var a PatientAllergy
+		if err := rows.Scan(&a.ID, &a.PatientID, &a.DrugID, &a.DrugName, &a.Reaction, &a.CreatedAt); err != nil {
+			log.Println("Error scanning allergy row:", err)
+			continue
+		}
+		allergies = append(allergies, a)
+	}
+
+	return c.JSON(http.StatusOK, allergies)
+}
+
+// Handler function to record a patient's allergy to a drug
+func createPatientAllergy(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid patient ID")
+	}
+
+	var allergy PatientAllergy
+	if err := c.Bind(&allergy); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid request payload")
+	}
+	allergy.PatientID = uint(id)
+
+	err = checkReferences(
+		reference{"patient_id", "patients", int64(allergy.PatientID)},
+		reference{"drug_id", "drugs", int64(allergy.DrugID)},
+	)
+	if err != nil {
+		var ref *referenceError
+		if errors.As(err, &ref) && ref.Table == "patients" {
+			return c.String(http.StatusNotFound, "Patient not found")
+		}
+		if status, message, ok := integrityError(err); ok {
+			return c.String(status, message)
+		}
+		log.Println("Error validating allergy:", err)
+		return c.String(http.StatusInternalServerError, "Failed to insert allergy")
+	}
+
+	result, err := db.Exec("INSERT INTO patient_allergies (patient_id, drug_id, reaction) VALUES (?, ?, ?)", allergy.PatientID, allergy.DrugID, allergy.Reaction)
+	if err != nil {
+		log.Println("Error inserting allergy:", err)
+		return c.String(http.StatusInternalServerError, "Failed to insert allergy")
+	}
+	allergyID, err := result.LastInsertId()
+	if err != nil {
+		return c.String(http.StatusInternalServerError, "Failed to get last insert ID")
+	}
+
+	err = db.QueryRow("SELECT a.id, a.patient_id, a.drug_id, d.drug_name, a.reaction, a.created_at FROM patient_allergies a JOIN drugs d ON d.id = a.drug_id WHERE a.id = ?", allergyID).
+		Scan(&allergy.ID, &allergy.PatientID, &allergy.DrugID, &allergy.DrugName, &allergy.Reaction, &allergy.CreatedAt)
+	if err != nil {
+		log.Println("Error reading back allergy:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get allergy")
+	}
+
+	return c.JSON(http.StatusCreated, allergy)
+}
+
+// Handler function to remove a patient's allergy
+func deletePatientAllergy(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid patient ID")
+	}
+	allergyID, err := strconv.Atoi(c.Param("allergy_id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid allergy ID")
+	}
+
+	result, err := db.Exec("DELETE FROM patient_allergies WHERE id = ? AND patient_id = ?", allergyID, id)
+	if err != nil {
+		log.Println("Error deleting allergy:", err)
+		return c.String(http.StatusInternalServerError, "Failed to delete allergy")
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return c.String(http.StatusNotFound, "Allergy not found")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadInteractionCSV(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    []interactionRecord
+		wantErr bool
+	}{
+		{"IDs and names", "drug_a,drug_b,severity,description,source\n12,Warfarin,severe,Bleeding risk,BNF\n",
+			[]interactionRecord{{DrugA: "12", DrugB: "Warfarin", Severity: "severe", Description: "Bleeding risk", Source: "BNF"}}, false},
+		{"header case, spacing and order", " Severity , DRUG_B,drug_a\nminor, Aspirin, Ibuprofen\n",
+			[]interactionRecord{{DrugA: "Ibuprofen", DrugB: "Aspirin", Severity: "minor"}}, false},
+		{"quoted description", "drug_a,drug_b,severity,description\n1,2,moderate,\"Take apart, 2 hours\"\n",
+			[]interactionRecord{{DrugA: "1", DrugB: "2", Severity: "moderate", Description: "Take apart, 2 hours"}}, false},
+		{"trailing optional columns left out", "drug_a,drug_b,severity,description,source\n1,2,minor\n3,4,severe,Avoid\n",
+			[]interactionRecord{{DrugA: "1", DrugB: "2", Severity: "minor"}, {DrugA: "3", DrugB: "4", Severity: "severe", Description: "Avoid"}}, false},
+		{"header only", "drug_a,drug_b,severity\n", nil, false},
+		{"missing required column", "drug_a,drug_b,description\n1,2,x\n", nil, true},
+		{"empty file", "", nil, true},
+		{"unterminated quote", "drug_a,drug_b,severity\n1,2,\"minor\n", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readInteractionCSV(strings.NewReader(tt.in))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d records %v, want %v", len(got), got, tt.want)
+			}
+			for i := range tt.want {
+				if got[i] != tt.want[i] {
+					t.Errorf("record %d = %+v, want %+v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// DrugLot is one delivered lot of a drug, with its own expiry.
+type DrugLot struct {
+	ID               uint      `json:"id"`
+	DrugID           uint      `json:"drug_id"`
+	LotNumber        string    `json:"lot_number"`
+	ExpiryDate       Date      `json:"expiry_date"`
+	Supplier         string    `json:"supplier"`
+	QuantityReceived Decimal   `json:"quantity_received"`
+	QuantityOnHand   Decimal   `json:"quantity_on_hand"`
+	RecallID         *uint     `json:"recall_id,omitempty"` // recalled lots are quarantined
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+// DrugLotTrace is a lot with every stock movement in or out of it. Dispense
+// movements carry the transaction they were dispensed for.
+type DrugLotTrace struct {
+	DrugLot
+	Movements []StockMovement `json:"movements"`
+}
+
+// lotMismatchError is returned for a receipt into an existing lot with a
+// different expiry date.
+type lotMismatchError struct {
+	LotNumber  string
+	ExpiryDate Date
+}
+
+func (e *lotMismatchError) Error() string {
+	return fmt.Sprintf("lot %s already exists with expiry_date %s", e.LotNumber, e.ExpiryDate)
+}
+
+// errLotRecalled is returned for receipts into a recalled lot.
+var errLotRecalled = errors.New("lot has been recalled")
+
+// lotAllocation is the part of a stock change applied to one lot, or to
+// untracked stock when LotID is nil. Quantity is signed like a movement's.
+type lotAllocation struct {
+	LotID    *uint
+	Quantity Decimal
+}
+
+const drugLotColumns = "id, drug_id, lot_number, expiry_date, supplier, quantity_received, quantity_on_hand, recall_id, created_at"
+
+func scanDrugLot(row rowScanner) (DrugLot, error) {
+	var lot DrugLot
+	err := row.Scan(&lot.ID, &lot.DrugID, &lot.LotNumber, &lot.ExpiryDate, &lot.Supplier, &lot.QuantityReceived, &lot.QuantityOnHand, &lot.RecallID, &lot.CreatedAt)
+	return lot, err
+}
+
+// findDrugLots returns a drug's lots, first expiry first. Depleted lots are
+// left out unless includeEmpty is set.
+func findDrugLots(drugID int, includeEmpty bool) ([]DrugLot, error) {
+	query := "SELECT " + drugLotColumns + " FROM drug_lots WHERE drug_id = ?"
+	if !includeEmpty {
+		query += " AND quantity_on_hand > 0"
+	}
+	rows, err := db.Query(query+" ORDER BY expiry_date, id", drugID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lots := make([]DrugLot, 0)
+	for rows.Next() {
+		lot, err := scanDrugLot(rows)
+		if err != nil {
+			return nil, err
+		}
+		lots = append(lots, lot)
+	}
+	return lots, rows.Err()
+}
+
+// receiveLot returns the lot a receipt goes into, creating it on its first
+// receipt, and counts the received quantity. The stock itself is added by
+// the receipt's movement.
+func receiveLot(tx *sql.Tx, drugID uint, lotNumber string, expiry Date, supplier string, quantity Decimal) (uint, error) {
+	if _, err := lockDrugStock(tx, drugID); err != nil {
+		return 0, err
+	}
+
+	var id uint
+	var existingExpiry Date
+	var recallID *uint
+	err := tx.QueryRow("SELECT id, expiry_date, recall_id FROM drug_lots WHERE drug_id = ? AND lot_number = ? FOR UPDATE", drugID, lotNumber).Scan(&id, &existingExpiry, &recallID)
+	if err == sql.ErrNoRows {
+		result, err := tx.Exec("INSERT INTO drug_lots (drug_id, lot_number, expiry_date, supplier, quantity_received) VALUES (?, ?, ?, ?, ?)",
+			drugID, lotNumber, expiry, supplier, quantity)
+		if err != nil {
+			return 0, err
+		}
+		lastID, err := result.LastInsertId()
+		return uint(lastID), err
+	}
+	if err != nil {
+		return 0, err
+	}
+	if recallID != nil {
+		return 0, errLotRecalled
+	}
+	if existingExpiry != expiry {
+		return 0, &lotMismatchError{LotNumber: lotNumber, ExpiryDate: existingExpiry}
+	}
+
+	_, err = tx.Exec("UPDATE drug_lots SET quantity_received = quantity_received + ? WHERE id = ?", quantity, id)
+	return id, err
+}
+
+// lotHolding is the stock a lot holds, or untracked stock when LotID is nil.
+type lotHolding struct {
+	LotID    *uint
+	Expiry   Date // zero for untracked stock
+	Quantity Decimal
+}
+
+// fefoOrder sorts lots first expiry first out, lots expiring on the same day
+// by ID.
+func fefoOrder(holdings []lotHolding) {
+	sort.SliceStable(holdings, func(i, j int) bool {
+		a, b := holdings[i], holdings[j]
+		if a.Expiry != b.Expiry {
+			return a.Expiry.Before(b.Expiry)
+		}
+		return *a.LotID < *b.LotID
+	})
+}
+
+// returnOrder sorts what a transaction took for a return, the reverse of
+// fefoOrder: untracked stock first, then lots last expiry first.
+func returnOrder(holdings []lotHolding) {
+	sort.SliceStable(holdings, func(i, j int) bool {
+		a, b := holdings[i], holdings[j]
+		if (a.LotID == nil) != (b.LotID == nil) {
+			return a.LotID == nil
+		}
+		if a.LotID == nil {
+			return false
+		}
+		if a.Expiry != b.Expiry {
+			return b.Expiry.Before(a.Expiry)
+		}
+		return *a.LotID > *b.LotID
+	})
+}
+
+// takeInOrder splits quantity over holdings in order, taking from each no
+// more than it holds. It returns the positive parts taken and the quantity
+// left over.
+func takeInOrder(quantity Decimal, holdings []lotHolding) ([]lotAllocation, Decimal) {
+	var taken []lotAllocation
+	remaining := quantity
+	for _, holding := range holdings {
+		if remaining.Sign() <= 0 {
+			break
+		}
+		take := minDecimal(remaining, holding.Quantity)
+		taken = append(taken, lotAllocation{LotID: holding.LotID, Quantity: take})
+		remaining = remaining.Sub(take)
+	}
+	return taken, remaining
+}
+
+// allocateFEFO splits a dispense of quantity over the drug's unexpired lots,
+// first expiry first out, and then over untracked stock. Expired and
+// recalled lots are never dispensed from.
+func allocateFEFO(tx *sql.Tx, drugID uint, quantity Decimal) ([]lotAllocation, error) {
+	onHand, err := lockDrugStock(tx, drugID)
+	if err != nil {
+		return nil, err
+	}
+
+	today := dateOf(time.Now().In(clinicLocation))
+	rows, err := tx.Query("SELECT id, expiry_date, quantity_on_hand FROM drug_lots WHERE drug_id = ? AND quantity_on_hand > 0 AND expiry_date >= ? AND recall_id IS NULL ORDER BY expiry_date, id FOR UPDATE",
+		drugID, today)
+	if err != nil {
+		return nil, err
+	}
+	var lots []lotHolding
+	available := Decimal{}
+	for rows.Next() {
+		var id uint
+		var lot lotHolding
+		if err := rows.Scan(&id, &lot.Expiry, &lot.Quantity); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		lot.LotID = &id
+		lots = append(lots, lot)
+		available = available.Add(lot.Quantity)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	fefoOrder(lots)
+	allocations, remaining := takeInOrder(quantity, lots)
+	if remaining.Sign() > 0 {
+		untracked, err := untrackedStock(tx, drugID, onHand)
+		if err != nil {
+			return nil, err
+		}
+		if untracked.Cmp(remaining) < 0 {
+			if untracked.Sign() > 0 {
+				available = available.Add(untracked)
+			}
+			return nil, &insufficientStockError{DrugID: drugID, Available: available, Requested: quantity}
+		}
+		allocations = append(allocations, lotAllocation{Quantity: remaining})
+	}
+	for i := range allocations {
+		allocations[i].Quantity = allocations[i].Quantity.Neg()
+	}
+	return allocations, nil
+}
+
+// allocateReturn splits a return of quantity from a transaction over the
+// lots it was dispensed from, in returnOrder. Any quantity the transaction
+// took outside the ledger goes to untracked stock.
+func allocateReturn(tx *sql.Tx, transactionID, drugID uint, quantity Decimal) ([]lotAllocation, error) {
+	if _, err := lockDrugStock(tx, drugID); err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query("SELECT m.lot_id, MAX(l.expiry_date), -SUM(m.quantity) FROM stock_movements m LEFT JOIN drug_lots l ON l.id = m.lot_id"+
+		" WHERE m.transaction_id = ? AND m.drug_id = ? AND m.kind = ?"+
+		" GROUP BY m.lot_id HAVING -SUM(m.quantity) > 0",
+		transactionID, drugID, stockDispense)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var dispensed []lotHolding
+	for rows.Next() {
+		var holding lotHolding
+		if err := rows.Scan(&holding.LotID, &holding.Expiry, &holding.Quantity); err != nil {
+			return nil, err
+		}
+		dispensed = append(dispensed, holding)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	returnOrder(dispensed)
+	allocations, remaining := takeInOrder(quantity, dispensed)
+	if remaining.Sign() > 0 {
+		allocations = append(allocations, lotAllocation{Quantity: remaining})
+	}
+	return allocations, nil
+}
+
+// Handler function to list a drug's lots, first expiry first. Depleted lots
+// are included with ?include_empty=true.
+func getDrugLots(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid drug ID")
+	}
+
+	if _, err := findDrug(id); err != nil {
+		if err == sql.ErrNoRows {
+			return c.String(http.StatusNotFound, "Drug not found")
+		}
+		log.Println("Error getting drug:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get drug")
+	}
+
+	lots, err := findDrugLots(id, c.QueryParam("include_empty") == "true")
+	if err != nil {
+		log.Println("Error querying drug lots:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get lots")
+	}
+
+	return c.JSON(http.StatusOK, lots)
+}
+
+// Handler function to get a lot with every movement in or out of it, to
+// trace where it was dispensed
+func getDrugLot(c echo.Context) error {
+	drugID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid drug ID")
+	}
+	lotID, err := strconv.Atoi(c.Param("lot_id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid lot ID")
+	}
+
+	lot, err := scanDrugLot(db.QueryRow("SELECT "+drugLotColumns+" FROM drug_lots WHERE id = ? AND drug_id = ?", lotID, drugID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.String(http.StatusNotFound, "Lot not found")
+		}
+		log.Println("Error getting drug lot:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get lot")
+	}
+
+	rows, err := db.Query(stockMovementSelect+" WHERE m.lot_id = ? ORDER BY m.id", lotID)
+	if err != nil {
+		log.Println("Error querying lot movements:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get lot")
+	}
+	defer rows.Close()
+
+	trace := DrugLotTrace{DrugLot: lot, Movements: make([]StockMovement, 0)}
+	for rows.Next() {
+		m, err := scanStockMovement(rows)
+		if err != nil {
+			log.Println("Error scanning stock movement row:", err)
+			continue
+		}
+		trace.Movements = append(trace.Movements, m)
+	}
+
+	return c.JSON(http.StatusOK, trace)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+func lotID(id uint) *uint { return &id }
+
+// formatAllocations renders allocations as "lot:quantity", "-" for untracked.
+func formatAllocations(allocations []lotAllocation) []string {
+	var out []string
+	for _, a := range allocations {
+		lot := "-"
+		if a.LotID != nil {
+			lot = fmt.Sprint(*a.LotID)
+		}
+		out = append(out, lot+":"+a.Quantity.String())
+	}
+	return out
+}
+
+func TestFEFOAllocation(t *testing.T) {
+	march := Date{Year: 2026, Month: time.March, Day: 1}
+	lots := func() []lotHolding {
+		return []lotHolding{
+			{LotID: lotID(3), Expiry: march.AddDays(60), Quantity: mustDecimal(t, "10")},
+			{LotID: lotID(2), Expiry: march.AddDays(30), Quantity: mustDecimal(t, "5")},
+			{LotID: lotID(1), Expiry: march.AddDays(30), Quantity: mustDecimal(t, "4")},
+		}
+	}
+	tests := []struct {
+		name          string
+		quantity      string
+		want          []string
+		wantRemaining string
+	}{
+		{"first expiry, lowest ID first", "3", []string{"1:3"}, "0"},
+		{"lot used up exactly", "4", []string{"1:4"}, "0"},
+		{"split across lots", "12", []string{"1:4", "2:5", "3:3"}, "0"},
+		{"remainder left for untracked stock", "21.5", []string{"1:4", "2:5", "3:10"}, "2.5"},
+		{"fractional quantity", "4.3", []string{"1:4", "2:0.3"}, "0.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			holdings := lots()
+			fefoOrder(holdings)
+			got, remaining := takeInOrder(mustDecimal(t, tt.quantity), holdings)
+			if g := formatAllocations(got); !slices.Equal(g, tt.want) {
+				t.Errorf("allocations = %v, want %v", g, tt.want)
+			}
+			if remaining.Cmp(mustDecimal(t, tt.wantRemaining)) != 0 {
+				t.Errorf("remaining = %s, want %s", remaining, tt.wantRemaining)
+			}
+		})
+	}
+}
+
+func TestReturnAllocation(t *testing.T) {
+	march := Date{Year: 2026, Month: time.March, Day: 1}
+	dispensed := func() []lotHolding {
+		return []lotHolding{
+			{LotID: lotID(1), Expiry: march.AddDays(30), Quantity: mustDecimal(t, "4")},
+			{LotID: lotID(2), Expiry: march.AddDays(30), Quantity: mustDecimal(t, "5")},
+			{LotID: lotID(3), Expiry: march.AddDays(60), Quantity: mustDecimal(t, "3")},
+			{Quantity: mustDecimal(t, "2")},
+		}
+	}
+	tests := []struct {
+		name          string
+		quantity      string
+		want          []string
+		wantRemaining string
+	}{
+		{"untracked stock first", "1", []string{"-:1"}, "0"},
+		{"then last expiry first", "4", []string{"-:2", "3:2"}, "0"},
+		{"same expiry, highest ID first", "10", []string{"-:2", "3:3", "2:5"}, "0"},
+		{"whole transaction", "14", []string{"-:2", "3:3", "2:5", "1:4"}, "0"},
+		{"more than was dispensed", "15.5", []string{"-:2", "3:3", "2:5", "1:4"}, "1.5"},
+		{"fractional quantity", "2.25", []string{"-:2", "3:0.25"}, "0.00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			holdings := dispensed()
+			returnOrder(holdings)
+			got, remaining := takeInOrder(mustDecimal(t, tt.quantity), holdings)
+			if g := formatAllocations(got); !slices.Equal(g, tt.want) {
+				t.Errorf("allocations = %v, want %v", g, tt.want)
+			}
+			if remaining.Cmp(mustDecimal(t, tt.wantRemaining)) != 0 {
+				t.Errorf("remaining = %s, want %s", remaining, tt.wantRemaining)
+			}
+		})
+	}
+}
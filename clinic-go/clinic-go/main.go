@@ -2,6 +2,7 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -17,12 +18,24 @@ var db *sql.DB
 func main() {
 	// Database connection
 	var err error
-	db, err = sql.Open("mysql", "root:@tcp(localhost:3306)/clinic_db")
+	// Timestamps are stored and read in UTC; see clinicLocation for rendering
+	db, err = sql.Open("mysql", "root:@tcp(localhost:3306)/clinic_db?parseTime=true&loc=UTC&time_zone=%27%2B00%3A00%27")
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer db.Close()
 
+	clinicLocation = loadClinicLocation()
+	if err := migrate(db); err != nil {
+		log.Fatal(err)
+	}
+
+	pricing = loadPricingPolicy()
+	baseCurrency = loadBaseCurrency()
+	if err := convertPastTransactions(); err != nil {
+		log.Println("Error converting past transactions:", err)
+	}
+
 	// Echo instance
 	e := echo.New()
 
@@ -36,6 +49,7 @@ func main() {
 	e.GET("/users/:id", getUser)
 	e.POST("/users", createUser)
 	e.PUT("/users/:id", updateUser)
+	e.PATCH("/users/:id", patchUser)
 	e.DELETE("/users/:id", deleteUser)
 
 	// PatientAppointments CRUD
@@ -43,14 +57,77 @@ func main() {
 	e.GET("/appointments/:id", getAppointment)
 	e.POST("/appointments", createAppointment)
 	e.PUT("/appointments/:id", updateAppointment)
+	e.PATCH("/appointments/:id", patchAppointment)
 	e.DELETE("/appointments/:id", deleteAppointment)
+	e.POST("/appointments/:id/restore", restoreHandler("patient_appointments", "Appointment", getAppointment))
+	e.GET("/appointments/:id/history", getAppointmentHistory)
+	e.GET("/appointments/:id/reminders", getAppointmentReminders)
+	e.POST("/appointments/:id/confirm", transitionHandler(statusConfirmed))
+	e.POST("/appointments/:id/check-in", transitionHandler(statusCheckedIn))
+	e.POST("/appointments/:id/start", transitionHandler(statusInConsultation))
+	e.POST("/appointments/:id/complete", transitionHandler(statusCompleted))
+	e.POST("/appointments/:id/cancel", transitionHandler(statusCancelled))
+	e.POST("/appointments/:id/no-show", transitionHandler(statusNoShow))
+	e.POST("/appointments/:id/series/edit", editAppointmentSeries)
+	e.POST("/appointments/:id/series/cancel", cancelAppointmentSeries)
+
+	// Recurring appointment series
+	e.POST("/appointment-series", createAppointmentSeries)
+	e.GET("/appointment-series/:id", getAppointmentSeries)
+
+	// Waitlist and slot offers
+	e.POST("/waitlist", createWaitlistEntry)
+	e.GET("/waitlist", getWaitlist)
+	e.GET("/waitlist/:id", getWaitlistEntry)
+	e.DELETE("/waitlist/:id", deleteWaitlistEntry)
+	e.POST("/waitlist/offers/:id/accept", acceptWaitlistOffer)
+	e.POST("/waitlist/offers/:id/decline", declineWaitlistOffer)
 
 	// Drugs CRUD
 	e.GET("/drugs", getDrugs)
 	e.GET("/drugs/:id", getDrug)
 	e.POST("/drugs", createDrug)
 	e.PUT("/drugs/:id", updateDrug)
+	e.PATCH("/drugs/:id", patchDrug)
 	e.DELETE("/drugs/:id", deleteDrug)
+	e.GET("/drugs/:id/stock", getDrugStock)
+	e.POST("/drugs/:id/stock/receipts", stockMovementHandler(stockReceipt))
+	e.POST("/drugs/:id/stock/adjustments", stockMovementHandler(stockAdjustment))
+	e.POST("/drugs/:id/stock/write-offs", stockMovementHandler(stockWriteOff))
+	e.GET("/drugs/:id/prices", getDrugPrices)
+	e.POST("/drugs/:id/prices", createDrugPrice)
+	e.DELETE("/drugs/:id/prices/:price_id", deleteDrugPrice)
+	e.GET("/drugs/:id/lots", getDrugLots)
+	e.GET("/drugs/:id/lots/:lot_id", getDrugLot)
+	e.GET("/drugs/:id/recalls", getDrugRecalls)
+	e.POST("/drugs/:id/recalls", createDrugRecall)
+	e.GET("/recalls/:id", getDrugRecall)
+	e.GET("/recalls/:id/affected.csv", exportRecallAffected)
+
+	// Interaction knowledge base and prescribing checks
+	e.GET("/drug-interactions", getDrugInteractions)
+	e.POST("/drug-interactions", createDrugInteraction)
+	e.POST("/drug-interactions/import", importDrugInteractions)
+	e.DELETE("/drug-interactions/:id", deleteDrugInteraction)
+	e.POST("/interaction-checks", checkInteractionsHandler)
+
+	// Exchange rates to the base currency
+	e.GET("/exchange-rates", getExchangeRates)
+	e.POST("/exchange-rates", createExchangeRate)
+	e.POST("/exchange-rates/import", importExchangeRates)
+	e.DELETE("/exchange-rates/:id", deleteExchangeRate)
+
+	// Prescriptions
+	e.POST("/appointments/:id/prescriptions", createPrescription)
+	e.GET("/appointments/:id/prescriptions", getAppointmentPrescriptions)
+	e.GET("/patients/:id/prescriptions", getPatientPrescriptions)
+	e.GET("/prescriptions/:id", getPrescription)
+	e.POST("/prescriptions/:id/cancel", cancelPrescription)
+	e.POST("/prescriptions/:id/dispense", dispensePrescription)
+
+	// Pharmacy alerts
+	e.GET("/alerts/pharmacy", getPharmacyAlerts)
+	e.POST("/alerts/pharmacy/:id/acknowledge", acknowledgePharmacyAlert)
 
 	// Patients CRUD
 	e.POST("/login", login)
@@ -58,21 +135,72 @@ func main() {
 	e.GET("/patients/:id", getPatient)
 	e.POST("/patients", createPatient)
 	e.PUT("/patients/:id", updatePatient)
+	e.PATCH("/patients/:id", patchPatient)
 	e.DELETE("/patients/:id", deletePatient)
+	e.POST("/patients/:id/restore", restoreHandler("patients", "Patient", getPatient))
+	e.GET("/patients/:id/contact-preferences", getContactPreferences)
+	e.PUT("/patients/:id/contact-preferences", updateContactPreferences)
+	e.GET("/patients/:id/calendar-feeds", calendarFeedsHandler(feedOwnerPatient))
+	e.POST("/patients/:id/calendar-feeds", createCalendarFeedHandler(feedOwnerPatient))
+	e.GET("/patients/:id/allergies", getPatientAllergies)
+	e.POST("/patients/:id/allergies", createPatientAllergy)
+	e.DELETE("/patients/:id/allergies/:allergy_id", deletePatientAllergy)
 
 	// Doctors CRUD
 	e.GET("/doctors", getDoctors)
 	e.GET("/doctors/:id", getDoctor)
 	e.POST("/doctors", createDoctor)
 	e.PUT("/doctors/:id", updateDoctor)
+	e.PATCH("/doctors/:id", patchDoctor)
 	e.DELETE("/doctors/:id", deleteDoctor)
+	e.GET("/doctors/:id/calendar-feeds", calendarFeedsHandler(feedOwnerDoctor))
+	e.POST("/doctors/:id/calendar-feeds", createCalendarFeedHandler(feedOwnerDoctor))
+
+	// Doctor schedules
+	e.GET("/doctors/:id/schedule", getDoctorSchedule)
+	e.PUT("/doctors/:id/schedule", updateDoctorSchedule)
+	e.GET("/doctors/:id/exceptions", getDoctorExceptions)
+	e.POST("/doctors/:id/exceptions", createDoctorException)
+	e.DELETE("/doctors/:id/exceptions/:exception_id", deleteDoctorException)
+	e.GET("/doctors/:id/slots", getDoctorSlots)
+	e.GET("/holidays", getHolidays)
+	e.POST("/holidays", createHoliday)
+	e.DELETE("/holidays/:id", deleteHoliday)
+
+	// Walk-in queues
+	e.GET("/queues/:doctor_id/today", getTodayQueue)
+	e.POST("/queues/:doctor_id/today/walk-ins", createWalkIn)
+	e.POST("/queues/:doctor_id/today/call-next", callNextPatient)
+	e.POST("/queues/:doctor_id/today/:number/skip", queueActionHandler("skip", []string{queueWaiting, queueCalled}, queueSkipped))
+	e.POST("/queues/:doctor_id/today/:number/recall", queueActionHandler("recall", []string{queueCalled, queueSkipped}, queueCalled))
 
 	// Transactions CRUD
 	e.GET("/transactions", getAllTransactions)
 	e.GET("/transactions/:id", getTransactionByID)
 	e.POST("/transactions", createTransaction)
 	e.PUT("/transactions/:id", updateTransaction)
+	e.PATCH("/transactions/:id", patchTransaction)
 	e.DELETE("/transactions/:id", deleteTransaction)
+	e.POST("/transactions/:id/restore", restoreHandler("transactions", "Transaction", getTransactionByID))
+
+	// Reports
+	e.GET("/reports/daily", getDailyReport)
+
+	// Calendar feeds, authenticated by their secret token
+	e.GET("/calendar/:token", getCalendarFeed)
+	e.DELETE("/calendar-feeds/:id", revokeCalendarFeed)
+
+	// Server-Sent Events
+	e.GET("/events", streamEvents)
+
+	// Notification delivery receipts
+	e.POST("/notifications/status", updateDeliveryStatus)
+
+	startRetentionJob(loadRetentionPolicy())
+	notifications = loadNotifiers()
+	startReminderJob(loadReminderPolicy(), notifications)
+	startWaitlistJob(getenvDuration("WAITLIST_SWEEP_INTERVAL", time.Minute))
+	startPharmacyAlertJob(loadAlertPolicy(), notifications)
 
 	// Start server
 	e.Logger.Fatal(e.Start(":8080"))
@@ -80,83 +208,143 @@ func main() {
 
 // User struct represents a user in the system
 type User struct {
-	ID        uint   `json:"id"`
-	Name      string `json:"name"`
-	Email     string `json:"email"`
-	CreatedAt string `json:"created_at"`
-	UpdatedAt string `json:"updated_at"`
+	ID        uint      `json:"id"`
+	Name      string    `json:"name"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Version   uint      `json:"version"`
 }
 
 // PatientAppointment struct represents an appointment made by a patient
 type PatientAppointment struct {
-	ID              uint   `json:"id"`
-	PatientID       uint   `json:"patient_id"`
-	UserID          int    `json:"user_id"`
-	AppointmentDate string `json:"appointment_date"`
-	Notes           string `json:"notes"`
-	Prescription    string `json:"prescription"`
-	Status          string `json:"status"`
-	CreatedAt       string `json:"created_at"`
-	UpdatedAt       string `json:"updated_at"`
+	ID              uint            `json:"id"`
+	PatientID       uint            `json:"patient_id"`
+	DoctorID        int             `json:"doctor_id"`
+	AppointmentDate time.Time       `json:"appointment_date"`
+	Notes           string          `json:"notes"`
+	Prescription    string          `json:"prescription"` // legacy free text, see Prescription
+	Status          string          `json:"status"`
+	CreatedAt       time.Time       `json:"created_at"`
+	UpdatedAt       time.Time       `json:"updated_at"`
+	DeletedAt       *time.Time      `json:"deleted_at,omitempty"`
+	Version         uint            `json:"version"`
+	SeriesID        *uint           `json:"series_id,omitempty"`    // read-only, see AppointmentSeries
+	Occurrence      *int            `json:"occurrence,omitempty"`   // read-only, 1-based position in the series
+	QueueNumber     *int            `json:"queue_number,omitempty"` // read-only, set at check-in
+	Patient         *PatientSummary `json:"patient,omitempty"`      // read-only
+	Doctor          *DoctorSummary  `json:"doctor,omitempty"`       // read-only
+}
+
+// PatientSummary is the part of a patient embedded in an appointment
+type PatientSummary struct {
+	ID   uint   `json:"id"`
+	Name string `json:"name"`
+}
+
+// DoctorSummary is the part of a doctor embedded in an appointment
+type DoctorSummary struct {
+	ID             int    `json:"id"`
+	Name           string `json:"name"`
+	Specialization string `json:"specialization"`
 }
 
 // Drug struct represents a drug in the clinic
 type Drug struct {
-	ID                uint    `json:"id"`
-	DrugName          string  `json:"drug_name"`
-	DrugType          string  `json:"drug_type"`
-	Description       string  `json:"description,omitempty"`
-	Composition       string  `json:"composition,omitempty"`
-	Packaging         string  `json:"packaging,omitempty"`
-	Dosage            string  `json:"dosage,omitempty"`
-	Contraindications string  `json:"contraindications,omitempty"`
-	SideEffects       string  `json:"side_effects,omitempty"`
-	Price             float64 `json:"price"`    // New field for price
-	Currency          string  `json:"currency"` // New field for currency
-	ExpirationDate    string  `json:"expiration_date,omitempty"`
-	CreatedAt         string  `json:"created_at"`
-	UpdatedAt         string  `json:"updated_at"`
+	ID                uint      `json:"id"`
+	DrugName          string    `json:"drug_name"`
+	DrugType          string    `json:"drug_type"`
+	Description       string    `json:"description,omitempty"`
+	Composition       string    `json:"composition,omitempty"`
+	Packaging         string    `json:"packaging,omitempty"`
+	Dosage            string    `json:"dosage,omitempty"`
+	Contraindications string    `json:"contraindications,omitempty"`
+	SideEffects       string    `json:"side_effects,omitempty"`
+	Price             Decimal   `json:"price"`    // current general price, see DrugPrice
+	Currency          string    `json:"currency"` // currency of Price
+	ExpirationDate    *Date     `json:"expiration_date,omitempty"`
+	QuantityOnHand    Decimal   `json:"quantity_on_hand"`            // read-only, see StockMovement
+	ReorderThreshold  *Decimal  `json:"reorder_threshold,omitempty"` // low-stock alert level
+	CreatedAt         time.Time `json:"created_at"`
+	UpdatedAt         time.Time `json:"updated_at"`
+	Version           uint      `json:"version"`
 }
 
 // Patient struct represents a patient in the clinic
 type Patient struct {
-	ID          uint   `json:"id"`
-	Nik         string `json:"nik"`
-	Name        string `json:"name"`
-	Gender      string `json:"gender"`
-	DateOfBirth string `json:"date_of_birth"`
-	Address     string `json:"address"`
-	Password    string `json:"password"`
-	CreatedAt   string `json:"created_at"`
-	UpdatedAt   string `json:"updated_at"`
+	ID          uint       `json:"id"`
+	Nik         string     `json:"nik"`
+	Name        string     `json:"name"`
+	Gender      string     `json:"gender"`
+	DateOfBirth Date       `json:"date_of_birth"`
+	Address     string     `json:"address"`
+	Password    string     `json:"password"`
+	PriceTier   string     `json:"price_tier"` // e.g. general or insured, see DrugPrice
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	DeletedAt   *time.Time `json:"deleted_at,omitempty"`
+	Version     uint       `json:"version"`
 }
 
 // Doctor represents a doctor entity
 type Doctor struct {
-	ID               int    `json:"id"`
-	UserID           int    `json:"user_id"`
-	Specialization   string `json:"specialization"`
-	CreatedAt        string `json:"created_at"`
-	UpdatedAt        string `json:"updated_at"`
-	ProfilePhotoPath string `json:"profile_photo_path"`
+	ID               int       `json:"id"`
+	UserID           int       `json:"user_id"`
+	Specialization   string    `json:"specialization"`
+	CreatedAt        time.Time `json:"created_at"`
+	UpdatedAt        time.Time `json:"updated_at"`
+	ProfilePhotoPath string    `json:"profile_photo_path"`
+	Version          uint      `json:"version"`
 }
 
 // Transaction represents a doctor entity
 type Transaction struct {
-	ID           uint    `json:"id"`
-	PatientID    uint    `json:"patient_id"`
-	DrugID       uint    `json:"drug_id"`
-	Quantity     float64 `json:"quantity"`
-	TotalPrice   float64 `json:"total_price"`
-	Currency     string  `json:"currency"`
-	Prescription string  `json:"prescription"`
-	CreatedAt    string  `json:"created_at"`
-	UpdatedAt    string  `json:"updated_at"`
+	ID           uint       `json:"id"`
+	PatientID    uint       `json:"patient_id"`
+	DrugID       uint       `json:"drug_id"`
+	Quantity     Decimal    `json:"quantity"`
+	TotalPrice   Decimal    `json:"total_price"`
+	Currency     string     `json:"currency"`
+	Prescription string     `json:"prescription"` // free text, or the directions of a prescription line
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+	DeletedAt    *time.Time `json:"deleted_at,omitempty"`
+	Version      uint       `json:"version"`
+
+	// PrescriptionItemID is set on transactions created by dispensing a
+	// prescription. Read-only.
+	PrescriptionItemID *uint `json:"prescription_item_id,omitempty"`
+
+	// Pricing is worked out by the server; see priceTransaction. All but
+	// DiscountPercent and PriceOverrideReason are read-only. DrugPriceID is
+	// the price list entry in effect for the patient's tier when the
+	// transaction was created, and UnitPrice a snapshot of its price.
+	DrugPriceID         *uint   `json:"drug_price_id,omitempty"`
+	UnitPrice           Decimal `json:"unit_price"`
+	DiscountPercent     Decimal `json:"discount_percent"`
+	DiscountAmount      Decimal `json:"discount_amount"`
+	TaxRate             Decimal `json:"tax_rate"`
+	TaxAmount           Decimal `json:"tax_amount"`
+	PriceOverrideReason string  `json:"price_override_reason,omitempty"` // admins only, keeps a total_price that differs from the calculation
+	PriceOverriddenBy   *uint   `json:"price_overridden_by,omitempty"`
+
+	// The total in the clinic's base currency, converted when priced at the
+	// rate in effect at the time; see ExchangeRate. Read-only. BaseCurrency
+	// is empty on older transactions in a currency no rate was entered for.
+	BaseCurrency   string  `json:"base_currency,omitempty"`
+	ExchangeRate   Decimal `json:"exchange_rate"`
+	ExchangeRateID *uint   `json:"exchange_rate_id,omitempty"` // nil when already in the base currency
+	BaseTotalPrice Decimal `json:"base_total_price"`
+
+	// OverrideReason lets a prescriber go ahead despite severe interaction
+	// or allergy warnings. Warnings are only returned on creation.
+	OverrideReason string               `json:"override_reason,omitempty"`
+	Warnings       []InteractionWarning `json:"warnings,omitempty"`
 }
 
 // Handler function to get all users
 func getUsers(c echo.Context) error {
-	rows, err := db.Query("SELECT id, name, email, created_at, updated_at FROM users")
+	rows, err := db.Query("SELECT id, name, email, created_at, updated_at, version FROM users")
 	if err != nil {
 		log.Println("Error querying users:", err)
 		return c.String(http.StatusInternalServerError, "Failed to get users")
@@ -166,7 +354,7 @@ func getUsers(c echo.Context) error {
 	users := make([]User, 0)
 	for rows.Next() {
 		var user User
-		err := rows.Scan(&user.ID, &user.Name, &user.Email, &user.CreatedAt, &user.UpdatedAt)
+		err := rows.Scan(&user.ID, &user.Name, &user.Email, &user.CreatedAt, &user.UpdatedAt, &user.Version)
 		if err != nil {
 			log.Println("Error scanning user row:", err)
 			continue
@@ -184,8 +372,7 @@ func getUser(c echo.Context) error {
 		return c.String(http.StatusBadRequest, "Invalid user ID")
 	}
 
-	var user User
-	err = db.QueryRow("SELECT id, name, email, created_at, updated_at FROM users WHERE id = ?", id).Scan(&user.ID, &user.Name, &user.Email, &user.CreatedAt, &user.UpdatedAt)
+	user, err := findUser(id)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return c.String(http.StatusNotFound, "User not found")
@@ -194,6 +381,7 @@ func getUser(c echo.Context) error {
 		return c.String(http.StatusInternalServerError, "Failed to get user")
 	}
 
+	setETag(c, user.Version)
 	return c.JSON(http.StatusOK, user)
 }
 
@@ -216,7 +404,14 @@ func createUser(c echo.Context) error {
 		return c.String(http.StatusInternalServerError, "Failed to get last insert ID")
 	}
 
-	user.ID = uint(id)
+	// Re-read the row so the response carries the server-set columns
+	user, err = findUser(int(id))
+	if err != nil {
+		log.Println("Error reading back user:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get user")
+	}
+
+	setETag(c, user.Version)
 	return c.JSON(http.StatusCreated, user)
 }
 
@@ -227,19 +422,72 @@ func updateUser(c echo.Context) error {
 		return c.String(http.StatusBadRequest, "Invalid user ID")
 	}
 
+	expected, err := ifMatch(c)
+	if err != nil {
+		return updateFailed(c, err, "User")
+	}
+
 	var user User
 	if err := c.Bind(&user); err != nil {
 		return c.String(http.StatusBadRequest, "Invalid request payload")
 	}
 
-	_, err = db.Exec("UPDATE users SET name = ?, email = ? WHERE id = ?", user.Name, user.Email, id)
+	if err := saveUser(id, expected, user); err != nil {
+		return updateFailed(c, err, "User")
+	}
+
+	return getUser(c)
+}
+
+// Handler function to partially update a user with a merge patch or JSON Patch
+func patchUser(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
-		log.Println("Error updating user:", err)
-		return c.String(http.StatusInternalServerError, "Failed to update user")
+		return c.String(http.StatusBadRequest, "Invalid user ID")
 	}
 
-	user.ID = uint(id)
-	return c.JSON(http.StatusOK, user)
+	expected, err := ifMatch(c)
+	if err != nil {
+		return updateFailed(c, err, "User")
+	}
+
+	user, err := findUser(id)
+	if err != nil {
+		return updateFailed(c, err, "User")
+	}
+	if expected != 0 && expected != user.Version {
+		return updateFailed(c, errPreconditionFailed, "User")
+	}
+
+	version := user.Version
+	if err := applyPatch(c, &user); err != nil {
+		return patchFailed(c, err)
+	}
+
+	if err := saveUser(id, version, user); err != nil {
+		return updateFailed(c, err, "User")
+	}
+
+	return getUser(c)
+}
+
+// findUser loads a single user by ID
+func findUser(id int) (User, error) {
+	var user User
+	err := db.QueryRow("SELECT id, name, email, created_at, updated_at, version FROM users WHERE id = ?", id).Scan(
+		&user.ID, &user.Name, &user.Email, &user.CreatedAt, &user.UpdatedAt, &user.Version)
+	return user, err
+}
+
+// saveUser writes the mutable columns of a user and bumps its version. A
+// non-zero version makes the write conditional on the stored version.
+func saveUser(id int, version uint, user User) error {
+	result, err := db.Exec("UPDATE users SET name = ?, email = ?, version = version + 1 WHERE id = ? AND (? = 0 OR version = ?)",
+		user.Name, user.Email, id, version, version)
+	if err != nil {
+		return err
+	}
+	return checkVersionedUpdate(result, "users", id)
 }
 
 // Handler function to delete a user by ID
@@ -249,18 +497,34 @@ func deleteUser(c echo.Context) error {
 		return c.String(http.StatusBadRequest, "Invalid user ID")
 	}
 
-	_, err = db.Exec("DELETE FROM users WHERE id = ?", id)
+	err = deleteRecord("users", id)
 	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.String(http.StatusNotFound, "User not found")
+		}
+		if status, message, ok := integrityError(err); ok {
+			return c.String(status, message)
+		}
 		log.Println("Error deleting user:", err)
 		return c.String(http.StatusInternalServerError, "Failed to delete user")
 	}
 
-	return c.String(http.StatusOK, fmt.Sprintf("User with ID %d deleted", id))
+	return c.NoContent(http.StatusNoContent)
 }
 
 // Handler function to get all appointments
 func getAppointments(c echo.Context) error {
-	rows, err := db.Query("SELECT id, patient_id, user_id, appointment_date, notes, prescription, status, created_at, updated_at FROM patient_appointments")
+	withDeleted, err := includeDeleted(c)
+	if err != nil {
+		return c.String(http.StatusForbidden, "Only admins can list deleted appointments")
+	}
+
+	query := appointmentSelect
+	if !withDeleted {
+		query += " WHERE a.deleted_at IS NULL"
+	}
+
+	rows, err := db.Query(query)
 	if err != nil {
 		log.Println("Error querying appointments:", err)
 		return c.String(http.StatusInternalServerError, "Failed to get appointments")
@@ -269,9 +533,7 @@ func getAppointments(c echo.Context) error {
 
 	appointments := make([]PatientAppointment, 0)
 	for rows.Next() {
-		var appointment PatientAppointment
-		err := rows.Scan(&appointment.ID, &appointment.PatientID, &appointment.UserID, &appointment.AppointmentDate,
-			&appointment.Notes, &appointment.Prescription, &appointment.Status, &appointment.CreatedAt, &appointment.UpdatedAt)
+		appointment, err := scanAppointment(rows)
 		if err != nil {
 			log.Println("Error scanning appointment row:", err)
 			continue
@@ -289,10 +551,12 @@ func getAppointment(c echo.Context) error {
 		return c.String(http.StatusBadRequest, "Invalid appointment ID")
 	}
 
-	var appointment PatientAppointment
-	err = db.QueryRow("SELECT id, patient_id, user_id, appointment_date, notes, prescription, status, created_at, updated_at FROM patient_appointments WHERE id = ?", id).Scan(
-		&appointment.ID, &appointment.PatientID, &appointment.UserID, &appointment.AppointmentDate,
-		&appointment.Notes, &appointment.Prescription, &appointment.Status, &appointment.CreatedAt, &appointment.UpdatedAt)
+	withDeleted, err := includeDeleted(c)
+	if err != nil {
+		return c.String(http.StatusForbidden, "Only admins can view deleted appointments")
+	}
+
+	appointment, err := findAppointment(id, withDeleted)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return c.String(http.StatusNotFound, "Appointment not found")
@@ -301,6 +565,7 @@ func getAppointment(c echo.Context) error {
 		return c.String(http.StatusInternalServerError, "Failed to get appointment")
 	}
 
+	setETag(c, appointment.Version)
 	return c.JSON(http.StatusOK, appointment)
 }
 
@@ -311,24 +576,47 @@ func createAppointment(c echo.Context) error {
 		return c.String(http.StatusBadRequest, "Invalid request payload")
 	}
 
-	// Execute the SQL query to insert a new appointment
-	result, err := db.Exec("INSERT INTO patient_appointments (patient_id, user_id, appointment_date, notes, prescription, status) VALUES (?, ?, ?, ?, ?, ?)",
-		appointment.PatientID, appointment.UserID, appointment.AppointmentDate,
-		appointment.Notes, appointment.Prescription, appointment.Status)
+	// New appointments always start at the beginning of the lifecycle; the
+	// status only changes through the transition endpoints. Series
+	// occurrences are created through /appointment-series.
+	appointment.Status = statusRequested
+	appointment.SeriesID, appointment.Occurrence = nil, nil
+
+	err := validateAppointment(appointment, true)
+	if err != nil {
+		if status, message, ok := integrityError(err); ok {
+			return c.String(status, message)
+		}
+		if err == errOutsideSchedule {
+			return c.String(http.StatusUnprocessableEntity, err.Error())
+		}
+		log.Println("Error validating appointment:", err)
+		return c.String(http.StatusInternalServerError, "Failed to insert appointment")
+	}
+
+	id, err := insertAppointment(appointment, currentActor(c))
 	if err != nil {
+		var conflict *bookingConflict
+		if errors.As(err, &conflict) {
+			return conflictResponse(c, conflict)
+		}
+		if status, message, ok := integrityError(err); ok {
+			return c.String(status, message)
+		}
 		log.Println("Error inserting appointment:", err)
 		return c.String(http.StatusInternalServerError, "Failed to insert appointment")
 	}
 
-	// Retrieve the last insert ID
-	id, err := result.LastInsertId()
+	// Re-read the row so the response carries the server-set columns
+	appointment, err = findAppointment(int(id), false)
 	if err != nil {
-		log.Println("Error getting last insert ID:", err)
-		return c.String(http.StatusInternalServerError, "Failed to get last insert ID")
+		log.Println("Error reading back appointment:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get appointment")
 	}
 
-	// Set the ID of the appointment struct and return as JSON response
-	appointment.ID = uint(id)
+	publishAppointment("created", int(id))
+
+	setETag(c, appointment.Version)
 	return c.JSON(http.StatusCreated, appointment)
 }
 
@@ -339,21 +627,211 @@ func updateAppointment(c echo.Context) error {
 		return c.String(http.StatusBadRequest, "Invalid appointment ID")
 	}
 
+	expected, err := ifMatch(c)
+	if err != nil {
+		return updateFailed(c, err, "Appointment")
+	}
+
 	var appointment PatientAppointment
 	if err := c.Bind(&appointment); err != nil {
 		return c.String(http.StatusBadRequest, "Invalid request payload")
 	}
 
-	_, err = db.Exec("UPDATE patient_appointments SET patient_id = ?, doctor_id = ?, appointment_date = ?, notes = ?, prescription = ?, status = ? WHERE id = ?",
-		appointment.PatientID, appointment.UserID, appointment.AppointmentDate,
-		appointment.Notes, appointment.Prescription, appointment.Status, id)
+	if err := saveAppointment(id, expected, appointment); err != nil {
+		return updateFailed(c, err, "Appointment")
+	}
+	publishAppointment("updated", id)
+
+	return getAppointment(c)
+}
+
+// Handler function to partially update an appointment with a merge patch or JSON Patch
+func patchAppointment(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
-		log.Println("Error updating appointment:", err)
-		return c.String(http.StatusInternalServerError, "Failed to update appointment")
+		return c.String(http.StatusBadRequest, "Invalid appointment ID")
 	}
 
-	appointment.ID = uint(id)
-	return c.JSON(http.StatusOK, appointment)
+	expected, err := ifMatch(c)
+	if err != nil {
+		return updateFailed(c, err, "Appointment")
+	}
+
+	appointment, err := findAppointment(id, false)
+	if err != nil {
+		return updateFailed(c, err, "Appointment")
+	}
+	if expected != 0 && expected != appointment.Version {
+		return updateFailed(c, errPreconditionFailed, "Appointment")
+	}
+
+	version := appointment.Version
+	if err := applyPatch(c, &appointment); err != nil {
+		return patchFailed(c, err)
+	}
+
+	if err := saveAppointment(id, version, appointment); err != nil {
+		return updateFailed(c, err, "Appointment")
+	}
+	publishAppointment("updated", id)
+
+	return getAppointment(c)
+}
+
+// findAppointment loads a single appointment by ID. Soft-deleted appointments
+// are only returned when withDeleted is set.
+func findAppointment(id int, withDeleted bool) (PatientAppointment, error) {
+	query := appointmentSelect + " WHERE a.id = ?"
+	if !withDeleted {
+		query += " AND a.deleted_at IS NULL"
+	}
+
+	return scanAppointment(db.QueryRow(query, id))
+}
+
+// validateAppointment checks the references of an appointment and, when it
+// is new or has been moved, that its time fits the doctor's schedule.
+func validateAppointment(appointment PatientAppointment, rescheduled bool) error {
+	err := checkReferences(
+		reference{"patient_id", "patients", int64(appointment.PatientID)},
+		reference{"doctor_id", "doctors", int64(appointment.DoctorID)},
+	)
+	if err != nil || !rescheduled {
+		return err
+	}
+	return checkSchedule(appointment.DoctorID, appointment.AppointmentDate)
+}
+
+// appointmentSelect is the query read by scanAppointment. Appointments are
+// aliased as a, so callers qualify the columns of their WHERE clauses.
+// Appointments whose doctor could not be reconciled by the doctor_id
+// migration read as doctor 0 with no doctor summary.
+const appointmentSelect = "SELECT a.id, a.patient_id, COALESCE(a.doctor_id, 0), a.appointment_date, a.notes, a.prescription, a.status," +
+	" a.created_at, a.updated_at, a.deleted_at, a.version, a.series_id, a.occurrence, q.number, p.name, d.specialization, u.name" +
+	" FROM patient_appointments a" +
+	" LEFT JOIN patients p ON p.id = a.patient_id" +
+	" LEFT JOIN doctors d ON d.id = a.doctor_id" +
+	" LEFT JOIN users u ON u.id = d.user_id" +
+	" LEFT JOIN queue_entries q ON q.appointment_id = a.id"
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanAppointment reads an appointment selected with appointmentSelect,
+// together with its patient and doctor summaries. The appointment time is
+// converted to the clinic's timezone for rendering.
+func scanAppointment(row rowScanner) (PatientAppointment, error) {
+	var appointment PatientAppointment
+	var patientName, specialization, doctorName sql.NullString
+	err := row.Scan(&appointment.ID, &appointment.PatientID, &appointment.DoctorID, &appointment.AppointmentDate,
+		&appointment.Notes, &appointment.Prescription, &appointment.Status, &appointment.CreatedAt, &appointment.UpdatedAt, &appointment.DeletedAt, &appointment.Version,
+		&appointment.SeriesID, &appointment.Occurrence, &appointment.QueueNumber, &patientName, &specialization, &doctorName)
+	if err != nil {
+		return appointment, err
+	}
+
+	appointment.AppointmentDate = appointment.AppointmentDate.In(clinicLocation)
+	if patientName.Valid {
+		appointment.Patient = &PatientSummary{ID: appointment.PatientID, Name: patientName.String}
+	}
+	if specialization.Valid {
+		appointment.Doctor = &DoctorSummary{ID: appointment.DoctorID, Name: doctorName.String, Specialization: specialization.String}
+	}
+	return appointment, nil
+}
+
+// saveAppointment writes the mutable columns of an appointment and bumps its
+// version. A non-zero version makes the write conditional on the stored version.
+// The status is not written here; see transitionAppointment.
+func saveAppointment(id int, version uint, appointment PatientAppointment) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := updateAppointmentTx(tx, id, version, appointment); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// updateAppointmentTx is saveAppointment within the caller's transaction.
+func updateAppointmentTx(tx *sql.Tx, id int, version uint, appointment PatientAppointment) error {
+	var current PatientAppointment
+	err := tx.QueryRow("SELECT patient_id, COALESCE(doctor_id, 0), appointment_date FROM patient_appointments WHERE id = ?", id).Scan(
+		&current.PatientID, &current.DoctorID, &current.AppointmentDate)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	moved := !current.AppointmentDate.Equal(appointment.AppointmentDate) ||
+		current.DoctorID != appointment.DoctorID || current.PatientID != appointment.PatientID
+	if err := validateAppointment(appointment, moved); err != nil {
+		return err
+	}
+
+	if moved {
+		if err := lockBooking(tx, appointment); err != nil {
+			return err
+		}
+		if err := findBookingConflict(tx, appointment, id); err != nil {
+			return err
+		}
+	}
+
+	result, err := tx.Exec("UPDATE patient_appointments SET patient_id = ?, doctor_id = ?, appointment_date = ?, notes = ?, prescription = ?, version = version + 1 WHERE id = ? AND deleted_at IS NULL AND (? = 0 OR version = ?)",
+		appointment.PatientID, appointment.DoctorID, appointment.AppointmentDate,
+		appointment.Notes, appointment.Prescription, id, version, version)
+	if err != nil {
+		return err
+	}
+	return checkVersionedUpdate(result, "patient_appointments", id)
+}
+
+// insertAppointment books a new appointment, refusing it with a
+// *bookingConflict when it overlaps another appointment of the same doctor
+// or patient.
+func insertAppointment(appointment PatientAppointment, actor Actor) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	id, err := bookAppointment(tx, appointment, actor)
+	if err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+// bookAppointment is insertAppointment within the caller's transaction.
+func bookAppointment(tx *sql.Tx, appointment PatientAppointment, actor Actor) (int64, error) {
+	if err := lockBooking(tx, appointment); err != nil {
+		return 0, err
+	}
+	if err := findBookingConflict(tx, appointment, 0); err != nil {
+		return 0, err
+	}
+
+	result, err := tx.Exec("INSERT INTO patient_appointments (patient_id, doctor_id, appointment_date, notes, prescription, status, series_id, occurrence) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		appointment.PatientID, appointment.DoctorID, appointment.AppointmentDate,
+		appointment.Notes, appointment.Prescription, appointment.Status, appointment.SeriesID, appointment.Occurrence)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec("INSERT INTO appointment_status_history (appointment_id, from_status, to_status, actor_user_id, actor_role) VALUES (?, '', ?, ?, ?)",
+		id, appointment.Status, actor.nullableID(), actor.Role)
+	return id, err
 }
 
 // Handler function to delete an appointment by ID
@@ -363,18 +841,25 @@ func deleteAppointment(c echo.Context) error {
 		return c.String(http.StatusBadRequest, "Invalid appointment ID")
 	}
 
-	_, err = db.Exec("DELETE FROM patient_appointments WHERE id = ?", id)
+	err = deleteRecord("patient_appointments", id)
 	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.String(http.StatusNotFound, "Appointment not found")
+		}
+		if status, message, ok := integrityError(err); ok {
+			return c.String(status, message)
+		}
 		log.Println("Error deleting appointment:", err)
 		return c.String(http.StatusInternalServerError, "Failed to delete appointment")
 	}
+	publishAppointment("deleted", id)
 
-	return c.String(http.StatusOK, fmt.Sprintf("Appointment with ID %d deleted", id))
+	return c.NoContent(http.StatusNoContent)
 }
 
 // Handler function to get all drugs
 func getDrugs(c echo.Context) error {
-	rows, err := db.Query("SELECT id, drug_name, drug_type, description, composition, packaging, dosage, contraindications, side_effects, price, currency, expiration_date, created_at, updated_at FROM drugs")
+	rows, err := db.Query("SELECT id, drug_name, drug_type, description, composition, packaging, dosage, contraindications, side_effects, " + currentPriceColumns + ", expiration_date, quantity_on_hand, reorder_threshold, created_at, updated_at, version FROM drugs")
 	if err != nil {
 		log.Println("Error querying drugs:", err)
 		return c.String(http.StatusInternalServerError, "Failed to get drugs")
@@ -384,11 +869,12 @@ func getDrugs(c echo.Context) error {
 	drugs := make([]Drug, 0)
 	for rows.Next() {
 		var drug Drug
-		err := rows.Scan(&drug.ID, &drug.DrugName, &drug.DrugType, &drug.Description, &drug.Composition, &drug.Packaging, &drug.Dosage, &drug.Contraindications, &drug.SideEffects, &drug.Price, &drug.Currency, &drug.ExpirationDate, &drug.CreatedAt, &drug.UpdatedAt)
+		err := rows.Scan(&drug.ID, &drug.DrugName, &drug.DrugType, &drug.Description, &drug.Composition, &drug.Packaging, &drug.Dosage, &drug.Contraindications, &drug.SideEffects, &drug.Price, &drug.Currency, &drug.ExpirationDate, &drug.QuantityOnHand, &drug.ReorderThreshold, &drug.CreatedAt, &drug.UpdatedAt, &drug.Version)
 		if err != nil {
 			log.Println("Error scanning drug row:", err)
 			continue
 		}
+		drug.Price = roundMoney(drug.Price, drug.Currency)
 		drugs = append(drugs, drug)
 	}
 
@@ -402,9 +888,7 @@ func getDrug(c echo.Context) error {
 		return c.String(http.StatusBadRequest, "Invalid drug ID")
 	}
 
-	var drug Drug
-	err = db.QueryRow("SELECT id, drug_name, drug_type, description, composition, packaging, dosage, contraindications, side_effects, price, currency, expiration_date, created_at, updated_at FROM drugs WHERE id = ?", id).Scan(
-		&drug.ID, &drug.DrugName, &drug.DrugType, &drug.Description, &drug.Composition, &drug.Packaging, &drug.Dosage, &drug.Contraindications, &drug.SideEffects, &drug.Price, &drug.Currency, &drug.ExpirationDate, &drug.CreatedAt, &drug.UpdatedAt)
+	drug, err := findDrug(id)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return c.String(http.StatusNotFound, "Drug not found")
@@ -413,6 +897,7 @@ func getDrug(c echo.Context) error {
 		return c.String(http.StatusInternalServerError, "Failed to get drug")
 	}
 
+	setETag(c, drug.Version)
 	return c.JSON(http.StatusOK, drug)
 }
 
@@ -423,23 +908,47 @@ func createDrug(c echo.Context) error {
 		return c.String(http.StatusBadRequest, "Invalid request payload")
 	}
 
-	result, err := db.Exec("INSERT INTO drugs (drug_name, drug_type, description, composition, packaging, dosage, contraindications, side_effects, price, currency, expiration_date) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
-		drug.DrugName, drug.DrugType, drug.Description, drug.Composition, drug.Packaging, drug.Dosage, drug.Contraindications, drug.SideEffects, drug.Price, drug.Currency, drug.ExpirationDate)
+	id, err := insertDrug(drug, currentActor(c))
 	if err != nil {
 		log.Println("Error inserting drug:", err)
 		return c.String(http.StatusInternalServerError, "Failed to insert drug")
 	}
 
-	id, err := result.LastInsertId()
+	// Re-read the row so the response carries the server-set columns
+	drug, err = findDrug(int(id))
 	if err != nil {
-		log.Println("Error getting last insert ID:", err)
-		return c.String(http.StatusInternalServerError, "Failed to get last insert ID")
+		log.Println("Error reading back drug:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get drug")
 	}
 
-	drug.ID = uint(id)
+	setETag(c, drug.Version)
 	return c.JSON(http.StatusCreated, drug)
 }
 
+// insertDrug inserts a drug and starts its price list with its price.
+func insertDrug(drug Drug, actor Actor) (int64, error) {
+	drug.Price = roundMoney(drug.Price, drug.Currency)
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("INSERT INTO drugs (drug_name, drug_type, description, composition, packaging, dosage, contraindications, side_effects, price, currency, expiration_date, reorder_threshold) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		drug.DrugName, drug.DrugType, drug.Description, drug.Composition, drug.Packaging, drug.Dosage, drug.Contraindications, drug.SideEffects, drug.Price, drug.Currency, drug.ExpirationDate, drug.ReorderThreshold)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	if err := recordPriceChange(tx, uint(id), drug.Price, drug.Currency, actor); err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
 // Handler function to update an existing drug
 func updateDrug(c echo.Context) error {
 	id, err := strconv.Atoi(c.Param("id"))
@@ -447,20 +956,87 @@ func updateDrug(c echo.Context) error {
 		return c.String(http.StatusBadRequest, "Invalid drug ID")
 	}
 
+	expected, err := ifMatch(c)
+	if err != nil {
+		return updateFailed(c, err, "Drug")
+	}
+
 	var drug Drug
 	if err := c.Bind(&drug); err != nil {
 		return c.String(http.StatusBadRequest, "Invalid request payload")
 	}
 
-	_, err = db.Exec("UPDATE drugs SET drug_name = ?, drug_type = ?, description = ?, composition = ?, packaging = ?, dosage = ?, contraindications = ?, side_effects = ?, price = ?, currency = ?, expiration_date = ? WHERE id = ?",
-		drug.DrugName, drug.DrugType, drug.Description, drug.Composition, drug.Packaging, drug.Dosage, drug.Contraindications, drug.SideEffects, drug.Price, drug.Currency, drug.ExpirationDate, id)
+	if err := saveDrug(id, expected, drug, currentActor(c)); err != nil {
+		return updateFailed(c, err, "Drug")
+	}
+
+	return getDrug(c)
+}
+
+// Handler function to partially update a drug with a merge patch or JSON Patch
+func patchDrug(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
-		log.Println("Error updating drug:", err)
-		return c.String(http.StatusInternalServerError, "Failed to update drug")
+		return c.String(http.StatusBadRequest, "Invalid drug ID")
 	}
 
-	drug.ID = uint(id)
-	return c.JSON(http.StatusOK, drug)
+	expected, err := ifMatch(c)
+	if err != nil {
+		return updateFailed(c, err, "Drug")
+	}
+
+	drug, err := findDrug(id)
+	if err != nil {
+		return updateFailed(c, err, "Drug")
+	}
+	if expected != 0 && expected != drug.Version {
+		return updateFailed(c, errPreconditionFailed, "Drug")
+	}
+
+	version := drug.Version
+	if err := applyPatch(c, &drug); err != nil {
+		return patchFailed(c, err)
+	}
+
+	if err := saveDrug(id, version, drug, currentActor(c)); err != nil {
+		return updateFailed(c, err, "Drug")
+	}
+
+	return getDrug(c)
+}
+
+// findDrug loads a single drug by ID
+func findDrug(id int) (Drug, error) {
+	var drug Drug
+	err := db.QueryRow("SELECT id, drug_name, drug_type, description, composition, packaging, dosage, contraindications, side_effects, "+currentPriceColumns+", expiration_date, quantity_on_hand, reorder_threshold, created_at, updated_at, version FROM drugs WHERE id = ?", id).Scan(
+		&drug.ID, &drug.DrugName, &drug.DrugType, &drug.Description, &drug.Composition, &drug.Packaging, &drug.Dosage, &drug.Contraindications, &drug.SideEffects, &drug.Price, &drug.Currency, &drug.ExpirationDate, &drug.QuantityOnHand, &drug.ReorderThreshold, &drug.CreatedAt, &drug.UpdatedAt, &drug.Version)
+	drug.Price = roundMoney(drug.Price, drug.Currency)
+	return drug, err
+}
+
+// saveDrug writes the mutable columns of a drug and bumps its version. A
+// non-zero version makes the write conditional on the stored version. A
+// changed price is added to the drug's price list effective now.
+func saveDrug(id int, version uint, drug Drug, actor Actor) error {
+	drug.Price = roundMoney(drug.Price, drug.Currency)
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE drugs SET drug_name = ?, drug_type = ?, description = ?, composition = ?, packaging = ?, dosage = ?, contraindications = ?, side_effects = ?, price = ?, currency = ?, expiration_date = ?, reorder_threshold = ?, version = version + 1 WHERE id = ? AND (? = 0 OR version = ?)",
+		drug.DrugName, drug.DrugType, drug.Description, drug.Composition, drug.Packaging, drug.Dosage, drug.Contraindications, drug.SideEffects, drug.Price, drug.Currency, drug.ExpirationDate, drug.ReorderThreshold, id, version, version)
+	if err != nil {
+		return err
+	}
+	if err := checkVersionedUpdate(result, "drugs", id); err != nil {
+		return err
+	}
+	if err := recordPriceChange(tx, uint(id), drug.Price, drug.Currency, actor); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 // Handler function to delete a drug by ID
@@ -470,13 +1046,19 @@ func deleteDrug(c echo.Context) error {
 		return c.String(http.StatusBadRequest, "Invalid drug ID")
 	}
 
-	_, err = db.Exec("DELETE FROM drugs WHERE id = ?", id)
+	err = deleteRecord("drugs", id)
 	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.String(http.StatusNotFound, "Drug not found")
+		}
+		if status, message, ok := integrityError(err); ok {
+			return c.String(status, message)
+		}
 		log.Println("Error deleting drug:", err)
 		return c.String(http.StatusInternalServerError, "Failed to delete drug")
 	}
 
-	return c.String(http.StatusOK, fmt.Sprintf("Drug with ID %d deleted", id))
+	return c.NoContent(http.StatusNoContent)
 }
 
 // Handler function to login
@@ -491,7 +1073,7 @@ func login(c echo.Context) error {
 	}
 
 	var patient Patient
-	err := db.QueryRow("SELECT id, nik, name, gender, date_of_birth, address, password, created_at, updated_at FROM patients WHERE nik = ?", credentials.Nik).Scan(
+	err := db.QueryRow("SELECT id, nik, name, gender, date_of_birth, address, password, created_at, updated_at FROM patients WHERE nik = ? AND deleted_at IS NULL", credentials.Nik).Scan(
 		&patient.ID, &patient.Nik, &patient.Name, &patient.Gender, &patient.DateOfBirth,
 		&patient.Address, &patient.Password, &patient.CreatedAt, &patient.UpdatedAt)
 	if err != nil {
@@ -512,7 +1094,17 @@ func login(c echo.Context) error {
 
 // Handler function to get all patients
 func getPatients(c echo.Context) error {
-	rows, err := db.Query("SELECT id, nik, name, gender, date_of_birth, address, password, created_at, updated_at FROM patients")
+	withDeleted, err := includeDeleted(c)
+	if err != nil {
+		return c.String(http.StatusForbidden, "Only admins can list deleted patients")
+	}
+
+	query := "SELECT id, nik, name, gender, date_of_birth, address, password, price_tier, created_at, updated_at, deleted_at, version FROM patients"
+	if !withDeleted {
+		query += " WHERE deleted_at IS NULL"
+	}
+
+	rows, err := db.Query(query)
 	if err != nil {
 		log.Println("Error querying patients:", err)
 		return c.String(http.StatusInternalServerError, "Failed to get patients")
@@ -523,7 +1115,7 @@ func getPatients(c echo.Context) error {
 	for rows.Next() {
 		var patient Patient
 		err := rows.Scan(&patient.ID, &patient.Nik, &patient.Name, &patient.Gender, &patient.DateOfBirth,
-			&patient.Address, &patient.Password, &patient.CreatedAt, &patient.UpdatedAt)
+			&patient.Address, &patient.Password, &patient.PriceTier, &patient.CreatedAt, &patient.UpdatedAt, &patient.DeletedAt, &patient.Version)
 		if err != nil {
 			log.Println("Error scanning patient row:", err)
 			continue
@@ -541,10 +1133,12 @@ func getPatient(c echo.Context) error {
 		return c.String(http.StatusBadRequest, "Invalid patient ID")
 	}
 
-	var patient Patient
-	err = db.QueryRow("SELECT id, nik, name, gender, date_of_birth, address, password, created_at, updated_at FROM patients WHERE id = ?", id).Scan(
-		&patient.ID, &patient.Nik, &patient.Name, &patient.Gender, &patient.DateOfBirth,
-		&patient.Address, &patient.Password, &patient.CreatedAt, &patient.UpdatedAt)
+	withDeleted, err := includeDeleted(c)
+	if err != nil {
+		return c.String(http.StatusForbidden, "Only admins can view deleted patients")
+	}
+
+	patient, err := findPatient(id, withDeleted)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return c.String(http.StatusNotFound, "Patient not found")
@@ -553,6 +1147,7 @@ func getPatient(c echo.Context) error {
 		return c.String(http.StatusInternalServerError, "Failed to get patient")
 	}
 
+	setETag(c, patient.Version)
 	return c.JSON(http.StatusOK, patient)
 }
 
@@ -563,8 +1158,12 @@ func createPatient(c echo.Context) error {
 		return c.String(http.StatusBadRequest, "Invalid request payload")
 	}
 
-	result, err := db.Exec("INSERT INTO patients (nik, name, gender, date_of_birth, address, password) VALUES (?, ?, ?, ?, ?, ?)",
-		patient.Nik, patient.Name, patient.Gender, patient.DateOfBirth, patient.Address, patient.Password)
+	if err := validatePriceTier(&patient.PriceTier); err != nil {
+		return c.String(http.StatusUnprocessableEntity, err.Error())
+	}
+
+	result, err := db.Exec("INSERT INTO patients (nik, name, gender, date_of_birth, address, password, price_tier) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		patient.Nik, patient.Name, patient.Gender, patient.DateOfBirth, patient.Address, patient.Password, patient.PriceTier)
 	if err != nil {
 		log.Println("Error inserting patient:", err)
 		return c.String(http.StatusInternalServerError, "Failed to insert patient")
@@ -576,7 +1175,14 @@ func createPatient(c echo.Context) error {
 		return c.String(http.StatusInternalServerError, "Failed to get last insert ID")
 	}
 
-	patient.ID = uint(id)
+	// Re-read the row so the response carries the server-set columns
+	patient, err = findPatient(int(id), false)
+	if err != nil {
+		log.Println("Error reading back patient:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get patient")
+	}
+
+	setETag(c, patient.Version)
 	return c.JSON(http.StatusCreated, patient)
 }
 
@@ -587,20 +1193,82 @@ func updatePatient(c echo.Context) error {
 		return c.String(http.StatusBadRequest, "Invalid patient ID")
 	}
 
+	expected, err := ifMatch(c)
+	if err != nil {
+		return updateFailed(c, err, "Patient")
+	}
+
 	var patient Patient
 	if err := c.Bind(&patient); err != nil {
 		return c.String(http.StatusBadRequest, "Invalid request payload")
 	}
 
-	_, err = db.Exec("UPDATE patients SET nik = ?, name = ?, gender = ?, date_of_birth = ?, address = ?, password = ? WHERE id = ?",
-		patient.Nik, patient.Name, patient.Gender, patient.DateOfBirth, patient.Address, patient.Password, id)
+	if err := savePatient(id, expected, patient); err != nil {
+		return updateFailed(c, err, "Patient")
+	}
+
+	return getPatient(c)
+}
+
+// Handler function to partially update a patient with a merge patch or JSON Patch
+func patchPatient(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
-		log.Println("Error updating patient:", err)
-		return c.String(http.StatusInternalServerError, "Failed to update patient")
+		return c.String(http.StatusBadRequest, "Invalid patient ID")
 	}
 
-	patient.ID = uint(id)
-	return c.JSON(http.StatusOK, patient)
+	expected, err := ifMatch(c)
+	if err != nil {
+		return updateFailed(c, err, "Patient")
+	}
+
+	patient, err := findPatient(id, false)
+	if err != nil {
+		return updateFailed(c, err, "Patient")
+	}
+	if expected != 0 && expected != patient.Version {
+		return updateFailed(c, errPreconditionFailed, "Patient")
+	}
+
+	version := patient.Version
+	if err := applyPatch(c, &patient); err != nil {
+		return patchFailed(c, err)
+	}
+
+	if err := savePatient(id, version, patient); err != nil {
+		return updateFailed(c, err, "Patient")
+	}
+
+	return getPatient(c)
+}
+
+// findPatient loads a single patient by ID. Soft-deleted patients are only
+// returned when withDeleted is set.
+func findPatient(id int, withDeleted bool) (Patient, error) {
+	query := "SELECT id, nik, name, gender, date_of_birth, address, password, price_tier, created_at, updated_at, deleted_at, version FROM patients WHERE id = ?"
+	if !withDeleted {
+		query += " AND deleted_at IS NULL"
+	}
+
+	var patient Patient
+	err := db.QueryRow(query, id).Scan(
+		&patient.ID, &patient.Nik, &patient.Name, &patient.Gender, &patient.DateOfBirth,
+		&patient.Address, &patient.Password, &patient.PriceTier, &patient.CreatedAt, &patient.UpdatedAt, &patient.DeletedAt, &patient.Version)
+	return patient, err
+}
+
+// savePatient writes the mutable columns of a patient and bumps its version.
+// A non-zero version makes the write conditional on the stored version.
+func savePatient(id int, version uint, patient Patient) error {
+	if err := validatePriceTier(&patient.PriceTier); err != nil {
+		return err
+	}
+	result, err := db.Exec("UPDATE patients SET nik = ?, name = ?, gender = ?, date_of_birth = ?, address = ?, password = ?, price_tier = ?, version = version + 1 WHERE id = ? AND deleted_at IS NULL AND (? = 0 OR version = ?)",
+		patient.Nik, patient.Name, patient.Gender, patient.DateOfBirth, patient.Address, patient.Password, patient.PriceTier, id, version, version)
+	if err != nil {
+		return err
+	}
+	return checkVersionedUpdate(result, "patients", id)
 }
 
 // Handler function to delete a patient by ID
@@ -610,18 +1278,24 @@ func deletePatient(c echo.Context) error {
 		return c.String(http.StatusBadRequest, "Invalid patient ID")
 	}
 
-	_, err = db.Exec("DELETE FROM patients WHERE id = ?", id)
+	err = deleteRecord("patients", id)
 	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.String(http.StatusNotFound, "Patient not found")
+		}
+		if status, message, ok := integrityError(err); ok {
+			return c.String(status, message)
+		}
 		log.Println("Error deleting patient:", err)
 		return c.String(http.StatusInternalServerError, "Failed to delete patient")
 	}
 
-	return c.String(http.StatusOK, fmt.Sprintf("Patient with ID %d deleted", id))
+	return c.NoContent(http.StatusNoContent)
 }
 
 // Handler function to get all doctors
 func getDoctors(c echo.Context) error {
-	rows, err := db.Query("SELECT id, user_id, specialization, created_at, updated_at, profile_photo_path FROM doctors")
+	rows, err := db.Query("SELECT id, user_id, specialization, created_at, updated_at, profile_photo_path, version FROM doctors")
 	if err != nil {
 		log.Println("Error querying doctors:", err)
 		return c.String(http.StatusInternalServerError, "Failed to get doctors")
@@ -631,7 +1305,7 @@ func getDoctors(c echo.Context) error {
 	doctors := make([]Doctor, 0)
 	for rows.Next() {
 		var doctor Doctor
-		err := rows.Scan(&doctor.ID, &doctor.UserID, &doctor.Specialization, &doctor.CreatedAt, &doctor.UpdatedAt, &doctor.ProfilePhotoPath)
+		err := rows.Scan(&doctor.ID, &doctor.UserID, &doctor.Specialization, &doctor.CreatedAt, &doctor.UpdatedAt, &doctor.ProfilePhotoPath, &doctor.Version)
 		if err != nil {
 			log.Println("Error scanning doctor row:", err)
 			continue
@@ -652,9 +1326,7 @@ func getDoctor(c echo.Context) error {
 		return c.String(http.StatusBadRequest, "Invalid doctor ID")
 	}
 
-	var doctor Doctor
-	err = db.QueryRow("SELECT id, user_id, specialization, created_at, updated_at, profile_photo_path FROM doctors WHERE id = ?", id).
-		Scan(&doctor.ID, &doctor.UserID, &doctor.Specialization, &doctor.CreatedAt, &doctor.UpdatedAt, &doctor.ProfilePhotoPath)
+	doctor, err := findDoctor(id)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return c.String(http.StatusNotFound, "Doctor not found")
@@ -663,6 +1335,7 @@ func getDoctor(c echo.Context) error {
 		return c.String(http.StatusInternalServerError, "Failed to get doctor")
 	}
 
+	setETag(c, doctor.Version)
 	return c.JSON(http.StatusOK, doctor)
 }
 
@@ -673,9 +1346,20 @@ func createDoctor(c echo.Context) error {
 		return c.String(http.StatusBadRequest, "Invalid request payload")
 	}
 
+	if err := checkReferences(reference{"user_id", "users", int64(doctor.UserID)}); err != nil {
+		if status, message, ok := integrityError(err); ok {
+			return c.String(status, message)
+		}
+		log.Println("Error checking doctor references:", err)
+		return c.String(http.StatusInternalServerError, "Failed to insert doctor")
+	}
+
 	result, err := db.Exec("INSERT INTO doctors (user_id, specialization, created_at, updated_at, profile_photo_path) VALUES (?, ?, ?, ?, ?)",
 		doctor.UserID, doctor.Specialization, time.Now(), time.Now(), doctor.ProfilePhotoPath)
 	if err != nil {
+		if status, message, ok := integrityError(err); ok {
+			return c.String(status, message)
+		}
 		log.Println("Error inserting doctor:", err)
 		return c.String(http.StatusInternalServerError, "Failed to insert doctor")
 	}
@@ -686,7 +1370,14 @@ func createDoctor(c echo.Context) error {
 		return c.String(http.StatusInternalServerError, "Failed to get last insert ID")
 	}
 
-	doctor.ID = int(id)
+	// Re-read the row so the response carries the server-set columns
+	doctor, err = findDoctor(int(id))
+	if err != nil {
+		log.Println("Error reading back doctor:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get doctor")
+	}
+
+	setETag(c, doctor.Version)
 	return c.JSON(http.StatusCreated, doctor)
 }
 
@@ -697,20 +1388,76 @@ func updateDoctor(c echo.Context) error {
 		return c.String(http.StatusBadRequest, "Invalid doctor ID")
 	}
 
+	expected, err := ifMatch(c)
+	if err != nil {
+		return updateFailed(c, err, "Doctor")
+	}
+
 	var doctor Doctor
 	if err := c.Bind(&doctor); err != nil {
 		return c.String(http.StatusBadRequest, "Invalid request payload")
 	}
 
-	_, err = db.Exec("UPDATE doctors SET user_id = ?, specialization = ?, profile_photo_path = ?, updated_at = ? WHERE id = ?",
-		doctor.UserID, doctor.Specialization, doctor.ProfilePhotoPath, time.Now(), id)
+	if err := saveDoctor(id, expected, doctor); err != nil {
+		return updateFailed(c, err, "Doctor")
+	}
+
+	return getDoctor(c)
+}
+
+// Handler function to partially update a doctor with a merge patch or JSON Patch
+func patchDoctor(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
-		log.Println("Error updating doctor:", err)
-		return c.String(http.StatusInternalServerError, "Failed to update doctor")
+		return c.String(http.StatusBadRequest, "Invalid doctor ID")
 	}
 
-	doctor.ID = id
-	return c.JSON(http.StatusOK, doctor)
+	expected, err := ifMatch(c)
+	if err != nil {
+		return updateFailed(c, err, "Doctor")
+	}
+
+	doctor, err := findDoctor(id)
+	if err != nil {
+		return updateFailed(c, err, "Doctor")
+	}
+	if expected != 0 && expected != doctor.Version {
+		return updateFailed(c, errPreconditionFailed, "Doctor")
+	}
+
+	version := doctor.Version
+	if err := applyPatch(c, &doctor); err != nil {
+		return patchFailed(c, err)
+	}
+
+	if err := saveDoctor(id, version, doctor); err != nil {
+		return updateFailed(c, err, "Doctor")
+	}
+
+	return getDoctor(c)
+}
+
+// findDoctor loads a single doctor by ID
+func findDoctor(id int) (Doctor, error) {
+	var doctor Doctor
+	err := db.QueryRow("SELECT id, user_id, specialization, created_at, updated_at, profile_photo_path, version FROM doctors WHERE id = ?", id).
+		Scan(&doctor.ID, &doctor.UserID, &doctor.Specialization, &doctor.CreatedAt, &doctor.UpdatedAt, &doctor.ProfilePhotoPath, &doctor.Version)
+	return doctor, err
+}
+
+// saveDoctor writes the mutable columns of a doctor and bumps its version. A
+// non-zero version makes the write conditional on the stored version.
+func saveDoctor(id int, version uint, doctor Doctor) error {
+	if err := checkReferences(reference{"user_id", "users", int64(doctor.UserID)}); err != nil {
+		return err
+	}
+
+	result, err := db.Exec("UPDATE doctors SET user_id = ?, specialization = ?, profile_photo_path = ?, updated_at = ?, version = version + 1 WHERE id = ? AND (? = 0 OR version = ?)",
+		doctor.UserID, doctor.Specialization, doctor.ProfilePhotoPath, time.Now(), id, version, version)
+	if err != nil {
+		return err
+	}
+	return checkVersionedUpdate(result, "doctors", id)
 }
 
 // Handler function to delete a doctor by ID
@@ -720,17 +1467,33 @@ func deleteDoctor(c echo.Context) error {
 		return c.String(http.StatusBadRequest, "Invalid doctor ID")
 	}
 
-	_, err = db.Exec("DELETE FROM doctors WHERE id = ?", id)
+	err = deleteRecord("doctors", id)
 	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.String(http.StatusNotFound, "Doctor not found")
+		}
+		if status, message, ok := integrityError(err); ok {
+			return c.String(status, message)
+		}
 		log.Println("Error deleting doctor:", err)
 		return c.String(http.StatusInternalServerError, "Failed to delete doctor")
 	}
 
-	return c.String(http.StatusOK, fmt.Sprintf("Doctor with ID %d deleted", id))
+	return c.NoContent(http.StatusNoContent)
 }
 
 func getAllTransactions(c echo.Context) error {
-	rows, err := db.Query("SELECT id, patient_id, drug_id, quantity, total_price, currency, prescription, created_at, updated_at FROM transactions")
+	withDeleted, err := includeDeleted(c)
+	if err != nil {
+		return c.String(http.StatusForbidden, "Only admins can list deleted transactions")
+	}
+
+	query := "SELECT " + transactionColumns + " FROM transactions"
+	if !withDeleted {
+		query += " WHERE deleted_at IS NULL"
+	}
+
+	rows, err := db.Query(query)
 	if err != nil {
 		return c.String(http.StatusInternalServerError, "Failed to get transactions")
 	}
@@ -738,8 +1501,7 @@ func getAllTransactions(c echo.Context) error {
 
 	transactions := make([]Transaction, 0)
 	for rows.Next() {
-		var t Transaction
-		err := rows.Scan(&t.ID, &t.PatientID, &t.DrugID, &t.Quantity, &t.TotalPrice, &t.Currency, &t.Prescription, &t.CreatedAt, &t.UpdatedAt)
+		t, err := scanTransaction(rows)
 		if err != nil {
 			return c.String(http.StatusInternalServerError, "Failed to scan transactions")
 		}
@@ -755,9 +1517,12 @@ func getTransactionByID(c echo.Context) error {
 		return c.String(http.StatusBadRequest, "Invalid transaction ID")
 	}
 
-	var t Transaction
-	err = db.QueryRow("SELECT id, patient_id, drug_id, quantity, total_price, currency, prescription, created_at, updated_at FROM transactions WHERE id = ?", id).Scan(
-		&t.ID, &t.PatientID, &t.DrugID, &t.Quantity, &t.TotalPrice, &t.Currency, &t.Prescription, &t.CreatedAt, &t.UpdatedAt)
+	withDeleted, err := includeDeleted(c)
+	if err != nil {
+		return c.String(http.StatusForbidden, "Only admins can view deleted transactions")
+	}
+
+	t, err := findTransaction(id, withDeleted)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return c.String(http.StatusNotFound, "Transaction not found")
@@ -765,6 +1530,7 @@ func getTransactionByID(c echo.Context) error {
 		return c.String(http.StatusInternalServerError, "Failed to get transaction")
 	}
 
+	setETag(c, t.Version)
 	return c.JSON(http.StatusOK, t)
 }
 
@@ -774,52 +1540,294 @@ func createTransaction(c echo.Context) error {
 		return c.String(http.StatusBadRequest, "Invalid request payload")
 	}
 
-	result, err := db.Exec("INSERT INTO transactions (patient_id, drug_id, quantity, total_price, currency, prescription) VALUES (?, ?, ?, ?, ?, ?)",
-		t.PatientID, t.DrugID, t.Quantity, t.TotalPrice, t.Currency, t.Prescription)
+	if err := validateQuantity(t.Quantity); err != nil {
+		return c.String(http.StatusUnprocessableEntity, err.Error())
+	}
+	t.PrescriptionItemID = nil // prescriptions are dispensed through /prescriptions/:id/dispense
+
+	err := checkReferences(
+		reference{"patient_id", "patients", int64(t.PatientID)},
+		reference{"drug_id", "drugs", int64(t.DrugID)},
+	)
 	if err != nil {
+		if status, message, ok := integrityError(err); ok {
+			return c.String(status, message)
+		}
 		return c.String(http.StatusInternalServerError, "Failed to insert transaction")
 	}
 
-	id, err := result.LastInsertId()
+	warnings, err := checkPrescribing(t.PatientID, t.DrugID, 0, t.OverrideReason)
 	if err != nil {
-		return c.String(http.StatusInternalServerError, "Failed to get last insert ID")
+		var blocked *interactionBlockedError
+		if errors.As(err, &blocked) {
+			return interactionBlockedResponse(c, blocked)
+		}
+		log.Println("Error checking interactions:", err)
+		return c.String(http.StatusInternalServerError, "Failed to insert transaction")
+	}
+
+	id, err := insertTransaction(t, warnings, currentActor(c))
+	if err != nil {
+		var insufficient *insufficientStockError
+		var refused *pricingError
+		if errors.As(err, &insufficient) {
+			return c.String(http.StatusConflict, insufficient.Error())
+		}
+		if errors.As(err, &refused) {
+			return c.String(refused.Status, refused.Message)
+		}
+		if status, message, ok := integrityError(err); ok {
+			return c.String(status, message)
+		}
+		log.Println("Error inserting transaction:", err)
+		return c.String(http.StatusInternalServerError, "Failed to insert transaction")
+	}
+
+	t, err = findTransaction(int(id), false)
+	if err != nil {
+		return c.String(http.StatusInternalServerError, "Failed to get transaction")
 	}
-	t.ID = uint(id)
+	t.Warnings = warnings
 
+	publishTransaction("created", int(id))
+
+	setETag(c, t.Version)
 	return c.JSON(http.StatusCreated, t)
 }
 
+// insertTransaction inserts a transaction and dispenses its quantity from
+// stock in one database transaction, recording any override of warnings.
+func insertTransaction(t Transaction, warnings []InteractionWarning, actor Actor) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	id, err := insertTransactionTx(tx, t, warnings, actor)
+	if err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+// insertTransactionTx is insertTransaction within a caller's transaction.
+// The transaction is priced from the drug's price list; a non-zero
+// total_price is checked against the calculation.
+func insertTransactionTx(tx *sql.Tx, t Transaction, warnings []InteractionWarning, actor Actor) (int64, error) {
+	if err := priceTransaction(tx, &t, time.Now(), pricing.TaxRate, !t.TotalPrice.IsZero(), actor); err != nil {
+		return 0, err
+	}
+
+	result, err := tx.Exec("INSERT INTO transactions (patient_id, drug_id, quantity, total_price, currency, prescription, prescription_item_id,"+
+		" drug_price_id, unit_price, discount_percent, discount_amount, tax_rate, tax_amount, price_override_reason, price_overridden_by,"+
+		" base_currency, exchange_rate, exchange_rate_id, base_total_price) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		t.PatientID, t.DrugID, t.Quantity, t.TotalPrice, t.Currency, t.Prescription, t.PrescriptionItemID,
+		t.DrugPriceID, t.UnitPrice, t.DiscountPercent, t.DiscountAmount, t.TaxRate, t.TaxAmount, t.PriceOverrideReason, t.PriceOverriddenBy,
+		t.BaseCurrency, t.ExchangeRate, t.ExchangeRateID, t.BaseTotalPrice)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	if err := dispenseStock(tx, uint(id), t.DrugID, t.Quantity, actor); err != nil {
+		return 0, err
+	}
+	if err := recordOverride(tx, overrideTransaction, uint(id), t.PatientID, t.DrugID, t.OverrideReason, warnings, actor); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
 func updateTransaction(c echo.Context) error {
 	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
 		return c.String(http.StatusBadRequest, "Invalid transaction ID")
 	}
 
+	expected, err := ifMatch(c)
+	if err != nil {
+		return updateFailed(c, err, "Transaction")
+	}
+
 	var t Transaction
 	if err := c.Bind(&t); err != nil {
 		return c.String(http.StatusBadRequest, "Invalid request payload")
 	}
 
-	_, err = db.Exec("UPDATE transactions SET patient_id = ?, drug_id = ?, quantity = ?, total_price = ?, currency = ?, prescription = ? WHERE id = ?",
-		t.PatientID, t.DrugID, t.Quantity, t.TotalPrice, t.Currency, t.Prescription, id)
+	if err := saveTransaction(id, expected, t, currentActor(c)); err != nil {
+		return updateFailed(c, err, "Transaction")
+	}
+	publishTransaction("updated", id)
+
+	return getTransactionByID(c)
+}
+
+func patchTransaction(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
-		return c.String(http.StatusInternalServerError, "Failed to update transaction")
+		return c.String(http.StatusBadRequest, "Invalid transaction ID")
 	}
 
-	t.ID = uint(id)
-	return c.JSON(http.StatusOK, t)
+	expected, err := ifMatch(c)
+	if err != nil {
+		return updateFailed(c, err, "Transaction")
+	}
+
+	t, err := findTransaction(id, false)
+	if err != nil {
+		return updateFailed(c, err, "Transaction")
+	}
+	if expected != 0 && expected != t.Version {
+		return updateFailed(c, errPreconditionFailed, "Transaction")
+	}
+
+	version := t.Version
+	if err := applyPatch(c, &t); err != nil {
+		return patchFailed(c, err)
+	}
+
+	if err := saveTransaction(id, version, t, currentActor(c)); err != nil {
+		return updateFailed(c, err, "Transaction")
+	}
+	publishTransaction("updated", id)
+
+	return getTransactionByID(c)
+}
+
+func findTransaction(id int, withDeleted bool) (Transaction, error) {
+	query := "SELECT " + transactionColumns + " FROM transactions WHERE id = ?"
+	if !withDeleted {
+		query += " AND deleted_at IS NULL"
+	}
+
+	return scanTransaction(db.QueryRow(query, id))
+}
+
+const transactionColumns = "id, patient_id, drug_id, quantity, total_price, currency, prescription, created_at, updated_at, deleted_at, version, prescription_item_id," +
+	" drug_price_id, unit_price, discount_percent, discount_amount, tax_rate, tax_amount, price_override_reason, price_overridden_by," +
+	" base_currency, exchange_rate, exchange_rate_id, base_total_price"
+
+func scanTransaction(row rowScanner) (Transaction, error) {
+	var t Transaction
+	err := row.Scan(&t.ID, &t.PatientID, &t.DrugID, &t.Quantity, &t.TotalPrice, &t.Currency, &t.Prescription, &t.CreatedAt, &t.UpdatedAt, &t.DeletedAt, &t.Version, &t.PrescriptionItemID,
+		&t.DrugPriceID, &t.UnitPrice, &t.DiscountPercent, &t.DiscountAmount, &t.TaxRate, &t.TaxAmount, &t.PriceOverrideReason, &t.PriceOverriddenBy,
+		&t.BaseCurrency, &t.ExchangeRate, &t.ExchangeRateID, &t.BaseTotalPrice)
+	for _, amount := range []*Decimal{&t.TotalPrice, &t.UnitPrice, &t.DiscountAmount, &t.TaxAmount} {
+		*amount = roundMoney(*amount, t.Currency)
+	}
+	if t.BaseCurrency != "" {
+		t.BaseTotalPrice = roundMoney(t.BaseTotalPrice, t.BaseCurrency)
+	}
+	return t, err
+}
+
+func saveTransaction(id int, version uint, t Transaction, actor Actor) error {
+	if err := validateQuantity(t.Quantity); err != nil {
+		return err
+	}
+	err := checkReferences(
+		reference{"patient_id", "patients", int64(t.PatientID)},
+		reference{"drug_id", "drugs", int64(t.DrugID)},
+	)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var oldPatientID, oldDrugID uint
+	var oldQuantity, oldTotal, taxRate Decimal
+	var prescriptionItemID *uint
+	var createdAt time.Time
+	err = tx.QueryRow("SELECT patient_id, drug_id, quantity, prescription_item_id, created_at, total_price, tax_rate FROM transactions WHERE id = ? AND deleted_at IS NULL FOR UPDATE", id).
+		Scan(&oldPatientID, &oldDrugID, &oldQuantity, &prescriptionItemID, &createdAt, &oldTotal, &taxRate)
+	if err != nil {
+		return err
+	}
+
+	// Giving the drug to another patient, or another drug to the patient, is
+	// prescribing anew and needs the same checks and overrides as on create.
+	var warnings []InteractionWarning
+	if t.PatientID != oldPatientID || t.DrugID != oldDrugID {
+		warnings, err = checkPrescribing(t.PatientID, t.DrugID, uint(id), t.OverrideReason)
+		if err != nil {
+			return err
+		}
+	}
+	if prescriptionItemID != nil {
+		if err := checkPrescriptionLine(tx, *prescriptionItemID, id, t); err != nil {
+			return err
+		}
+	}
+
+	// Reprice with the prices and tax rate of the original sale. A total
+	// left out, or left as stored, is recalculated rather than checked.
+	clientTotal := !t.TotalPrice.IsZero() && t.TotalPrice.Cmp(oldTotal) != 0
+	if err := priceTransaction(tx, &t, createdAt, taxRate, clientTotal, actor); err != nil {
+		return err
+	}
+
+	result, err := tx.Exec("UPDATE transactions SET patient_id = ?, drug_id = ?, quantity = ?, total_price = ?, currency = ?, prescription = ?,"+
+		" drug_price_id = ?, unit_price = ?, discount_percent = ?, discount_amount = ?, tax_rate = ?, tax_amount = ?, price_override_reason = ?, price_overridden_by = ?,"+
+		" base_currency = ?, exchange_rate = ?, exchange_rate_id = ?, base_total_price = ?, version = version + 1 WHERE id = ? AND deleted_at IS NULL AND (? = 0 OR version = ?)",
+		t.PatientID, t.DrugID, t.Quantity, t.TotalPrice, t.Currency, t.Prescription,
+		t.DrugPriceID, t.UnitPrice, t.DiscountPercent, t.DiscountAmount, t.TaxRate, t.TaxAmount, t.PriceOverrideReason, t.PriceOverriddenBy,
+		t.BaseCurrency, t.ExchangeRate, t.ExchangeRateID, t.BaseTotalPrice, id, version, version)
+	if err != nil {
+		return err
+	}
+	if err := checkVersionedUpdate(result, "transactions", id); err != nil {
+		return err
+	}
+	if err := recordOverride(tx, overrideTransaction, uint(id), t.PatientID, t.DrugID, t.OverrideReason, warnings, actor); err != nil {
+		return err
+	}
+
+	// Correct the stock dispensed for the transaction. When the drug changes,
+	// the old drug gets its quantity back; drugs are locked in ID order.
+	if oldDrugID == t.DrugID {
+		err = dispenseStock(tx, uint(id), t.DrugID, t.Quantity.Sub(oldQuantity), actor)
+	} else if oldDrugID < t.DrugID {
+		if err = dispenseStock(tx, uint(id), oldDrugID, oldQuantity.Neg(), actor); err == nil {
+			err = dispenseStock(tx, uint(id), t.DrugID, t.Quantity, actor)
+		}
+	} else {
+		if err = dispenseStock(tx, uint(id), t.DrugID, t.Quantity, actor); err == nil {
+			err = dispenseStock(tx, uint(id), oldDrugID, oldQuantity.Neg(), actor)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
+// Handler function to delete a transaction by ID. The stock it dispensed is
+// not returned, so it still counts against its prescription line.
 func deleteTransaction(c echo.Context) error {
 	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
 		return c.String(http.StatusBadRequest, "Invalid transaction ID")
 	}
 
-	_, err = db.Exec("DELETE FROM transactions WHERE id = ?", id)
+	err = deleteRecord("transactions", id)
 	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.String(http.StatusNotFound, "Transaction not found")
+		}
+		if status, message, ok := integrityError(err); ok {
+			return c.String(status, message)
+		}
 		return c.String(http.StatusInternalServerError, "Failed to delete transaction")
 	}
+	publishTransaction("deleted", id)
 
 	return c.NoContent(http.StatusNoContent)
 }
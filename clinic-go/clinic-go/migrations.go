@@ -0,0 +1,513 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// migrations lists the schema changes applied on top of the base clinic_db
+// schema, in order. Entries are append-only: once a migration has shipped,
+// add a new one instead of editing it.
+var migrations = []string{
+	// 1-6: row versions used for ETag / If-Match concurrency control
+	"ALTER TABLE users ADD COLUMN version INT UNSIGNED NOT NULL DEFAULT 1",
+	"ALTER TABLE patient_appointments ADD COLUMN version INT UNSIGNED NOT NULL DEFAULT 1",
+	"ALTER TABLE drugs ADD COLUMN version INT UNSIGNED NOT NULL DEFAULT 1",
+	"ALTER TABLE patients ADD COLUMN version INT UNSIGNED NOT NULL DEFAULT 1",
+	"ALTER TABLE doctors ADD COLUMN version INT UNSIGNED NOT NULL DEFAULT 1",
+	"ALTER TABLE transactions ADD COLUMN version INT UNSIGNED NOT NULL DEFAULT 1",
+
+	// 7-9: soft delete and retention bookkeeping for clinical and financial records
+	"ALTER TABLE patients ADD COLUMN deleted_at DATETIME NULL, ADD COLUMN anonymized_at DATETIME NULL, ADD INDEX idx_patients_deleted_at (deleted_at)",
+	"ALTER TABLE patient_appointments ADD COLUMN deleted_at DATETIME NULL, ADD COLUMN anonymized_at DATETIME NULL, ADD INDEX idx_patient_appointments_deleted_at (deleted_at)",
+	"ALTER TABLE transactions ADD COLUMN deleted_at DATETIME NULL, ADD COLUMN anonymized_at DATETIME NULL, ADD INDEX idx_transactions_deleted_at (deleted_at)",
+
+	// 10-14: foreign keys backing the relationships in integrity.go
+	"ALTER TABLE patient_appointments ADD CONSTRAINT fk_patient_appointments_patient_id FOREIGN KEY (patient_id) REFERENCES patients (id) ON DELETE RESTRICT",
+	"ALTER TABLE patient_appointments ADD CONSTRAINT fk_patient_appointments_user_id FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE RESTRICT",
+	"ALTER TABLE transactions ADD CONSTRAINT fk_transactions_patient_id FOREIGN KEY (patient_id) REFERENCES patients (id) ON DELETE RESTRICT",
+	"ALTER TABLE transactions ADD CONSTRAINT fk_transactions_drug_id FOREIGN KEY (drug_id) REFERENCES drugs (id) ON DELETE RESTRICT",
+	"ALTER TABLE doctors ADD CONSTRAINT fk_doctors_user_id FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE RESTRICT",
+
+	// 15-18: typed dates and times. Appointment times used to be written as
+	// local wall-clock strings in the clinic's timezone; they are stored in
+	// UTC from now on.
+	"ALTER TABLE patient_appointments MODIFY appointment_date DATETIME NOT NULL",
+	migrateAppointmentTimesToUTC,
+	"ALTER TABLE drugs MODIFY expiration_date DATE NULL",
+	"ALTER TABLE patients MODIFY date_of_birth DATE NULL",
+
+	// 19-21: doctor weekly schedules, breaks and exceptions (leave, holidays)
+	`CREATE TABLE doctor_schedules (
+		id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		doctor_id BIGINT UNSIGNED NOT NULL,
+		weekday TINYINT UNSIGNED NOT NULL,
+		start_time TIME NOT NULL,
+		end_time TIME NOT NULL,
+		slot_minutes SMALLINT UNSIGNED NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_doctor_schedules_doctor_weekday (doctor_id, weekday),
+		CONSTRAINT fk_doctor_schedules_doctor_id FOREIGN KEY (doctor_id) REFERENCES doctors (id) ON DELETE CASCADE
+	)`,
+	`CREATE TABLE doctor_schedule_breaks (
+		id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		doctor_id BIGINT UNSIGNED NOT NULL,
+		weekday TINYINT UNSIGNED NOT NULL,
+		start_time TIME NOT NULL,
+		end_time TIME NOT NULL,
+		INDEX idx_doctor_schedule_breaks_doctor_weekday (doctor_id, weekday),
+		CONSTRAINT fk_doctor_schedule_breaks_doctor_id FOREIGN KEY (doctor_id) REFERENCES doctors (id) ON DELETE CASCADE
+	)`,
+	`CREATE TABLE doctor_schedule_exceptions (
+		id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		doctor_id BIGINT UNSIGNED NULL,
+		date DATE NOT NULL,
+		start_time TIME NULL,
+		end_time TIME NULL,
+		kind VARCHAR(20) NOT NULL,
+		reason VARCHAR(255) NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_doctor_schedule_exceptions_date (date, doctor_id),
+		CONSTRAINT fk_doctor_schedule_exceptions_doctor_id FOREIGN KEY (doctor_id) REFERENCES doctors (id) ON DELETE CASCADE
+	)`,
+
+	// 22: indexes for the double-booking checks
+	"ALTER TABLE patient_appointments ADD INDEX idx_patient_appointments_user_date (user_id, appointment_date), ADD INDEX idx_patient_appointments_patient_date (patient_id, appointment_date)",
+
+	// 23-25: appointment lifecycle. Free-form statuses are mapped onto the
+	// state machine in appointment_status.go; anything unrecognised restarts
+	// as requested.
+	`UPDATE patient_appointments SET status = CASE LOWER(TRIM(status))
+		WHEN 'confirmed' THEN 'confirmed'
+		WHEN 'scheduled' THEN 'confirmed'
+		WHEN 'checked_in' THEN 'checked_in'
+		WHEN 'checked in' THEN 'checked_in'
+		WHEN 'in_consultation' THEN 'in_consultation'
+		WHEN 'completed' THEN 'completed'
+		WHEN 'done' THEN 'completed'
+		WHEN 'cancelled' THEN 'cancelled'
+		WHEN 'canceled' THEN 'cancelled'
+		WHEN 'no_show' THEN 'no_show'
+		ELSE 'requested' END`,
+	"ALTER TABLE patient_appointments MODIFY status VARCHAR(20) NOT NULL DEFAULT 'requested'",
+	`CREATE TABLE appointment_status_history (
+		id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		appointment_id BIGINT UNSIGNED NOT NULL,
+		from_status VARCHAR(20) NOT NULL,
+		to_status VARCHAR(20) NOT NULL,
+		actor_user_id BIGINT UNSIGNED NULL,
+		actor_role VARCHAR(20) NOT NULL DEFAULT '',
+		reason VARCHAR(255) NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_appointment_status_history_appointment (appointment_id)
+	)`,
+
+	// 26-29: appointments reference the doctors table. They used to store the
+	// doctor's user account in user_id; rows are reconciled through
+	// doctors.user_id. Rows whose user is not a doctor keep a NULL doctor_id
+	// and their original user_id for manual review.
+	"ALTER TABLE patient_appointments ADD COLUMN doctor_id BIGINT UNSIGNED NULL AFTER patient_id",
+	"UPDATE patient_appointments a JOIN doctors d ON d.user_id = a.user_id SET a.doctor_id = d.id",
+	"ALTER TABLE patient_appointments ADD CONSTRAINT fk_patient_appointments_doctor_id FOREIGN KEY (doctor_id) REFERENCES doctors (id) ON DELETE RESTRICT, ADD INDEX idx_patient_appointments_doctor_date (doctor_id, appointment_date)",
+	"ALTER TABLE patient_appointments DROP FOREIGN KEY fk_patient_appointments_user_id, DROP INDEX idx_patient_appointments_user_date, MODIFY user_id BIGINT UNSIGNED NULL",
+
+	// 30: per-doctor, per-day walk-in queues
+	`CREATE TABLE queue_entries (
+		id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		doctor_id BIGINT UNSIGNED NOT NULL,
+		queue_date DATE NOT NULL,
+		number INT UNSIGNED NOT NULL,
+		appointment_id BIGINT UNSIGNED NOT NULL,
+		status VARCHAR(20) NOT NULL,
+		checked_in_at DATETIME NOT NULL,
+		called_at DATETIME NULL,
+		served_at DATETIME NULL,
+		UNIQUE KEY uq_queue_entries_doctor_date_number (doctor_id, queue_date, number),
+		UNIQUE KEY uq_queue_entries_appointment (appointment_id),
+		CONSTRAINT fk_queue_entries_doctor_id FOREIGN KEY (doctor_id) REFERENCES doctors (id) ON DELETE CASCADE,
+		CONSTRAINT fk_queue_entries_appointment_id FOREIGN KEY (appointment_id) REFERENCES patient_appointments (id) ON DELETE CASCADE
+	)`,
+	// 31-32: appointment reminders and the contact preferences they use
+	`CREATE TABLE patient_contact_preferences (
+		patient_id BIGINT UNSIGNED NOT NULL PRIMARY KEY,
+		channel VARCHAR(20) NOT NULL DEFAULT 'none',
+		phone VARCHAR(32) NOT NULL DEFAULT '',
+		email VARCHAR(255) NOT NULL DEFAULT '',
+		reminders_enabled BOOLEAN NOT NULL DEFAULT TRUE,
+		updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		CONSTRAINT fk_patient_contact_preferences_patient_id FOREIGN KEY (patient_id) REFERENCES patients (id) ON DELETE CASCADE
+	)`,
+	`CREATE TABLE appointment_reminders (
+		id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		appointment_id BIGINT UNSIGNED NOT NULL,
+		offset_minutes INT UNSIGNED NOT NULL,
+		scheduled_for DATETIME NOT NULL,
+		channel VARCHAR(20) NOT NULL DEFAULT '',
+		recipient VARCHAR(255) NOT NULL DEFAULT '',
+		status VARCHAR(20) NOT NULL,
+		attempts INT UNSIGNED NOT NULL DEFAULT 0,
+		last_error VARCHAR(500) NOT NULL DEFAULT '',
+		provider_message_id VARCHAR(255) NOT NULL DEFAULT '',
+		sent_at DATETIME NULL,
+		delivered_at DATETIME NULL,
+		UNIQUE KEY uq_appointment_reminders_due (appointment_id, offset_minutes, scheduled_for),
+		INDEX idx_appointment_reminders_provider_message_id (provider_message_id),
+		CONSTRAINT fk_appointment_reminders_appointment_id FOREIGN KEY (appointment_id) REFERENCES patient_appointments (id) ON DELETE CASCADE
+	)`,
+	// 33-34: recurring appointment series
+	`CREATE TABLE appointment_series (
+		id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		patient_id BIGINT UNSIGNED NOT NULL,
+		doctor_id BIGINT UNSIGNED NOT NULL,
+		first_appointment_date DATETIME NOT NULL,
+		interval_weeks SMALLINT UNSIGNED NOT NULL,
+		until DATE NULL,
+		count SMALLINT UNSIGNED NOT NULL DEFAULT 0,
+		notes TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		CONSTRAINT fk_appointment_series_patient_id FOREIGN KEY (patient_id) REFERENCES patients (id) ON DELETE RESTRICT,
+		CONSTRAINT fk_appointment_series_doctor_id FOREIGN KEY (doctor_id) REFERENCES doctors (id) ON DELETE RESTRICT
+	)`,
+	"ALTER TABLE patient_appointments ADD COLUMN series_id BIGINT UNSIGNED NULL, ADD COLUMN occurrence SMALLINT UNSIGNED NULL, ADD CONSTRAINT fk_patient_appointments_series_id FOREIGN KEY (series_id) REFERENCES appointment_series (id) ON DELETE RESTRICT, ADD INDEX idx_patient_appointments_series (series_id, occurrence)",
+	// 35-36: waitlist and the slots offered from it
+	`CREATE TABLE waitlist_entries (
+		id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		patient_id BIGINT UNSIGNED NOT NULL,
+		doctor_id BIGINT UNSIGNED NULL,
+		specialization VARCHAR(255) NOT NULL DEFAULT '',
+		earliest_date DATE NOT NULL,
+		latest_date DATE NOT NULL,
+		time_of_day VARCHAR(20) NOT NULL DEFAULT 'any',
+		status VARCHAR(20) NOT NULL,
+		notes TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		INDEX idx_waitlist_entries_status_created (status, created_at),
+		CONSTRAINT fk_waitlist_entries_patient_id FOREIGN KEY (patient_id) REFERENCES patients (id) ON DELETE CASCADE,
+		CONSTRAINT fk_waitlist_entries_doctor_id FOREIGN KEY (doctor_id) REFERENCES doctors (id) ON DELETE CASCADE
+	)`,
+	`CREATE TABLE waitlist_offers (
+		id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		entry_id BIGINT UNSIGNED NOT NULL,
+		doctor_id BIGINT UNSIGNED NOT NULL,
+		appointment_date DATETIME NOT NULL,
+		status VARCHAR(20) NOT NULL,
+		expires_at DATETIME NOT NULL,
+		appointment_id BIGINT UNSIGNED NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		responded_at DATETIME NULL,
+		INDEX idx_waitlist_offers_slot (doctor_id, appointment_date, status),
+		INDEX idx_waitlist_offers_status_expires (status, expires_at),
+		CONSTRAINT fk_waitlist_offers_entry_id FOREIGN KEY (entry_id) REFERENCES waitlist_entries (id) ON DELETE CASCADE,
+		CONSTRAINT fk_waitlist_offers_doctor_id FOREIGN KEY (doctor_id) REFERENCES doctors (id) ON DELETE CASCADE,
+		CONSTRAINT fk_waitlist_offers_appointment_id FOREIGN KEY (appointment_id) REFERENCES patient_appointments (id) ON DELETE SET NULL
+	)`,
+	// 37: secret calendar feed tokens for doctors and patients
+	`CREATE TABLE calendar_feeds (
+		id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		owner_type VARCHAR(20) NOT NULL,
+		owner_id BIGINT UNSIGNED NOT NULL,
+		label VARCHAR(255) NOT NULL DEFAULT '',
+		token_hash CHAR(64) NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		last_used_at DATETIME NULL,
+		revoked_at DATETIME NULL,
+		UNIQUE KEY uq_calendar_feeds_token_hash (token_hash),
+		INDEX idx_calendar_feeds_owner (owner_type, owner_id)
+	)`,
+	// 38-39: pharmacy stock ledger
+	"ALTER TABLE drugs ADD COLUMN quantity_on_hand DECIMAL(12,3) NOT NULL DEFAULT 0",
+	`CREATE TABLE stock_movements (
+		id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		drug_id BIGINT UNSIGNED NOT NULL,
+		kind VARCHAR(20) NOT NULL,
+		quantity DECIMAL(12,3) NOT NULL,
+		balance_after DECIMAL(12,3) NOT NULL,
+		transaction_id BIGINT UNSIGNED NULL,
+		reference VARCHAR(255) NOT NULL DEFAULT '',
+		reason VARCHAR(500) NOT NULL DEFAULT '',
+		created_by BIGINT UNSIGNED NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_stock_movements_drug (drug_id, id),
+		INDEX idx_stock_movements_transaction (transaction_id),
+		CONSTRAINT fk_stock_movements_drug_id FOREIGN KEY (drug_id) REFERENCES drugs (id) ON DELETE RESTRICT,
+		CONSTRAINT fk_stock_movements_transaction_id FOREIGN KEY (transaction_id) REFERENCES transactions (id) ON DELETE SET NULL
+	)`,
+	// 40-41: drug lots, dispensed first-expiry-first-out
+	`CREATE TABLE drug_lots (
+		id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		drug_id BIGINT UNSIGNED NOT NULL,
+		lot_number VARCHAR(100) NOT NULL,
+		expiry_date DATE NOT NULL,
+		supplier VARCHAR(255) NOT NULL DEFAULT '',
+		quantity_received DECIMAL(12,3) NOT NULL DEFAULT 0,
+		quantity_on_hand DECIMAL(12,3) NOT NULL DEFAULT 0,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE KEY uq_drug_lots_number (drug_id, lot_number),
+		INDEX idx_drug_lots_expiry (drug_id, expiry_date),
+		CONSTRAINT fk_drug_lots_drug_id FOREIGN KEY (drug_id) REFERENCES drugs (id) ON DELETE RESTRICT
+	)`,
+	"ALTER TABLE stock_movements ADD COLUMN lot_id BIGINT UNSIGNED NULL AFTER transaction_id, ADD CONSTRAINT fk_stock_movements_lot_id FOREIGN KEY (lot_id) REFERENCES drug_lots (id) ON DELETE RESTRICT, ADD INDEX idx_stock_movements_lot (lot_id)",
+	// 42-43: expiry and low-stock alerts
+	"ALTER TABLE drugs ADD COLUMN reorder_threshold DECIMAL(12,3) NULL",
+	`CREATE TABLE pharmacy_alerts (
+		id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		kind VARCHAR(20) NOT NULL,
+		drug_id BIGINT UNSIGNED NOT NULL,
+		lot_id BIGINT UNSIGNED NULL,
+		window_days INT UNSIGNED NULL,
+		message VARCHAR(500) NOT NULL,
+		open_key VARCHAR(100) NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		notified_at DATETIME NULL,
+		acknowledged_at DATETIME NULL,
+		acknowledged_by BIGINT UNSIGNED NULL,
+		resolved_at DATETIME NULL,
+		UNIQUE KEY uq_pharmacy_alerts_open_key (open_key),
+		INDEX idx_pharmacy_alerts_resolved (resolved_at),
+		CONSTRAINT fk_pharmacy_alerts_drug_id FOREIGN KEY (drug_id) REFERENCES drugs (id) ON DELETE CASCADE,
+		CONSTRAINT fk_pharmacy_alerts_lot_id FOREIGN KEY (lot_id) REFERENCES drug_lots (id) ON DELETE CASCADE
+	)`,
+	// 44-45: recalls, which quarantine lots
+	`CREATE TABLE drug_recalls (
+		id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		drug_id BIGINT UNSIGNED NOT NULL,
+		reason VARCHAR(500) NOT NULL,
+		reference VARCHAR(255) NOT NULL DEFAULT '',
+		created_by BIGINT UNSIGNED NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		CONSTRAINT fk_drug_recalls_drug_id FOREIGN KEY (drug_id) REFERENCES drugs (id) ON DELETE RESTRICT
+	)`,
+	"ALTER TABLE drug_lots ADD COLUMN recall_id BIGINT UNSIGNED NULL, ADD CONSTRAINT fk_drug_lots_recall_id FOREIGN KEY (recall_id) REFERENCES drug_recalls (id) ON DELETE RESTRICT",
+	// 46-48: interaction knowledge base, allergies and prescribing overrides
+	`CREATE TABLE drug_interactions (
+		id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		drug_a_id BIGINT UNSIGNED NOT NULL,
+		drug_b_id BIGINT UNSIGNED NOT NULL,
+		severity VARCHAR(20) NOT NULL,
+		description TEXT NOT NULL,
+		source VARCHAR(255) NOT NULL DEFAULT '',
+		updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		UNIQUE KEY uq_drug_interactions_pair (drug_a_id, drug_b_id),
+		INDEX idx_drug_interactions_drug_b (drug_b_id),
+		CONSTRAINT fk_drug_interactions_drug_a_id FOREIGN KEY (drug_a_id) REFERENCES drugs (id) ON DELETE CASCADE,
+		CONSTRAINT fk_drug_interactions_drug_b_id FOREIGN KEY (drug_b_id) REFERENCES drugs (id) ON DELETE CASCADE
+	)`,
+	`CREATE TABLE patient_allergies (
+		id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		patient_id BIGINT UNSIGNED NOT NULL,
+		drug_id BIGINT UNSIGNED NOT NULL,
+		reaction VARCHAR(500) NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_patient_allergies_patient_drug (patient_id, drug_id),
+		CONSTRAINT fk_patient_allergies_patient_id FOREIGN KEY (patient_id) REFERENCES patients (id) ON DELETE CASCADE,
+		CONSTRAINT fk_patient_allergies_drug_id FOREIGN KEY (drug_id) REFERENCES drugs (id) ON DELETE RESTRICT
+	)`,
+	`CREATE TABLE interaction_overrides (
+		id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		transaction_id BIGINT UNSIGNED NOT NULL,
+		patient_id BIGINT UNSIGNED NOT NULL,
+		drug_id BIGINT UNSIGNED NOT NULL,
+		reason VARCHAR(500) NOT NULL,
+		warnings TEXT NOT NULL,
+		created_by BIGINT UNSIGNED NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_interaction_overrides_patient (patient_id),
+		CONSTRAINT fk_interaction_overrides_transaction_id FOREIGN KEY (transaction_id) REFERENCES transactions (id) ON DELETE CASCADE
+	)`,
+	// 49-52: structured prescriptions, dispensed as transactions
+	`CREATE TABLE prescriptions (
+		id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		appointment_id BIGINT UNSIGNED NOT NULL,
+		notes TEXT NOT NULL,
+		issued_by BIGINT UNSIGNED NULL,
+		cancelled_at DATETIME NULL,
+		cancel_reason VARCHAR(500) NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		CONSTRAINT fk_prescriptions_appointment_id FOREIGN KEY (appointment_id) REFERENCES patient_appointments (id) ON DELETE RESTRICT
+	)`,
+	`CREATE TABLE prescription_items (
+		id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		prescription_id BIGINT UNSIGNED NOT NULL,
+		drug_id BIGINT UNSIGNED NOT NULL,
+		dose VARCHAR(100) NOT NULL,
+		route VARCHAR(50) NOT NULL DEFAULT '',
+		frequency VARCHAR(100) NOT NULL,
+		duration_days INT NOT NULL DEFAULT 0,
+		quantity DECIMAL(12,3) NOT NULL,
+		refills INT NOT NULL DEFAULT 0,
+		instructions VARCHAR(500) NOT NULL DEFAULT '',
+		CONSTRAINT fk_prescription_items_prescription_id FOREIGN KEY (prescription_id) REFERENCES prescriptions (id) ON DELETE CASCADE,
+		CONSTRAINT fk_prescription_items_drug_id FOREIGN KEY (drug_id) REFERENCES drugs (id) ON DELETE RESTRICT
+	)`,
+	"ALTER TABLE transactions ADD COLUMN prescription_item_id BIGINT UNSIGNED NULL, ADD CONSTRAINT fk_transactions_prescription_item_id FOREIGN KEY (prescription_item_id) REFERENCES prescription_items (id) ON DELETE RESTRICT",
+	"ALTER TABLE interaction_overrides MODIFY transaction_id BIGINT UNSIGNED NULL, ADD COLUMN prescription_item_id BIGINT UNSIGNED NULL, ADD CONSTRAINT fk_interaction_overrides_prescription_item_id FOREIGN KEY (prescription_item_id) REFERENCES prescription_items (id) ON DELETE CASCADE",
+	// 53-57: effective-dated price lists with tiers, started from each
+	// drug's current price
+	`CREATE TABLE drug_prices (
+		id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		drug_id BIGINT UNSIGNED NOT NULL,
+		tier VARCHAR(30) NOT NULL DEFAULT 'general',
+		price DECIMAL(15,2) NOT NULL,
+		currency VARCHAR(10) NOT NULL,
+		effective_from DATETIME NOT NULL,
+		created_by BIGINT UNSIGNED NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE KEY uq_drug_prices_effective (drug_id, tier, effective_from),
+		CONSTRAINT fk_drug_prices_drug_id FOREIGN KEY (drug_id) REFERENCES drugs (id) ON DELETE CASCADE
+	)`,
+	"INSERT INTO drug_prices (drug_id, tier, price, currency, effective_from) SELECT id, 'general', price, currency, created_at FROM drugs",
+	"ALTER TABLE patients ADD COLUMN price_tier VARCHAR(30) NOT NULL DEFAULT 'general'",
+	"ALTER TABLE transactions ADD COLUMN drug_price_id BIGINT UNSIGNED NULL, ADD CONSTRAINT fk_transactions_drug_price_id FOREIGN KEY (drug_price_id) REFERENCES drug_prices (id) ON DELETE RESTRICT",
+	"UPDATE transactions t SET t.drug_price_id = (SELECT p.id FROM drug_prices p WHERE p.drug_id = t.drug_id AND p.effective_from <= t.created_at ORDER BY p.effective_from DESC LIMIT 1), t.updated_at = t.updated_at",
+	// 58-59: server-side pricing with a snapshot of the unit price, taken
+	// from what existing transactions were charged
+	`ALTER TABLE transactions
+		ADD COLUMN unit_price DECIMAL(15,2) NOT NULL DEFAULT 0,
+		ADD COLUMN discount_percent DECIMAL(5,2) NOT NULL DEFAULT 0,
+		ADD COLUMN discount_amount DECIMAL(15,2) NOT NULL DEFAULT 0,
+		ADD COLUMN tax_rate DECIMAL(5,2) NOT NULL DEFAULT 0,
+		ADD COLUMN tax_amount DECIMAL(15,2) NOT NULL DEFAULT 0,
+		ADD COLUMN price_override_reason VARCHAR(500) NOT NULL DEFAULT '',
+		ADD COLUMN price_overridden_by BIGINT UNSIGNED NULL`,
+	"UPDATE transactions SET unit_price = ROUND(total_price / quantity, 2), updated_at = updated_at WHERE quantity > 0",
+
+	// 60-61: exact decimal prices, totals and quantities. Existing values
+	// are rounded to cents and to the stock ledger's precision.
+	"ALTER TABLE drugs MODIFY price DECIMAL(15,2) NOT NULL DEFAULT 0",
+	"ALTER TABLE transactions MODIFY quantity DECIMAL(12,3) NOT NULL, MODIFY total_price DECIMAL(15,2) NOT NULL",
+
+	// 62-63: offline exchange rates and the base currency amount of each
+	// transaction. Existing transactions are converted at startup; see
+	// convertPastTransactions.
+	`CREATE TABLE exchange_rates (
+		id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		base_currency VARCHAR(10) NOT NULL,
+		currency VARCHAR(10) NOT NULL,
+		rate DECIMAL(20,8) NOT NULL,
+		effective_from DATETIME NOT NULL,
+		source VARCHAR(255) NOT NULL DEFAULT '',
+		created_by BIGINT UNSIGNED NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE KEY uq_exchange_rates_effective (base_currency, currency, effective_from)
+	)`,
+	`ALTER TABLE transactions
+		ADD COLUMN base_currency VARCHAR(10) NOT NULL DEFAULT '',
+		ADD COLUMN exchange_rate DECIMAL(20,8) NOT NULL DEFAULT 0,
+		ADD COLUMN exchange_rate_id BIGINT UNSIGNED NULL,
+		ADD COLUMN base_total_price DECIMAL(15,2) NOT NULL DEFAULT 0,
+		ADD INDEX idx_transactions_base_currency (base_currency),
+		ADD CONSTRAINT fk_transactions_exchange_rate_id FOREIGN KEY (exchange_rate_id) REFERENCES exchange_rates (id) ON DELETE RESTRICT`,
+}
+
+// migrateAppointmentTimesToUTC stands for a migration run in Go rather than
+// SQL: local times are converted with clinicLocation, which may observe
+// daylight saving, so no fixed offset fits every row.
+const migrateAppointmentTimesToUTC = "-- convert appointment_date from the clinic's timezone to UTC"
+
+// convertAppointmentTimesToUTC reinterprets every appointment_date as a
+// wall-clock time in clinicLocation and stores it in UTC. The rows are
+// converted and the migration recorded as version in one transaction, so a
+// failure leaves every row as it was and the migration can simply be rerun.
+func convertAppointmentTimesToUTC(ctx context.Context, conn *sql.Conn, version int) error {
+	if name := getenv("CLINIC_TIMEZONE", "Asia/Jakarta"); clinicLocation.String() != name {
+		return fmt.Errorf("CLINIC_TIMEZONE %q must be a valid timezone to convert appointment times", name)
+	}
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, "SELECT id, appointment_date FROM patient_appointments FOR UPDATE")
+	if err != nil {
+		return err
+	}
+	local := make(map[int64]time.Time)
+	for rows.Next() {
+		var id int64
+		var wall time.Time
+		if err := rows.Scan(&id, &wall); err != nil {
+			rows.Close()
+			return err
+		}
+		local[id] = wall
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id, wall := range local {
+		at := time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour(), wall.Minute(), wall.Second(), 0, clinicLocation)
+		if _, err := tx.ExecContext(ctx, "UPDATE patient_appointments SET appointment_date = ? WHERE id = ?", at.UTC(), id); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO schema_migrations (version) VALUES (?)", version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// migrate brings the database schema up to date by applying every migration
+// that has not been recorded in schema_migrations yet.
+//
+// clinicLocation must be loaded first: one migration converts local times.
+//
+// Migrations run on a single connection with foreign key checks disabled, so
+// adding a constraint does not fail on rows that predate it; the API checks
+// references on every write from then on.
+func migrate(db *sql.DB) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INT UNSIGNED NOT NULL PRIMARY KEY,
+		applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if err != nil {
+		return fmt.Errorf("creating schema_migrations: %w", err)
+	}
+
+	var applied int
+	if err := conn.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&applied); err != nil {
+		return fmt.Errorf("reading schema version: %w", err)
+	}
+	if applied >= len(migrations) {
+		return nil
+	}
+
+	if _, err := conn.ExecContext(ctx, "SET FOREIGN_KEY_CHECKS = 0"); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, "SET FOREIGN_KEY_CHECKS = 1")
+
+	for i := applied; i < len(migrations); i++ {
+		version := i + 1
+		if migrations[i] == migrateAppointmentTimesToUTC {
+			// Recorded in the same transaction as the conversion
+			if err := convertAppointmentTimesToUTC(ctx, conn, version); err != nil {
+				return fmt.Errorf("applying migration %d: %w", version, err)
+			}
+			log.Printf("Applied migration %d", version)
+			continue
+		}
+		if _, err := conn.ExecContext(ctx, migrations[i]); err != nil {
+			return fmt.Errorf("applying migration %d: %w", version, err)
+		}
+		if _, err := conn.ExecContext(ctx, "INSERT INTO schema_migrations (version) VALUES (?)", version); err != nil {
+			return fmt.Errorf("recording migration %d: %w", version, err)
+		}
+		log.Printf("Applied migration %d", version)
+	}
+
+	return nil
+}
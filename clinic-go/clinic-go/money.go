@@ -0,0 +1,274 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Decimal is an exact decimal number, coef × 10^-scale. Prices, totals and
+// stock quantities use it instead of float64 so sums and balances come out
+// exact. It is stored in DECIMAL columns and encoded in JSON as a string
+// such as "12500" or "3.50"; numbers are accepted on input.
+type Decimal struct {
+	coef  *big.Int // nil means zero; never modified once set
+	scale int32
+}
+
+// Bounds on numbers, derived from the widest DECIMAL column: exchange rates
+// are DECIMAL(20,8) and money columns DECIMAL(15,2), whose SUM() results
+// also fit. maxDecimalScale also bounds the digits kept by Mul.
+const (
+	maxDecimalDigits = 20
+	maxDecimalScale  = 8
+)
+
+var (
+	errDecimalSyntax = errors.New("invalid decimal number")
+	errDecimalRange  = errors.New("decimal number out of range")
+)
+
+// decimalFromInt returns the Decimal for an integer.
+func decimalFromInt(n int64) Decimal {
+	return Decimal{coef: big.NewInt(n)}
+}
+
+// parseDecimal parses a plain decimal such as "-12.50". Exponents are not
+// accepted.
+func parseDecimal(s string) (Decimal, error) {
+	s = strings.TrimSpace(s)
+	digits := strings.TrimLeft(s, "+-")
+	if len(s)-len(digits) > 1 {
+		return Decimal{}, errDecimalSyntax
+	}
+	whole, fraction, _ := strings.Cut(digits, ".")
+	if whole == "" && fraction == "" {
+		return Decimal{}, errDecimalSyntax
+	}
+	for _, r := range whole + fraction {
+		if r < '0' || r > '9' {
+			return Decimal{}, errDecimalSyntax
+		}
+	}
+	if len(fraction) > maxDecimalScale {
+		return Decimal{}, errDecimalRange
+	}
+	coef, _ := new(big.Int).SetString(whole+fraction, 10)
+	if strings.HasPrefix(s, "-") {
+		coef.Neg(coef)
+	}
+	if precision(coef, int32(len(fraction))) > maxDecimalDigits {
+		return Decimal{}, errDecimalRange
+	}
+	return Decimal{coef: coef, scale: int32(len(fraction))}, nil
+}
+
+// precision returns the number of digits in coef × 10^-scale, leaving out
+// zeros that trail the decimal point.
+func precision(coef *big.Int, scale int32) int {
+	digits := new(big.Int).Abs(coef).String()
+	for ; scale > 0 && len(digits) > 1 && digits[len(digits)-1] == '0'; scale-- {
+		digits = digits[:len(digits)-1]
+	}
+	return len(digits)
+}
+
+// int returns the coefficient of d, which must not be modified.
+func (d Decimal) int() *big.Int {
+	if d.coef == nil {
+		return new(big.Int)
+	}
+	return d.coef
+}
+
+// big returns a copy of the coefficient of d at scale.
+func (d Decimal) big(scale int32) *big.Int {
+	b := new(big.Int).Set(d.int())
+	if scale > d.scale {
+		b.Mul(b, new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(scale-d.scale)), nil))
+	}
+	return b
+}
+
+func maxScale(a, b Decimal) int32 {
+	if a.scale > b.scale {
+		return a.scale
+	}
+	return b.scale
+}
+
+// Add returns d + o.
+func (d Decimal) Add(o Decimal) Decimal {
+	scale := maxScale(d, o)
+	return Decimal{coef: new(big.Int).Add(d.big(scale), o.big(scale)), scale: scale}
+}
+
+// Sub returns d - o.
+func (d Decimal) Sub(o Decimal) Decimal {
+	scale := maxScale(d, o)
+	return Decimal{coef: new(big.Int).Sub(d.big(scale), o.big(scale)), scale: scale}
+}
+
+// Neg returns -d.
+func (d Decimal) Neg() Decimal {
+	return Decimal{coef: new(big.Int).Neg(d.int()), scale: d.scale}
+}
+
+// Mul returns d × o, rounded to maxDecimalScale fractional digits, or
+// errDecimalRange when the product has more digits than any column holds.
+func (d Decimal) Mul(o Decimal) (Decimal, error) {
+	product := new(big.Int).Mul(d.int(), o.int())
+	result := roundBig(product, d.scale+o.scale, maxDecimalScale)
+	if precision(result.coef, result.scale) > maxDecimalDigits {
+		return Decimal{}, errDecimalRange
+	}
+	return result, nil
+}
+
+// MulInt returns d × n exactly, e.g. a quantity times a number of fills.
+func (d Decimal) MulInt(n int64) Decimal {
+	return Decimal{coef: new(big.Int).Mul(d.int(), big.NewInt(n)), scale: d.scale}
+}
+
+// Percent returns p percent of d, rounded like Mul.
+func (d Decimal) Percent(p Decimal) Decimal {
+	product := new(big.Int).Mul(d.int(), p.int())
+	return roundBig(product, d.scale+p.scale+2, maxDecimalScale)
+}
+
+// Round rounds d half away from zero to exactly places fractional digits.
+func (d Decimal) Round(places int32) Decimal {
+	if places >= d.scale {
+		return Decimal{coef: d.big(places), scale: places}
+	}
+	return roundBig(d.int(), d.scale, places)
+}
+
+// roundBig rounds coef × 10^-scale half away from zero to at most places
+// fractional digits.
+func roundBig(coef *big.Int, scale, places int32) Decimal {
+	if scale <= places {
+		return Decimal{coef: coef, scale: scale}
+	}
+	divisor := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(scale-places)), nil)
+	quotient, remainder := new(big.Int).QuoRem(coef, divisor, new(big.Int))
+	if new(big.Int).Mul(new(big.Int).Abs(remainder), big.NewInt(2)).Cmp(divisor) >= 0 {
+		quotient.Add(quotient, big.NewInt(int64(coef.Sign())))
+	}
+	return Decimal{coef: quotient, scale: places}
+}
+
+// Cmp compares d and o, returning -1, 0 or +1.
+func (d Decimal) Cmp(o Decimal) int {
+	scale := maxScale(d, o)
+	return d.big(scale).Cmp(o.big(scale))
+}
+
+// minDecimal returns the smaller of a and b.
+func minDecimal(a, b Decimal) Decimal {
+	if b.Cmp(a) < 0 {
+		return b
+	}
+	return a
+}
+
+// Sign returns -1, 0 or +1 by the sign of d.
+func (d Decimal) Sign() int {
+	return d.int().Sign()
+}
+
+// IsZero reports whether d is zero.
+func (d Decimal) IsZero() bool {
+	return d.int().Sign() == 0
+}
+
+// String formats d with its scale, e.g. "12.50".
+func (d Decimal) String() string {
+	digits := d.int().String()
+	sign := ""
+	if d.Sign() < 0 {
+		sign, digits = "-", digits[1:]
+	}
+	if d.scale <= 0 {
+		return sign + digits
+	}
+	if pad := int(d.scale) + 1 - len(digits); pad > 0 {
+		digits = strings.Repeat("0", pad) + digits
+	}
+	point := len(digits) - int(d.scale)
+	return sign + digits[:point] + "." + digits[point:]
+}
+
+// MarshalJSON encodes d as a JSON string.
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + d.String() + `"`), nil
+}
+
+// UnmarshalJSON accepts a JSON string or number.
+func (d *Decimal) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if s == "null" {
+		return nil
+	}
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	}
+	parsed, err := parseDecimal(s)
+	if err != nil {
+		return fmt.Errorf("%q: %w", s, err)
+	}
+	*d = parsed
+	return nil
+}
+
+// Scan implements sql.Scanner for DECIMAL columns.
+func (d *Decimal) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*d = Decimal{}
+		return nil
+	case []byte:
+		parsed, err := parseDecimal(string(v))
+		*d = parsed
+		return err
+	case string:
+		parsed, err := parseDecimal(v)
+		*d = parsed
+		return err
+	case int64:
+		*d = decimalFromInt(v)
+		return nil
+	case float64:
+		parsed, err := parseDecimal(strconv.FormatFloat(v, 'f', -1, 64))
+		*d = parsed
+		return err
+	}
+	return fmt.Errorf("cannot scan %T into Decimal", src)
+}
+
+// Value implements driver.Valuer.
+func (d Decimal) Value() (driver.Value, error) {
+	return d.String(), nil
+}
+
+// currencyDecimals lists the currencies whose amounts are not counted in
+// hundredths. Rupiah amounts are whole in practice.
+var currencyDecimals = map[string]int32{
+	"IDR": 0,
+	"JPY": 0,
+	"KRW": 0,
+	"VND": 0,
+}
+
+// roundMoney rounds an amount half away from zero to the precision of its
+// currency.
+func roundMoney(amount Decimal, currency string) Decimal {
+	places, ok := currencyDecimals[strings.ToUpper(currency)]
+	if !ok {
+		places = 2
+	}
+	return amount.Round(places)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func mustDecimal(t *testing.T, s string) Decimal {
+	t.Helper()
+	d, err := parseDecimal(s)
+	if err != nil {
+		t.Fatalf("parseDecimal(%q): %v", s, err)
+	}
+	return d
+}
+
+func TestParseDecimalColumnRange(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr error
+	}{
+		{"12500", "12500", nil},
+		{"-3.50", "-3.50", nil},
+		{"9999999999999.99", "9999999999999.99", nil},           // DECIMAL(15,2)
+		{"999999999999.99999999", "999999999999.99999999", nil}, // DECIMAL(20,8)
+		{"123456789012345678.00", "123456789012345678.00", nil}, // SUM() of money columns
+		{"123456789012345678901", "", errDecimalRange},
+		{"1.123456789", "", errDecimalRange},
+		{"1e5", "", errDecimalSyntax},
+		{"--1", "", errDecimalSyntax},
+	}
+	for _, tt := range tests {
+		got, err := parseDecimal(tt.in)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("parseDecimal(%q) error = %v, want %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got.String() != tt.want {
+			t.Errorf("parseDecimal(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestDecimalMul(t *testing.T) {
+	tests := []struct {
+		a, b, want string
+	}{
+		{"12500", "3.000", "37500.000"},
+		{"0.10", "0.3", "0.030"},
+		{"1.005", "0.00000001", "0.00000001"},
+		{"10000000.00", "15800.00000000", "158000000000.00000000"},
+		{"9999999999999.99", "15800", "157999999999999842.00"},
+	}
+	for _, tt := range tests {
+		got, err := mustDecimal(t, tt.a).Mul(mustDecimal(t, tt.b))
+		if err != nil {
+			t.Errorf("%s × %s: %v", tt.a, tt.b, err)
+			continue
+		}
+		if got.String() != tt.want {
+			t.Errorf("%s × %s = %s, want %s", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestDecimalMulOverflow(t *testing.T) {
+	_, err := mustDecimal(t, "9999999999999.99").Mul(mustDecimal(t, "999999999999.99999999"))
+	if !errors.Is(err, errDecimalRange) {
+		t.Errorf("error = %v, want %v", err, errDecimalRange)
+	}
+}
+
+func TestDecimalArithmetic(t *testing.T) {
+	a, b := mustDecimal(t, "0.1"), mustDecimal(t, "0.2")
+	if got := a.Add(b).String(); got != "0.3" {
+		t.Errorf("0.1 + 0.2 = %s, want 0.3", got)
+	}
+	if got := a.Sub(b).String(); got != "-0.1" {
+		t.Errorf("0.1 - 0.2 = %s, want -0.1", got)
+	}
+	if got := mustDecimal(t, "12500").Percent(mustDecimal(t, "11")).String(); got != "1375.00" {
+		t.Errorf("11%% of 12500 = %s, want 1375.00", got)
+	}
+	if got := mustDecimal(t, "-2.345").Round(2).String(); got != "-2.35" {
+		t.Errorf("-2.345 rounded = %s, want -2.35", got)
+	}
+	if got := roundMoney(mustDecimal(t, "12499.5"), "IDR").String(); got != "12500" {
+		t.Errorf("IDR 12499.5 = %s, want 12500", got)
+	}
+	var zero Decimal
+	if !zero.IsZero() || zero.String() != "0" || zero.Cmp(mustDecimal(t, "0.00")) != 0 {
+		t.Errorf("zero value = %s", zero)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Notification channels
+const (
+	channelSMS      = "sms"
+	channelEmail    = "email"
+	channelWhatsApp = "whatsapp"
+	channelNone     = "none"
+)
+
+// Message is one notification to one recipient.
+type Message struct {
+	Channel string
+	To      string // phone number in E.164 form, or email address
+	Subject string // email only
+	Body    string
+}
+
+// Notifier delivers messages over one channel. Send returns the provider's
+// message ID, if it has one, for delivery status tracking.
+type Notifier interface {
+	Send(ctx context.Context, msg Message) (string, error)
+}
+
+// errChannelUnavailable is returned for channels with no configured notifier.
+var errChannelUnavailable = errors.New("notification channel is not configured")
+
+// notifications delivers messages to patients. main configures it with
+// loadNotifiers; until then every channel is unavailable.
+var notifications Notifier = notifiers{}
+
+// notifiers maps each channel to the notifier that delivers it.
+type notifiers map[string]Notifier
+
+// Send delivers msg over its channel.
+func (n notifiers) Send(ctx context.Context, msg Message) (string, error) {
+	notifier, ok := n[msg.Channel]
+	if !ok {
+		return "", errChannelUnavailable
+	}
+	return notifier.Send(ctx, msg)
+}
+
+// loadNotifiers configures the notifiers from the environment. With
+// NOTIFY_MODE=outbox (the default) every channel is written to the local
+// outbox file instead of being sent, for development and testing. With
+// NOTIFY_MODE=live each channel whose provider is configured is sent for real.
+func loadNotifiers() notifiers {
+	mode := getenv("NOTIFY_MODE", "outbox")
+	if mode != "live" {
+		if mode != "outbox" {
+			log.Printf("Unknown NOTIFY_MODE %q, using %q", mode, "outbox")
+		}
+		outbox := &outboxNotifier{Path: getenv("NOTIFY_OUTBOX", "outbox.jsonl")}
+		return notifiers{channelSMS: outbox, channelEmail: outbox, channelWhatsApp: outbox}
+	}
+
+	client := &http.Client{Timeout: 15 * time.Second}
+	configured := notifiers{}
+	if url := os.Getenv("SMS_GATEWAY_URL"); url != "" {
+		configured[channelSMS] = &smsNotifier{URL: url, APIKey: os.Getenv("SMS_API_KEY"), Client: client}
+	}
+	if addr := os.Getenv("SMTP_ADDR"); addr != "" {
+		configured[channelEmail] = &emailNotifier{
+			Addr:     addr,
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     getenv("SMTP_FROM", "no-reply@clinic.local"),
+		}
+	}
+	if phoneID := os.Getenv("WHATSAPP_PHONE_NUMBER_ID"); phoneID != "" {
+		configured[channelWhatsApp] = &whatsAppNotifier{
+			URL:    getenv("WHATSAPP_API_URL", "https://graph.facebook.com/v19.0") + "/" + phoneID + "/messages",
+			Token:  os.Getenv("WHATSAPP_TOKEN"),
+			Client: client,
+		}
+	}
+	return configured
+}
+
+// smsNotifier sends SMS through an HTTP gateway that accepts
+// {"to": ..., "message": ...} and answers with {"id": ...}.
+type smsNotifier struct {
+	URL    string
+	APIKey string
+	Client *http.Client
+}
+
+func (n *smsNotifier) Send(ctx context.Context, msg Message) (string, error) {
+	var response struct {
+		ID string `json:"id"`
+	}
+	err := postJSON(ctx, n.Client, n.URL, "Bearer "+n.APIKey, map[string]string{
+		"to":      msg.To,
+		"message": msg.Body,
+	}, &response)
+	return response.ID, err
+}
+
+// whatsAppNotifier sends text messages through the WhatsApp Cloud API.
+type whatsAppNotifier struct {
+	URL    string
+	Token  string
+	Client *http.Client
+}
+
+func (n *whatsAppNotifier) Send(ctx context.Context, msg Message) (string, error) {
+	var response struct {
+		Messages []struct {
+			ID string `json:"id"`
+		} `json:"messages"`
+	}
+	err := postJSON(ctx, n.Client, n.URL, "Bearer "+n.Token, map[string]interface{}{
+		"messaging_product": "whatsapp",
+		"to":                strings.TrimPrefix(msg.To, "+"),
+		"type":              "text",
+		"text":              map[string]string{"body": msg.Body},
+	}, &response)
+	if err != nil || len(response.Messages) == 0 {
+		return "", err
+	}
+	return response.Messages[0].ID, nil
+}
+
+// postJSON posts body as JSON and decodes a successful JSON response into out.
+func postJSON(ctx context.Context, client *http.Client, url, authorization string, body, out interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", authorization)
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		detail, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("provider returned %s: %s", res.Status, strings.TrimSpace(string(detail)))
+	}
+	if err := json.NewDecoder(res.Body).Decode(out); err != nil && err != io.EOF {
+		return fmt.Errorf("decoding provider response: %w", err)
+	}
+	return nil
+}
+
+// emailNotifier sends plain-text email over SMTP.
+type emailNotifier struct {
+	Addr     string // host:port
+	Username string
+	Password string
+	From     string
+}
+
+func (n *emailNotifier) Send(ctx context.Context, msg Message) (string, error) {
+	var auth smtp.Auth
+	if n.Username != "" {
+		host, _, _ := strings.Cut(n.Addr, ":")
+		auth = smtp.PlainAuth("", n.Username, n.Password, host)
+	}
+
+	id := fmt.Sprintf("<%d.%s>", time.Now().UnixNano(), n.From)
+	body := "From: " + n.From + "\r\n" +
+		"To: " + msg.To + "\r\n" +
+		"Subject: " + msg.Subject + "\r\n" +
+		"Message-ID: " + id + "\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" + msg.Body + "\r\n"
+	if err := smtp.SendMail(n.Addr, auth, n.From, []string{msg.To}, []byte(body)); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// outboxNotifier appends messages to a JSON Lines file instead of sending
+// them.
+type outboxNotifier struct {
+	Path string
+	mu   sync.Mutex
+}
+
+func (n *outboxNotifier) Send(ctx context.Context, msg Message) (string, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	file, err := os.OpenFile(n.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	id := fmt.Sprintf("outbox-%d", time.Now().UnixNano())
+	err = json.NewEncoder(file).Encode(map[string]interface{}{
+		"id":      id,
+		"time":    time.Now().UTC(),
+		"channel": msg.Channel,
+		"to":      msg.To,
+		"subject": msg.Subject,
+		"body":    msg.Body,
+	})
+	return id, err
+}
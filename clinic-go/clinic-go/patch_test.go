@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func patchContext(contentType, body string) echo.Context {
+	req := httptest.NewRequest(http.MethodPatch, "/", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, contentType)
+	return echo.New().NewContext(req, httptest.NewRecorder())
+}
+
+func TestApplyPatchClearsFields(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+	}{
+		{"merge patch null", mimeMergePatch, `{"notes": null}`},
+		{"json patch remove", mimeJSONPatch, `[{"op": "remove", "path": "/notes"}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			appointment := PatientAppointment{ID: 7, Notes: "fasting", Status: statusConfirmed}
+			if err := applyPatch(patchContext(tt.contentType, tt.body), &appointment); err != nil {
+				t.Fatal(err)
+			}
+			if appointment.Notes != "" {
+				t.Errorf("Notes = %q, want it cleared", appointment.Notes)
+			}
+			if appointment.ID != 7 || appointment.Status != statusConfirmed {
+				t.Errorf("untouched fields changed: %+v", appointment)
+			}
+		})
+	}
+}
+
+func TestApplyPatchReplacesFields(t *testing.T) {
+	appointment := PatientAppointment{Notes: "fasting"}
+	err := applyPatch(patchContext(mimeJSONPatch, `[{"op": "test", "path": "/notes", "value": "fasting"}, {"op": "replace", "path": "/notes", "value": "bring results"}]`), &appointment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if appointment.Notes != "bring results" {
+		t.Errorf("Notes = %q, want %q", appointment.Notes, "bring results")
+	}
+
+	err = applyPatch(patchContext(mimeJSONPatch, `[{"op": "test", "path": "/notes", "value": "fasting"}]`), &appointment)
+	if err == nil || !strings.Contains(err.Error(), errPatchTestFailed.Error()) {
+		t.Errorf("failed test op returned %v, want %v", err, errPatchTestFailed)
+	}
+}
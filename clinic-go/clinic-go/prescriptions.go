@@ -0,0 +1,735 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Prescription statuses. Only cancellation is stored; the other statuses
+// follow from how much of each line has been dispensed.
+const (
+	prescriptionIssued             = "issued"
+	prescriptionPartiallyDispensed = "partially_dispensed"
+	prescriptionDispensed          = "dispensed"
+	prescriptionCancelled          = "cancelled"
+)
+
+// Prescription is issued by a doctor during an appointment and dispensed at
+// the pharmacy, possibly over several visits.
+type Prescription struct {
+	ID            uint               `json:"id"`
+	AppointmentID uint               `json:"appointment_id"`
+	PatientID     uint               `json:"patient_id"` // read-only, the appointment's patient
+	DoctorID      int                `json:"doctor_id"`  // read-only, the appointment's doctor
+	Status        string             `json:"status"`     // read-only
+	Notes         string             `json:"notes"`
+	IssuedBy      *uint              `json:"issued_by,omitempty"`
+	CancelledAt   *time.Time         `json:"cancelled_at,omitempty"`
+	CancelReason  string             `json:"cancel_reason,omitempty"`
+	CreatedAt     time.Time          `json:"created_at"`
+	Items         []PrescriptionItem `json:"items"`
+
+	// OverrideReason lets the doctor issue drugs with severe interaction or
+	// allergy warnings. Warnings are only returned on creation.
+	OverrideReason string               `json:"override_reason,omitempty"`
+	Warnings       []InteractionWarning `json:"warnings,omitempty"`
+}
+
+// PrescriptionItem is one drug on a prescription. Each fill dispenses up to
+// Quantity, and the line may be filled 1 + Refills times in total.
+type PrescriptionItem struct {
+	ID                uint    `json:"id"`
+	DrugID            uint    `json:"drug_id"`
+	DrugName          string  `json:"drug_name"` // read-only
+	Dose              string  `json:"dose"`      // e.g. "500 mg"
+	Route             string  `json:"route"`     // e.g. "oral"
+	Frequency         string  `json:"frequency"` // e.g. "3x daily"
+	DurationDays      int     `json:"duration_days"`
+	Quantity          Decimal `json:"quantity"`
+	Refills           int     `json:"refills"`
+	Instructions      string  `json:"instructions,omitempty"`
+	QuantityDispensed Decimal `json:"quantity_dispensed"` // read-only, deleted transactions included
+	QuantityRemaining Decimal `json:"quantity_remaining"` // read-only
+}
+
+// allowance is the total quantity that may be dispensed for the line.
+func (i PrescriptionItem) allowance() Decimal {
+	return i.Quantity.MulInt(int64(1 + i.Refills))
+}
+
+// sig renders the line's directions, kept on the transactions dispensing it.
+func (i PrescriptionItem) sig() string {
+	parts := []string{}
+	for _, part := range []string{i.Dose, i.Route, i.Frequency} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	sig := strings.Join(parts, " ")
+	if i.DurationDays > 0 {
+		sig += fmt.Sprintf(" for %d days", i.DurationDays)
+	}
+	if i.Instructions != "" {
+		sig += "; " + i.Instructions
+	}
+	return sig
+}
+
+// validate checks the fields a doctor supplies for a line.
+func (i PrescriptionItem) validate() error {
+	switch {
+	case i.Dose == "":
+		return errors.New("dose is required")
+	case i.Frequency == "":
+		return errors.New("frequency is required")
+	case i.Quantity.Sign() <= 0:
+		return errNonPositiveQuantity
+	case i.Quantity.Round(3).Cmp(i.Quantity) != 0:
+		return errQuantityPrecision
+	case i.Refills < 0:
+		return errors.New("refills cannot be negative")
+	case i.DurationDays < 0:
+		return errors.New("duration_days cannot be negative")
+	}
+	return nil
+}
+
+// prescriptionError reports a prescription that cannot be issued, changed
+// or dispensed as requested.
+type prescriptionError struct {
+	Status  int
+	Message string
+}
+
+func (e *prescriptionError) Error() string {
+	return e.Message
+}
+
+// derivedStatus works out a prescription's status from its lines.
+func (p *Prescription) derivedStatus() string {
+	if p.CancelledAt != nil {
+		return prescriptionCancelled
+	}
+	dispensed, complete := false, true
+	for _, item := range p.Items {
+		if item.QuantityDispensed.Sign() > 0 {
+			dispensed = true
+		}
+		if item.QuantityRemaining.Sign() > 0 {
+			complete = false
+		}
+	}
+	switch {
+	case complete && dispensed:
+		return prescriptionDispensed
+	case dispensed:
+		return prescriptionPartiallyDispensed
+	}
+	return prescriptionIssued
+}
+
+const prescriptionSelect = "SELECT p.id, p.appointment_id, a.patient_id, COALESCE(a.doctor_id, 0), p.notes, p.issued_by, p.cancelled_at, p.cancel_reason, p.created_at" +
+	" FROM prescriptions p JOIN patient_appointments a ON a.id = p.appointment_id"
+
+func scanPrescription(row rowScanner) (Prescription, error) {
+	var p Prescription
+	err := row.Scan(&p.ID, &p.AppointmentID, &p.PatientID, &p.DoctorID, &p.Notes, &p.IssuedBy, &p.CancelledAt, &p.CancelReason, &p.CreatedAt)
+	return p, err
+}
+
+// loadPrescriptionItems fills in the lines of prescriptions and their
+// statuses. Deleted transactions still count as dispensed: deleting one
+// does not return its stock, so the drug has left the pharmacy.
+func loadPrescriptionItems(prescriptions []Prescription) error {
+	if len(prescriptions) == 0 {
+		return nil
+	}
+	index := make(map[uint]*Prescription, len(prescriptions))
+	placeholders := make([]string, len(prescriptions))
+	args := make([]interface{}, len(prescriptions))
+	for i := range prescriptions {
+		prescriptions[i].Items = make([]PrescriptionItem, 0)
+		index[prescriptions[i].ID] = &prescriptions[i]
+		placeholders[i] = "?"
+		args[i] = prescriptions[i].ID
+	}
+
+	rows, err := db.Query("SELECT i.prescription_id, i.id, i.drug_id, d.drug_name, i.dose, i.route, i.frequency, i.duration_days, i.quantity, i.refills, i.instructions,"+
+		" COALESCE((SELECT SUM(t.quantity) FROM transactions t WHERE t.prescription_item_id = i.id), 0)"+
+		" FROM prescription_items i JOIN drugs d ON d.id = i.drug_id"+
+		" WHERE i.prescription_id IN ("+strings.Join(placeholders, ", ")+") ORDER BY i.id", args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var prescriptionID uint
+		var item PrescriptionItem
+		err := rows.Scan(&prescriptionID, &item.ID, &item.DrugID, &item.DrugName, &item.Dose, &item.Route, &item.Frequency,
+			&item.DurationDays, &item.Quantity, &item.Refills, &item.Instructions, &item.QuantityDispensed)
+		if err != nil {
+			return err
+		}
+		item.QuantityRemaining = item.allowance().Sub(item.QuantityDispensed)
+		p := index[prescriptionID]
+		p.Items = append(p.Items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for i := range prescriptions {
+		p := &prescriptions[i]
+		if p.CancelledAt != nil {
+			for j := range p.Items {
+				p.Items[j].QuantityRemaining = Decimal{}
+			}
+		}
+		p.Status = p.derivedStatus()
+	}
+	return nil
+}
+
+// findPrescription loads a prescription with its lines.
+func findPrescription(id int) (Prescription, error) {
+	p, err := scanPrescription(db.QueryRow(prescriptionSelect+" WHERE p.id = ?", id))
+	if err != nil {
+		return p, err
+	}
+	prescriptions := []Prescription{p}
+	err = loadPrescriptionItems(prescriptions)
+	return prescriptions[0], err
+}
+
+// queryPrescriptions loads the prescriptions matching a WHERE clause on
+// prescriptionSelect, newest first, keeping those with the given status if
+// one is set.
+func queryPrescriptions(where, status string, args ...interface{}) ([]Prescription, error) {
+	rows, err := db.Query(prescriptionSelect+" WHERE "+where+" ORDER BY p.id DESC", args...)
+	if err != nil {
+		return nil, err
+	}
+	prescriptions := make([]Prescription, 0)
+	for rows.Next() {
+		p, err := scanPrescription(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		prescriptions = append(prescriptions, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if err := loadPrescriptionItems(prescriptions); err != nil {
+		return nil, err
+	}
+	if status == "" {
+		return prescriptions, nil
+	}
+	filtered := make([]Prescription, 0)
+	for _, p := range prescriptions {
+		if p.Status == status {
+			filtered = append(filtered, p)
+		}
+	}
+	return filtered, nil
+}
+
+// isAppointmentDoctor reports whether the actor is the doctor of an
+// appointment. Admins act for any doctor.
+func isAppointmentDoctor(actor Actor, doctorID int) (bool, error) {
+	if actor.IsAdmin() {
+		return true, nil
+	}
+	if actor.Role != roleDoctor || actor.UserID == 0 {
+		return false, nil
+	}
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM doctors WHERE id = ? AND user_id = ?)", doctorID, actor.UserID).Scan(&exists)
+	return exists, err
+}
+
+// Handler function to issue a prescription during an appointment. Every
+// line is checked against the patient's allergies, their active medications
+// and the other lines; severe warnings need an override_reason.
+func createPrescription(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid appointment ID")
+	}
+
+	var p Prescription
+	if err := c.Bind(&p); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid request payload")
+	}
+
+	appointment, err := findAppointment(id, false)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.String(http.StatusNotFound, "Appointment not found")
+		}
+		log.Println("Error getting appointment:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get appointment")
+	}
+	actor := currentActor(c)
+	allowed, err := isAppointmentDoctor(actor, appointment.DoctorID)
+	if err != nil {
+		log.Println("Error checking prescriber:", err)
+		return c.String(http.StatusInternalServerError, "Failed to insert prescription")
+	}
+	if !allowed {
+		return c.String(http.StatusForbidden, "Only the appointment's doctor can issue prescriptions")
+	}
+	switch appointment.Status {
+	case statusCheckedIn, statusInConsultation, statusCompleted:
+	default:
+		return c.String(http.StatusConflict, fmt.Sprintf("Cannot prescribe for an appointment that is %s", appointment.Status))
+	}
+
+	if len(p.Items) == 0 {
+		return c.String(http.StatusUnprocessableEntity, "items is required")
+	}
+	for i, item := range p.Items {
+		if err := item.validate(); err != nil {
+			return c.String(http.StatusUnprocessableEntity, fmt.Sprintf("items[%d]: %s", i, err.Error()))
+		}
+		if err := checkReferences(reference{fmt.Sprintf("items[%d].drug_id", i), "drugs", int64(item.DrugID)}); err != nil {
+			if status, message, ok := integrityError(err); ok {
+				return c.String(status, message)
+			}
+			log.Println("Error validating prescription:", err)
+			return c.String(http.StatusInternalServerError, "Failed to insert prescription")
+		}
+	}
+
+	warnings, err := prescriptionWarnings(appointment.PatientID, p.Items)
+	if err != nil {
+		log.Println("Error checking interactions:", err)
+		return c.String(http.StatusInternalServerError, "Failed to insert prescription")
+	}
+	var all []InteractionWarning
+	for _, w := range warnings {
+		all = append(all, w...)
+	}
+	if strings.TrimSpace(p.OverrideReason) == "" {
+		for _, w := range all {
+			if w.RequiresOverride {
+				return interactionBlockedResponse(c, &interactionBlockedError{Warnings: all})
+			}
+		}
+	}
+
+	prescriptionID, err := insertPrescription(uint(id), p, warnings, actor)
+	if err != nil {
+		if status, message, ok := integrityError(err); ok {
+			return c.String(status, message)
+		}
+		log.Println("Error inserting prescription:", err)
+		return c.String(http.StatusInternalServerError, "Failed to insert prescription")
+	}
+
+	created, err := findPrescription(int(prescriptionID))
+	if err != nil {
+		log.Println("Error reading back prescription:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get prescription")
+	}
+	created.Warnings = all
+	return c.JSON(http.StatusCreated, created)
+}
+
+// prescriptionWarnings checks each line of a new prescription, returning
+// its warnings by line. An interaction between two lines is reported on the
+// later one.
+func prescriptionWarnings(patientID uint, items []PrescriptionItem) ([][]InteractionWarning, error) {
+	warnings := make([][]InteractionWarning, len(items))
+	for i, item := range items {
+		w, err := checkInteractions(patientID, item.DrugID, 0)
+		if err != nil {
+			return nil, err
+		}
+		for j := 0; j < i; j++ {
+			between, err := interactionBetween(item.DrugID, items[j].DrugID)
+			if err != nil {
+				return nil, err
+			}
+			if between != nil {
+				w = append(w, *between)
+			}
+		}
+		sort.SliceStable(w, func(a, b int) bool {
+			return severityRank[w[a].Severity] > severityRank[w[b].Severity]
+		})
+		warnings[i] = w
+	}
+	return warnings, nil
+}
+
+// insertPrescription inserts a prescription and its lines, recording any
+// override of their warnings, in one database transaction.
+func insertPrescription(appointmentID uint, p Prescription, warnings [][]InteractionWarning, actor Actor) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("INSERT INTO prescriptions (appointment_id, notes, issued_by) VALUES (?, ?, ?)", appointmentID, p.Notes, actor.nullableID())
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	var patientID uint
+	if err := tx.QueryRow("SELECT patient_id FROM patient_appointments WHERE id = ?", appointmentID).Scan(&patientID); err != nil {
+		return 0, err
+	}
+	for i, item := range p.Items {
+		result, err := tx.Exec("INSERT INTO prescription_items (prescription_id, drug_id, dose, route, frequency, duration_days, quantity, refills, instructions) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			id, item.DrugID, item.Dose, item.Route, item.Frequency, item.DurationDays, item.Quantity, item.Refills, item.Instructions)
+		if err != nil {
+			return 0, err
+		}
+		itemID, err := result.LastInsertId()
+		if err != nil {
+			return 0, err
+		}
+		if err := recordOverride(tx, overridePrescriptionItem, uint(itemID), patientID, item.DrugID, p.OverrideReason, warnings[i], actor); err != nil {
+			return 0, err
+		}
+	}
+	return id, tx.Commit()
+}
+
+// Handler function to get a prescription. Patients can only read their own.
+func getPrescription(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid prescription ID")
+	}
+
+	p, err := findPrescription(id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.String(http.StatusNotFound, "Prescription not found")
+		}
+		log.Println("Error getting prescription:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get prescription")
+	}
+	if actor := currentActor(c); actor.Role == rolePatient && actor.UserID != p.PatientID {
+		return c.String(http.StatusForbidden, "Prescription belongs to another patient")
+	}
+
+	return c.JSON(http.StatusOK, p)
+}
+
+// Handler function to list a patient's prescriptions, newest first,
+// optionally with a given ?status=
+func getPatientPrescriptions(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid patient ID")
+	}
+	if actor := currentActor(c); actor.Role == rolePatient && actor.UserID != uint(id) {
+		return c.String(http.StatusForbidden, "Prescriptions belong to another patient")
+	}
+
+	prescriptions, err := queryPrescriptions("a.patient_id = ?", c.QueryParam("status"), id)
+	if err != nil {
+		log.Println("Error querying prescriptions:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get prescriptions")
+	}
+
+	return c.JSON(http.StatusOK, prescriptions)
+}
+
+// Handler function to list the prescriptions issued during an appointment
+func getAppointmentPrescriptions(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid appointment ID")
+	}
+
+	appointment, err := findAppointment(id, true)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.String(http.StatusNotFound, "Appointment not found")
+		}
+		log.Println("Error getting appointment:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get appointment")
+	}
+	if actor := currentActor(c); actor.Role == rolePatient && actor.UserID != appointment.PatientID {
+		return c.String(http.StatusForbidden, "Appointment belongs to another patient")
+	}
+
+	prescriptions, err := queryPrescriptions("p.appointment_id = ?", c.QueryParam("status"), id)
+	if err != nil {
+		log.Println("Error querying prescriptions:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get prescriptions")
+	}
+
+	return c.JSON(http.StatusOK, prescriptions)
+}
+
+// Handler function to cancel what remains of a prescription. Quantities
+// already dispensed are unaffected.
+func cancelPrescription(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid prescription ID")
+	}
+
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	if err := c.Bind(&body); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid request payload")
+	}
+
+	p, err := findPrescription(id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.String(http.StatusNotFound, "Prescription not found")
+		}
+		log.Println("Error getting prescription:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get prescription")
+	}
+	allowed, err := isAppointmentDoctor(currentActor(c), p.DoctorID)
+	if err != nil {
+		log.Println("Error checking prescriber:", err)
+		return c.String(http.StatusInternalServerError, "Failed to cancel prescription")
+	}
+	if !allowed {
+		return c.String(http.StatusForbidden, "Only the appointment's doctor can cancel prescriptions")
+	}
+	if p.Status == prescriptionCancelled || p.Status == prescriptionDispensed {
+		return c.String(http.StatusConflict, fmt.Sprintf("Prescription is already %s", p.Status))
+	}
+
+	_, err = db.Exec("UPDATE prescriptions SET cancelled_at = NOW(), cancel_reason = ? WHERE id = ? AND cancelled_at IS NULL", body.Reason, id)
+	if err != nil {
+		log.Println("Error cancelling prescription:", err)
+		return c.String(http.StatusInternalServerError, "Failed to cancel prescription")
+	}
+
+	p, err = findPrescription(id)
+	if err != nil {
+		log.Println("Error reading back prescription:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get prescription")
+	}
+	return c.JSON(http.StatusOK, p)
+}
+
+// dispenseLine is a quantity to dispense against a prescription line.
+type dispenseLine struct {
+	ItemID   uint    `json:"item_id"`
+	Quantity Decimal `json:"quantity"` // defaults to one fill, or what remains if less
+}
+
+// Handler function to dispense a prescription at the pharmacy. Each line
+// dispensed becomes a transaction referencing it, priced from the drug's
+// price list for the patient's tier. Without items, one fill of every line is dispensed.
+func dispensePrescription(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid prescription ID")
+	}
+
+	var body struct {
+		Items []dispenseLine `json:"items"`
+	}
+	if err := c.Bind(&body); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid request payload")
+	}
+
+	actor := currentActor(c)
+	if !actor.IsAdmin() && actor.Role != rolePharmacist {
+		return c.String(http.StatusForbidden, "Only pharmacists can dispense prescriptions")
+	}
+
+	transactionIDs, err := dispenseLines(id, body.Items, actor)
+	if err != nil {
+		var refused *prescriptionError
+		var insufficient *insufficientStockError
+		var unpriced *pricingError
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return c.String(http.StatusNotFound, "Prescription not found")
+		case errors.As(err, &refused):
+			return c.String(refused.Status, refused.Message)
+		case errors.As(err, &unpriced):
+			return c.String(unpriced.Status, unpriced.Message)
+		case errors.As(err, &insufficient):
+			return c.String(http.StatusConflict, insufficient.Error())
+		}
+		log.Println("Error dispensing prescription:", err)
+		return c.String(http.StatusInternalServerError, "Failed to dispense prescription")
+	}
+	for _, transactionID := range transactionIDs {
+		publishTransaction("created", int(transactionID))
+	}
+
+	p, err := findPrescription(id)
+	if err != nil {
+		log.Println("Error reading back prescription:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get prescription")
+	}
+	transactions := make([]Transaction, 0, len(transactionIDs))
+	for _, transactionID := range transactionIDs {
+		t, err := findTransaction(int(transactionID), false)
+		if err != nil {
+			log.Println("Error reading back transaction:", err)
+			return c.String(http.StatusInternalServerError, "Failed to get transaction")
+		}
+		transactions = append(transactions, t)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"prescription": p,
+		"transactions": transactions,
+	})
+}
+
+// dispenseLines creates the transactions dispensing lines of a prescription
+// in one database transaction. The prescription row is locked so concurrent
+// dispenses cannot exceed a line's allowance; drugs are dispensed in ID
+// order to keep stock locks ordered.
+func dispenseLines(prescriptionID int, lines []dispenseLine, actor Actor) ([]int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var patientID uint
+	var cancelledAt *time.Time
+	err = tx.QueryRow("SELECT a.patient_id, p.cancelled_at FROM prescriptions p JOIN patient_appointments a ON a.id = p.appointment_id WHERE p.id = ? FOR UPDATE",
+		prescriptionID).Scan(&patientID, &cancelledAt)
+	if err != nil {
+		return nil, err
+	}
+	if cancelledAt != nil {
+		return nil, &prescriptionError{http.StatusConflict, "Prescription has been cancelled"}
+	}
+
+	items := make(map[uint]PrescriptionItem)
+	rows, err := tx.Query("SELECT i.id, i.drug_id, i.dose, i.route, i.frequency, i.duration_days, i.quantity, i.refills, i.instructions,"+
+		" COALESCE((SELECT SUM(t.quantity) FROM transactions t WHERE t.prescription_item_id = i.id), 0)"+
+		" FROM prescription_items i WHERE i.prescription_id = ? ORDER BY i.id", prescriptionID)
+	if err != nil {
+		return nil, err
+	}
+	var order []uint
+	for rows.Next() {
+		var item PrescriptionItem
+		err := rows.Scan(&item.ID, &item.DrugID, &item.Dose, &item.Route, &item.Frequency, &item.DurationDays, &item.Quantity, &item.Refills, &item.Instructions, &item.QuantityDispensed)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		item.QuantityRemaining = item.allowance().Sub(item.QuantityDispensed)
+		items[item.ID] = item
+		order = append(order, item.ID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(lines) == 0 {
+		for _, itemID := range order {
+			if items[itemID].QuantityRemaining.Sign() > 0 {
+				lines = append(lines, dispenseLine{ItemID: itemID})
+			}
+		}
+		if len(lines) == 0 {
+			return nil, &prescriptionError{http.StatusConflict, "Prescription has been fully dispensed"}
+		}
+	}
+
+	seen := make(map[uint]bool)
+	for i := range lines {
+		item, ok := items[lines[i].ItemID]
+		if !ok {
+			return nil, &prescriptionError{http.StatusUnprocessableEntity, fmt.Sprintf("item %d is not on prescription %d", lines[i].ItemID, prescriptionID)}
+		}
+		if seen[item.ID] {
+			return nil, &prescriptionError{http.StatusUnprocessableEntity, fmt.Sprintf("item %d is listed more than once", item.ID)}
+		}
+		seen[item.ID] = true
+		if lines[i].Quantity.IsZero() {
+			lines[i].Quantity = minDecimal(item.Quantity, item.QuantityRemaining)
+		}
+		if err := validateQuantity(lines[i].Quantity); err != nil {
+			return nil, &prescriptionError{http.StatusUnprocessableEntity, fmt.Sprintf("item %d: %s", item.ID, err)}
+		}
+		if lines[i].Quantity.Cmp(item.QuantityRemaining) > 0 {
+			return nil, &prescriptionError{http.StatusConflict, fmt.Sprintf("item %d has %s left to dispense, %s requested", item.ID, item.QuantityRemaining, lines[i].Quantity)}
+		}
+	}
+	sort.SliceStable(lines, func(a, b int) bool {
+		return items[lines[a].ItemID].DrugID < items[lines[b].ItemID].DrugID
+	})
+
+	var ids []int64
+	for _, line := range lines {
+		item := items[line.ItemID]
+		itemID := item.ID
+		t := Transaction{
+			PatientID:          patientID,
+			DrugID:             item.DrugID,
+			Quantity:           line.Quantity,
+			Prescription:       item.sig(),
+			PrescriptionItemID: &itemID,
+		}
+		id, err := insertTransactionTx(tx, t, nil, actor)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, tx.Commit()
+}
+
+// checkPrescriptionLine checks a change to a transaction that dispensed a
+// prescription line: it must stay with the line's patient and drug and
+// within the line's allowance. The prescription row is locked as when
+// dispensing.
+func checkPrescriptionLine(tx *sql.Tx, itemID uint, transactionID int, t Transaction) error {
+	var patientID, drugID uint
+	var quantity Decimal
+	var refills int
+	err := tx.QueryRow("SELECT a.patient_id, i.drug_id, i.quantity, i.refills FROM prescription_items i"+
+		" JOIN prescriptions p ON p.id = i.prescription_id JOIN patient_appointments a ON a.id = p.appointment_id"+
+		" WHERE i.id = ? FOR UPDATE", itemID).Scan(&patientID, &drugID, &quantity, &refills)
+	if err != nil {
+		return err
+	}
+	if patientID != t.PatientID || drugID != t.DrugID {
+		return &prescriptionError{http.StatusUnprocessableEntity, "patient_id and drug_id of a prescribed transaction cannot change"}
+	}
+
+	var others Decimal
+	err = tx.QueryRow("SELECT COALESCE(SUM(quantity), 0) FROM transactions WHERE prescription_item_id = ? AND id <> ?", itemID, transactionID).Scan(&others)
+	if err != nil {
+		return err
+	}
+	item := PrescriptionItem{Quantity: quantity, Refills: refills}
+	if remaining := item.allowance().Sub(others); t.Quantity.Cmp(remaining) > 0 {
+		return &prescriptionError{http.StatusConflict, fmt.Sprintf("prescription item %d has %s left to dispense, %s requested", itemID, remaining, t.Quantity)}
+	}
+	return nil
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// priceTierGeneral is the tier every patient falls back to when their own
+// tier has no price for a drug.
+const priceTierGeneral = "general"
+
+var priceTierPattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,29}$`)
+
+var errInvalidPriceTier = errors.New("price tier must be a lowercase identifier such as general or insured")
+
+// pricingPolicy holds the rules transactions are priced by.
+type pricingPolicy struct {
+	TaxRate     Decimal // percent added to the discounted subtotal
+	MaxDiscount Decimal // largest discount percent staff may give without an admin
+}
+
+// pricing is the policy in use, loaded at startup.
+var pricing = pricingPolicy{MaxDiscount: decimalFromInt(10)}
+
+// loadPricingPolicy reads the pricing policy from the environment.
+func loadPricingPolicy() pricingPolicy {
+	return pricingPolicy{
+		TaxRate:     getenvDecimal("TAX_RATE_PERCENT", decimalFromInt(0)),
+		MaxDiscount: getenvDecimal("MAX_DISCOUNT_PERCENT", decimalFromInt(10)),
+	}
+}
+
+// pricingError reports a transaction price that cannot be accepted.
+type pricingError struct {
+	Status  int
+	Message string
+}
+
+func (e *pricingError) Error() string {
+	return e.Message
+}
+
+// priceTransaction works out a transaction's price from the drug's price
+// list for the patient's tier at a time: the unit price times the quantity,
+// less the discount, plus tax at taxRate, each rounded for the currency.
+//
+// A total the client asserted must match the calculated one unless an admin
+// overrides it with a price_override_reason. Discounts above the policy's
+// maximum also need an admin. The total is then converted to the base
+// currency.
+func priceTransaction(tx *sql.Tx, t *Transaction, at time.Time, taxRate Decimal, clientTotal bool, actor Actor) error {
+	price, err := patientPrice(tx, t.DrugID, t.PatientID, at)
+	if err == sql.ErrNoRows {
+		return &pricingError{http.StatusUnprocessableEntity, fmt.Sprintf("drug %d has no price", t.DrugID)}
+	}
+	if err != nil {
+		return err
+	}
+	if t.Currency != "" && !strings.EqualFold(t.Currency, price.Currency) {
+		return &pricingError{http.StatusUnprocessableEntity, fmt.Sprintf("currency must be %s, the currency of the drug's price", price.Currency)}
+	}
+	if t.DiscountPercent.Sign() < 0 || t.DiscountPercent.Cmp(decimalFromInt(100)) > 0 {
+		return &pricingError{http.StatusUnprocessableEntity, "discount_percent must be between 0 and 100"}
+	}
+	if t.DiscountPercent.Cmp(pricing.MaxDiscount) > 0 && !actor.IsAdmin() {
+		return &pricingError{http.StatusForbidden, fmt.Sprintf("Only admins can give discounts above %s%%", pricing.MaxDiscount)}
+	}
+
+	currency := price.Currency
+	discount, tax, total, err := calculatePrice(price.Price, t.Quantity, t.DiscountPercent, taxRate, currency)
+	if err != nil {
+		return &pricingError{http.StatusUnprocessableEntity, "total_price is out of range"}
+	}
+
+	t.DrugPriceID = &price.ID
+	t.UnitPrice, t.Currency = price.Price, currency
+	t.DiscountAmount, t.TaxRate, t.TaxAmount = discount, taxRate, tax
+	t.PriceOverriddenBy = nil
+
+	switch {
+	case strings.TrimSpace(t.PriceOverrideReason) != "":
+		if !actor.IsAdmin() {
+			return &pricingError{http.StatusForbidden, "Only admins can override transaction prices"}
+		}
+		if t.TotalPrice.Sign() < 0 {
+			return &pricingError{http.StatusUnprocessableEntity, "total_price cannot be negative"}
+		}
+		t.TotalPrice = roundMoney(t.TotalPrice, currency)
+		t.PriceOverriddenBy = actor.nullableID()
+	case clientTotal && roundMoney(t.TotalPrice, currency).Cmp(total) != 0:
+		return &pricingError{http.StatusUnprocessableEntity, fmt.Sprintf("total_price %s does not match the calculated %s %s", t.TotalPrice, total, currency)}
+	default:
+		t.TotalPrice = total
+	}
+	return convertTransaction(tx, t, at)
+}
+
+// calculatePrice works out a line's discount, tax and total. The discount
+// comes off the rounded subtotal and tax is charged on what is left, each
+// rounded to the currency's precision before the next step.
+func calculatePrice(unitPrice, quantity, discountPercent, taxRate Decimal, currency string) (discount, tax, total Decimal, err error) {
+	amount, err := unitPrice.Mul(quantity)
+	if err != nil {
+		return Decimal{}, Decimal{}, Decimal{}, err
+	}
+	subtotal := roundMoney(amount, currency)
+	discount = roundMoney(subtotal.Percent(discountPercent), currency)
+	tax = roundMoney(subtotal.Sub(discount).Percent(taxRate), currency)
+	total = roundMoney(subtotal.Sub(discount).Add(tax), currency)
+	return discount, tax, total, nil
+}
+
+// DrugPrice is one entry of a drug's price list. An entry applies to its
+// tier from EffectiveFrom until the next entry of the same tier takes
+// effect, so past transactions can be explained by the entry they used.
+type DrugPrice struct {
+	ID            uint       `json:"id"`
+	DrugID        uint       `json:"drug_id"`
+	Tier          string     `json:"tier"`
+	Price         Decimal    `json:"price"`
+	Currency      string     `json:"currency"`
+	EffectiveFrom time.Time  `json:"effective_from"`
+	EffectiveTo   *time.Time `json:"effective_to,omitempty"` // read-only, when the next entry took over
+	Current       bool       `json:"current"`                // read-only
+	CreatedBy     *uint      `json:"created_by,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+// currentPriceColumns selects the drug's current general price and
+// currency in queries on drugs, falling back to the drug's own columns.
+const currentPriceColumns = "COALESCE((SELECT p.price FROM drug_prices p WHERE p.drug_id = drugs.id AND p.tier = 'general' AND p.effective_from <= NOW() ORDER BY p.effective_from DESC, p.id DESC LIMIT 1), price)," +
+	" COALESCE((SELECT p.currency FROM drug_prices p WHERE p.drug_id = drugs.id AND p.tier = 'general' AND p.effective_from <= NOW() ORDER BY p.effective_from DESC, p.id DESC LIMIT 1), currency)"
+
+const drugPriceColumns = "id, drug_id, tier, price, currency, effective_from, created_by, created_at"
+
+func scanDrugPrice(row rowScanner) (DrugPrice, error) {
+	var p DrugPrice
+	err := row.Scan(&p.ID, &p.DrugID, &p.Tier, &p.Price, &p.Currency, &p.EffectiveFrom, &p.CreatedBy, &p.CreatedAt)
+	p.Price = roundMoney(p.Price, p.Currency)
+	return p, err
+}
+
+// effectivePrice returns the price entry of a drug in effect at a time for
+// a tier, or for the general tier when the tier has none.
+func effectivePrice(tx *sql.Tx, drugID uint, tier string, at time.Time) (DrugPrice, error) {
+	return scanDrugPrice(tx.QueryRow("SELECT "+drugPriceColumns+" FROM drug_prices WHERE drug_id = ? AND tier IN (?, 'general') AND effective_from <= ?"+
+		" ORDER BY tier = 'general', effective_from DESC, id DESC LIMIT 1", drugID, tier, at.UTC()))
+}
+
+// patientPrice returns the price entry of a drug in effect at a time for
+// the patient's tier.
+func patientPrice(tx *sql.Tx, drugID, patientID uint, at time.Time) (DrugPrice, error) {
+	var tier string
+	if err := tx.QueryRow("SELECT price_tier FROM patients WHERE id = ?", patientID).Scan(&tier); err != nil {
+		return DrugPrice{}, err
+	}
+	return effectivePrice(tx, drugID, tier, at)
+}
+
+// insertPrice adds an entry to a drug's price list and returns its ID. A scheduled entry for
+// the same tier and time is replaced; one that has taken effect or priced a
+// transaction is history and is never overwritten.
+func insertPrice(tx *sql.Tx, p DrugPrice, actor Actor) (int64, error) {
+	var effective, used bool
+	err := tx.QueryRow("SELECT effective_from <= NOW(), EXISTS (SELECT 1 FROM transactions t WHERE t.drug_price_id = drug_prices.id)"+
+		" FROM drug_prices WHERE drug_id = ? AND tier = ? AND effective_from = ? FOR UPDATE",
+		p.DrugID, p.Tier, p.EffectiveFrom.UTC()).Scan(&effective, &used)
+	switch {
+	case err == nil && (effective || used):
+		return 0, &pricingError{http.StatusConflict, "A price for this tier and time has already taken effect"}
+	case err != nil && err != sql.ErrNoRows:
+		return 0, err
+	}
+
+	result, err := tx.Exec("INSERT INTO drug_prices (drug_id, tier, price, currency, effective_from, created_by) VALUES (?, ?, ?, ?, ?, ?)"+
+		" ON DUPLICATE KEY UPDATE id = LAST_INSERT_ID(id), price = VALUES(price), currency = VALUES(currency), created_by = VALUES(created_by)",
+		p.DrugID, p.Tier, p.Price, p.Currency, p.EffectiveFrom.UTC(), actor.nullableID())
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// validatePriceTier checks a tier name, defaulting an empty one to general.
+func validatePriceTier(tier *string) error {
+	if *tier == "" {
+		*tier = priceTierGeneral
+	}
+	if !priceTierPattern.MatchString(*tier) {
+		return errInvalidPriceTier
+	}
+	return nil
+}
+
+// Handler function to get a drug's price history, newest first, optionally
+// for one ?tier=
+func getDrugPrices(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid drug ID")
+	}
+
+	if _, err := findDrug(id); err != nil {
+		if err == sql.ErrNoRows {
+			return c.String(http.StatusNotFound, "Drug not found")
+		}
+		log.Println("Error getting drug:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get drug")
+	}
+
+	query := "SELECT " + drugPriceColumns + " FROM drug_prices WHERE drug_id = ?"
+	args := []interface{}{id}
+	if tier := c.QueryParam("tier"); tier != "" {
+		query += " AND tier = ?"
+		args = append(args, tier)
+	}
+	rows, err := db.Query(query+" ORDER BY effective_from DESC, id DESC", args...)
+	if err != nil {
+		log.Println("Error querying drug prices:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get prices")
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	prices := make([]DrugPrice, 0)
+	superseding := make(map[string]time.Time) // the entry after the one being read, by tier
+	for rows.Next() {
+		p, err := scanDrugPrice(rows)
+		if err != nil {
+			log.Println("Error scanning drug price row:", err)
+			continue
+		}
+		next, superseded := superseding[p.Tier]
+		if superseded {
+			p.EffectiveTo = &next
+		}
+		p.Current = !p.EffectiveFrom.After(now) && (!superseded || next.After(now))
+		superseding[p.Tier] = p.EffectiveFrom
+		prices = append(prices, p)
+	}
+
+	return c.JSON(http.StatusOK, prices)
+}
+
+// Handler function to add an entry to a drug's price list. effective_from
+// defaults to now and may be in the future to schedule a price change, but
+// not in the past: history cannot be rewritten. Responds with the entry.
+func createDrugPrice(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid drug ID")
+	}
+
+	var p DrugPrice
+	if err := c.Bind(&p); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid request payload")
+	}
+	p.DrugID = uint(id)
+	if err := validatePriceTier(&p.Tier); err != nil {
+		return c.String(http.StatusUnprocessableEntity, err.Error())
+	}
+	if p.Price.Sign() < 0 {
+		return c.String(http.StatusUnprocessableEntity, "price cannot be negative")
+	}
+	if p.Currency == "" {
+		return c.String(http.StatusUnprocessableEntity, "currency is required")
+	}
+	p.Price = roundMoney(p.Price, p.Currency)
+	now := time.Now().Truncate(time.Second)
+	if p.EffectiveFrom.IsZero() {
+		p.EffectiveFrom = now
+	}
+	p.EffectiveFrom = p.EffectiveFrom.Truncate(time.Second)
+	if p.EffectiveFrom.Before(now) {
+		return c.String(http.StatusUnprocessableEntity, "effective_from cannot be in the past")
+	}
+
+	if err := checkReferences(reference{"drug_id", "drugs", int64(id)}); err != nil {
+		var ref *referenceError
+		if errors.As(err, &ref) {
+			return c.String(http.StatusNotFound, "Drug not found")
+		}
+		log.Println("Error validating drug price:", err)
+		return c.String(http.StatusInternalServerError, "Failed to insert price")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println("Error inserting drug price:", err)
+		return c.String(http.StatusInternalServerError, "Failed to insert price")
+	}
+	defer tx.Rollback()
+	priceID, err := insertPrice(tx, p, currentActor(c))
+	if err != nil {
+		var price *pricingError
+		if errors.As(err, &price) {
+			return c.String(price.Status, price.Message)
+		}
+		log.Println("Error inserting drug price:", err)
+		return c.String(http.StatusInternalServerError, "Failed to insert price")
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println("Error inserting drug price:", err)
+		return c.String(http.StatusInternalServerError, "Failed to insert price")
+	}
+
+	p, err = scanDrugPrice(db.QueryRow("SELECT "+drugPriceColumns+" FROM drug_prices WHERE id = ?", priceID))
+	if err == nil {
+		var next *time.Time
+		err = db.QueryRow("SELECT MIN(effective_from) FROM drug_prices WHERE drug_id = ? AND tier = ? AND effective_from > ?", p.DrugID, p.Tier, p.EffectiveFrom).Scan(&next)
+		p.EffectiveTo = next
+	}
+	if err != nil {
+		log.Println("Error reading back drug price:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get price")
+	}
+	p.Current = !p.EffectiveFrom.After(now) && (p.EffectiveTo == nil || p.EffectiveTo.After(now))
+
+	return c.JSON(http.StatusCreated, p)
+}
+
+// recordPriceChange adds a general price entry effective now when a drug's
+// price or currency has been changed through the drug itself.
+func recordPriceChange(tx *sql.Tx, drugID uint, price Decimal, currency string, actor Actor) error {
+	now := time.Now().Truncate(time.Second)
+	current, err := effectivePrice(tx, drugID, priceTierGeneral, now)
+	if err == nil && current.Price.Cmp(price) == 0 && current.Currency == currency {
+		return nil
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	_, err = insertPrice(tx, DrugPrice{DrugID: drugID, Tier: priceTierGeneral, Price: price, Currency: currency, EffectiveFrom: now}, actor)
+	return err
+}
+
+// Handler function to withdraw a scheduled price before it takes effect.
+// Prices that have been in effect are history and cannot be deleted.
+func deleteDrugPrice(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid drug ID")
+	}
+	priceID, err := strconv.Atoi(c.Param("price_id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid price ID")
+	}
+
+	var effectiveFrom time.Time
+	err = db.QueryRow("SELECT effective_from FROM drug_prices WHERE id = ? AND drug_id = ?", priceID, id).Scan(&effectiveFrom)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.String(http.StatusNotFound, "Price not found")
+		}
+		log.Println("Error getting drug price:", err)
+		return c.String(http.StatusInternalServerError, "Failed to delete price")
+	}
+	if !effectiveFrom.After(time.Now()) {
+		return c.String(http.StatusConflict, "Price has already taken effect")
+	}
+
+	if _, err := db.Exec("DELETE FROM drug_prices WHERE id = ? AND effective_from > NOW()", priceID); err != nil {
+		log.Println("Error deleting drug price:", err)
+		return c.String(http.StatusInternalServerError, "Failed to delete price")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCalculatePrice(t *testing.T) {
+	tests := []struct {
+		name                     string
+		unitPrice, quantity      string
+		discountPercent, taxRate string
+		currency                 string
+		discount, tax, total     string
+	}{
+		{"no discount or tax", "12500", "3", "0", "0", "IDR", "0", "0", "37500"},
+		{"tax on the discounted amount", "10000", "1", "10", "11", "IDR", "1000", "990", "9990"},
+		{"subtotal rounded before the discount", "3333.5", "1", "0", "0", "IDR", "0", "0", "3334"},
+		{"discount rounded before tax", "999", "1", "12.5", "0", "IDR", "125", "0", "874"},
+		{"tax rounded half away from zero", "1050", "1", "0", "10", "IDR", "0", "105", "1155"},
+		{"cents", "2.35", "3", "10", "8.25", "USD", "0.71", "0.52", "6.86"},
+		{"unknown currency rounds to cents", "0.333", "3", "0", "0", "XYZ", "0.00", "0.00", "1.00"},
+		{"fractional quantity", "12000", "0.5", "0", "11", "IDR", "0", "660", "6660"},
+		{"full discount leaves no tax", "12500", "2", "100", "11", "IDR", "25000", "0", "0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			discount, tax, total, err := calculatePrice(mustDecimal(t, tt.unitPrice), mustDecimal(t, tt.quantity),
+				mustDecimal(t, tt.discountPercent), mustDecimal(t, tt.taxRate), tt.currency)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if discount.String() != tt.discount || tax.String() != tt.tax || total.String() != tt.total {
+				t.Errorf("discount, tax, total = %s, %s, %s, want %s, %s, %s", discount, tax, total, tt.discount, tt.tax, tt.total)
+			}
+		})
+	}
+}
+
+func TestCalculatePriceOverflow(t *testing.T) {
+	_, _, _, err := calculatePrice(mustDecimal(t, "9999999999999.99"), mustDecimal(t, "999999999999.99999999"),
+		Decimal{}, Decimal{}, "IDR")
+	if !errors.Is(err, errDecimalRange) {
+		t.Errorf("error = %v, want %v", err, errDecimalRange)
+	}
+}
+
+func TestRoundMoney(t *testing.T) {
+	tests := []struct {
+		amount, currency, want string
+	}{
+		{"12499.5", "IDR", "12500"},
+		{"12499.49", "IDR", "12499"},
+		{"-12499.5", "IDR", "-12500"},
+		{"12499.5", "idr", "12500"},
+		{"1234.5", "JPY", "1235"},
+		{"2.345", "USD", "2.35"},
+		{"2.344", "USD", "2.34"},
+		{"-2.345", "EUR", "-2.35"},
+		{"7", "USD", "7.00"},
+		{"7", "XYZ", "7.00"},
+		{"0.005", "SGD", "0.01"},
+	}
+	for _, tt := range tests {
+		if got := roundMoney(mustDecimal(t, tt.amount), tt.currency).String(); got != tt.want {
+			t.Errorf("roundMoney(%s, %s) = %s, want %s", tt.amount, tt.currency, got, tt.want)
+		}
+	}
+}
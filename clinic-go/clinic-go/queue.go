@@ -0,0 +1,420 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Queue entry statuses
+const (
+	queueWaiting = "waiting" // checked in, waiting to be called
+	queueCalled  = "called"  // called to the consultation room
+	queueSkipped = "skipped" // called but did not come; may be recalled
+	queueServed  = "served"  // consultation started
+	queueLeft    = "left"    // appointment cancelled or marked no-show
+)
+
+// queueHistoryWindow is how far back consultation durations are averaged for
+// wait estimates.
+const queueHistoryWindow = 30 * 24 * time.Hour
+
+// QueueEntry is a patient's place in a doctor's queue for one day. Entries
+// are created when an appointment is checked in, or by registering a walk-in.
+type QueueEntry struct {
+	ID                   uint       `json:"id"`
+	DoctorID             int        `json:"doctor_id"`
+	QueueDate            Date       `json:"queue_date"`
+	Number               int        `json:"number"`
+	AppointmentID        uint       `json:"appointment_id"`
+	Status               string     `json:"status"`
+	CheckedInAt          time.Time  `json:"checked_in_at"`
+	CalledAt             *time.Time `json:"called_at,omitempty"`
+	ServedAt             *time.Time `json:"served_at,omitempty"`
+	EstimatedWaitMinutes *int       `json:"estimated_wait_minutes,omitempty"`
+}
+
+// QueueBoard is a doctor's queue for today, as shown on the waiting-room
+// display.
+type QueueBoard struct {
+	DoctorID                   int          `json:"doctor_id"`
+	Date                       Date         `json:"date"`
+	NowServing                 *int         `json:"now_serving"`
+	AverageConsultationMinutes float64      `json:"average_consultation_minutes"`
+	Entries                    []QueueEntry `json:"entries"`
+}
+
+// errQueueEmpty is returned by callNext when nobody is waiting.
+var errQueueEmpty = errors.New("no patients waiting")
+
+// queueTransitionError reports a queue action the entry's status does not
+// allow.
+type queueTransitionError struct {
+	Status string
+	Action string
+}
+
+func (e *queueTransitionError) Error() string {
+	return "cannot " + e.Action + " a queue entry that is " + e.Status
+}
+
+// queueToday returns the clinic's current calendar day.
+func queueToday() Date {
+	return dateOf(time.Now().In(clinicLocation))
+}
+
+const queueEntryColumns = "id, doctor_id, queue_date, number, appointment_id, status, checked_in_at, called_at, served_at"
+
+func scanQueueEntry(row rowScanner) (QueueEntry, error) {
+	var entry QueueEntry
+	err := row.Scan(&entry.ID, &entry.DoctorID, &entry.QueueDate, &entry.Number, &entry.AppointmentID,
+		&entry.Status, &entry.CheckedInAt, &entry.CalledAt, &entry.ServedAt)
+	return entry, err
+}
+
+// syncQueue keeps an appointment's queue entry in step with its status. It
+// runs inside the transaction that changes the status.
+func syncQueue(tx *sql.Tx, appointmentID int, status string) error {
+	switch status {
+	case statusCheckedIn:
+		return issueQueueNumber(tx, appointmentID)
+	case statusInConsultation:
+		_, err := tx.Exec("UPDATE queue_entries SET status = ?, served_at = NOW() WHERE appointment_id = ? AND status IN (?, ?, ?)",
+			queueServed, appointmentID, queueWaiting, queueCalled, queueSkipped)
+		return err
+	case statusCancelled, statusNoShow:
+		_, err := tx.Exec("UPDATE queue_entries SET status = ? WHERE appointment_id = ? AND status IN (?, ?, ?)",
+			queueLeft, appointmentID, queueWaiting, queueCalled, queueSkipped)
+		return err
+	}
+	return nil
+}
+
+// issueQueueNumber gives a checked-in appointment the next number in its
+// doctor's queue for today. Appointments without a doctor are not queued.
+func issueQueueNumber(tx *sql.Tx, appointmentID int) error {
+	var doctorID int
+	err := tx.QueryRow("SELECT COALESCE(doctor_id, 0) FROM patient_appointments WHERE id = ?", appointmentID).Scan(&doctorID)
+	if err != nil || doctorID == 0 {
+		return err
+	}
+
+	// Locking the doctor serializes numbering within the doctor's queue
+	if err := tx.QueryRow("SELECT id FROM doctors WHERE id = ? FOR UPDATE", doctorID).Scan(&doctorID); err != nil {
+		return err
+	}
+
+	today := queueToday()
+	var number int
+	err = tx.QueryRow("SELECT COALESCE(MAX(number), 0) + 1 FROM queue_entries WHERE doctor_id = ? AND queue_date = ?", doctorID, today).Scan(&number)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("INSERT INTO queue_entries (doctor_id, queue_date, number, appointment_id, status, checked_in_at) VALUES (?, ?, ?, ?, ?, NOW())",
+		doctorID, today, number, appointmentID, queueWaiting)
+	return err
+}
+
+// findQueueEntryByAppointment loads the queue entry of an appointment.
+func findQueueEntryByAppointment(appointmentID int) (QueueEntry, error) {
+	return scanQueueEntry(db.QueryRow("SELECT "+queueEntryColumns+" FROM queue_entries WHERE appointment_id = ?", appointmentID))
+}
+
+// averageConsultation returns the doctor's mean consultation length over
+// queueHistoryWindow, measured from start to completion in the appointment
+// status history, or defaultAppointmentDuration without any history.
+func averageConsultation(doctorID int) (time.Duration, error) {
+	var seconds sql.NullFloat64
+	err := db.QueryRow("SELECT AVG(TIMESTAMPDIFF(SECOND, s.created_at, f.created_at))"+
+		" FROM appointment_status_history s"+
+		" JOIN appointment_status_history f ON f.appointment_id = s.appointment_id AND f.to_status = ?"+
+		" JOIN patient_appointments a ON a.id = s.appointment_id"+
+		" WHERE s.to_status = ? AND a.doctor_id = ? AND s.created_at >= ?",
+		statusCompleted, statusInConsultation, doctorID, time.Now().Add(-queueHistoryWindow).UTC()).Scan(&seconds)
+	if err != nil {
+		return 0, err
+	}
+	if !seconds.Valid || seconds.Float64 <= 0 {
+		return defaultAppointmentDuration, nil
+	}
+	return time.Duration(seconds.Float64 * float64(time.Second)), nil
+}
+
+// Handler function to get a doctor's queue for today
+func getTodayQueue(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("doctor_id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid doctor ID")
+	}
+
+	if _, err := findDoctor(id); err != nil {
+		if err == sql.ErrNoRows {
+			return c.String(http.StatusNotFound, "Doctor not found")
+		}
+		log.Println("Error getting doctor:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get doctor")
+	}
+
+	average, err := averageConsultation(id)
+	if err != nil {
+		log.Println("Error estimating consultation time:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get queue")
+	}
+
+	board := QueueBoard{
+		DoctorID:                   id,
+		Date:                       queueToday(),
+		AverageConsultationMinutes: average.Minutes(),
+		Entries:                    make([]QueueEntry, 0),
+	}
+
+	rows, err := db.Query("SELECT "+queueEntryColumns+" FROM queue_entries WHERE doctor_id = ? AND queue_date = ? ORDER BY number", id, board.Date)
+	if err != nil {
+		log.Println("Error querying queue:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get queue")
+	}
+	defer rows.Close()
+
+	// Everyone called but not yet seen is ahead of the waiting patients
+	var latestCall time.Time
+	ahead := 0
+	for rows.Next() {
+		entry, err := scanQueueEntry(rows)
+		if err != nil {
+			log.Println("Error scanning queue row:", err)
+			return c.String(http.StatusInternalServerError, "Failed to get queue")
+		}
+		switch entry.Status {
+		case queueCalled:
+			ahead++
+			fallthrough
+		case queueServed:
+			if entry.CalledAt != nil && !entry.CalledAt.Before(latestCall) {
+				latestCall = *entry.CalledAt
+				number := entry.Number
+				board.NowServing = &number
+			}
+		}
+		board.Entries = append(board.Entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Error reading queue:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get queue")
+	}
+
+	for i := range board.Entries {
+		if board.Entries[i].Status != queueWaiting {
+			continue
+		}
+		wait := int((time.Duration(ahead) * average).Round(time.Minute).Minutes())
+		board.Entries[i].EstimatedWaitMinutes = &wait
+		ahead++
+	}
+
+	return c.JSON(http.StatusOK, board)
+}
+
+// Handler function to register a walk-in patient. The walk-in is booked as
+// an appointment starting now, checked in straight away and queued.
+func createWalkIn(c echo.Context) error {
+	doctorID, err := strconv.Atoi(c.Param("doctor_id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid doctor ID")
+	}
+
+	var walkIn struct {
+		PatientID uint   `json:"patient_id"`
+		Notes     string `json:"notes"`
+	}
+	if err := c.Bind(&walkIn); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid request payload")
+	}
+
+	appointment := PatientAppointment{
+		PatientID:       walkIn.PatientID,
+		DoctorID:        doctorID,
+		AppointmentDate: time.Now().UTC().Truncate(time.Second),
+		Notes:           walkIn.Notes,
+		Status:          statusCheckedIn,
+	}
+
+	// Walk-ins are fitted into the queue, so the schedule and double-booking
+	// checks of createAppointment do not apply.
+	if err := validateAppointment(appointment, false); err != nil {
+		if status, message, ok := integrityError(err); ok {
+			return c.String(status, message)
+		}
+		log.Println("Error validating walk-in:", err)
+		return c.String(http.StatusInternalServerError, "Failed to register walk-in")
+	}
+
+	entry, err := insertWalkIn(appointment, currentActor(c))
+	if err != nil {
+		if status, message, ok := integrityError(err); ok {
+			return c.String(status, message)
+		}
+		log.Println("Error registering walk-in:", err)
+		return c.String(http.StatusInternalServerError, "Failed to register walk-in")
+	}
+	publishAppointment("created", int(entry.AppointmentID))
+	publishQueueEntry(entry)
+
+	return c.JSON(http.StatusCreated, entry)
+}
+
+// insertWalkIn stores a checked-in walk-in appointment and its queue entry.
+func insertWalkIn(appointment PatientAppointment, actor Actor) (QueueEntry, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return QueueEntry{}, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("INSERT INTO patient_appointments (patient_id, doctor_id, appointment_date, notes, prescription, status) VALUES (?, ?, ?, ?, '', ?)",
+		appointment.PatientID, appointment.DoctorID, appointment.AppointmentDate, appointment.Notes, appointment.Status)
+	if err != nil {
+		return QueueEntry{}, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return QueueEntry{}, err
+	}
+
+	_, err = tx.Exec("INSERT INTO appointment_status_history (appointment_id, from_status, to_status, actor_user_id, actor_role, reason) VALUES (?, '', ?, ?, ?, 'walk-in')",
+		id, appointment.Status, actor.nullableID(), actor.Role)
+	if err != nil {
+		return QueueEntry{}, err
+	}
+	if err := issueQueueNumber(tx, int(id)); err != nil {
+		return QueueEntry{}, err
+	}
+
+	entry, err := scanQueueEntry(tx.QueryRow("SELECT "+queueEntryColumns+" FROM queue_entries WHERE appointment_id = ?", id))
+	if err != nil {
+		return QueueEntry{}, err
+	}
+	return entry, tx.Commit()
+}
+
+// Handler function to call the next waiting patient in a doctor's queue
+func callNextPatient(c echo.Context) error {
+	doctorID, err := strconv.Atoi(c.Param("doctor_id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid doctor ID")
+	}
+
+	entry, err := callNext(doctorID)
+	if err != nil {
+		if err == errQueueEmpty {
+			return c.String(http.StatusNotFound, "No patients waiting")
+		}
+		log.Println("Error calling next patient:", err)
+		return c.String(http.StatusInternalServerError, "Failed to call next patient")
+	}
+	publishQueueEntry(entry)
+
+	return c.JSON(http.StatusOK, entry)
+}
+
+// callNext marks the lowest-numbered waiting entry in today's queue as called.
+func callNext(doctorID int) (QueueEntry, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return QueueEntry{}, err
+	}
+	defer tx.Rollback()
+
+	var id uint
+	err = tx.QueryRow("SELECT id FROM queue_entries WHERE doctor_id = ? AND queue_date = ? AND status = ? ORDER BY number LIMIT 1 FOR UPDATE",
+		doctorID, queueToday(), queueWaiting).Scan(&id)
+	if err == sql.ErrNoRows {
+		return QueueEntry{}, errQueueEmpty
+	}
+	if err != nil {
+		return QueueEntry{}, err
+	}
+
+	if _, err := tx.Exec("UPDATE queue_entries SET status = ?, called_at = NOW() WHERE id = ?", queueCalled, id); err != nil {
+		return QueueEntry{}, err
+	}
+
+	entry, err := scanQueueEntry(tx.QueryRow("SELECT "+queueEntryColumns+" FROM queue_entries WHERE id = ?", id))
+	if err != nil {
+		return QueueEntry{}, err
+	}
+	return entry, tx.Commit()
+}
+
+// queueActionHandler returns a handler that moves the entry with the queue
+// number in the path, in today's queue of the doctor in the path, from one of
+// the given statuses to another. Moving to called records the call time.
+func queueActionHandler(action string, from []string, to string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		doctorID, err := strconv.Atoi(c.Param("doctor_id"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid doctor ID")
+		}
+		number, err := strconv.Atoi(c.Param("number"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid queue number")
+		}
+
+		entry, err := moveQueueEntry(doctorID, number, action, from, to)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return c.String(http.StatusNotFound, "Queue entry not found")
+			}
+			var illegal *queueTransitionError
+			if errors.As(err, &illegal) {
+				return c.String(http.StatusConflict, illegal.Error())
+			}
+			log.Println("Error updating queue entry:", err)
+			return c.String(http.StatusInternalServerError, "Failed to update queue entry")
+		}
+		publishQueueEntry(entry)
+
+		return c.JSON(http.StatusOK, entry)
+	}
+}
+
+func moveQueueEntry(doctorID, number int, action string, from []string, to string) (QueueEntry, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return QueueEntry{}, err
+	}
+	defer tx.Rollback()
+
+	entry, err := scanQueueEntry(tx.QueryRow("SELECT "+queueEntryColumns+" FROM queue_entries WHERE doctor_id = ? AND queue_date = ? AND number = ? FOR UPDATE",
+		doctorID, queueToday(), number))
+	if err != nil {
+		return QueueEntry{}, err
+	}
+
+	allowed := false
+	for _, status := range from {
+		allowed = allowed || entry.Status == status
+	}
+	if !allowed {
+		return QueueEntry{}, &queueTransitionError{Status: entry.Status, Action: action}
+	}
+
+	query := "UPDATE queue_entries SET status = ? WHERE id = ?"
+	if to == queueCalled {
+		query = "UPDATE queue_entries SET status = ?, called_at = NOW() WHERE id = ?"
+	}
+	if _, err := tx.Exec(query, to, entry.ID); err != nil {
+		return QueueEntry{}, err
+	}
+
+	entry, err = scanQueueEntry(tx.QueryRow("SELECT "+queueEntryColumns+" FROM queue_entries WHERE id = ?", entry.ID))
+	if err != nil {
+		return QueueEntry{}, err
+	}
+	return entry, tx.Commit()
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// DrugRecall is a supplier recall of one or more lots of a drug. Recalling a
+// lot quarantines its remaining stock and blocks it from being dispensed.
+type DrugRecall struct {
+	ID        uint      `json:"id"`
+	DrugID    uint      `json:"drug_id"`
+	DrugName  string    `json:"drug_name"`
+	Reason    string    `json:"reason"`
+	Reference string    `json:"reference,omitempty"` // e.g. the supplier's recall notice
+	CreatedBy *uint     `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+
+	Lots             []RecalledLot      `json:"lots,omitempty"`
+	Affected         []AffectedDispense `json:"affected,omitempty"`
+	AffectedPatients int                `json:"affected_patients"`
+}
+
+// RecalledLot is a lot in a recall with the stock quarantined from it.
+type RecalledLot struct {
+	DrugLot
+	QuantityQuarantined Decimal `json:"quantity_quarantined"`
+}
+
+// AffectedDispense is a transaction that dispensed a recalled lot, with the
+// patient's contact details.
+type AffectedDispense struct {
+	TransactionID      uint      `json:"transaction_id"`
+	DispensedAt        time.Time `json:"dispensed_at"`
+	TransactionDeleted bool      `json:"transaction_deleted,omitempty"`
+	LotID              uint      `json:"lot_id"`
+	LotNumber          string    `json:"lot_number"`
+	Quantity           Decimal   `json:"quantity"`
+	PatientID          uint      `json:"patient_id"`
+	PatientName        string    `json:"patient_name"`
+	Nik                string    `json:"nik"`
+	Address            string    `json:"address"`
+	Phone              string    `json:"phone,omitempty"`
+	Email              string    `json:"email,omitempty"`
+	PreferredChannel   string    `json:"preferred_channel,omitempty"`
+}
+
+// recallError reports a lot that cannot be recalled.
+type recallError struct {
+	Status  int
+	Message string
+}
+
+func (e *recallError) Error() string {
+	return e.Message
+}
+
+// Handler function to recall lots of a drug, by lot_ids and/or lot_numbers.
+// Responds with the recall and the transactions and patients affected.
+func createDrugRecall(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid drug ID")
+	}
+
+	var body struct {
+		LotIDs     []uint   `json:"lot_ids"`
+		LotNumbers []string `json:"lot_numbers"`
+		Reason     string   `json:"reason"`
+		Reference  string   `json:"reference"`
+	}
+	if err := c.Bind(&body); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid request payload")
+	}
+	if len(body.LotIDs) == 0 && len(body.LotNumbers) == 0 {
+		return c.String(http.StatusUnprocessableEntity, "lot_ids or lot_numbers is required")
+	}
+	if body.Reason == "" {
+		return c.String(http.StatusUnprocessableEntity, "reason is required")
+	}
+
+	recallID, err := recallLots(uint(id), body.LotIDs, body.LotNumbers, body.Reason, body.Reference, currentActor(c))
+	if err != nil {
+		var refused *recallError
+		var ref *referenceError
+		switch {
+		case errors.As(err, &refused):
+			return c.String(refused.Status, refused.Message)
+		case errors.As(err, &ref):
+			return c.String(http.StatusNotFound, "Drug not found")
+		}
+		log.Println("Error recalling drug lots:", err)
+		return c.String(http.StatusInternalServerError, "Failed to create recall")
+	}
+
+	recall, err := findDrugRecall(int(recallID))
+	if err != nil {
+		log.Println("Error reading back recall:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get recall")
+	}
+	return c.JSON(http.StatusCreated, recall)
+}
+
+// recallLots records a recall and quarantines the remaining stock of its
+// lots in one database transaction.
+func recallLots(drugID uint, lotIDs []uint, lotNumbers []string, reason, reference string, actor Actor) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := lockDrugStock(tx, drugID); err != nil {
+		return 0, err
+	}
+
+	var lots []DrugLot
+	seen := make(map[uint]bool)
+	lookup := func(column string, value interface{}) error {
+		lot, err := scanDrugLot(tx.QueryRow("SELECT "+drugLotColumns+" FROM drug_lots WHERE drug_id = ? AND "+column+" = ? FOR UPDATE", drugID, value))
+		if err == sql.ErrNoRows {
+			return &recallError{http.StatusUnprocessableEntity, fmt.Sprintf("lot %v of drug %d does not exist", value, drugID)}
+		}
+		if err != nil {
+			return err
+		}
+		if lot.RecallID != nil {
+			return &recallError{http.StatusConflict, fmt.Sprintf("lot %s has already been recalled by recall %d", lot.LotNumber, *lot.RecallID)}
+		}
+		if !seen[lot.ID] {
+			seen[lot.ID] = true
+			lots = append(lots, lot)
+		}
+		return nil
+	}
+	for _, lotID := range lotIDs {
+		if err := lookup("id", lotID); err != nil {
+			return 0, err
+		}
+	}
+	for _, number := range lotNumbers {
+		if err := lookup("lot_number", number); err != nil {
+			return 0, err
+		}
+	}
+
+	result, err := tx.Exec("INSERT INTO drug_recalls (drug_id, reason, reference, created_by) VALUES (?, ?, ?, ?)",
+		drugID, reason, reference, actor.nullableID())
+	if err != nil {
+		return 0, err
+	}
+	recallID, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, lot := range lots {
+		if _, err := tx.Exec("UPDATE drug_lots SET recall_id = ? WHERE id = ?", recallID, lot.ID); err != nil {
+			return 0, err
+		}
+		if lot.QuantityOnHand.Sign() <= 0 {
+			continue
+		}
+		lotID := lot.ID
+		_, err := recordStockMovement(tx, StockMovement{
+			DrugID:    drugID,
+			Kind:      stockQuarantine,
+			Quantity:  lot.QuantityOnHand.Neg(),
+			LotID:     &lotID,
+			Reference: fmt.Sprintf("recall %d", recallID),
+			Reason:    reason,
+			CreatedBy: actor.nullableID(),
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return recallID, tx.Commit()
+}
+
+// findDrugRecall loads a recall with its lots and affected dispenses.
+func findDrugRecall(id int) (DrugRecall, error) {
+	var recall DrugRecall
+	err := db.QueryRow("SELECT r.id, r.drug_id, d.drug_name, r.reason, r.reference, r.created_by, r.created_at FROM drug_recalls r JOIN drugs d ON d.id = r.drug_id WHERE r.id = ?", id).
+		Scan(&recall.ID, &recall.DrugID, &recall.DrugName, &recall.Reason, &recall.Reference, &recall.CreatedBy, &recall.CreatedAt)
+	if err != nil {
+		return recall, err
+	}
+
+	rows, err := db.Query("SELECT "+drugLotColumns+" FROM drug_lots WHERE recall_id = ? ORDER BY expiry_date, id", id)
+	if err != nil {
+		return recall, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		lot, err := scanDrugLot(rows)
+		if err != nil {
+			return recall, err
+		}
+		recalled := RecalledLot{DrugLot: lot}
+		err = db.QueryRow("SELECT COALESCE(-SUM(quantity), 0) FROM stock_movements WHERE lot_id = ? AND kind = ?", lot.ID, stockQuarantine).
+			Scan(&recalled.QuantityQuarantined)
+		if err != nil {
+			return recall, err
+		}
+		recall.Lots = append(recall.Lots, recalled)
+	}
+	if err := rows.Err(); err != nil {
+		return recall, err
+	}
+
+	recall.Affected, err = affectedDispenses(id)
+	patients := make(map[uint]bool)
+	for _, affected := range recall.Affected {
+		patients[affected.PatientID] = true
+	}
+	recall.AffectedPatients = len(patients)
+	return recall, err
+}
+
+// affectedDispenses lists the transactions that dispensed the recall's lots,
+// net of corrections, including transactions deleted since.
+func affectedDispenses(recallID int) ([]AffectedDispense, error) {
+	rows, err := db.Query("SELECT t.id, t.created_at, t.deleted_at IS NOT NULL, l.id, l.lot_number, -SUM(m.quantity),"+
+		" p.id, p.name, p.nik, p.address, COALESCE(cp.phone, ''), COALESCE(cp.email, ''), COALESCE(cp.channel, '')"+
+		" FROM stock_movements m"+
+		" JOIN drug_lots l ON l.id = m.lot_id"+
+		" JOIN transactions t ON t.id = m.transaction_id"+
+		" JOIN patients p ON p.id = t.patient_id"+
+		" LEFT JOIN patient_contact_preferences cp ON cp.patient_id = p.id"+
+		" WHERE l.recall_id = ? AND m.kind = ?"+
+		" GROUP BY t.id, l.id HAVING SUM(m.quantity) < 0 ORDER BY p.name, p.id, t.id, l.id",
+		recallID, stockDispense)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	affected := make([]AffectedDispense, 0)
+	for rows.Next() {
+		var a AffectedDispense
+		err := rows.Scan(&a.TransactionID, &a.DispensedAt, &a.TransactionDeleted, &a.LotID, &a.LotNumber, &a.Quantity,
+			&a.PatientID, &a.PatientName, &a.Nik, &a.Address, &a.Phone, &a.Email, &a.PreferredChannel)
+		if err != nil {
+			return nil, err
+		}
+		affected = append(affected, a)
+	}
+	return affected, rows.Err()
+}
+
+// Handler function to list the recalls of a drug, newest first
+func getDrugRecalls(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid drug ID")
+	}
+
+	rows, err := db.Query("SELECT id FROM drug_recalls WHERE drug_id = ? ORDER BY id DESC", id)
+	if err != nil {
+		log.Println("Error querying recalls:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get recalls")
+	}
+	var ids []int
+	for rows.Next() {
+		var recallID int
+		if err := rows.Scan(&recallID); err != nil {
+			log.Println("Error scanning recall row:", err)
+			continue
+		}
+		ids = append(ids, recallID)
+	}
+	rows.Close()
+
+	recalls := make([]DrugRecall, 0, len(ids))
+	for _, recallID := range ids {
+		recall, err := findDrugRecall(recallID)
+		if err != nil {
+			log.Println("Error getting recall:", err)
+			return c.String(http.StatusInternalServerError, "Failed to get recalls")
+		}
+		recalls = append(recalls, recall)
+	}
+
+	return c.JSON(http.StatusOK, recalls)
+}
+
+// Handler function to get a recall with its affected transactions and
+// patients
+func getDrugRecall(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid recall ID")
+	}
+
+	recall, err := findDrugRecall(id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.String(http.StatusNotFound, "Recall not found")
+		}
+		log.Println("Error getting recall:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get recall")
+	}
+
+	return c.JSON(http.StatusOK, recall)
+}
+
+// Handler function to export the transactions and patients affected by a
+// recall as CSV, for contacting the patients
+func exportRecallAffected(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid recall ID")
+	}
+
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM drug_recalls WHERE id = ?)", id).Scan(&exists); err != nil || !exists {
+		if err != nil {
+			log.Println("Error getting recall:", err)
+			return c.String(http.StatusInternalServerError, "Failed to get recall")
+		}
+		return c.String(http.StatusNotFound, "Recall not found")
+	}
+
+	affected, err := affectedDispenses(id)
+	if err != nil {
+		log.Println("Error querying recall dispenses:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get recall")
+	}
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/csv; charset=utf-8")
+	res.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="recall-%d-affected.csv"`, id))
+	res.WriteHeader(http.StatusOK)
+
+	w := csv.NewWriter(res)
+	w.Write([]string{"patient_id", "patient_name", "nik", "phone", "email", "preferred_channel", "address",
+		"transaction_id", "dispensed_at", "lot_number", "quantity", "transaction_deleted"})
+	for _, a := range affected {
+		w.Write([]string{
+			strconv.FormatUint(uint64(a.PatientID), 10), a.PatientName, a.Nik, a.Phone, a.Email, a.PreferredChannel, a.Address,
+			strconv.FormatUint(uint64(a.TransactionID), 10), a.DispensedAt.In(clinicLocation).Format(time.RFC3339),
+			a.LotNumber, a.Quantity.String(), strconv.FormatBool(a.TransactionDeleted),
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Reminder delivery statuses
+const (
+	reminderPending     = "pending"     // claimed, being sent
+	reminderSent        = "sent"        // accepted by the provider
+	reminderFailed      = "failed"      // not accepted; retried while attempts remain
+	reminderSkipped     = "skipped"     // patient has no usable contact or opted out
+	reminderDelivered   = "delivered"   // provider confirmed delivery
+	reminderUndelivered = "undelivered" // provider reported a delivery failure
+)
+
+// reminderPolicy controls when appointment reminders are sent.
+type reminderPolicy struct {
+	Offsets     []time.Duration // before the appointment, shortest first
+	Interval    time.Duration   // how often the job runs
+	MaxAttempts int             // sends per reminder before giving up
+}
+
+// loadReminderPolicy reads the reminder policy from the environment.
+// REMINDER_OFFSETS is a comma-separated list of durations such as "24h,2h".
+func loadReminderPolicy() reminderPolicy {
+	policy := reminderPolicy{
+		Interval:    getenvDuration("REMINDER_INTERVAL", 5*time.Minute),
+		MaxAttempts: getenvInt("REMINDER_MAX_ATTEMPTS", 3),
+	}
+	for _, value := range strings.Split(getenv("REMINDER_OFFSETS", "24h,2h"), ",") {
+		offset, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || offset <= 0 {
+			log.Printf("Invalid reminder offset %q, ignoring it", value)
+			continue
+		}
+		policy.Offsets = append(policy.Offsets, offset)
+	}
+	sort.Slice(policy.Offsets, func(i, j int) bool { return policy.Offsets[i] < policy.Offsets[j] })
+	return policy
+}
+
+// startReminderJob sends due reminders now and then every policy.Interval in
+// the background.
+func startReminderJob(policy reminderPolicy, sender Notifier) {
+	if len(policy.Offsets) == 0 {
+		log.Println("No reminder offsets configured, reminders are disabled")
+		return
+	}
+	go func() {
+		for {
+			if err := sendDueReminders(policy, sender); err != nil {
+				log.Println("Error sending appointment reminders:", err)
+			}
+			time.Sleep(policy.Interval)
+		}
+	}()
+}
+
+// dueAppointment is an upcoming appointment the reminder job considers.
+type dueAppointment struct {
+	ID         int
+	PatientID  uint
+	At         time.Time
+	DoctorName string
+}
+
+// sendDueReminders sends the reminders that have come due. An appointment is
+// only reminded once per window: booked two hours ahead, it gets the 2h
+// reminder but not the 24h one.
+func sendDueReminders(policy reminderPolicy, sender Notifier) error {
+	now := time.Now().UTC()
+	longest := policy.Offsets[len(policy.Offsets)-1]
+
+	rows, err := db.Query("SELECT a.id, a.patient_id, a.appointment_date, COALESCE(u.name, '')"+
+		" FROM patient_appointments a"+
+		" LEFT JOIN doctors d ON d.id = a.doctor_id"+
+		" LEFT JOIN users u ON u.id = d.user_id"+
+		" WHERE a.deleted_at IS NULL AND a.status IN (?, ?) AND a.appointment_date > ? AND a.appointment_date <= ?",
+		statusRequested, statusConfirmed, now, now.Add(longest))
+	if err != nil {
+		return err
+	}
+	var due []dueAppointment
+	for rows.Next() {
+		var a dueAppointment
+		if err := rows.Scan(&a.ID, &a.PatientID, &a.At, &a.DoctorName); err != nil {
+			rows.Close()
+			return err
+		}
+		due = append(due, a)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, a := range due {
+		remaining := a.At.Sub(now)
+		for _, offset := range policy.Offsets {
+			if offset >= remaining {
+				if err := sendReminder(a, offset, policy.MaxAttempts, sender); err != nil {
+					log.Printf("Error sending reminder for appointment %d: %v", a.ID, err)
+				}
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// sendReminder sends the reminder for one appointment and offset unless it
+// has already been sent, or has failed too often.
+func sendReminder(a dueAppointment, offset time.Duration, maxAttempts int, sender Notifier) error {
+	id, claimed, err := claimReminder(a, offset, maxAttempts)
+	if err != nil || !claimed {
+		return err
+	}
+
+	prefs, err := findContactPreferences(a.PatientID)
+	if err != nil {
+		return err
+	}
+	msg, ok := prefs.message()
+	if !ok {
+		_, err := db.Exec("UPDATE appointment_reminders SET status = ?, last_error = ? WHERE id = ?",
+			reminderSkipped, "no usable contact or reminders disabled", id)
+		return err
+	}
+	msg.Subject, msg.Body = reminderText(a)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	providerID, sendErr := sender.Send(ctx, msg)
+	if sendErr != nil {
+		_, err = db.Exec("UPDATE appointment_reminders SET status = ?, channel = ?, recipient = ?, attempts = attempts + 1, last_error = ? WHERE id = ?",
+			reminderFailed, msg.Channel, msg.To, sendErr.Error(), id)
+		return err
+	}
+	_, err = db.Exec("UPDATE appointment_reminders SET status = ?, channel = ?, recipient = ?, attempts = attempts + 1, last_error = '', provider_message_id = ?, sent_at = NOW() WHERE id = ?",
+		reminderSent, msg.Channel, msg.To, providerID, id)
+	return err
+}
+
+// claimReminder records that a reminder is being sent, so concurrent runs
+// never send it twice. claimed is false when it was sent or given up on
+// already. Reminders are keyed by the appointment time they were due for, so
+// a rescheduled appointment is reminded again.
+func claimReminder(a dueAppointment, offset time.Duration, maxAttempts int) (id int64, claimed bool, err error) {
+	minutes := int(offset / time.Minute)
+	scheduledFor := a.At.Add(-offset).UTC()
+
+	// Without CLIENT_FOUND_ROWS, MySQL reports 0 affected rows for a
+	// duplicate that is left unchanged.
+	result, err := db.Exec("INSERT INTO appointment_reminders (appointment_id, offset_minutes, scheduled_for, status) VALUES (?, ?, ?, ?)"+
+		" ON DUPLICATE KEY UPDATE id = id",
+		a.ID, minutes, scheduledFor, reminderPending)
+	if err != nil {
+		return 0, false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return 0, false, err
+	}
+	if affected == 1 {
+		id, err = result.LastInsertId()
+		return id, err == nil, err
+	}
+
+	var attempts int
+	var status string
+	err = db.QueryRow("SELECT id, status, attempts FROM appointment_reminders WHERE appointment_id = ? AND offset_minutes = ? AND scheduled_for = ?",
+		a.ID, minutes, scheduledFor).Scan(&id, &status, &attempts)
+	if err != nil || status != reminderFailed || attempts >= maxAttempts {
+		return 0, false, err
+	}
+
+	result, err = db.Exec("UPDATE appointment_reminders SET status = ? WHERE id = ? AND status = ?", reminderPending, id, reminderFailed)
+	if err != nil {
+		return 0, false, err
+	}
+	affected, err = result.RowsAffected()
+	return id, affected == 1, err
+}
+
+// reminderText renders the subject and body of an appointment reminder in
+// the clinic's timezone.
+func reminderText(a dueAppointment) (subject, body string) {
+	local := a.At.In(clinicLocation)
+	with := "your appointment"
+	if a.DoctorName != "" {
+		with = "your appointment with " + a.DoctorName
+	}
+	subject = "Appointment reminder"
+	body = fmt.Sprintf("Reminder: %s is on %s at %s %s.", with,
+		local.Format("Monday, 2 January 2006"), local.Format("15:04"), local.Format("MST"))
+	return subject, body
+}
+
+// ContactPreferences says how a patient wants to be reminded
+type ContactPreferences struct {
+	PatientID        uint      `json:"patient_id"`
+	Channel          string    `json:"channel"` // sms, email, whatsapp or none
+	Phone            string    `json:"phone"`   // E.164, e.g. +6281234567890
+	Email            string    `json:"email"`
+	RemindersEnabled bool      `json:"reminders_enabled"`
+	UpdatedAt        time.Time `json:"updated_at"`
+}
+
+var phonePattern = regexp.MustCompile(`^\+[1-9][0-9]{7,14}$`)
+
+// validate checks that the preferred channel has an address to send to.
+func (p ContactPreferences) validate() error {
+	if p.Phone != "" && !phonePattern.MatchString(p.Phone) {
+		return fmt.Errorf("phone must be in international format, e.g. +6281234567890")
+	}
+	if p.Email != "" && !strings.Contains(p.Email, "@") {
+		return fmt.Errorf("email is not a valid address")
+	}
+	switch p.Channel {
+	case channelSMS, channelWhatsApp:
+		if p.Phone == "" {
+			return fmt.Errorf("channel %s requires a phone number", p.Channel)
+		}
+	case channelEmail:
+		if p.Email == "" {
+			return fmt.Errorf("channel email requires an email address")
+		}
+	case channelNone:
+	default:
+		return fmt.Errorf("channel must be one of sms, email, whatsapp or none")
+	}
+	return nil
+}
+
+// message returns a Message addressed over the patient's preferred channel,
+// without subject or body, or false when the patient should not be contacted.
+func (p ContactPreferences) message() (Message, bool) {
+	if !p.RemindersEnabled {
+		return Message{}, false
+	}
+	switch p.Channel {
+	case channelSMS, channelWhatsApp:
+		return Message{Channel: p.Channel, To: p.Phone}, p.Phone != ""
+	case channelEmail:
+		return Message{Channel: p.Channel, To: p.Email}, p.Email != ""
+	}
+	return Message{}, false
+}
+
+// findContactPreferences loads a patient's contact preferences. Patients
+// who never set any are not contacted.
+func findContactPreferences(patientID uint) (ContactPreferences, error) {
+	prefs := ContactPreferences{PatientID: patientID, Channel: channelNone}
+	err := db.QueryRow("SELECT channel, phone, email, reminders_enabled, updated_at FROM patient_contact_preferences WHERE patient_id = ?", patientID).
+		Scan(&prefs.Channel, &prefs.Phone, &prefs.Email, &prefs.RemindersEnabled, &prefs.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return prefs, nil
+	}
+	return prefs, err
+}
+
+// Handler function to get a patient's contact preferences
+func getContactPreferences(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid patient ID")
+	}
+
+	if _, err := findPatient(id, false); err != nil {
+		if err == sql.ErrNoRows {
+			return c.String(http.StatusNotFound, "Patient not found")
+		}
+		log.Println("Error getting patient:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get patient")
+	}
+
+	prefs, err := findContactPreferences(uint(id))
+	if err != nil {
+		log.Println("Error getting contact preferences:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get contact preferences")
+	}
+
+	return c.JSON(http.StatusOK, prefs)
+}
+
+// Handler function to replace a patient's contact preferences
+func updateContactPreferences(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid patient ID")
+	}
+
+	var prefs ContactPreferences
+	if err := c.Bind(&prefs); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid request payload")
+	}
+	if err := prefs.validate(); err != nil {
+		return c.String(http.StatusUnprocessableEntity, err.Error())
+	}
+
+	if _, err := findPatient(id, false); err != nil {
+		if err == sql.ErrNoRows {
+			return c.String(http.StatusNotFound, "Patient not found")
+		}
+		log.Println("Error getting patient:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get patient")
+	}
+
+	_, err = db.Exec("INSERT INTO patient_contact_preferences (patient_id, channel, phone, email, reminders_enabled) VALUES (?, ?, ?, ?, ?)"+
+		" ON DUPLICATE KEY UPDATE channel = VALUES(channel), phone = VALUES(phone), email = VALUES(email), reminders_enabled = VALUES(reminders_enabled)",
+		id, prefs.Channel, prefs.Phone, prefs.Email, prefs.RemindersEnabled)
+	if err != nil {
+		log.Println("Error updating contact preferences:", err)
+		return c.String(http.StatusInternalServerError, "Failed to update contact preferences")
+	}
+
+	return getContactPreferences(c)
+}
+
+// Reminder is the delivery record of one appointment reminder
+type Reminder struct {
+	ID                uint       `json:"id"`
+	AppointmentID     uint       `json:"appointment_id"`
+	OffsetMinutes     int        `json:"offset_minutes"`
+	Channel           string     `json:"channel"`
+	Recipient         string     `json:"recipient"`
+	Status            string     `json:"status"`
+	Attempts          int        `json:"attempts"`
+	LastError         string     `json:"last_error,omitempty"`
+	ProviderMessageID string     `json:"provider_message_id,omitempty"`
+	ScheduledFor      time.Time  `json:"scheduled_for"`
+	SentAt            *time.Time `json:"sent_at,omitempty"`
+	DeliveredAt       *time.Time `json:"delivered_at,omitempty"`
+}
+
+// Handler function to get the reminders sent for an appointment
+func getAppointmentReminders(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid appointment ID")
+	}
+
+	if _, err := findAppointment(id, false); err != nil {
+		if err == sql.ErrNoRows {
+			return c.String(http.StatusNotFound, "Appointment not found")
+		}
+		log.Println("Error getting appointment:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get appointment")
+	}
+
+	rows, err := db.Query("SELECT id, appointment_id, offset_minutes, channel, recipient, status, attempts, last_error, provider_message_id, scheduled_for, sent_at, delivered_at"+
+		" FROM appointment_reminders WHERE appointment_id = ? ORDER BY scheduled_for", id)
+	if err != nil {
+		log.Println("Error querying reminders:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get reminders")
+	}
+	defer rows.Close()
+
+	reminders := make([]Reminder, 0)
+	for rows.Next() {
+		var r Reminder
+		err := rows.Scan(&r.ID, &r.AppointmentID, &r.OffsetMinutes, &r.Channel, &r.Recipient, &r.Status, &r.Attempts,
+			&r.LastError, &r.ProviderMessageID, &r.ScheduledFor, &r.SentAt, &r.DeliveredAt)
+		if err != nil {
+			log.Println("Error scanning reminder row:", err)
+			continue
+		}
+		reminders = append(reminders, r)
+	}
+
+	return c.JSON(http.StatusOK, reminders)
+}
+
+// Handler function for provider delivery receipts. Providers post
+// {"provider_message_id": "...", "status": "delivered" | "undelivered",
+// "error": "..."} with the shared secret in X-Webhook-Secret.
+func updateDeliveryStatus(c echo.Context) error {
+	secret := os.Getenv("NOTIFY_WEBHOOK_SECRET")
+	if secret == "" || c.Request().Header.Get("X-Webhook-Secret") != secret {
+		return c.String(http.StatusForbidden, "Invalid webhook secret")
+	}
+
+	var receipt struct {
+		ProviderMessageID string `json:"provider_message_id"`
+		Status            string `json:"status"`
+		Error             string `json:"error"`
+	}
+	if err := c.Bind(&receipt); err != nil || receipt.ProviderMessageID == "" {
+		return c.String(http.StatusBadRequest, "Invalid request payload")
+	}
+
+	var result sql.Result
+	var err error
+	switch receipt.Status {
+	case reminderDelivered:
+		result, err = db.Exec("UPDATE appointment_reminders SET status = ?, delivered_at = NOW() WHERE provider_message_id = ?",
+			reminderDelivered, receipt.ProviderMessageID)
+	case reminderUndelivered:
+		result, err = db.Exec("UPDATE appointment_reminders SET status = ?, last_error = ? WHERE provider_message_id = ?",
+			reminderUndelivered, receipt.Error, receipt.ProviderMessageID)
+	default:
+		return c.String(http.StatusUnprocessableEntity, "status must be delivered or undelivered")
+	}
+	if err != nil {
+		log.Println("Error updating delivery status:", err)
+		return c.String(http.StatusInternalServerError, "Failed to update delivery status")
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return c.String(http.StatusNotFound, "Reminder not found")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
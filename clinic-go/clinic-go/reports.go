@@ -0,0 +1,104 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// DailyReport summarises one local calendar day at the clinic
+type DailyReport struct {
+	Date         Date                    `json:"date"`
+	Timezone     string                  `json:"timezone"`
+	From         time.Time               `json:"from"`
+	To           time.Time               `json:"to"`
+	Appointments DailyAppointmentSummary `json:"appointments"`
+	Transactions DailyTransactionSummary `json:"transactions"`
+}
+
+// DailyAppointmentSummary counts the appointments scheduled on a day
+type DailyAppointmentSummary struct {
+	Total    int            `json:"total"`
+	ByStatus map[string]int `json:"by_status"`
+}
+
+// DailyTransactionSummary totals the transactions recorded on a day, in
+// the base currency and by the currency they were charged in
+type DailyTransactionSummary struct {
+	Count        int                `json:"count"`
+	BaseCurrency string             `json:"base_currency"`
+	Total        Decimal            `json:"total"`       // in BaseCurrency
+	Unconverted  int                `json:"unconverted"` // transactions left out of Total for want of an exchange rate
+	Totals       map[string]Decimal `json:"totals"`      // by currency charged
+}
+
+// Handler function to get the report for one day, ?date=YYYY-MM-DD in the
+// clinic's timezone (defaults to today)
+func getDailyReport(c echo.Context) error {
+	from, to := clinicDay(time.Now())
+	if param := c.QueryParam("date"); param != "" {
+		day, err := parseDate(param)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid date, want YYYY-MM-DD")
+		}
+		from, to = clinicDay(time.Date(day.Year, day.Month, day.Day, 12, 0, 0, 0, clinicLocation))
+	}
+
+	report := DailyReport{
+		Date:         dateOf(from),
+		Timezone:     clinicLocation.String(),
+		From:         from,
+		To:           to,
+		Appointments: DailyAppointmentSummary{ByStatus: make(map[string]int)},
+		Transactions: DailyTransactionSummary{BaseCurrency: baseCurrency, Total: roundMoney(decimalFromInt(0), baseCurrency), Totals: make(map[string]Decimal)},
+	}
+
+	rows, err := db.Query("SELECT status, COUNT(*) FROM patient_appointments WHERE deleted_at IS NULL AND appointment_date >= ? AND appointment_date < ? GROUP BY status",
+		from.UTC(), to.UTC())
+	if err != nil {
+		log.Println("Error querying daily appointments:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get daily report")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var status string
+		var count int
+		if err := rows.Scan(&status, &count); err != nil {
+			log.Println("Error scanning daily appointments:", err)
+			return c.String(http.StatusInternalServerError, "Failed to get daily report")
+		}
+		report.Appointments.ByStatus[status] = count
+		report.Appointments.Total += count
+	}
+
+	rows, err = db.Query("SELECT currency, base_currency = ?, COUNT(*), SUM(total_price), SUM(base_total_price) FROM transactions"+
+		" WHERE deleted_at IS NULL AND created_at >= ? AND created_at < ? GROUP BY currency, base_currency = ?",
+		baseCurrency, from.UTC(), to.UTC(), baseCurrency)
+	if err != nil {
+		log.Println("Error querying daily transactions:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get daily report")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var currency string
+		var converted bool
+		var count int
+		var total, baseTotal Decimal
+		if err := rows.Scan(&currency, &converted, &count, &total, &baseTotal); err != nil {
+			log.Println("Error scanning daily transactions:", err)
+			return c.String(http.StatusInternalServerError, "Failed to get daily report")
+		}
+		summary := &report.Transactions
+		summary.Totals[currency] = roundMoney(summary.Totals[currency].Add(total), currency)
+		summary.Count += count
+		if converted {
+			summary.Total = roundMoney(summary.Total.Add(baseTotal), baseCurrency)
+		} else {
+			summary.Unconverted += count
+		}
+	}
+
+	return c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// Retention actions applied to soft-deleted records once their retention
+// period has passed.
+const (
+	retentionAnonymize = "anonymize"
+	retentionPurge     = "purge"
+)
+
+// retentionPolicy controls when soft-deleted records may leave the database.
+// Periods are counted from the deletion date, so a record is always kept at
+// least as long as the law requires from its last change.
+type retentionPolicy struct {
+	MedicalYears   int           // patients and appointments
+	FinancialYears int           // transactions
+	Action         string        // retentionAnonymize or retentionPurge
+	Interval       time.Duration // how often the job runs
+}
+
+// loadRetentionPolicy reads the retention policy from the environment. The
+// defaults follow the Indonesian rules for medical records (25 years) and
+// financial records (10 years), and anonymize rather than purge.
+func loadRetentionPolicy() retentionPolicy {
+	policy := retentionPolicy{
+		MedicalYears:   getenvInt("RETENTION_MEDICAL_YEARS", 25),
+		FinancialYears: getenvInt("RETENTION_FINANCIAL_YEARS", 10),
+		Action:         getenv("RETENTION_ACTION", retentionAnonymize),
+		Interval:       getenvDuration("RETENTION_INTERVAL", 24*time.Hour),
+	}
+	if policy.Action != retentionAnonymize && policy.Action != retentionPurge {
+		log.Printf("Unknown RETENTION_ACTION %q, using %q", policy.Action, retentionAnonymize)
+		policy.Action = retentionAnonymize
+	}
+	return policy
+}
+
+// startRetentionJob runs the retention policy now and then every
+// policy.Interval in the background.
+func startRetentionJob(policy retentionPolicy) {
+	go func() {
+		for {
+			if err := applyRetention(policy); err != nil {
+				log.Println("Error applying retention policy:", err)
+			}
+			time.Sleep(policy.Interval)
+		}
+	}()
+}
+
+// retentionStep is one statement of the retention job together with the
+// retention period, in years, it is bound to.
+type retentionStep struct {
+	query string
+	years int
+}
+
+// retentionSteps returns the statements applying policy, in order. Steps
+// that anonymize the rows of a record come before the step that marks the
+// record itself anonymized, since they select by its anonymized_at.
+func retentionSteps(policy retentionPolicy) []retentionStep {
+	if policy.Action == retentionPurge {
+		return purgeSteps(policy)
+	}
+	return []retentionStep{
+		{`UPDATE prescriptions p JOIN patient_appointments a ON a.id = p.appointment_id SET p.notes = '', p.cancel_reason = ''
+			WHERE a.deleted_at < NOW() - INTERVAL ? YEAR AND a.anonymized_at IS NULL`, policy.MedicalYears},
+		{`UPDATE prescription_items i JOIN prescriptions p ON p.id = i.prescription_id JOIN patient_appointments a ON a.id = p.appointment_id
+			SET i.instructions = '' WHERE a.deleted_at < NOW() - INTERVAL ? YEAR AND a.anonymized_at IS NULL`, policy.MedicalYears},
+		{`UPDATE appointment_status_history h JOIN patient_appointments a ON a.id = h.appointment_id SET h.reason = ''
+			WHERE a.deleted_at < NOW() - INTERVAL ? YEAR AND a.anonymized_at IS NULL`, policy.MedicalYears},
+		{`UPDATE appointment_reminders r JOIN patient_appointments a ON a.id = r.appointment_id SET r.recipient = ''
+			WHERE a.deleted_at < NOW() - INTERVAL ? YEAR AND a.anonymized_at IS NULL`, policy.MedicalYears},
+		{`UPDATE patient_appointments SET notes = '', prescription = '', anonymized_at = NOW()
+			WHERE deleted_at < NOW() - INTERVAL ? YEAR AND anonymized_at IS NULL`, policy.MedicalYears},
+		{`UPDATE transactions SET prescription = '', anonymized_at = NOW()
+			WHERE deleted_at < NOW() - INTERVAL ? YEAR AND anonymized_at IS NULL`, policy.FinancialYears},
+		{`DELETE c FROM patient_contact_preferences c JOIN patients p ON p.id = c.patient_id
+			WHERE p.deleted_at < NOW() - INTERVAL ? YEAR AND p.anonymized_at IS NULL`, policy.MedicalYears},
+		{`DELETE a FROM patient_allergies a JOIN patients p ON p.id = a.patient_id
+			WHERE p.deleted_at < NOW() - INTERVAL ? YEAR AND p.anonymized_at IS NULL`, policy.MedicalYears},
+		{`DELETE f FROM calendar_feeds f JOIN patients p ON p.id = f.owner_id AND f.owner_type = 'patient'
+			WHERE p.deleted_at < NOW() - INTERVAL ? YEAR AND p.anonymized_at IS NULL`, policy.MedicalYears},
+		{`DELETE w FROM waitlist_entries w JOIN patients p ON p.id = w.patient_id
+			WHERE p.deleted_at < NOW() - INTERVAL ? YEAR AND p.anonymized_at IS NULL`, policy.MedicalYears},
+		{`UPDATE appointment_series s JOIN patients p ON p.id = s.patient_id SET s.notes = ''
+			WHERE p.deleted_at < NOW() - INTERVAL ? YEAR AND p.anonymized_at IS NULL`, policy.MedicalYears},
+		// Keep the birth year so age statistics survive anonymization.
+		{`UPDATE patients SET nik = CONCAT('ANON-', id), name = 'Anonymized patient', address = '', password = '',
+			date_of_birth = MAKEDATE(YEAR(date_of_birth), 1), anonymized_at = NOW()
+			WHERE deleted_at < NOW() - INTERVAL ? YEAR AND anonymized_at IS NULL`, policy.MedicalYears},
+	}
+}
+
+// purgeSteps returns the statements deleting expired records, children
+// before the records they reference.
+func purgeSteps(policy retentionPolicy) []retentionStep {
+	return []retentionStep{
+		// Prescriptions go with their appointment unless a transaction
+		// still references them, which keeps the appointment too.
+		{`DELETE p FROM prescriptions p JOIN patient_appointments a ON a.id = p.appointment_id
+			WHERE a.deleted_at < NOW() - INTERVAL ? YEAR AND NOT EXISTS (SELECT 1 FROM prescription_items i
+			JOIN transactions t ON t.prescription_item_id = i.id WHERE i.prescription_id = p.id)`, policy.MedicalYears},
+		{`DELETE h FROM appointment_status_history h JOIN patient_appointments a ON a.id = h.appointment_id
+			WHERE a.deleted_at < NOW() - INTERVAL ? YEAR AND NOT EXISTS (SELECT 1 FROM prescriptions p WHERE p.appointment_id = a.id)`, policy.MedicalYears},
+		{`DELETE FROM patient_appointments WHERE deleted_at < NOW() - INTERVAL ? YEAR
+			AND NOT EXISTS (SELECT 1 FROM prescriptions p WHERE p.appointment_id = patient_appointments.id)`, policy.MedicalYears},
+		{"DELETE FROM transactions WHERE deleted_at < NOW() - INTERVAL ? YEAR", policy.FinancialYears},
+		// Series go with the patient once none of their appointments are left.
+		{`DELETE s FROM appointment_series s JOIN patients p ON p.id = s.patient_id
+			WHERE p.deleted_at < NOW() - INTERVAL ? YEAR AND NOT EXISTS (SELECT 1 FROM patient_appointments a WHERE a.series_id = s.id)`, policy.MedicalYears},
+		{`DELETE f FROM calendar_feeds f JOIN patients p ON p.id = f.owner_id AND f.owner_type = 'patient'
+			WHERE p.deleted_at < NOW() - INTERVAL ? YEAR`, policy.MedicalYears},
+		// Patients go last, and only once nothing references them any more.
+		// Their waitlist entries, allergies and contact preferences cascade.
+		{`DELETE FROM patients WHERE deleted_at < NOW() - INTERVAL ? YEAR
+			AND NOT EXISTS (SELECT 1 FROM patient_appointments a WHERE a.patient_id = patients.id)
+			AND NOT EXISTS (SELECT 1 FROM appointment_series s WHERE s.patient_id = patients.id)
+			AND NOT EXISTS (SELECT 1 FROM transactions t WHERE t.patient_id = patients.id)`, policy.MedicalYears},
+	}
+}
+
+// applyRetention anonymizes or purges every soft-deleted record whose
+// retention period has expired.
+func applyRetention(policy retentionPolicy) error {
+	for _, step := range retentionSteps(policy) {
+		result, err := db.Exec(step.query, step.years)
+		if err != nil {
+			return err
+		}
+		if affected, err := result.RowsAffected(); err == nil && affected > 0 {
+			log.Printf("Retention (%s): %d record(s) affected", policy.Action, affected)
+		}
+	}
+
+	return nil
+}
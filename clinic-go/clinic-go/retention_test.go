@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestRetentionAnonymizeOrder checks that every step selecting rows by an
+// appointment's or patient's anonymized_at runs before the step that sets
+// it, or the step would never match.
+func TestRetentionAnonymizeOrder(t *testing.T) {
+	steps := retentionSteps(retentionPolicy{MedicalYears: 25, FinancialYears: 10, Action: retentionAnonymize})
+	tests := []struct {
+		table  string // the record marked anonymized
+		marker string // the start of the step that marks it
+		guard  string // how dependent steps select by its anonymized_at
+	}{
+		{"patient_appointments", "UPDATE patient_appointments SET", "a.anonymized_at IS NULL"},
+		{"patients", "UPDATE patients SET", "p.anonymized_at IS NULL"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.table, func(t *testing.T) {
+			marker, dependents := -1, 0
+			for i, step := range steps {
+				query := strings.TrimSpace(step.query)
+				switch {
+				case strings.HasPrefix(query, tt.marker):
+					marker = i
+				case strings.Contains(query, "JOIN "+tt.table+" ") && strings.Contains(query, tt.guard):
+					dependents++
+					if marker >= 0 {
+						t.Errorf("step %d runs after %s is marked anonymized: %s", i, tt.table, strings.Join(strings.Fields(query)[:4], " "))
+					}
+				}
+			}
+			if marker < 0 {
+				t.Fatalf("no step marks %s anonymized", tt.table)
+			}
+			if dependents == 0 {
+				t.Errorf("no steps depend on %s", tt.table)
+			}
+		})
+	}
+}
@@ -0,0 +1,628 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Kinds of schedule exceptions
+const (
+	exceptionLeave   = "leave"
+	exceptionHoliday = "holiday"
+)
+
+// maxSlotRangeDays bounds how many days a single slots request may cover
+const maxSlotRangeDays = 31
+
+// ClockTime is a time of day in minutes after midnight, encoded as "HH:MM"
+type ClockTime int
+
+// parseClockTime parses an "HH:MM" or "HH:MM:SS" string.
+func parseClockTime(s string) (ClockTime, error) {
+	var hour, minute, second int
+	n, _ := fmt.Sscanf(s, "%d:%d:%d", &hour, &minute, &second)
+	if n < 2 || hour < 0 || hour > 24 || minute < 0 || minute > 59 || (hour == 24 && minute > 0) {
+		return 0, fmt.Errorf("invalid time of day %q, want HH:MM", s)
+	}
+	return ClockTime(hour*60 + minute), nil
+}
+
+func (t ClockTime) String() string {
+	return fmt.Sprintf("%02d:%02d", int(t)/60, int(t)%60)
+}
+
+// on returns the instant t on the local date d.
+func (t ClockTime) on(d Date) time.Time {
+	return time.Date(d.Year, d.Month, d.Day, 0, int(t), 0, 0, clinicLocation)
+}
+
+// MarshalJSON implements json.Marshaler.
+func (t ClockTime) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (t *ClockTime) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := parseClockTime(s)
+	if err != nil {
+		return err
+	}
+	*t = parsed
+	return nil
+}
+
+// Scan implements sql.Scanner for TIME columns.
+func (t *ClockTime) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case []byte:
+		return t.scanString(string(v))
+	case string:
+		return t.scanString(v)
+	default:
+		return fmt.Errorf("cannot scan %T into ClockTime", src)
+	}
+}
+
+func (t *ClockTime) scanString(s string) error {
+	parsed, err := parseClockTime(s)
+	if err != nil {
+		return err
+	}
+	*t = parsed
+	return nil
+}
+
+// Value implements driver.Valuer.
+func (t ClockTime) Value() (driver.Value, error) {
+	return t.String() + ":00", nil
+}
+
+// WeeklySchedule is a recurring working window of a doctor on one weekday
+type WeeklySchedule struct {
+	ID          uint      `json:"id"`
+	Weekday     int       `json:"weekday"` // 0 = Sunday
+	StartTime   ClockTime `json:"start_time"`
+	EndTime     ClockTime `json:"end_time"`
+	SlotMinutes int       `json:"slot_minutes"`
+}
+
+// ScheduleBreak is a recurring pause inside a doctor's working windows
+type ScheduleBreak struct {
+	ID        uint      `json:"id"`
+	Weekday   int       `json:"weekday"` // 0 = Sunday
+	StartTime ClockTime `json:"start_time"`
+	EndTime   ClockTime `json:"end_time"`
+}
+
+// DoctorSchedule is the complete recurring schedule of a doctor
+type DoctorSchedule struct {
+	Weekly []WeeklySchedule `json:"weekly"`
+	Breaks []ScheduleBreak  `json:"breaks"`
+}
+
+// ScheduleException removes time from the schedule on a given date: a
+// doctor's leave, or a clinic-wide holiday when DoctorID is nil
+type ScheduleException struct {
+	ID        uint       `json:"id"`
+	DoctorID  *int       `json:"doctor_id"`
+	Date      Date       `json:"date"`
+	StartTime *ClockTime `json:"start_time,omitempty"` // nil for the whole day
+	EndTime   *ClockTime `json:"end_time,omitempty"`
+	Kind      string     `json:"kind"`
+	Reason    string     `json:"reason"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// Slot is a bookable period of a doctor's time
+type Slot struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// validate checks that the schedule is internally consistent.
+func (s DoctorSchedule) validate() error {
+	for _, w := range s.Weekly {
+		if w.Weekday < 0 || w.Weekday > 6 {
+			return fmt.Errorf("weekday must be between 0 (Sunday) and 6 (Saturday)")
+		}
+		if w.StartTime >= w.EndTime {
+			return fmt.Errorf("start_time %s must be before end_time %s", w.StartTime, w.EndTime)
+		}
+		if w.SlotMinutes < 5 || w.SlotMinutes > int(w.EndTime-w.StartTime) {
+			return fmt.Errorf("slot_minutes must be at least 5 and fit in %s-%s", w.StartTime, w.EndTime)
+		}
+	}
+	for _, b := range s.Breaks {
+		if b.Weekday < 0 || b.Weekday > 6 {
+			return fmt.Errorf("weekday must be between 0 (Sunday) and 6 (Saturday)")
+		}
+		if b.StartTime >= b.EndTime {
+			return fmt.Errorf("break start_time %s must be before end_time %s", b.StartTime, b.EndTime)
+		}
+	}
+	return nil
+}
+
+// covers reports whether the exception removes [start, end) on its date.
+func (e ScheduleException) covers(start, end time.Time) bool {
+	if e.StartTime == nil || e.EndTime == nil {
+		dayStart := e.Date.In(clinicLocation)
+		return start.Before(dayStart.AddDate(0, 0, 1)) && end.After(dayStart)
+	}
+	return start.Before(e.EndTime.on(e.Date)) && end.After(e.StartTime.on(e.Date))
+}
+
+// buildSlots expands a schedule into slots for the local dates from through
+// to, leaving out breaks, exceptions and slots already holding one of the
+// busy appointment times.
+func buildSlots(schedule DoctorSchedule, exceptions []ScheduleException, busy []time.Time, from, to Date) []Slot {
+	slots := make([]Slot, 0)
+	for day := from; !to.Before(day); day = day.AddDays(1) {
+		weekday := int(day.In(clinicLocation).Weekday())
+		for _, window := range schedule.Weekly {
+			if window.Weekday != weekday {
+				continue
+			}
+			step := ClockTime(window.SlotMinutes)
+			for t := window.StartTime; t+step <= window.EndTime; t += step {
+				slot := Slot{Start: t.on(day), End: (t + step).on(day)}
+				if !slotAvailable(slot, weekday, schedule.Breaks, exceptions, busy) {
+					continue
+				}
+				slots = append(slots, slot)
+			}
+		}
+	}
+	return slots
+}
+
+func slotAvailable(slot Slot, weekday int, breaks []ScheduleBreak, exceptions []ScheduleException, busy []time.Time) bool {
+	day := dateOf(slot.Start)
+	for _, b := range breaks {
+		if b.Weekday == weekday && slot.Start.Before(b.EndTime.on(day)) && slot.End.After(b.StartTime.on(day)) {
+			return false
+		}
+	}
+	for _, e := range exceptions {
+		if e.covers(slot.Start, slot.End) {
+			return false
+		}
+	}
+	for _, at := range busy {
+		if !at.Before(slot.Start) && at.Before(slot.End) {
+			return false
+		}
+	}
+	return true
+}
+
+// loadDoctorSchedule reads the recurring schedule of a doctor.
+func loadDoctorSchedule(doctorID int) (DoctorSchedule, error) {
+	schedule := DoctorSchedule{Weekly: make([]WeeklySchedule, 0), Breaks: make([]ScheduleBreak, 0)}
+
+	rows, err := db.Query("SELECT id, weekday, start_time, end_time, slot_minutes FROM doctor_schedules WHERE doctor_id = ? ORDER BY weekday, start_time", doctorID)
+	if err != nil {
+		return schedule, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var w WeeklySchedule
+		if err := rows.Scan(&w.ID, &w.Weekday, &w.StartTime, &w.EndTime, &w.SlotMinutes); err != nil {
+			return schedule, err
+		}
+		schedule.Weekly = append(schedule.Weekly, w)
+	}
+	if err := rows.Err(); err != nil {
+		return schedule, err
+	}
+
+	rows, err = db.Query("SELECT id, weekday, start_time, end_time FROM doctor_schedule_breaks WHERE doctor_id = ? ORDER BY weekday, start_time", doctorID)
+	if err != nil {
+		return schedule, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var b ScheduleBreak
+		if err := rows.Scan(&b.ID, &b.Weekday, &b.StartTime, &b.EndTime); err != nil {
+			return schedule, err
+		}
+		schedule.Breaks = append(schedule.Breaks, b)
+	}
+	return schedule, rows.Err()
+}
+
+// loadExceptions reads the exceptions between the local dates from and to
+// that apply to a doctor, including clinic-wide holidays. A nil doctorID
+// reads only the holidays.
+func loadExceptions(doctorID *int, from, to Date) ([]ScheduleException, error) {
+	query := "SELECT id, doctor_id, date, start_time, end_time, kind, reason, created_at FROM doctor_schedule_exceptions WHERE date BETWEEN ? AND ? AND (doctor_id IS NULL"
+	args := []interface{}{from, to}
+	if doctorID != nil {
+		query += " OR doctor_id = ?"
+		args = append(args, *doctorID)
+	}
+	query += ") ORDER BY date, start_time"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	exceptions := make([]ScheduleException, 0)
+	for rows.Next() {
+		var e ScheduleException
+		if err := rows.Scan(&e.ID, &e.DoctorID, &e.Date, &e.StartTime, &e.EndTime, &e.Kind, &e.Reason, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		exceptions = append(exceptions, e)
+	}
+	return exceptions, rows.Err()
+}
+
+// bookedTimes returns the start times of a doctor's live appointments, and
+// of slots held for waitlist offers, in [from, to).
+func bookedTimes(doctor Doctor, from, to time.Time) ([]time.Time, error) {
+	rows, err := db.Query("SELECT appointment_date FROM patient_appointments WHERE doctor_id = ? AND deleted_at IS NULL AND status <> 'cancelled' AND appointment_date >= ? AND appointment_date < ?"+
+		" UNION ALL SELECT appointment_date FROM waitlist_offers WHERE doctor_id = ? AND status = ? AND expires_at > ? AND appointment_date >= ? AND appointment_date < ?",
+		doctor.ID, from.UTC(), to.UTC(), doctor.ID, offerPending, time.Now().UTC(), from.UTC(), to.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	busy := make([]time.Time, 0)
+	for rows.Next() {
+		var at time.Time
+		if err := rows.Scan(&at); err != nil {
+			return nil, err
+		}
+		busy = append(busy, at)
+	}
+	return busy, rows.Err()
+}
+
+// slotDuration returns the slot length of the doctor's schedule window
+// covering at, or defaultAppointmentDuration when there is none.
+func slotDuration(doctorID int, at time.Time) (time.Duration, error) {
+	local := at.In(clinicLocation)
+	minute := ClockTime(local.Hour()*60 + local.Minute())
+
+	var slotMinutes int
+	err := db.QueryRow("SELECT slot_minutes FROM doctor_schedules WHERE doctor_id = ? AND weekday = ? AND start_time <= ? AND end_time > ? LIMIT 1",
+		doctorID, int(local.Weekday()), minute, minute).Scan(&slotMinutes)
+	if err == sql.ErrNoRows {
+		return defaultAppointmentDuration, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(slotMinutes) * time.Minute, nil
+}
+
+// errOutsideSchedule is returned by checkSchedule for an appointment time
+// that is not the start of one of the doctor's slots.
+var errOutsideSchedule = errors.New("appointment_date is not the start of a slot in the doctor's schedule")
+
+// checkSchedule verifies that at is the start of a slot in the doctor's
+// schedule. Doctors without a schedule accept any time.
+func checkSchedule(doctorID int, at time.Time) error {
+	schedule, err := loadDoctorSchedule(doctorID)
+	if err != nil || len(schedule.Weekly) == 0 {
+		return err
+	}
+
+	day := dateOf(at.In(clinicLocation))
+	exceptions, err := loadExceptions(&doctorID, day, day)
+	if err != nil {
+		return err
+	}
+	return scheduleAllows(schedule, exceptions, at)
+}
+
+// scheduleAllows returns errOutsideSchedule unless at is the start of a
+// slot of schedule that no exception removes.
+func scheduleAllows(schedule DoctorSchedule, exceptions []ScheduleException, at time.Time) error {
+	day := dateOf(at.In(clinicLocation))
+	for _, slot := range buildSlots(schedule, exceptions, nil, day, day) {
+		if slot.Start.Equal(at) {
+			return nil
+		}
+	}
+	return errOutsideSchedule
+}
+
+// Handler function to get the weekly schedule of a doctor
+func getDoctorSchedule(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid doctor ID")
+	}
+
+	if _, err := findDoctor(id); err != nil {
+		if err == sql.ErrNoRows {
+			return c.String(http.StatusNotFound, "Doctor not found")
+		}
+		log.Println("Error getting doctor:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get doctor")
+	}
+
+	schedule, err := loadDoctorSchedule(id)
+	if err != nil {
+		log.Println("Error getting doctor schedule:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get doctor schedule")
+	}
+
+	return c.JSON(http.StatusOK, schedule)
+}
+
+// Handler function to replace the weekly schedule of a doctor
+func updateDoctorSchedule(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid doctor ID")
+	}
+
+	var schedule DoctorSchedule
+	if err := c.Bind(&schedule); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid request payload")
+	}
+	if err := schedule.validate(); err != nil {
+		return c.String(http.StatusUnprocessableEntity, err.Error())
+	}
+
+	if _, err := findDoctor(id); err != nil {
+		if err == sql.ErrNoRows {
+			return c.String(http.StatusNotFound, "Doctor not found")
+		}
+		log.Println("Error getting doctor:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get doctor")
+	}
+
+	if err := replaceDoctorSchedule(id, schedule); err != nil {
+		log.Println("Error updating doctor schedule:", err)
+		return c.String(http.StatusInternalServerError, "Failed to update doctor schedule")
+	}
+
+	return getDoctorSchedule(c)
+}
+
+func replaceDoctorSchedule(doctorID int, schedule DoctorSchedule) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM doctor_schedules WHERE doctor_id = ?", doctorID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM doctor_schedule_breaks WHERE doctor_id = ?", doctorID); err != nil {
+		return err
+	}
+	for _, w := range schedule.Weekly {
+		_, err := tx.Exec("INSERT INTO doctor_schedules (doctor_id, weekday, start_time, end_time, slot_minutes) VALUES (?, ?, ?, ?, ?)",
+			doctorID, w.Weekday, w.StartTime, w.EndTime, w.SlotMinutes)
+		if err != nil {
+			return err
+		}
+	}
+	for _, b := range schedule.Breaks {
+		_, err := tx.Exec("INSERT INTO doctor_schedule_breaks (doctor_id, weekday, start_time, end_time) VALUES (?, ?, ?, ?)",
+			doctorID, b.Weekday, b.StartTime, b.EndTime)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// dateRange reads the ?from= and ?to= local dates of a request. Missing
+// values default to today and maxDays-1 days after from.
+func dateRange(c echo.Context, maxDays int) (from, to Date, err error) {
+	from = dateOf(time.Now().In(clinicLocation))
+	if param := c.QueryParam("from"); param != "" {
+		if from, err = parseDate(param); err != nil {
+			return from, to, fmt.Errorf("invalid from, want YYYY-MM-DD")
+		}
+	}
+	to = from.AddDays(maxDays - 1)
+	if param := c.QueryParam("to"); param != "" {
+		if to, err = parseDate(param); err != nil {
+			return from, to, fmt.Errorf("invalid to, want YYYY-MM-DD")
+		}
+	}
+	if to.Before(from) {
+		return from, to, fmt.Errorf("to must not be before from")
+	}
+	if !to.Before(from.AddDays(maxDays)) {
+		return from, to, fmt.Errorf("range must not exceed %d days", maxDays)
+	}
+	return from, to, nil
+}
+
+// Handler function to list the free slots of a doctor between ?from= and
+// ?to= (local dates, inclusive)
+func getDoctorSlots(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid doctor ID")
+	}
+
+	from, to, err := dateRange(c, maxSlotRangeDays)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	doctor, err := findDoctor(id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.String(http.StatusNotFound, "Doctor not found")
+		}
+		log.Println("Error getting doctor:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get doctor")
+	}
+
+	schedule, err := loadDoctorSchedule(id)
+	if err != nil {
+		log.Println("Error getting doctor schedule:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get slots")
+	}
+	exceptions, err := loadExceptions(&id, from, to)
+	if err != nil {
+		log.Println("Error getting schedule exceptions:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get slots")
+	}
+	busy, err := bookedTimes(doctor, from.In(clinicLocation), to.AddDays(1).In(clinicLocation))
+	if err != nil {
+		log.Println("Error getting booked appointments:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get slots")
+	}
+
+	now := time.Now()
+	slots := make([]Slot, 0)
+	for _, slot := range buildSlots(schedule, exceptions, busy, from, to) {
+		if slot.Start.After(now) {
+			slots = append(slots, slot)
+		}
+	}
+
+	return c.JSON(http.StatusOK, slots)
+}
+
+// Handler function to list the exceptions of a doctor, including clinic-wide
+// holidays, between ?from= and ?to=
+func getDoctorExceptions(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid doctor ID")
+	}
+	return listExceptions(c, &id)
+}
+
+// Handler function to list clinic-wide holidays between ?from= and ?to=
+func getHolidays(c echo.Context) error {
+	return listExceptions(c, nil)
+}
+
+func listExceptions(c echo.Context, doctorID *int) error {
+	from, to, err := dateRange(c, 366)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	exceptions, err := loadExceptions(doctorID, from, to)
+	if err != nil {
+		log.Println("Error querying schedule exceptions:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get schedule exceptions")
+	}
+
+	return c.JSON(http.StatusOK, exceptions)
+}
+
+// Handler function to record leave for a doctor
+func createDoctorException(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid doctor ID")
+	}
+	if _, err := findDoctor(id); err != nil {
+		if err == sql.ErrNoRows {
+			return c.String(http.StatusNotFound, "Doctor not found")
+		}
+		log.Println("Error getting doctor:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get doctor")
+	}
+	return insertException(c, &id, exceptionLeave)
+}
+
+// Handler function to record a clinic-wide holiday
+func createHoliday(c echo.Context) error {
+	return insertException(c, nil, exceptionHoliday)
+}
+
+func insertException(c echo.Context, doctorID *int, kind string) error {
+	var e ScheduleException
+	if err := c.Bind(&e); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid request payload")
+	}
+	if e.Date.IsZero() {
+		return c.String(http.StatusUnprocessableEntity, "date is required")
+	}
+	if (e.StartTime == nil) != (e.EndTime == nil) {
+		return c.String(http.StatusUnprocessableEntity, "start_time and end_time must be given together")
+	}
+	if e.StartTime != nil && *e.StartTime >= *e.EndTime {
+		return c.String(http.StatusUnprocessableEntity, "start_time must be before end_time")
+	}
+
+	e.DoctorID = doctorID
+	e.Kind = kind
+	result, err := db.Exec("INSERT INTO doctor_schedule_exceptions (doctor_id, date, start_time, end_time, kind, reason) VALUES (?, ?, ?, ?, ?, ?)",
+		e.DoctorID, e.Date, e.StartTime, e.EndTime, e.Kind, e.Reason)
+	if err != nil {
+		log.Println("Error inserting schedule exception:", err)
+		return c.String(http.StatusInternalServerError, "Failed to insert schedule exception")
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		log.Println("Error getting last insert ID:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get last insert ID")
+	}
+
+	e.ID = uint(id)
+	e.CreatedAt = time.Now().UTC()
+	return c.JSON(http.StatusCreated, e)
+}
+
+// Handler function to remove leave from a doctor's schedule
+func deleteDoctorException(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid doctor ID")
+	}
+	exceptionID, err := strconv.Atoi(c.Param("exception_id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid exception ID")
+	}
+
+	result, err := db.Exec("DELETE FROM doctor_schedule_exceptions WHERE id = ? AND doctor_id = ?", exceptionID, id)
+	return exceptionDeleted(c, result, err)
+}
+
+// Handler function to remove a clinic-wide holiday
+func deleteHoliday(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid holiday ID")
+	}
+
+	result, err := db.Exec("DELETE FROM doctor_schedule_exceptions WHERE id = ? AND doctor_id IS NULL", id)
+	return exceptionDeleted(c, result, err)
+}
+
+func exceptionDeleted(c echo.Context, result sql.Result, err error) error {
+	if err != nil {
+		log.Println("Error deleting schedule exception:", err)
+		return c.String(http.StatusInternalServerError, "Failed to delete schedule exception")
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return c.String(http.StatusNotFound, "Schedule exception not found")
+	}
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// useClinicLocation sets clinicLocation for the duration of a test.
+func useClinicLocation(t *testing.T, loc *time.Location) {
+	t.Helper()
+	saved := clinicLocation
+	clinicLocation = loc
+	t.Cleanup(func() { clinicLocation = saved })
+}
+
+func clock(t *testing.T, s string) ClockTime {
+	t.Helper()
+	c, err := parseClockTime(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func clockPtr(t *testing.T, s string) *ClockTime {
+	c := clock(t, s)
+	return &c
+}
+
+func TestBuildSlots(t *testing.T) {
+	useClinicLocation(t, time.FixedZone("WIB", 7*60*60))
+	monday := Date{Year: 2026, Month: time.March, Day: 2}
+	tuesday := monday.AddDays(1)
+	at := func(d Date, hhmm string) time.Time { return clock(t, hhmm).on(d) }
+	morning := DoctorSchedule{Weekly: []WeeklySchedule{{Weekday: 1, StartTime: clock(t, "09:00"), EndTime: clock(t, "10:00"), SlotMinutes: 20}}}
+	doctorID := 1
+
+	tests := []struct {
+		name       string
+		schedule   DoctorSchedule
+		exceptions []ScheduleException
+		busy       []time.Time
+		from, to   Date
+		want       []string // slot starts, "HH:MM" on from unless prefixed by the day
+	}{
+		{"window split into slots", morning, nil, nil, monday, monday, []string{"09:00", "09:20", "09:40"}},
+		{"partial last slot left out", DoctorSchedule{Weekly: []WeeklySchedule{{Weekday: 1, StartTime: clock(t, "09:00"), EndTime: clock(t, "10:00"), SlotMinutes: 25}}},
+			nil, nil, monday, monday, []string{"09:00", "09:25"}},
+		{"other weekdays have no slots", morning, nil, nil, tuesday, tuesday, nil},
+		{"break removes overlapping slots", DoctorSchedule{Weekly: morning.Weekly, Breaks: []ScheduleBreak{{Weekday: 1, StartTime: clock(t, "09:30"), EndTime: clock(t, "09:45")}}},
+			nil, nil, monday, monday, []string{"09:00"}},
+		{"break on another weekday ignored", DoctorSchedule{Weekly: morning.Weekly, Breaks: []ScheduleBreak{{Weekday: 2, StartTime: clock(t, "09:00"), EndTime: clock(t, "10:00")}}},
+			nil, nil, monday, monday, []string{"09:00", "09:20", "09:40"}},
+		{"holiday removes the day", morning, []ScheduleException{{Date: monday, Kind: exceptionHoliday}}, nil, monday, monday, nil},
+		{"holiday on another day", morning, []ScheduleException{{Date: tuesday, Kind: exceptionHoliday}}, nil, monday, monday, []string{"09:00", "09:20", "09:40"}},
+		{"partial leave", morning, []ScheduleException{{DoctorID: &doctorID, Date: monday, StartTime: clockPtr(t, "09:00"), EndTime: clockPtr(t, "09:20"), Kind: exceptionLeave}},
+			nil, monday, monday, []string{"09:20", "09:40"}},
+		{"booked slot left out", morning, nil, []time.Time{at(monday, "09:20")}, monday, monday, []string{"09:00", "09:40"}},
+		{"booking inside a slot blocks it", morning, nil, []time.Time{at(monday, "09:50").UTC()}, monday, monday, []string{"09:00", "09:20"}},
+		{"range covers the next week", morning, nil, nil, monday, monday.AddDays(7), []string{"09:00", "09:20", "09:40", "+7 09:00", "+7 09:20", "+7 09:40"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			slots := buildSlots(tt.schedule, tt.exceptions, tt.busy, tt.from, tt.to)
+			if len(slots) != len(tt.want) {
+				t.Fatalf("got %d slots %v, want %v", len(slots), slots, tt.want)
+			}
+			for i, want := range tt.want {
+				day := tt.from
+				if want[0] == '+' {
+					day, want = day.AddDays(7), want[3:]
+				}
+				start := at(day, want)
+				if !slots[i].Start.Equal(start) {
+					t.Errorf("slot %d starts %s, want %s", i, slots[i].Start, start)
+				}
+				if slots[i].End.Sub(slots[i].Start) != time.Duration(tt.schedule.Weekly[0].SlotMinutes)*time.Minute {
+					t.Errorf("slot %d lasts %s", i, slots[i].End.Sub(slots[i].Start))
+				}
+			}
+		})
+	}
+}
+
+func TestScheduleAllows(t *testing.T) {
+	useClinicLocation(t, time.FixedZone("WIB", 7*60*60))
+	monday := Date{Year: 2026, Month: time.March, Day: 2}
+	schedule := DoctorSchedule{Weekly: []WeeklySchedule{{Weekday: 1, StartTime: clock(t, "09:00"), EndTime: clock(t, "10:00"), SlotMinutes: 20}}}
+	holiday := []ScheduleException{{Date: monday, Kind: exceptionHoliday}}
+
+	tests := []struct {
+		name       string
+		exceptions []ScheduleException
+		at         time.Time
+		want       error
+	}{
+		{"slot start", nil, clock(t, "09:20").on(monday), nil},
+		{"same instant in UTC", nil, clock(t, "09:20").on(monday).UTC(), nil},
+		{"inside a slot", nil, clock(t, "09:30").on(monday), errOutsideSchedule},
+		{"end of the window", nil, clock(t, "10:00").on(monday), errOutsideSchedule},
+		{"another weekday", nil, clock(t, "09:00").on(monday.AddDays(1)), errOutsideSchedule},
+		{"holiday", holiday, clock(t, "09:00").on(monday), errOutsideSchedule},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := scheduleAllows(schedule, tt.exceptions, tt.at); !errors.Is(err, tt.want) {
+				t.Errorf("scheduleAllows(%s) = %v, want %v", tt.at, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDoctorScheduleValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		weekly  WeeklySchedule
+		wantErr bool
+	}{
+		{"valid", WeeklySchedule{Weekday: 1, StartTime: 9 * 60, EndTime: 12 * 60, SlotMinutes: 15}, false},
+		{"weekday out of range", WeeklySchedule{Weekday: 7, StartTime: 9 * 60, EndTime: 12 * 60, SlotMinutes: 15}, true},
+		{"start after end", WeeklySchedule{Weekday: 1, StartTime: 12 * 60, EndTime: 9 * 60, SlotMinutes: 15}, true},
+		{"slot too short", WeeklySchedule{Weekday: 1, StartTime: 9 * 60, EndTime: 12 * 60, SlotMinutes: 4}, true},
+		{"slot longer than the window", WeeklySchedule{Weekday: 1, StartTime: 9 * 60, EndTime: 10 * 60, SlotMinutes: 90}, true},
+	}
+	for _, tt := range tests {
+		err := DoctorSchedule{Weekly: []WeeklySchedule{tt.weekly}}.validate()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: validate() = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
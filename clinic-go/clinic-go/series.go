@@ -0,0 +1,521 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// maxSeriesOccurrences caps the length of an appointment series.
+const maxSeriesOccurrences = 52
+
+// Scopes of a series edit or cancellation
+const (
+	scopeThis      = "this"
+	scopeFollowing = "following"
+	scopeAll       = "all"
+)
+
+// AppointmentSeries is a recurring appointment for chronic-care patients:
+// every IntervalWeeks weeks from FirstAppointmentDate, until a date or for a
+// number of occurrences. Each occurrence is a normal PatientAppointment.
+type AppointmentSeries struct {
+	ID                   uint                 `json:"id"`
+	PatientID            uint                 `json:"patient_id"`
+	DoctorID             int                  `json:"doctor_id"`
+	FirstAppointmentDate time.Time            `json:"first_appointment_date"`
+	IntervalWeeks        int                  `json:"interval_weeks"`
+	Until                *Date                `json:"until,omitempty"` // inclusive, in the clinic's timezone
+	Count                int                  `json:"count,omitempty"`
+	Notes                string               `json:"notes"`
+	CreatedAt            time.Time            `json:"created_at"`
+	Appointments         []PatientAppointment `json:"appointments"`
+	Conflicts            []OccurrenceConflict `json:"conflicts,omitempty"`
+}
+
+// OccurrenceConflict reports an occurrence that could not be booked or moved.
+type OccurrenceConflict struct {
+	Occurrence             int                 `json:"occurrence"`
+	AppointmentID          uint                `json:"appointment_id,omitempty"`
+	AppointmentDate        time.Time           `json:"appointment_date"`
+	Reason                 string              `json:"reason"`
+	ConflictingAppointment *PatientAppointment `json:"conflicting_appointment,omitempty"`
+}
+
+// occurrenceConflict returns the conflict for err when it is a booking or
+// schedule conflict, or nil for any other error.
+func occurrenceConflict(err error, appointment PatientAppointment) *OccurrenceConflict {
+	conflict := OccurrenceConflict{
+		AppointmentID:   appointment.ID,
+		AppointmentDate: appointment.AppointmentDate,
+		Reason:          err.Error(),
+	}
+	if appointment.Occurrence != nil {
+		conflict.Occurrence = *appointment.Occurrence
+	}
+
+	var booking *bookingConflict
+	switch {
+	case errors.As(err, &booking):
+		conflict.ConflictingAppointment = booking.Conflicting
+	case errors.Is(err, errOutsideSchedule):
+	default:
+		return nil
+	}
+	return &conflict
+}
+
+// validate checks the recurrence rule.
+func (s AppointmentSeries) validate() error {
+	if s.IntervalWeeks < 1 {
+		return fmt.Errorf("interval_weeks must be at least 1")
+	}
+	if (s.Until == nil) == (s.Count == 0) {
+		return fmt.Errorf("exactly one of until and count is required")
+	}
+	if s.Count < 0 || s.Count > maxSeriesOccurrences {
+		return fmt.Errorf("count must be between 1 and %d", maxSeriesOccurrences)
+	}
+	if s.FirstAppointmentDate.IsZero() {
+		return fmt.Errorf("first_appointment_date is required")
+	}
+	if s.Until != nil && s.Until.Before(dateOf(s.FirstAppointmentDate.In(clinicLocation))) {
+		return fmt.Errorf("until is before first_appointment_date")
+	}
+	if len(s.occurrences()) > maxSeriesOccurrences {
+		return fmt.Errorf("series has more than %d occurrences", maxSeriesOccurrences)
+	}
+	return nil
+}
+
+// occurrences returns the start times of the series. Occurrences keep the
+// wall-clock time of the first one in the clinic's timezone.
+func (s AppointmentSeries) occurrences() []time.Time {
+	first := s.FirstAppointmentDate.In(clinicLocation)
+	var times []time.Time
+	for i := 0; ; i++ {
+		at := first.AddDate(0, 0, 7*s.IntervalWeeks*i)
+		if s.Count > 0 && i >= s.Count {
+			break
+		}
+		if s.Until != nil && s.Until.Before(dateOf(at)) {
+			break
+		}
+		if i > maxSeriesOccurrences {
+			break
+		}
+		times = append(times, at)
+	}
+	return times
+}
+
+// Handler function to create an appointment series. Occurrences that collide
+// with other appointments or fall outside the doctor's schedule are reported
+// with 409 and nothing is booked, unless "skip_conflicts" is set, in which
+// case the remaining occurrences are booked and the conflicts listed.
+func createAppointmentSeries(c echo.Context) error {
+	var request struct {
+		AppointmentSeries
+		SkipConflicts bool `json:"skip_conflicts"`
+	}
+	if err := c.Bind(&request); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid request payload")
+	}
+	series := request.AppointmentSeries
+	if err := series.validate(); err != nil {
+		return c.String(http.StatusUnprocessableEntity, err.Error())
+	}
+
+	first := PatientAppointment{PatientID: series.PatientID, DoctorID: series.DoctorID}
+	if err := validateAppointment(first, false); err != nil {
+		if status, message, ok := integrityError(err); ok {
+			return c.String(status, message)
+		}
+		log.Println("Error validating appointment series:", err)
+		return c.String(http.StatusInternalServerError, "Failed to insert appointment series")
+	}
+
+	ids, conflicts, err := insertAppointmentSeries(&series, request.SkipConflicts, currentActor(c))
+	if err != nil {
+		if status, message, ok := integrityError(err); ok {
+			return c.String(status, message)
+		}
+		log.Println("Error inserting appointment series:", err)
+		return c.String(http.StatusInternalServerError, "Failed to insert appointment series")
+	}
+	if len(ids) == 0 {
+		return seriesConflictResponse(c, conflicts)
+	}
+	for _, id := range ids {
+		publishAppointment("created", int(id))
+	}
+
+	created, err := findAppointmentSeries(int(series.ID))
+	if err != nil {
+		log.Println("Error reading back appointment series:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get appointment series")
+	}
+	created.Conflicts = conflicts
+	return c.JSON(http.StatusCreated, created)
+}
+
+// insertAppointmentSeries stores the series and books its occurrences in one
+// transaction. Unless skipConflicts is set, any conflict rolls everything
+// back and no IDs are returned.
+func insertAppointmentSeries(series *AppointmentSeries, skipConflicts bool, actor Actor) ([]int64, []OccurrenceConflict, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	var until interface{}
+	if series.Until != nil {
+		until = *series.Until
+	}
+	result, err := tx.Exec("INSERT INTO appointment_series (patient_id, doctor_id, first_appointment_date, interval_weeks, until, count, notes) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		series.PatientID, series.DoctorID, series.FirstAppointmentDate.UTC(), series.IntervalWeeks, until, series.Count, series.Notes)
+	if err != nil {
+		return nil, nil, err
+	}
+	seriesID, err := result.LastInsertId()
+	if err != nil {
+		return nil, nil, err
+	}
+	series.ID = uint(seriesID)
+
+	var ids []int64
+	conflicts := make([]OccurrenceConflict, 0)
+	for i, at := range series.occurrences() {
+		occurrence := i + 1
+		appointment := PatientAppointment{
+			PatientID:       series.PatientID,
+			DoctorID:        series.DoctorID,
+			AppointmentDate: at,
+			Notes:           series.Notes,
+			Status:          statusRequested,
+			SeriesID:        &series.ID,
+			Occurrence:      &occurrence,
+		}
+
+		err := checkSchedule(appointment.DoctorID, appointment.AppointmentDate)
+		if err == nil {
+			var id int64
+			id, err = bookAppointment(tx, appointment, actor)
+			if err == nil {
+				ids = append(ids, id)
+				continue
+			}
+		}
+		conflict := occurrenceConflict(err, appointment)
+		if conflict == nil {
+			return nil, nil, err
+		}
+		conflicts = append(conflicts, *conflict)
+	}
+
+	if len(conflicts) > 0 && !skipConflicts {
+		return nil, conflicts, nil
+	}
+	if len(ids) == 0 {
+		return nil, conflicts, nil
+	}
+	return ids, conflicts, tx.Commit()
+}
+
+// seriesConflictResponse writes the 409 response for series operations that
+// collide with other appointments.
+func seriesConflictResponse(c echo.Context, conflicts []OccurrenceConflict) error {
+	return c.JSON(http.StatusConflict, map[string]interface{}{
+		"error":     "some occurrences conflict with other appointments or the doctor's schedule",
+		"conflicts": conflicts,
+	})
+}
+
+// Handler function to get an appointment series with its occurrences
+func getAppointmentSeries(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid appointment series ID")
+	}
+
+	series, err := findAppointmentSeries(id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.String(http.StatusNotFound, "Appointment series not found")
+		}
+		log.Println("Error getting appointment series:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get appointment series")
+	}
+
+	return c.JSON(http.StatusOK, series)
+}
+
+// findAppointmentSeries loads a series with its live occurrences.
+func findAppointmentSeries(id int) (AppointmentSeries, error) {
+	var series AppointmentSeries
+	var until Date
+	err := db.QueryRow("SELECT id, patient_id, doctor_id, first_appointment_date, interval_weeks, until, count, notes, created_at FROM appointment_series WHERE id = ?", id).
+		Scan(&series.ID, &series.PatientID, &series.DoctorID, &series.FirstAppointmentDate, &series.IntervalWeeks, &until, &series.Count, &series.Notes, &series.CreatedAt)
+	if err != nil {
+		return series, err
+	}
+	series.FirstAppointmentDate = series.FirstAppointmentDate.In(clinicLocation)
+	if !until.IsZero() {
+		series.Until = &until
+	}
+
+	series.Appointments, err = seriesAppointments(series.ID, 0)
+	return series, err
+}
+
+// seriesAppointments returns the live occurrences of a series from the
+// given occurrence on.
+func seriesAppointments(seriesID uint, fromOccurrence int) ([]PatientAppointment, error) {
+	rows, err := db.Query(appointmentSelect+" WHERE a.series_id = ? AND a.occurrence >= ? AND a.deleted_at IS NULL ORDER BY a.occurrence",
+		seriesID, fromOccurrence)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	appointments := make([]PatientAppointment, 0)
+	for rows.Next() {
+		appointment, err := scanAppointment(rows)
+		if err != nil {
+			return nil, err
+		}
+		appointments = append(appointments, appointment)
+	}
+	return appointments, rows.Err()
+}
+
+// seriesScope returns the occurrences affected by an operation on the
+// appointment in the path with the ?scope= in the query (default "this").
+// When the occurrences are nil, the error response has already been written
+// and err is what the handler returns.
+func seriesScope(c echo.Context) (PatientAppointment, []PatientAppointment, error) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return PatientAppointment{}, nil, c.String(http.StatusBadRequest, "Invalid appointment ID")
+	}
+
+	anchor, err := findAppointment(id, false)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return anchor, nil, c.String(http.StatusNotFound, "Appointment not found")
+		}
+		log.Println("Error getting appointment:", err)
+		return anchor, nil, c.String(http.StatusInternalServerError, "Failed to get appointment")
+	}
+	if anchor.SeriesID == nil || anchor.Occurrence == nil {
+		return anchor, nil, c.String(http.StatusUnprocessableEntity, "Appointment is not part of a series")
+	}
+
+	var from int
+	switch scope := c.QueryParam("scope"); scope {
+	case "", scopeThis:
+		return anchor, []PatientAppointment{anchor}, nil
+	case scopeFollowing:
+		from = *anchor.Occurrence
+	case scopeAll:
+		from = 0
+	default:
+		return anchor, nil, c.String(http.StatusBadRequest, "scope must be this, following or all")
+	}
+
+	appointments, err := seriesAppointments(*anchor.SeriesID, from)
+	if err != nil {
+		log.Println("Error getting series appointments:", err)
+		return anchor, nil, c.String(http.StatusInternalServerError, "Failed to get appointment series")
+	}
+	return anchor, appointments, nil
+}
+
+// seriesEditable reports whether a series operation may still change an
+// occurrence: only appointments that have not started yet.
+func seriesEditable(appointment PatientAppointment) bool {
+	return appointment.Status == statusRequested || appointment.Status == statusConfirmed
+}
+
+// seriesMoveDate returns where an occurrence at moves to when the series is
+// shifted by days, at the time of day of newLocal.
+func seriesMoveDate(at time.Time, days int, newLocal time.Time) time.Time {
+	day := dateOf(at.In(clinicLocation)).AddDays(days)
+	return time.Date(day.Year, day.Month, day.Day, newLocal.Hour(), newLocal.Minute(), newLocal.Second(), 0, clinicLocation)
+}
+
+// seriesMoveOrder returns the order to move occurrences in when a series is
+// shifted by days. A forward shift moves the last occurrence first, so each
+// one lands on a slot its successor has already left; the booking check
+// would otherwise see the next, unmoved occurrence as a conflict.
+func seriesMoveOrder(appointments []PatientAppointment, days int) []PatientAppointment {
+	ordered := make([]PatientAppointment, len(appointments))
+	copy(ordered, appointments)
+	if days > 0 {
+		for i, j := 0, len(ordered)-1; i < j; i, j = i+1, j-1 {
+			ordered[i], ordered[j] = ordered[j], ordered[i]
+		}
+	}
+	return ordered
+}
+
+// Handler function to edit one, the following or all occurrences of a
+// series, ?scope=this|following|all. The body may change the doctor, the
+// notes and the appointment_date of the appointment in the path; the other
+// occurrences move by the same number of days to the same time of day.
+// Occurrences that have already started are left alone.
+func editAppointmentSeries(c echo.Context) error {
+	var edit struct {
+		AppointmentDate *time.Time `json:"appointment_date"`
+		DoctorID        *int       `json:"doctor_id"`
+		Notes           *string    `json:"notes"`
+	}
+	if err := c.Bind(&edit); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid request payload")
+	}
+
+	anchor, appointments, err := seriesScope(c)
+	if appointments == nil {
+		return err
+	}
+	if !seriesEditable(anchor) {
+		return c.String(http.StatusConflict, "Appointment is "+anchor.Status+" and can no longer be edited")
+	}
+
+	var days int
+	var newLocal time.Time
+	if edit.AppointmentDate != nil {
+		oldLocal := anchor.AppointmentDate.In(clinicLocation)
+		newLocal = edit.AppointmentDate.In(clinicLocation)
+		days = daysBetween(dateOf(oldLocal), dateOf(newLocal))
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println("Error editing appointment series:", err)
+		return c.String(http.StatusInternalServerError, "Failed to update appointment series")
+	}
+	defer tx.Rollback()
+
+	conflicts := make([]OccurrenceConflict, 0)
+	var edited []int
+	for _, appointment := range seriesMoveOrder(appointments, days) {
+		if !seriesEditable(appointment) {
+			continue
+		}
+		if edit.AppointmentDate != nil {
+			appointment.AppointmentDate = seriesMoveDate(appointment.AppointmentDate, days, newLocal)
+		}
+		if edit.DoctorID != nil {
+			appointment.DoctorID = *edit.DoctorID
+		}
+		if edit.Notes != nil {
+			appointment.Notes = *edit.Notes
+		}
+
+		err := updateAppointmentTx(tx, int(appointment.ID), 0, appointment)
+		if err != nil {
+			conflict := occurrenceConflict(err, appointment)
+			if conflict == nil {
+				return updateFailed(c, err, "Appointment")
+			}
+			conflicts = append(conflicts, *conflict)
+			continue
+		}
+		edited = append(edited, int(appointment.ID))
+	}
+	if days > 0 { // report in occurrence order
+		slices.Reverse(conflicts)
+		slices.Reverse(edited)
+	}
+	if len(conflicts) > 0 {
+		return seriesConflictResponse(c, conflicts)
+	}
+	if err := tx.Commit(); err != nil {
+		return updateFailed(c, err, "Appointment")
+	}
+
+	for _, id := range edited {
+		publishAppointment("updated", id)
+	}
+	return c.JSON(http.StatusOK, reloadAppointments(edited))
+}
+
+// Handler function to cancel one, the following or all occurrences of a
+// series, ?scope=this|following|all, with an optional {"reason": "..."}.
+// Occurrences that can no longer be cancelled are left alone.
+func cancelAppointmentSeries(c echo.Context) error {
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	if c.Request().ContentLength > 0 {
+		if err := c.Bind(&body); err != nil {
+			return c.String(http.StatusBadRequest, "Invalid request payload")
+		}
+	}
+
+	anchor, appointments, err := seriesScope(c)
+	if appointments == nil {
+		return err
+	}
+	if !canTransition(anchor.Status, statusCancelled) {
+		return c.String(http.StatusConflict, (&transitionError{From: anchor.Status, To: statusCancelled}).Error())
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println("Error cancelling appointment series:", err)
+		return c.String(http.StatusInternalServerError, "Failed to cancel appointment series")
+	}
+	defer tx.Rollback()
+
+	actor := currentActor(c)
+	var cancelled []int
+	for _, appointment := range appointments {
+		if !canTransition(appointment.Status, statusCancelled) {
+			continue
+		}
+		if err := transitionAppointmentTx(tx, int(appointment.ID), statusCancelled, actor, body.Reason, 0); err != nil {
+			return updateFailed(c, err, "Appointment")
+		}
+		cancelled = append(cancelled, int(appointment.ID))
+	}
+	if err := tx.Commit(); err != nil {
+		return updateFailed(c, err, "Appointment")
+	}
+
+	for _, id := range cancelled {
+		publishStatusChange(id)
+		offerCancelledSlot(id)
+	}
+	return c.JSON(http.StatusOK, reloadAppointments(cancelled))
+}
+
+// reloadAppointments re-reads appointments after a series operation.
+func reloadAppointments(ids []int) []PatientAppointment {
+	appointments := make([]PatientAppointment, 0, len(ids))
+	for _, id := range ids {
+		appointment, err := findAppointment(id, false)
+		if err != nil {
+			log.Println("Error reading back appointment:", err)
+			continue
+		}
+		appointments = append(appointments, appointment)
+	}
+	return appointments
+}
+
+// daysBetween returns the number of calendar days from a to b.
+func daysBetween(a, b Date) int {
+	start := time.Date(a.Year, a.Month, a.Day, 0, 0, 0, 0, time.UTC)
+	end := time.Date(b.Year, b.Month, b.Day, 0, 0, 0, 0, time.UTC)
+	return int(end.Sub(start).Hours() / 24)
+}
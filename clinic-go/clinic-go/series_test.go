@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestSeriesMoveOrderNoSelfConflict moves the occurrences of a series one at
+// a time, as editAppointmentSeries does, and checks none lands on a slot
+// another occurrence of the same series still holds.
+func TestSeriesMoveOrderNoSelfConflict(t *testing.T) {
+	start := time.Date(2026, 3, 2, 9, 0, 0, 0, clinicLocation)
+	tests := []struct {
+		name     string
+		interval int // days between occurrences
+		days     int // shift
+		newLocal time.Time
+	}{
+		{"weekly forward one interval", 7, 7, start},
+		{"daily forward one interval", 1, 1, start},
+		{"weekly back one interval", 7, -7, start},
+		{"weekly forward two intervals", 7, 14, start},
+		{"daily forward with a new time", 1, 1, start.Add(time.Hour)},
+		{"same day, new time", 7, 0, start.Add(30 * time.Minute)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			appointments := make([]PatientAppointment, 5)
+			slots := make(map[time.Time]uint) // who holds each slot
+			for i := range appointments {
+				at := start.AddDate(0, 0, i*tt.interval)
+				appointments[i] = PatientAppointment{ID: uint(i + 1), AppointmentDate: at}
+				slots[at] = appointments[i].ID
+			}
+
+			for _, appointment := range seriesMoveOrder(appointments, tt.days) {
+				to := seriesMoveDate(appointment.AppointmentDate, tt.days, tt.newLocal)
+				if holder, taken := slots[to]; taken && holder != appointment.ID {
+					t.Fatalf("occurrence %d moves onto %s, still held by occurrence %d", appointment.ID, to, holder)
+				}
+				delete(slots, appointment.AppointmentDate)
+				slots[to] = appointment.ID
+			}
+			if len(slots) != len(appointments) {
+				t.Errorf("%d slots held after the move, want %d", len(slots), len(appointments))
+			}
+		})
+	}
+}
+
+func TestSeriesMoveOrderKeepsInput(t *testing.T) {
+	appointments := []PatientAppointment{{ID: 1}, {ID: 2}, {ID: 3}}
+	moved := seriesMoveOrder(appointments, 7)
+	if moved[0].ID != 3 || moved[2].ID != 1 {
+		t.Errorf("forward order = %d, %d, %d, want 3, 2, 1", moved[0].ID, moved[1].ID, moved[2].ID)
+	}
+	if appointments[0].ID != 1 {
+		t.Error("seriesMoveOrder reordered its input")
+	}
+	if back := seriesMoveOrder(appointments, -7); back[0].ID != 1 {
+		t.Errorf("backward order starts with %d, want 1", back[0].ID)
+	}
+}
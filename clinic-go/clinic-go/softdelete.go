@@ -0,0 +1,133 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	errForbidden  = errors.New("forbidden")
+	errNotDeleted = errors.New("record is not deleted")
+)
+
+// softDeleteTables lists the tables whose rows are never removed by the API.
+// Deleting one of their rows only sets deleted_at; the retention job decides
+// when the data may actually go.
+var softDeleteTables = map[string]bool{
+	"patients":             true,
+	"patient_appointments": true,
+	"transactions":         true,
+}
+
+// includeDeleted reports whether the request asked for soft-deleted rows
+// with ?include_deleted=true. Only admins may see them.
+func includeDeleted(c echo.Context) (bool, error) {
+	if c.QueryParam("include_deleted") != "true" {
+		return false, nil
+	}
+	if !currentActor(c).IsAdmin() {
+		return false, errForbidden
+	}
+	return true, nil
+}
+
+// archivedRow identifies a row restored along with its parent.
+type archivedRow struct {
+	Table string
+	ID    int
+}
+
+// restoreDeleted clears deleted_at on a soft-deleted row and on the rows
+// archived along with it, which carry the same deleted_at; see
+// deleteRecord. Rows deleted on their own before their parent stay deleted.
+// It returns the restored children, sql.ErrNoRows when the row does not
+// exist and errNotDeleted when it is not deleted or has already been
+// anonymized by the retention job.
+func restoreDeleted(table string, id int) ([]archivedRow, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var deletedAt *time.Time
+	var anonymizedAt *time.Time
+	err = tx.QueryRow("SELECT deleted_at, anonymized_at FROM "+table+" WHERE id = ? FOR UPDATE", id).Scan(&deletedAt, &anonymizedAt)
+	if err != nil {
+		return nil, err
+	}
+	if deletedAt == nil || anonymizedAt != nil {
+		return nil, errNotDeleted
+	}
+	if _, err := tx.Exec("UPDATE "+table+" SET deleted_at = NULL, version = version + 1 WHERE id = ?", id); err != nil {
+		return nil, err
+	}
+
+	var restored []archivedRow
+	for _, rel := range relationships {
+		if rel.Parent != table || rel.OnDelete != cascadeArchive {
+			continue
+		}
+		where := " WHERE " + rel.Column + " = ? AND deleted_at = ? AND anonymized_at IS NULL"
+		rows, err := tx.Query("SELECT id FROM "+rel.Child+where+" FOR UPDATE", id, *deletedAt)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var childID int
+			if err := rows.Scan(&childID); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			restored = append(restored, archivedRow{rel.Child, childID})
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec("UPDATE "+rel.Child+" SET deleted_at = NULL, version = version + 1"+where, id, *deletedAt); err != nil {
+			return nil, err
+		}
+	}
+
+	return restored, tx.Commit()
+}
+
+// restoreHandler returns a handler that undoes the soft deletion of a row in
+// table and responds with the row as rendered by get.
+func restoreHandler(table, name string, get echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !currentActor(c).IsAdmin() {
+			return c.String(http.StatusForbidden, "Only admins can restore records")
+		}
+
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid "+strings.ToLower(name)+" ID")
+		}
+
+		children, err := restoreDeleted(table, id)
+		switch {
+		case err == nil:
+			publishRestored(table, id)
+			for _, child := range children {
+				publishRestored(child.Table, child.ID)
+			}
+			return get(c)
+		case errors.Is(err, sql.ErrNoRows):
+			return c.String(http.StatusNotFound, name+" not found")
+		case errors.Is(err, errNotDeleted):
+			return c.String(http.StatusConflict, name+" is not deleted or can no longer be restored")
+		default:
+			log.Printf("Error restoring %s: %v", strings.ToLower(name), err)
+			return c.String(http.StatusInternalServerError, "Failed to restore "+strings.ToLower(name))
+		}
+	}
+}
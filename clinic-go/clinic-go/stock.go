@@ -0,0 +1,363 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Kinds of stock movement. Receipts add stock, dispenses, write-offs and
+// quarantines remove it, adjustments go either way.
+const (
+	stockReceipt    = "receipt"
+	stockDispense   = "dispense"
+	stockAdjustment = "adjustment"
+	stockWriteOff   = "write_off"
+	stockQuarantine = "quarantine" // recalled stock taken off the shelf
+)
+
+// StockMovement is one entry of a drug's append-only stock ledger. Quantity
+// is signed: positive entries add stock, negative ones remove it.
+type StockMovement struct {
+	ID            uint      `json:"id"`
+	DrugID        uint      `json:"drug_id"`
+	Kind          string    `json:"kind"`
+	Quantity      Decimal   `json:"quantity"`
+	BalanceAfter  Decimal   `json:"balance_after"`
+	TransactionID *uint     `json:"transaction_id,omitempty"`
+	LotID         *uint     `json:"lot_id,omitempty"`     // nil for stock received before lot tracking
+	LotNumber     string    `json:"lot_number,omitempty"` // read-only
+	Reference     string    `json:"reference,omitempty"`  // e.g. supplier invoice number
+	Reason        string    `json:"reason,omitempty"`
+	CreatedBy     *uint     `json:"created_by,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// DrugStock is a drug's quantity on hand with its lots and ledger.
+type DrugStock struct {
+	DrugID         uint            `json:"drug_id"`
+	QuantityOnHand Decimal         `json:"quantity_on_hand"`
+	Untracked      Decimal         `json:"untracked_quantity"` // on hand but not in any lot
+	Lots           []DrugLot       `json:"lots"`
+	Movements      []StockMovement `json:"movements"`
+}
+
+// errNonPositiveQuantity is returned for transactions that do not dispense
+// anything.
+var errNonPositiveQuantity = errors.New("quantity must be positive")
+
+// errQuantityPrecision is returned for quantities finer than the stock
+// ledger keeps.
+var errQuantityPrecision = errors.New("quantity can have at most 3 decimal places")
+
+// validateQuantity checks a transaction's quantity can be dispensed.
+func validateQuantity(q Decimal) error {
+	if q.Sign() <= 0 {
+		return errNonPositiveQuantity
+	}
+	if q.Round(3).Cmp(q) != 0 {
+		return errQuantityPrecision
+	}
+	return nil
+}
+
+// insufficientStockError is returned for movements that would take a drug's
+// stock below zero.
+type insufficientStockError struct {
+	DrugID    uint
+	Available Decimal
+	Requested Decimal
+}
+
+func (e *insufficientStockError) Error() string {
+	return fmt.Sprintf("insufficient stock for drug %d: %s on hand, %s requested", e.DrugID, e.Available, e.Requested)
+}
+
+// lockDrugStock locks a drug's row until tx ends and returns its quantity
+// on hand. Every stock change locks the drug before any of its lots, so
+// concurrent movements of the same drug are serialized.
+func lockDrugStock(tx *sql.Tx, drugID uint) (Decimal, error) {
+	var onHand Decimal
+	err := tx.QueryRow("SELECT quantity_on_hand FROM drugs WHERE id = ? FOR UPDATE", drugID).Scan(&onHand)
+	if err == sql.ErrNoRows {
+		return Decimal{}, &referenceError{Field: "drug_id", Table: "drugs", ID: int64(drugID)}
+	}
+	return onHand, err
+}
+
+// untrackedStock returns the part of a drug's quantity on hand that is not
+// in any lot: stock received before lot tracking, or without a lot number.
+func untrackedStock(tx *sql.Tx, drugID uint, onHand Decimal) (Decimal, error) {
+	var tracked Decimal
+	err := tx.QueryRow("SELECT COALESCE(SUM(quantity_on_hand), 0) FROM drug_lots WHERE drug_id = ?", drugID).Scan(&tracked)
+	return onHand.Sub(tracked), err
+}
+
+// recordStockMovement appends m to the ledger and updates the quantity on
+// hand of the drug, and of the lot when m has one, within tx. Neither can go
+// negative; movements without a lot may only take untracked stock.
+func recordStockMovement(tx *sql.Tx, m StockMovement) (StockMovement, error) {
+	onHand, err := lockDrugStock(tx, m.DrugID)
+	if err != nil {
+		return m, err
+	}
+	m.BalanceAfter = onHand.Add(m.Quantity)
+	if m.BalanceAfter.Sign() < 0 {
+		return m, &insufficientStockError{DrugID: m.DrugID, Available: onHand, Requested: m.Quantity.Neg()}
+	}
+
+	if m.LotID != nil {
+		var lotOnHand Decimal
+		err := tx.QueryRow("SELECT lot_number, quantity_on_hand FROM drug_lots WHERE id = ? AND drug_id = ? FOR UPDATE", *m.LotID, m.DrugID).
+			Scan(&m.LotNumber, &lotOnHand)
+		if err == sql.ErrNoRows {
+			return m, &referenceError{Field: "lot_id", Table: "drug_lots", ID: int64(*m.LotID)}
+		}
+		if err != nil {
+			return m, err
+		}
+		if lotOnHand.Add(m.Quantity).Sign() < 0 {
+			return m, &insufficientStockError{DrugID: m.DrugID, Available: lotOnHand, Requested: m.Quantity.Neg()}
+		}
+		if _, err := tx.Exec("UPDATE drug_lots SET quantity_on_hand = quantity_on_hand + ? WHERE id = ?", m.Quantity, *m.LotID); err != nil {
+			return m, err
+		}
+	} else if m.Quantity.Sign() < 0 {
+		untracked, err := untrackedStock(tx, m.DrugID, onHand)
+		if err != nil {
+			return m, err
+		}
+		if untracked.Add(m.Quantity).Sign() < 0 {
+			return m, &insufficientStockError{DrugID: m.DrugID, Available: untracked, Requested: m.Quantity.Neg()}
+		}
+	}
+
+	if _, err := tx.Exec("UPDATE drugs SET quantity_on_hand = ? WHERE id = ?", m.BalanceAfter, m.DrugID); err != nil {
+		return m, err
+	}
+	result, err := tx.Exec("INSERT INTO stock_movements (drug_id, kind, quantity, balance_after, transaction_id, lot_id, reference, reason, created_by) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		m.DrugID, m.Kind, m.Quantity, m.BalanceAfter, m.TransactionID, m.LotID, m.Reference, m.Reason, m.CreatedBy)
+	if err != nil {
+		return m, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return m, err
+	}
+	m.ID = uint(id)
+	m.CreatedAt = time.Now().UTC()
+	return m, nil
+}
+
+// dispenseStock records the stock taken by a transaction, first-expiry-
+// first-out from the drug's unexpired lots and then from untracked stock. A
+// negative quantity returns stock to the lots the transaction took it from,
+// when a transaction is corrected downwards.
+func dispenseStock(tx *sql.Tx, transactionID, drugID uint, quantity Decimal, actor Actor) error {
+	if quantity.IsZero() {
+		return nil
+	}
+
+	var allocations []lotAllocation
+	var err error
+	if quantity.Sign() > 0 {
+		allocations, err = allocateFEFO(tx, drugID, quantity)
+	} else {
+		allocations, err = allocateReturn(tx, transactionID, drugID, quantity.Neg())
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, allocation := range allocations {
+		_, err := recordStockMovement(tx, StockMovement{
+			DrugID:        drugID,
+			Kind:          stockDispense,
+			Quantity:      allocation.Quantity,
+			TransactionID: &transactionID,
+			LotID:         allocation.LotID,
+			CreatedBy:     actor.nullableID(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const stockMovementSelect = "SELECT m.id, m.drug_id, m.kind, m.quantity, m.balance_after, m.transaction_id, m.lot_id, COALESCE(l.lot_number, ''), m.reference, m.reason, m.created_by, m.created_at" +
+	" FROM stock_movements m LEFT JOIN drug_lots l ON l.id = m.lot_id"
+
+func scanStockMovement(row rowScanner) (StockMovement, error) {
+	var m StockMovement
+	err := row.Scan(&m.ID, &m.DrugID, &m.Kind, &m.Quantity, &m.BalanceAfter, &m.TransactionID, &m.LotID, &m.LotNumber, &m.Reference, &m.Reason, &m.CreatedBy, &m.CreatedAt)
+	return m, err
+}
+
+// Handler function to get a drug's quantity on hand and stock ledger, newest
+// first, optionally limited to ?from= and ?to= dates
+func getDrugStock(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid drug ID")
+	}
+
+	drug, err := findDrug(id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.String(http.StatusNotFound, "Drug not found")
+		}
+		log.Println("Error getting drug:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get drug")
+	}
+
+	query := stockMovementSelect + " WHERE m.drug_id = ?"
+	args := []interface{}{id}
+	if param := c.QueryParam("from"); param != "" {
+		from, err := parseDate(param)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid from date")
+		}
+		query += " AND m.created_at >= ?"
+		args = append(args, from.In(clinicLocation).UTC())
+	}
+	if param := c.QueryParam("to"); param != "" {
+		to, err := parseDate(param)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid to date")
+		}
+		query += " AND m.created_at < ?"
+		args = append(args, to.AddDays(1).In(clinicLocation).UTC())
+	}
+
+	rows, err := db.Query(query+" ORDER BY m.id DESC", args...)
+	if err != nil {
+		log.Println("Error querying stock movements:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get stock")
+	}
+	defer rows.Close()
+
+	stock := DrugStock{DrugID: drug.ID, QuantityOnHand: drug.QuantityOnHand, Movements: make([]StockMovement, 0)}
+	for rows.Next() {
+		m, err := scanStockMovement(rows)
+		if err != nil {
+			log.Println("Error scanning stock movement row:", err)
+			continue
+		}
+		stock.Movements = append(stock.Movements, m)
+	}
+
+	stock.Lots, err = findDrugLots(id, false)
+	if err != nil {
+		log.Println("Error querying drug lots:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get stock")
+	}
+	stock.Untracked = stock.QuantityOnHand
+	for _, lot := range stock.Lots {
+		stock.Untracked = stock.Untracked.Sub(lot.QuantityOnHand)
+	}
+
+	return c.JSON(http.StatusOK, stock)
+}
+
+// stockMovementHandler returns a handler that records a manual stock
+// movement of the given kind for the drug in the path. Receipts and
+// write-offs take a positive quantity; adjustments a signed one and a reason.
+// Receipts with a lot_number go into that lot, which is created on its first
+// receipt; write-offs and adjustments apply to lot_id, or to untracked stock.
+func stockMovementHandler(kind string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid drug ID")
+		}
+
+		var body struct {
+			Quantity   Decimal `json:"quantity"`
+			LotID      *uint   `json:"lot_id"`
+			LotNumber  string  `json:"lot_number"`
+			ExpiryDate Date    `json:"expiry_date"`
+			Supplier   string  `json:"supplier"`
+			Reference  string  `json:"reference"`
+			Reason     string  `json:"reason"`
+		}
+		if err := c.Bind(&body); err != nil {
+			return c.String(http.StatusBadRequest, "Invalid request payload")
+		}
+
+		m := StockMovement{
+			DrugID:    uint(id),
+			Kind:      kind,
+			Quantity:  body.Quantity,
+			LotID:     body.LotID,
+			Reference: body.Reference,
+			Reason:    body.Reason,
+			CreatedBy: currentActor(c).nullableID(),
+		}
+		switch {
+		case kind == stockAdjustment && body.Quantity.IsZero():
+			return c.String(http.StatusUnprocessableEntity, "quantity must not be zero")
+		case kind != stockAdjustment && body.Quantity.Sign() <= 0:
+			return c.String(http.StatusUnprocessableEntity, "quantity must be positive")
+		case body.Quantity.Round(3).Cmp(body.Quantity) != 0:
+			return c.String(http.StatusUnprocessableEntity, errQuantityPrecision.Error())
+		case kind != stockReceipt && body.Reason == "":
+			return c.String(http.StatusUnprocessableEntity, "reason is required")
+		case kind == stockReceipt && body.LotID != nil:
+			return c.String(http.StatusUnprocessableEntity, "receipts take lot_number, not lot_id")
+		case kind == stockReceipt && body.LotNumber != "" && body.ExpiryDate.IsZero():
+			return c.String(http.StatusUnprocessableEntity, "expiry_date is required with lot_number")
+		}
+		if kind == stockWriteOff {
+			m.Quantity = body.Quantity.Neg()
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Println("Error recording stock movement:", err)
+			return c.String(http.StatusInternalServerError, "Failed to record stock movement")
+		}
+		defer tx.Rollback()
+
+		if kind == stockReceipt && body.LotNumber != "" {
+			lotID, err := receiveLot(tx, uint(id), body.LotNumber, body.ExpiryDate, body.Supplier, body.Quantity)
+			if err != nil {
+				return stockMovementFailed(c, err)
+			}
+			m.LotID = &lotID
+		}
+
+		m, err = recordStockMovement(tx, m)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			return stockMovementFailed(c, err)
+		}
+
+		return c.JSON(http.StatusCreated, m)
+	}
+}
+
+// stockMovementFailed writes the response for an error recording a stock
+// movement.
+func stockMovementFailed(c echo.Context, err error) error {
+	var ref *referenceError
+	if errors.As(err, &ref) && ref.Table == "drugs" {
+		return c.String(http.StatusNotFound, "Drug not found")
+	}
+	var mismatch *lotMismatchError
+	if errors.As(err, &mismatch) {
+		return c.String(http.StatusConflict, mismatch.Error())
+	}
+	if errors.Is(err, errLotRecalled) {
+		return c.String(http.StatusConflict, err.Error())
+	}
+	return updateFailed(c, err, "Stock")
+}
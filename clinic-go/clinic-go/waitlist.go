@@ -0,0 +1,627 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Waitlist entry statuses
+const (
+	waitlistWaiting   = "waiting"
+	waitlistOffered   = "offered"
+	waitlistBooked    = "booked"
+	waitlistCancelled = "cancelled"
+)
+
+// Waitlist offer statuses
+const (
+	offerPending   = "pending"
+	offerAccepted  = "accepted"
+	offerDeclined  = "declined"
+	offerExpired   = "expired"
+	offerWithdrawn = "withdrawn" // the waitlist entry was cancelled
+)
+
+// Preferred times of day, in the clinic's timezone
+const (
+	timeOfDayAny       = "any"
+	timeOfDayMorning   = "morning"   // before 12:00
+	timeOfDayAfternoon = "afternoon" // 12:00 to 17:00
+	timeOfDayEvening   = "evening"   // from 17:00
+)
+
+// waitlistHold is how long a freed slot is held for the patient it is
+// offered to. Offers never outlast the slot itself.
+var waitlistHold = getenvDuration("WAITLIST_HOLD", 2*time.Hour)
+
+// WaitlistEntry is a patient waiting for a slot with a doctor, or with any
+// doctor of a specialization, within a date range.
+type WaitlistEntry struct {
+	ID             uint            `json:"id"`
+	PatientID      uint            `json:"patient_id"`
+	DoctorID       *int            `json:"doctor_id,omitempty"`
+	Specialization string          `json:"specialization,omitempty"`
+	EarliestDate   Date            `json:"earliest_date"`
+	LatestDate     Date            `json:"latest_date"`
+	TimeOfDay      string          `json:"time_of_day"`
+	Status         string          `json:"status"`
+	Notes          string          `json:"notes"`
+	CreatedAt      time.Time       `json:"created_at"`
+	UpdatedAt      time.Time       `json:"updated_at"`
+	Offers         []WaitlistOffer `json:"offers,omitempty"`
+}
+
+// WaitlistOffer is a freed slot offered to a waitlisted patient
+type WaitlistOffer struct {
+	ID              uint       `json:"id"`
+	EntryID         uint       `json:"entry_id"`
+	PatientID       uint       `json:"patient_id"`
+	DoctorID        int        `json:"doctor_id"`
+	AppointmentDate time.Time  `json:"appointment_date"`
+	Status          string     `json:"status"`
+	ExpiresAt       time.Time  `json:"expires_at"`
+	AppointmentID   *uint      `json:"appointment_id,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+	RespondedAt     *time.Time `json:"responded_at,omitempty"`
+}
+
+// errOfferClosed is returned for offers that are no longer pending or have
+// expired.
+var errOfferClosed = errors.New("offer is no longer available")
+
+// timeOfDay returns the time-of-day preference matching t.
+func timeOfDay(t time.Time) string {
+	switch hour := t.In(clinicLocation).Hour(); {
+	case hour < 12:
+		return timeOfDayMorning
+	case hour < 17:
+		return timeOfDayAfternoon
+	default:
+		return timeOfDayEvening
+	}
+}
+
+// validate checks a new waitlist entry.
+func (w *WaitlistEntry) validate() error {
+	if (w.DoctorID == nil) == (w.Specialization == "") {
+		return fmt.Errorf("exactly one of doctor_id and specialization is required")
+	}
+	if w.EarliestDate.IsZero() || w.LatestDate.IsZero() {
+		return fmt.Errorf("earliest_date and latest_date are required")
+	}
+	if w.LatestDate.Before(w.EarliestDate) {
+		return fmt.Errorf("latest_date is before earliest_date")
+	}
+	if w.LatestDate.Before(dateOf(time.Now().In(clinicLocation))) {
+		return fmt.Errorf("latest_date is in the past")
+	}
+	switch w.TimeOfDay {
+	case "":
+		w.TimeOfDay = timeOfDayAny
+	case timeOfDayAny, timeOfDayMorning, timeOfDayAfternoon, timeOfDayEvening:
+	default:
+		return fmt.Errorf("time_of_day must be any, morning, afternoon or evening")
+	}
+	return nil
+}
+
+// Handler function to add a patient to the waitlist
+func createWaitlistEntry(c echo.Context) error {
+	var entry WaitlistEntry
+	if err := c.Bind(&entry); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid request payload")
+	}
+	if err := entry.validate(); err != nil {
+		return c.String(http.StatusUnprocessableEntity, err.Error())
+	}
+
+	refs := []reference{{"patient_id", "patients", int64(entry.PatientID)}}
+	if entry.DoctorID != nil {
+		refs = append(refs, reference{"doctor_id", "doctors", int64(*entry.DoctorID)})
+	}
+	if err := checkReferences(refs...); err != nil {
+		if status, message, ok := integrityError(err); ok {
+			return c.String(status, message)
+		}
+		log.Println("Error validating waitlist entry:", err)
+		return c.String(http.StatusInternalServerError, "Failed to insert waitlist entry")
+	}
+
+	result, err := db.Exec("INSERT INTO waitlist_entries (patient_id, doctor_id, specialization, earliest_date, latest_date, time_of_day, status, notes) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		entry.PatientID, entry.DoctorID, entry.Specialization, entry.EarliestDate, entry.LatestDate, entry.TimeOfDay, waitlistWaiting, entry.Notes)
+	if err != nil {
+		if status, message, ok := integrityError(err); ok {
+			return c.String(status, message)
+		}
+		log.Println("Error inserting waitlist entry:", err)
+		return c.String(http.StatusInternalServerError, "Failed to insert waitlist entry")
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return c.String(http.StatusInternalServerError, "Failed to get last insert ID")
+	}
+	entry, err = findWaitlistEntry(int(id))
+	if err != nil {
+		log.Println("Error reading back waitlist entry:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get waitlist entry")
+	}
+
+	return c.JSON(http.StatusCreated, entry)
+}
+
+const waitlistEntryColumns = "id, patient_id, doctor_id, specialization, earliest_date, latest_date, time_of_day, status, notes, created_at, updated_at"
+
+func scanWaitlistEntry(row rowScanner) (WaitlistEntry, error) {
+	var entry WaitlistEntry
+	err := row.Scan(&entry.ID, &entry.PatientID, &entry.DoctorID, &entry.Specialization, &entry.EarliestDate, &entry.LatestDate,
+		&entry.TimeOfDay, &entry.Status, &entry.Notes, &entry.CreatedAt, &entry.UpdatedAt)
+	return entry, err
+}
+
+// findWaitlistEntry loads a waitlist entry with its offers.
+func findWaitlistEntry(id int) (WaitlistEntry, error) {
+	entry, err := scanWaitlistEntry(db.QueryRow("SELECT "+waitlistEntryColumns+" FROM waitlist_entries WHERE id = ?", id))
+	if err != nil {
+		return entry, err
+	}
+
+	rows, err := db.Query(offerSelect+" WHERE o.entry_id = ? ORDER BY o.id", id)
+	if err != nil {
+		return entry, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		offer, err := scanOffer(rows)
+		if err != nil {
+			return entry, err
+		}
+		entry.Offers = append(entry.Offers, offer)
+	}
+	return entry, rows.Err()
+}
+
+// Handler function to list the waitlist, optionally by ?doctor_id= and
+// ?status=, oldest first
+func getWaitlist(c echo.Context) error {
+	query := "SELECT " + waitlistEntryColumns + " FROM waitlist_entries WHERE 1 = 1"
+	var args []interface{}
+	if param := c.QueryParam("doctor_id"); param != "" {
+		doctorID, err := strconv.Atoi(param)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid doctor ID")
+		}
+		query += " AND (doctor_id = ? OR (doctor_id IS NULL AND specialization = (SELECT specialization FROM doctors WHERE id = ?)))"
+		args = append(args, doctorID, doctorID)
+	}
+	if status := c.QueryParam("status"); status != "" {
+		query += " AND status = ?"
+		args = append(args, status)
+	}
+
+	rows, err := db.Query(query+" ORDER BY created_at, id", args...)
+	if err != nil {
+		log.Println("Error querying waitlist:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get waitlist")
+	}
+	defer rows.Close()
+
+	entries := make([]WaitlistEntry, 0)
+	for rows.Next() {
+		entry, err := scanWaitlistEntry(rows)
+		if err != nil {
+			log.Println("Error scanning waitlist row:", err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	return c.JSON(http.StatusOK, entries)
+}
+
+// Handler function to get a waitlist entry with its offers
+func getWaitlistEntry(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid waitlist entry ID")
+	}
+
+	entry, err := findWaitlistEntry(id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.String(http.StatusNotFound, "Waitlist entry not found")
+		}
+		log.Println("Error getting waitlist entry:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get waitlist entry")
+	}
+
+	return c.JSON(http.StatusOK, entry)
+}
+
+// Handler function to take a patient off the waitlist. A slot on offer to
+// them is offered to the next patient.
+func deleteWaitlistEntry(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid waitlist entry ID")
+	}
+
+	withdrawn, err := cancelWaitlistEntry(id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.String(http.StatusNotFound, "Waitlist entry not found")
+		}
+		log.Println("Error cancelling waitlist entry:", err)
+		return c.String(http.StatusInternalServerError, "Failed to delete waitlist entry")
+	}
+	for _, offer := range withdrawn {
+		reofferSlot(offer)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// cancelWaitlistEntry cancels an entry and withdraws its pending offers,
+// which it returns.
+func cancelWaitlistEntry(id int) ([]WaitlistOffer, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var status string
+	if err := tx.QueryRow("SELECT status FROM waitlist_entries WHERE id = ? FOR UPDATE", id).Scan(&status); err != nil {
+		return nil, err
+	}
+	if status == waitlistCancelled || status == waitlistBooked {
+		return nil, tx.Commit()
+	}
+
+	rows, err := tx.Query(offerSelect+" WHERE o.entry_id = ? AND o.status = ? FOR UPDATE", id, offerPending)
+	if err != nil {
+		return nil, err
+	}
+	var withdrawn []WaitlistOffer
+	for rows.Next() {
+		offer, err := scanOffer(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		withdrawn = append(withdrawn, offer)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec("UPDATE waitlist_offers SET status = ? WHERE entry_id = ? AND status = ?", offerWithdrawn, id, offerPending); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("UPDATE waitlist_entries SET status = ? WHERE id = ?", waitlistCancelled, id); err != nil {
+		return nil, err
+	}
+	return withdrawn, tx.Commit()
+}
+
+const offerSelect = "SELECT o.id, o.entry_id, w.patient_id, o.doctor_id, o.appointment_date, o.status, o.expires_at, o.appointment_id, o.created_at, o.responded_at" +
+	" FROM waitlist_offers o JOIN waitlist_entries w ON w.id = o.entry_id"
+
+func scanOffer(row rowScanner) (WaitlistOffer, error) {
+	var offer WaitlistOffer
+	err := row.Scan(&offer.ID, &offer.EntryID, &offer.PatientID, &offer.DoctorID, &offer.AppointmentDate, &offer.Status,
+		&offer.ExpiresAt, &offer.AppointmentID, &offer.CreatedAt, &offer.RespondedAt)
+	offer.AppointmentDate = offer.AppointmentDate.In(clinicLocation)
+	return offer, err
+}
+
+// offerCancelledSlot offers the slot of a just-cancelled appointment to the
+// waitlist.
+func offerCancelledSlot(appointmentID int) {
+	appointment, err := findAppointment(appointmentID, false)
+	if err != nil {
+		log.Println("Error reading cancelled appointment:", err)
+		return
+	}
+	if appointment.DoctorID == 0 {
+		return
+	}
+	if err := offerSlot(appointment.DoctorID, appointment.AppointmentDate); err != nil {
+		log.Println("Error offering slot to the waitlist:", err)
+	}
+}
+
+// reofferSlot offers the slot of a declined, expired or withdrawn offer to
+// the next patient on the waitlist.
+func reofferSlot(offer WaitlistOffer) {
+	if err := offerSlot(offer.DoctorID, offer.AppointmentDate); err != nil {
+		log.Println("Error offering slot to the waitlist:", err)
+	}
+}
+
+// offerSlot offers a free future slot of a doctor to the longest-waiting
+// eligible patient who has not been offered it before, and holds it for them.
+func offerSlot(doctorID int, at time.Time) error {
+	now := time.Now()
+	if !at.After(now) {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Locking the doctor, as lockBooking does, keeps bookings out of the slot
+	// while it is being offered.
+	var specialization string
+	if err := tx.QueryRow("SELECT specialization FROM doctors WHERE id = ? FOR UPDATE", doctorID).Scan(&specialization); err != nil {
+		return err
+	}
+	err = findBookingConflict(tx, PatientAppointment{DoctorID: doctorID, AppointmentDate: at}, 0)
+	var taken *bookingConflict
+	if errors.As(err, &taken) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	day := dateOf(at.In(clinicLocation))
+	var entryID, patientID uint
+	err = tx.QueryRow("SELECT w.id, w.patient_id FROM waitlist_entries w"+
+		" WHERE w.status = ? AND (w.doctor_id = ? OR (w.doctor_id IS NULL AND w.specialization = ?))"+
+		" AND w.earliest_date <= ? AND w.latest_date >= ? AND w.time_of_day IN (?, ?)"+
+		" AND NOT EXISTS (SELECT 1 FROM waitlist_offers o WHERE o.entry_id = w.id AND o.doctor_id = ? AND o.appointment_date = ?)"+
+		" ORDER BY w.created_at, w.id LIMIT 1 FOR UPDATE",
+		waitlistWaiting, doctorID, specialization, day, day, timeOfDayAny, timeOfDay(at), doctorID, at.UTC()).Scan(&entryID, &patientID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	expires := now.Add(waitlistHold)
+	if expires.After(at) {
+		expires = at
+	}
+	_, err = tx.Exec("INSERT INTO waitlist_offers (entry_id, doctor_id, appointment_date, status, expires_at) VALUES (?, ?, ?, ?, ?)",
+		entryID, doctorID, at.UTC(), offerPending, expires.UTC())
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE waitlist_entries SET status = ? WHERE id = ?", waitlistOffered, entryID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	notifyOffer(patientID, doctorID, at, expires)
+	return nil
+}
+
+// notifyOffer tells a patient about a slot offered to them, through their
+// preferred channel.
+func notifyOffer(patientID uint, doctorID int, at, expires time.Time) {
+	prefs, err := findContactPreferences(patientID)
+	if err != nil {
+		log.Println("Error getting contact preferences:", err)
+		return
+	}
+	msg, ok := prefs.message()
+	if !ok {
+		return
+	}
+
+	var doctorName string
+	db.QueryRow("SELECT u.name FROM doctors d JOIN users u ON u.id = d.user_id WHERE d.id = ?", doctorID).Scan(&doctorName)
+	with := "An appointment slot"
+	if doctorName != "" {
+		with = "An appointment slot with " + doctorName
+	}
+	local := at.In(clinicLocation)
+	msg.Subject = "Appointment slot available"
+	msg.Body = fmt.Sprintf("%s on %s at %s %s is available for you. Accept it before %s to book it.", with,
+		local.Format("Monday, 2 January 2006"), local.Format("15:04"), local.Format("MST"),
+		expires.In(clinicLocation).Format("15:04 MST"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if _, err := notifications.Send(ctx, msg); err != nil {
+		log.Printf("Error notifying patient %d of waitlist offer: %v", patientID, err)
+	}
+}
+
+// offerForActor loads the offer in the path and checks that the actor may
+// respond to it: patients only to their own offers.
+func offerForActor(c echo.Context) (WaitlistOffer, int, error) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return WaitlistOffer{}, http.StatusBadRequest, errors.New("Invalid offer ID")
+	}
+	offer, err := scanOffer(db.QueryRow(offerSelect+" WHERE o.id = ?", id))
+	if err == sql.ErrNoRows {
+		return offer, http.StatusNotFound, errors.New("Offer not found")
+	}
+	if err != nil {
+		log.Println("Error getting waitlist offer:", err)
+		return offer, http.StatusInternalServerError, errors.New("Failed to get offer")
+	}
+	actor := currentActor(c)
+	if actor.Role == rolePatient && actor.UserID != offer.PatientID {
+		return offer, http.StatusForbidden, errors.New("Offer belongs to another patient")
+	}
+	return offer, 0, nil
+}
+
+// Handler function to accept a waitlist offer, booking the offered slot as a
+// confirmed appointment
+func acceptWaitlistOffer(c echo.Context) error {
+	offer, status, err := offerForActor(c)
+	if err != nil {
+		return c.String(status, err.Error())
+	}
+
+	appointment := PatientAppointment{
+		PatientID:       offer.PatientID,
+		DoctorID:        offer.DoctorID,
+		AppointmentDate: offer.AppointmentDate,
+		Status:          statusRequested,
+	}
+	if err := validateAppointment(appointment, true); err != nil {
+		return updateFailed(c, err, "Appointment")
+	}
+
+	id, err := acceptOffer(int(offer.ID), appointment, currentActor(c))
+	if err != nil {
+		if err == errOfferClosed {
+			return c.String(http.StatusConflict, err.Error())
+		}
+		return updateFailed(c, err, "Appointment")
+	}
+	publishAppointment("created", int(id))
+
+	appointment, err = findAppointment(int(id), false)
+	if err != nil {
+		log.Println("Error reading back appointment:", err)
+		return c.String(http.StatusInternalServerError, "Failed to get appointment")
+	}
+	setETag(c, appointment.Version)
+	return c.JSON(http.StatusCreated, appointment)
+}
+
+// acceptOffer books and confirms the appointment for a pending offer.
+func acceptOffer(offerID int, appointment PatientAppointment, actor Actor) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	offer, err := scanOffer(tx.QueryRow(offerSelect+" WHERE o.id = ? FOR UPDATE", offerID))
+	if err != nil {
+		return 0, err
+	}
+	if offer.Status != offerPending || !time.Now().Before(offer.ExpiresAt) {
+		return 0, errOfferClosed
+	}
+
+	id, err := bookAppointment(tx, appointment, actor)
+	if err != nil {
+		return 0, err
+	}
+	if err := transitionAppointmentTx(tx, int(id), statusConfirmed, actor, "waitlist offer accepted", 0); err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec("UPDATE waitlist_offers SET status = ?, appointment_id = ?, responded_at = NOW() WHERE id = ?", offerAccepted, id, offerID)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("UPDATE waitlist_entries SET status = ? WHERE id = ?", waitlistBooked, offer.EntryID); err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+// Handler function to decline a waitlist offer. The slot is offered to the
+// next patient and the entry stays on the waitlist.
+func declineWaitlistOffer(c echo.Context) error {
+	offer, status, err := offerForActor(c)
+	if err != nil {
+		return c.String(status, err.Error())
+	}
+
+	released, err := releaseOffer(int(offer.ID), offerDeclined)
+	if err != nil {
+		log.Println("Error declining waitlist offer:", err)
+		return c.String(http.StatusInternalServerError, "Failed to decline offer")
+	}
+	if !released {
+		return c.String(http.StatusConflict, errOfferClosed.Error())
+	}
+	reofferSlot(offer)
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// releaseOffer closes a pending offer with the given status and puts its
+// entry back on the waitlist. released is false when the offer was no longer
+// pending.
+func releaseOffer(offerID int, status string) (released bool, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	offer, err := scanOffer(tx.QueryRow(offerSelect+" WHERE o.id = ? FOR UPDATE", offerID))
+	if err != nil || offer.Status != offerPending {
+		return false, err
+	}
+
+	if _, err := tx.Exec("UPDATE waitlist_offers SET status = ?, responded_at = NOW() WHERE id = ?", status, offerID); err != nil {
+		return false, err
+	}
+	_, err = tx.Exec("UPDATE waitlist_entries SET status = ? WHERE id = ? AND status = ?", waitlistWaiting, offer.EntryID, waitlistOffered)
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// startWaitlistJob expires unanswered offers every interval in the
+// background, passing their slots on down the waitlist.
+func startWaitlistJob(interval time.Duration) {
+	go func() {
+		for {
+			if err := expireOffers(); err != nil {
+				log.Println("Error expiring waitlist offers:", err)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+func expireOffers() error {
+	rows, err := db.Query(offerSelect+" WHERE o.status = ? AND o.expires_at <= ?", offerPending, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	var expired []WaitlistOffer
+	for rows.Next() {
+		offer, err := scanOffer(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		expired = append(expired, offer)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, offer := range expired {
+		released, err := releaseOffer(int(offer.ID), offerExpired)
+		if err != nil {
+			return err
+		}
+		if released {
+			reofferSlot(offer)
+		}
+	}
+	return nil
+}